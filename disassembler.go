@@ -0,0 +1,562 @@
+package x86_emulator
+
+import (
+	"fmt"
+	"github.com/pkg/errors"
+	"strings"
+)
+
+// Render decoded instruction as NASM-like text such as "mov ax, 0x0001".
+// Instructions without String method are rendered as their type name.
+func Disassemble(inst interface{}) string {
+	return disassemble(inst, nil)
+}
+
+// Render instruction with segment override prefix, which is put into its memory operand like "[es:0x0036]"
+func disassemble(inst interface{}, segmentOverride *segmentOverride) string {
+	var text string
+	if stringer, ok := inst.(fmt.Stringer); ok {
+		text = stringer.String()
+	} else {
+		text = fmt.Sprintf("%T", inst)
+	}
+	if segmentOverride != nil {
+		text = strings.Replace(text, "[", "["+segmentOverride.sreg.String()+":", 1)
+	}
+	return text
+}
+
+// Disassemble count instructions from start of mem linearly.
+// When decoding fails or mem ends before count instructions, instructions decoded so far are returned with the error.
+func DisassembleRange(mem []byte, start int, count int) ([]string, error) {
+	if start < 0 || start >= len(mem) {
+		return nil, errors.Errorf("start is out of range: %d", start)
+	}
+	memory := &memory{loadModule: mem, memorySize: len(mem)}
+
+	var lines []string
+	at := start
+	for i := 0; i < count; i++ {
+		if at >= len(mem) {
+			return lines, errors.Errorf("reached the end of mem after %d instructions", i)
+		}
+		inst, readBytesCount, segmentOverride, err := decodeInstWithMemory(newAddress(uint16(at>>4), uint16(at&0xf)), memory)
+		if err != nil {
+			return lines, errors.Wrapf(err, "failed to disassemble at 0x%05x", at)
+		}
+		lines = append(lines, disassemble(inst, segmentOverride))
+		at += readBytesCount
+	}
+	return lines, nil
+}
+
+// Instruction is a decoded instruction, which String renders as NASM-like text
+type Instruction interface {
+	String() string
+}
+
+// instruction decoded by Decode with its segment override prefix
+type decodedInstruction struct {
+	inst            interface{}
+	segmentOverride *segmentOverride
+}
+
+func (inst decodedInstruction) String() string {
+	return disassemble(inst.inst, inst.segmentOverride)
+}
+
+// Prefix is a prefix byte of instruction
+type Prefix byte
+
+const (
+	PrefixES          Prefix = 0x26
+	PrefixCS          Prefix = 0x2e
+	PrefixSS          Prefix = 0x36
+	PrefixDS          Prefix = 0x3e
+	PrefixFS          Prefix = 0x64
+	PrefixGS          Prefix = 0x65
+	PrefixAddressSize Prefix = 0x67
+	PrefixRep         Prefix = 0xf3
+)
+
+var prefixNames = map[Prefix]string{
+	PrefixES:          "es",
+	PrefixCS:          "cs",
+	PrefixSS:          "ss",
+	PrefixDS:          "ds",
+	PrefixFS:          "fs",
+	PrefixGS:          "gs",
+	PrefixAddressSize: "a32",
+	PrefixRep:         "rep",
+}
+
+func (prefix Prefix) String() string {
+	if name, ok := prefixNames[prefix]; ok {
+		return name
+	}
+	return fmt.Sprintf("prefix(0x%02x)", byte(prefix))
+}
+
+// Decode an instruction at offset of code.
+// Return the instruction, the number of bytes including prefixes, and prefixes in the order of appearance.
+func Decode(code []byte, offset int) (Instruction, int, []Prefix, error) {
+	if offset < 0 || offset >= len(code) {
+		return nil, 0, nil, errors.Errorf("offset is out of range: %d", offset)
+	}
+	memory := &memory{loadModule: code, memorySize: len(code)}
+	inst, readBytesCount, segmentOverride, err := decodeInstWithMemory(newAddress(uint16(offset>>4), uint16(offset&0xf)), memory)
+	if err != nil {
+		return nil, 0, nil, errors.Wrapf(err, "failed to decode at 0x%05x", offset)
+	}
+
+	var prefixes []Prefix
+	for _, b := range code[offset : offset+readBytesCount-1] {
+		prefix := Prefix(b)
+		if _, ok := prefixNames[prefix]; !ok {
+			break
+		}
+		prefixes = append(prefixes, prefix)
+	}
+	return decodedInstruction{inst: inst, segmentOverride: segmentOverride}, readBytesCount, prefixes, nil
+}
+
+// --- registers
+
+var registerWNames = [...]string{"ax", "cx", "dx", "bx", "sp", "bp", "si", "di"}
+var registerBNames = [...]string{"al", "cl", "dl", "bl", "ah", "ch", "dh", "bh"}
+var registerSNames = [...]string{"es", "cs", "ss", "ds", "fs", "gs"}
+
+func (r registerW) String() string {
+	if int(r) < len(registerWNames) {
+		return registerWNames[r]
+	}
+	return fmt.Sprintf("registerW(%d)", uint8(r))
+}
+
+func (r registerB) String() string {
+	if int(r) < len(registerBNames) {
+		return registerBNames[r]
+	}
+	return fmt.Sprintf("registerB(%d)", uint8(r))
+}
+
+func (r registerS) String() string {
+	if int(r) < len(registerSNames) {
+		return registerSNames[r]
+	}
+	return fmt.Sprintf("registerS(%d)", uint8(r))
+}
+
+// --- operands
+
+// signed displacement such as "+0x04" or "-0x02"
+func dispText(disp int, digits int) string {
+	if disp < 0 {
+		return fmt.Sprintf("-0x%0*x", digits, -disp)
+	}
+	return fmt.Sprintf("+0x%0*x", digits, disp)
+}
+
+// effective address such as "[bx+si+0x04]", where zero displacement is omitted
+func baseIndexDispText(base string, disp int, digits int) string {
+	if disp == 0 {
+		return "[" + base + "]"
+	}
+	return "[" + base + dispText(disp, digits) + "]"
+}
+
+func (operand imm8) String() string {
+	return fmt.Sprintf("0x%02x", uint8(operand.value))
+}
+
+func (operand imm16) String() string {
+	return fmt.Sprintf("0x%04x", uint16(operand.value))
+}
+
+func (operand reg8) String() string {
+	return operand.value.String()
+}
+
+func (operand reg16) String() string {
+	return operand.value.String()
+}
+
+func (operand sreg) String() string {
+	return operand.value.String()
+}
+
+func (operand mem8BaseDisp8) addressText() string {
+	return baseIndexDispText(operand.base.String(), int(operand.disp8), 2)
+}
+
+func (operand mem8BaseDisp8) String() string {
+	return "byte " + operand.addressText()
+}
+
+func (operand mem8BaseDisp16) addressText() string {
+	return baseIndexDispText(operand.base.String(), int(operand.disp16), 4)
+}
+
+func (operand mem8BaseDisp16) String() string {
+	return "byte " + operand.addressText()
+}
+
+func (operand mem8BaseIndexDisp) addressText() string {
+	return baseIndexDispText(operand.base.String()+"+"+operand.index.String(), int(operand.disp), 2)
+}
+
+func (operand mem8BaseIndexDisp) String() string {
+	return "byte " + operand.addressText()
+}
+
+func (operand mem8Disp16) addressText() string {
+	return fmt.Sprintf("[0x%04x]", uint16(operand.offset))
+}
+
+func (operand mem8Disp16) String() string {
+	return "byte " + operand.addressText()
+}
+
+func (operand mem16BaseDisp8) addressText() string {
+	return baseIndexDispText(operand.base.String(), int(operand.disp8), 2)
+}
+
+func (operand mem16BaseDisp8) String() string {
+	return "word " + operand.addressText()
+}
+
+func (operand mem16BaseDisp16) addressText() string {
+	return baseIndexDispText(operand.base.String(), int(operand.disp16), 4)
+}
+
+func (operand mem16BaseDisp16) String() string {
+	return "word " + operand.addressText()
+}
+
+func (operand mem16BaseIndexDisp) addressText() string {
+	return baseIndexDispText(operand.base.String()+"+"+operand.index.String(), int(operand.disp), 2)
+}
+
+func (operand mem16BaseIndexDisp) String() string {
+	return "word " + operand.addressText()
+}
+
+func (operand mem16Disp16) addressText() string {
+	return fmt.Sprintf("[0x%04x]", uint16(operand.offset))
+}
+
+// effective address such as "[eax+ecx*2+0x00000010]"
+func (addressing addressing32) addressText() string {
+	var terms []string
+	if addressing.hasBase {
+		terms = append(terms, "e"+addressing.base.String())
+	}
+	if addressing.hasIndex {
+		index := "e" + addressing.index.String()
+		if addressing.scale > 1 {
+			index += fmt.Sprintf("*%d", addressing.scale)
+		}
+		terms = append(terms, index)
+	}
+	if len(terms) == 0 {
+		return fmt.Sprintf("[0x%08x]", uint32(addressing.disp))
+	}
+	return baseIndexDispText(strings.Join(terms, "+"), int(addressing.disp), 8)
+}
+
+func (operand mem8Addr32) String() string {
+	return "byte " + operand.addressText()
+}
+
+func (operand mem16Addr32) String() string {
+	return "word " + operand.addressText()
+}
+
+func (operand mem16Disp16) String() string {
+	return "word " + operand.addressText()
+}
+
+// effective address of memory operand without size, used where size is unnecessary like in lea
+func addressText(operand interface{}) string {
+	if op, ok := operand.(interface{ addressText() string }); ok {
+		return op.addressText()
+	}
+	return fmt.Sprint(operand)
+}
+
+// --- instructions
+
+func binaryText(mnemonic string, dest, src interface{}) string {
+	return fmt.Sprintf("%s %v, %v", mnemonic, dest, src)
+}
+
+func (inst instAaa) String() string {
+	return "aaa"
+}
+
+func (inst instAad) String() string {
+	return fmt.Sprintf("aad 0x%02x", inst.base)
+}
+
+func (inst instAam) String() string {
+	return fmt.Sprintf("aam 0x%02x", inst.base)
+}
+
+func (inst instAas) String() string {
+	return "aas"
+}
+
+func (inst instAdc) String() string {
+	return binaryText("adc", inst.dest, inst.src)
+}
+
+func (inst instAdd) String() string {
+	return binaryText("add", inst.dest, inst.src)
+}
+
+func (inst instAnd) String() string {
+	return binaryText("and", inst.dest, inst.src)
+}
+
+func (inst instBound) String() string {
+	return fmt.Sprintf("bound %s, %s", fmt.Sprint(inst.index), addressText(inst.bounds))
+}
+
+func (inst instCall) String() string {
+	return "call " + dispText(int(inst.rel), 4)
+}
+
+func (inst instCallAbsoluteIndirectMem16) String() string {
+	return "call " + fmt.Sprint(inst.operand)
+}
+
+func (inst instCallFarIndirect) String() string {
+	return "call far " + addressText(inst.operand)
+}
+
+func (inst instCld) String() string {
+	return "cld"
+}
+
+func (inst instCmp) String() string {
+	return binaryText("cmp", inst.dest, inst.src)
+}
+
+func (inst instDaa) String() string {
+	return "daa"
+}
+
+func (inst instDas) String() string {
+	return "das"
+}
+
+func (inst instDec) String() string {
+	return "dec " + inst.dest.String()
+}
+
+func (inst instDiv) String() string {
+	return "div " + fmt.Sprint(inst.src)
+}
+
+func (inst instIdiv) String() string {
+	return "idiv " + fmt.Sprint(inst.src)
+}
+
+func (inst instInc) String() string {
+	return "inc " + inst.dest.String()
+}
+
+func (inst instInt) String() string {
+	return fmt.Sprintf("int 0x%02x", inst.operand)
+}
+
+func (inst instInto) String() string {
+	return "into"
+}
+
+func (inst instIret) String() string {
+	return "iret"
+}
+
+func (inst instJae) String() string {
+	return "jae short " + dispText(int(inst.rel8), 2)
+}
+
+func (inst instJb) String() string {
+	return "jb short " + dispText(int(inst.rel8), 2)
+}
+
+func (inst instJccRel16) String() string {
+	return "j" + inst.cond.String() + " near " + dispText(int(inst.rel), 4)
+}
+
+func (inst instJeRel8) String() string {
+	return "je short " + dispText(int(inst.rel8), 2)
+}
+
+func (inst instJmpFarIndirect) String() string {
+	return "jmp far " + addressText(inst.operand)
+}
+
+func (inst instJmpIndirect) String() string {
+	return "jmp " + fmt.Sprint(inst.operand)
+}
+
+func (inst instJmpRel16) String() string {
+	return "jmp near " + dispText(int(inst.rel), 4)
+}
+
+func (inst instJneRel8) String() string {
+	return "jne short " + dispText(int(inst.rel8), 2)
+}
+
+func (inst instLea) String() string {
+	return fmt.Sprintf("lea %s, %s", fmt.Sprint(inst.dest), addressText(inst.src))
+}
+
+func (inst instLodsb) String() string {
+	return "lodsb"
+}
+
+func (inst instLoop) String() string {
+	return "loop short " + dispText(int(inst.rel8), 2)
+}
+
+func (inst instMov) String() string {
+	return binaryText("mov", inst.dest, inst.src)
+}
+
+func (inst instMovsb) String() string {
+	return "movsb"
+}
+
+func (inst instMovsx) String() string {
+	return binaryText("movsx", inst.dest, inst.src)
+}
+
+func (inst instMovzx) String() string {
+	return binaryText("movzx", inst.dest, inst.src)
+}
+
+func (inst instNeg) String() string {
+	return "neg " + fmt.Sprint(inst.dest)
+}
+
+func (inst instOr) String() string {
+	return binaryText("or", inst.dest, inst.src)
+}
+
+func (inst instPop) String() string {
+	return "pop " + inst.dest.String()
+}
+
+func (inst instPopSreg) String() string {
+	return "pop " + inst.dest.String()
+}
+
+func (inst instPopf) String() string {
+	return "popf"
+}
+
+func (inst instPush) String() string {
+	return "push " + inst.src.String()
+}
+
+func (inst instPushSreg) String() string {
+	return "push " + inst.src.String()
+}
+
+func (inst instPushf) String() string {
+	return "pushf"
+}
+
+func (inst instRep) String() string {
+	return "rep " + fmt.Sprint(inst.inst)
+}
+
+func (inst instRepeScasb) String() string {
+	return "repe scasb"
+}
+
+func (inst instRepeScasw) String() string {
+	return "repe scasw"
+}
+
+func (inst instRepMovsb) String() string {
+	return "rep movsb"
+}
+
+func (inst instRepStosb) String() string {
+	return "rep stosb"
+}
+
+func (inst instRet) String() string {
+	return "ret"
+}
+
+func (inst instRetFar) String() string {
+	if inst.imm16 == 0 {
+		return "retf"
+	}
+	return fmt.Sprintf("retf 0x%04x", inst.imm16)
+}
+
+var conditionNames = [...]string{"o", "no", "b", "ae", "e", "ne", "be", "a", "s", "ns", "p", "np", "l", "ge", "le", "g"}
+
+func (cond condition) String() string {
+	if int(cond) < len(conditionNames) {
+		return conditionNames[cond]
+	}
+	return fmt.Sprintf("condition(%d)", uint8(cond))
+}
+
+func (inst instSbb) String() string {
+	return binaryText("sbb", inst.dest, inst.src)
+}
+
+func (inst instScasb) String() string {
+	return "scasb"
+}
+
+func (inst instScasw) String() string {
+	return "scasw"
+}
+
+func (inst instSetcc) String() string {
+	return "set" + inst.cond.String() + " " + fmt.Sprint(inst.dest)
+}
+
+func (inst instShl) String() string {
+	return binaryText("shl", inst.dest, inst.src)
+}
+
+func (inst instShr) String() string {
+	return binaryText("shr", inst.dest, inst.src)
+}
+
+func (inst instSti) String() string {
+	return "sti"
+}
+
+func (inst instStosb) String() string {
+	return "stosb"
+}
+
+func (inst instSub) String() string {
+	return binaryText("sub", inst.dest, inst.src)
+}
+
+func (inst instTest) String() string {
+	return binaryText("test", inst.dest, inst.src)
+}
+
+func (inst instXchg) String() string {
+	if inst == xchgAX(AX) {
+		return "nop"
+	}
+	return binaryText("xchg", inst.dest, inst.src)
+}
+
+func (inst instXor) String() string {
+	return binaryText("xor", inst.dest, inst.src)
+}
@@ -0,0 +1,194 @@
+package x86_emulator
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestDisassemble(t *testing.T) {
+	cases := []struct {
+		code     []byte
+		expected string
+	}{
+		// mov ax,1
+		{[]byte{0xb8, 0x01, 0x00}, "mov ax, 0x0001"},
+		// mov ah,09h
+		{[]byte{0xb4, 0x09}, "mov ah, 0x09"},
+		// cmp es:0036, 0x00
+		{[]byte{0x26, 0x80, 0x3e, 0x36, 0x00, 0x00}, "cmp byte [es:0x0036], 0x00"},
+		// mov word ptr [bp-2],ax
+		{[]byte{0x89, 0x46, 0xfe}, "mov word [bp-0x02], ax"},
+		// mov byte [bp-1],0ah
+		{[]byte{0xc6, 0x46, 0xff, 0x0a}, "mov byte [bp-0x01], 0x0a"},
+		// cmp [si],al
+		{[]byte{0x38, 0x04}, "cmp byte [si], al"},
+		// mov ax,[bx+si]
+		{[]byte{0x8b, 0x00}, "mov ax, word [bx+si]"},
+		// lea dx,[0x0002]
+		{[]byte{0x8d, 0x16, 0x02, 0x00}, "lea dx, [0x0002]"},
+		// int 21h
+		{[]byte{0xcd, 0x21}, "int 0x21"},
+		// bound dx,[bp+4]
+		{[]byte{0x62, 0x56, 0x04}, "bound dx, [bp+0x04]"},
+		// nop
+		{[]byte{0x90}, "nop"},
+		// xchg ax,sp
+		{[]byte{0x94}, "xchg ax, sp"},
+		// xchg byte [bx+si],cl
+		{[]byte{0x86, 0x08}, "xchg byte [bx+si], cl"},
+		// loop -2
+		{[]byte{0xe2, 0xfe}, "loop short -0x02"},
+		// jmp far [bx+si]
+		{[]byte{0xff, 0x28}, "jmp far [bx+si]"},
+		// call far [es:0x0010]
+		{[]byte{0x26, 0xff, 0x1e, 0x10, 0x00}, "call far [es:0x0010]"},
+		// retf
+		{[]byte{0xcb}, "retf"},
+		// retf 4
+		{[]byte{0xca, 0x04, 0x00}, "retf 0x0004"},
+		// call [bp-2]
+		{[]byte{0xff, 0x56, 0xfe}, "call word [bp-0x02]"},
+		// jmp ax
+		{[]byte{0xff, 0xe0}, "jmp ax"},
+		// into
+		{[]byte{0xce}, "into"},
+		// iret
+		{[]byte{0xcf}, "iret"},
+		// jne -3
+		{[]byte{0x75, 0xfd}, "jne short -0x03"},
+		// jne near +0x0100
+		{[]byte{0x0f, 0x85, 0x00, 0x01}, "jne near +0x0100"},
+		// rep lodsb
+		{[]byte{0xf3, 0xac}, "rep lodsb"},
+		// push ds
+		{[]byte{0x1e}, "push ds"},
+		// div bl
+		{[]byte{0xf6, 0xf3}, "div bl"},
+		// idiv word [bx+si]
+		{[]byte{0xf7, 0x38}, "idiv word [bx+si]"},
+		// setl al
+		{[]byte{0x0f, 0x9c, 0xc0}, "setl al"},
+		// aam
+		{[]byte{0xd4, 0x0a}, "aam 0x0a"},
+		// daa
+		{[]byte{0x27}, "daa"},
+		// adc dl,0
+		{[]byte{0x80, 0xd2, 0x00}, "adc dl, 0x00"},
+		// sbb byte [si],1
+		{[]byte{0x80, 0x1c, 0x01}, "sbb byte [si], 0x01"},
+		// shl cx,8
+		{[]byte{0xc1, 0xe1, 0x08}, "shl cx, 0x08"},
+		// mov ax,[eax+ecx*2+0x10]
+		{[]byte{0x67, 0x8b, 0x84, 0x48, 0x10, 0x00, 0x00, 0x00}, "mov ax, word [eax+ecx*2+0x00000010]"},
+		// mov es:[ebx],al
+		{[]byte{0x26, 0x67, 0x88, 0x03}, "mov byte [es:ebx], al"},
+	}
+	for _, c := range cases {
+		inst, _, segmentOverride, err := decodeInst(bytes.NewReader(c.code))
+		if err != nil {
+			t.Errorf("%+v", err)
+			continue
+		}
+		actual := disassemble(inst, segmentOverride)
+		if actual != c.expected {
+			t.Errorf("expected %q but actual %q", c.expected, actual)
+		}
+	}
+}
+
+func TestDisassembleWithoutSegmentOverride(t *testing.T) {
+	inst := instCmp{dest: mem8Disp16{offset: 0x0036}, src: imm8{value: 0x00}}
+	expected := "cmp byte [0x0036], 0x00"
+	if actual := Disassemble(inst); actual != expected {
+		t.Errorf("expected %q but actual %q", expected, actual)
+	}
+}
+
+func TestDisassembleRange(t *testing.T) {
+	// hello world used in TestInt21_09
+	var b []byte
+	b = append(b, []byte{0xb8, 0x01, 0x00}...)       // mov ax,seg msg
+	b = append(b, []byte{0x8e, 0xd8}...)             // mov ds,ax
+	b = append(b, []byte{0xb4, 0x09}...)             // mov ah,09h
+	b = append(b, []byte{0x8d, 0x16, 0x02, 0x00}...) // lea dx,msg
+	b = append(b, []byte{0xcd, 0x21}...)             // int 21h
+	b = append(b, []byte{0xb8, 0x00, 0x4c}...)       // mov ax,4c00h
+	b = append(b, []byte{0xcd, 0x21}...)             // int 21h
+
+	actual, err := DisassembleRange(b, 0, 7)
+	if err != nil {
+		t.Errorf("%+v", err)
+	}
+	expected := []string{
+		"mov ax, 0x0001",
+		"mov ds, ax",
+		"mov ah, 0x09",
+		"lea dx, [0x0002]",
+		"int 0x21",
+		"mov ax, 0x4c00",
+		"int 0x21",
+	}
+	if strings.Join(actual, "\n") != strings.Join(expected, "\n") {
+		t.Errorf("expected %q but actual %q", expected, actual)
+	}
+}
+
+func TestDisassembleRangeStopsAtError(t *testing.T) {
+	// mov ax,1 followed by an unknown opcode
+	actual, err := DisassembleRange([]byte{0xb8, 0x01, 0x00, 0x0f, 0xff}, 0, 2)
+	if err == nil {
+		t.Errorf("expected error for unknown opcode")
+	}
+	if len(actual) != 1 || actual[0] != "mov ax, 0x0001" {
+		t.Errorf("expected instructions decoded so far but actual %q", actual)
+	}
+}
+
+func TestDisassembleRangeStopsAtEndOfMem(t *testing.T) {
+	// mov ax,imm16 is truncated
+	if _, err := DisassembleRange([]byte{0xb8, 0x01}, 0, 1); err == nil {
+		t.Errorf("expected error for truncated instruction")
+	}
+
+	// only one instruction in mem
+	actual, err := DisassembleRange([]byte{0xb8, 0x01, 0x00}, 0, 2)
+	if err == nil {
+		t.Errorf("expected error at the end of mem")
+	}
+	if len(actual) != 1 || actual[0] != "mov ax, 0x0001" {
+		t.Errorf("expected instructions decoded so far but actual %q", actual)
+	}
+}
+
+func TestDecode(t *testing.T) {
+	cases := []struct {
+		code     []byte
+		offset   int
+		expected string
+		length   int
+		prefixes string
+	}{
+		// mov es:[ebx],al
+		{[]byte{0x26, 0x67, 0x88, 0x03}, 0, "mov byte [es:ebx], al", 4, "[es a32]"},
+		// rep stosb after mov ax,1
+		{[]byte{0xb8, 0x01, 0x00, 0xf3, 0xaa}, 3, "rep stosb", 2, "[rep]"},
+		// mov ax,1 without prefix
+		{[]byte{0xb8, 0x01, 0x00, 0xf3, 0xaa}, 0, "mov ax, 0x0001", 3, "[]"},
+	}
+	for _, c := range cases {
+		inst, length, prefixes, err := Decode(c.code, c.offset)
+		if err != nil {
+			t.Errorf("%+v", err)
+			continue
+		}
+		if inst.String() != c.expected || length != c.length || fmt.Sprint(prefixes) != c.prefixes {
+			t.Errorf("expected %q of %d bytes with %s but actual %q of %d bytes with %v", c.expected, c.length, c.prefixes, inst, length, prefixes)
+		}
+	}
+
+	if _, _, _, err := Decode([]byte{0xb8, 0x01, 0x00}, 3); err == nil {
+		t.Errorf("expected error for offset out of range")
+	}
+}
@@ -1,6 +1,7 @@
 package x86_emulator
 
 import (
+	"bufio"
 	"bytes"
 	"encoding/binary"
 	"fmt"
@@ -8,6 +9,11 @@ import (
 	"io"
 	"io/ioutil"
 	"log"
+	"math"
+	"os"
+	"sort"
+	"strings"
+	"time"
 )
 
 // ref1. https://en.wikibooks.org/wiki/X86_Assembly/Machine_Language_Conversion
@@ -32,6 +38,16 @@ type segmentOverride struct {
 	sreg registerS
 }
 
+// segment registers selected by segment override prefixes
+var segmentOverridePrefixes = map[byte]registerS{
+	0x26: ES,
+	0x2e: CS,
+	0x36: SS,
+	0x3e: DS,
+	0x64: FS,
+	0x65: GS,
+}
+
 // -----------
 // memory
 // -----------
@@ -54,6 +70,7 @@ func newAddressFromWord(seg word, offset word) *address {
 	return &address{seg: uint16(seg), offset: uint16(offset)}
 }
 
+// offset wraps around within the segment as 8086 does
 func (address *address) plus(x int) {
 	address.offset = uint16(int(address.offset) + x)
 }
@@ -70,39 +87,182 @@ func (address *address) realAddress() int {
 	return int(address.seg)<<4 + int(address.offset)
 }
 
-// Prepare memory whose size is same as load module
+// size of the whole address space of real mode
+const realModeMemorySize = 0x100000
+
+// Prepare a flat memory covering the whole real-mode address space, with load module placed at the beginning
 func newMemory(loadModule []byte) *memory {
-	loadModuleSize := len(loadModule)
-	m := make([]byte, loadModuleSize)
-	for i := 0; i < loadModuleSize; i++ {
-		m[i] = loadModule[i]
+	m := make([]byte, realModeMemorySize)
+	copy(m, loadModule)
+	return &memory{loadModule: m, memorySize: realModeMemorySize}
+}
+
+const (
+	// segment of PSP, placed above interrupt vector table and BIOS data area
+	pspSegment word = 0x0100
+	// paragraphs of PSP, which is followed by load module
+	pspParagraphs word = 0x10
+	// default segment where load module is placed, just after 256 bytes of PSP
+	loadSegment word = pspSegment + pspParagraphs
+	// the lowest load segment whose PSP does not overlap interrupt vector table and BIOS data area
+	minLoadSegment word = 0x0050 + pspParagraphs
+	// the first segment beyond memory available for programs, which is recorded in PSP
+	memoryTopSegment word = 0xa000
+	// command tail in PSP has a length byte, up to 126 characters and the terminating CR
+	maxCommandTailLength = 126
+	// COM program is loaded and started at this offset of PSP segment
+	comEntryOffset = 0x100
+)
+
+// Prepare memory for the program described by header.
+// Load module is loaded at loadSeg and followed by the minimum extra allocation requested by header.
+// Initial SS:SP must also point inside memory so that the stack can grow down from there.
+func newMemoryFromHeader(loadModule []byte, header *header, loadSeg word) (*memory, error) {
+	imageStart := int(loadSeg) << 4
+	imageEnd := imageStart + len(loadModule) + int(header.exMinAlloc)*paragraphSize
+	if imageEnd > realModeMemorySize {
+		return nil, errors.Errorf("load module and its minimum allocation do not fit in memory: 0x%05x", imageEnd)
+	}
+
+	// SS is relative to load segment
+	// SP of 0 means that the stack starts from the end of 64KB segment
+	stackTop := (int(loadSeg)+int(header.exInitSS))<<4 + int(header.exInitSP)
+	if header.exInitSP == 0 {
+		stackTop += 0x10000
+	}
+	if stackTop > realModeMemorySize {
+		return nil, errors.Errorf("initial stack is out of memory: 0x%04x:0x%04x", header.exInitSS, header.exInitSP)
+	}
+
+	m := make([]byte, realModeMemorySize)
+	copy(m[imageStart:], loadModule)
+	memory := &memory{loadModule: m, memorySize: realModeMemorySize}
+
+	if err := memory.relocate(header.relocations, loadSeg); err != nil {
+		return nil, errors.Wrap(err, "failed to relocate load module")
+	}
+	return memory, nil
+}
+
+// Interrupt vector table at linear address 0 has far pointers (offset, then segment) for 256 interrupts
+const (
+	interruptVectorCount = 256
+	// vectors point into this segment until programs set them
+	biosSegment word = 0xf000
+)
+
+// Point each interrupt vector to biosSegment:<interrupt number> as a stub
+func (memory *memory) initInterruptVectors() error {
+	for n := 0; n < interruptVectorCount; n++ {
+		if err := memory.setInterruptVector(uint8(n), biosSegment, word(n)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (memory *memory) setInterruptVector(n uint8, seg, offset word) error {
+	if err := memory.writeWord(newAddressFromWord(0, word(n)*4), offset); err != nil {
+		return errors.Wrapf(err, "failed to set interrupt vector 0x%02x", n)
+	}
+	if err := memory.writeWord(newAddressFromWord(0, word(n)*4+2), seg); err != nil {
+		return errors.Wrapf(err, "failed to set interrupt vector 0x%02x", n)
+	}
+	return nil
+}
+
+// (segment, offset, error)
+func (memory *memory) interruptVector(n uint8) (word, word, error) {
+	offset, err := memory.readWord(newAddressFromWord(0, word(n)*4))
+	if err != nil {
+		return 0, 0, errors.Wrapf(err, "failed to get interrupt vector 0x%02x", n)
 	}
-	return &memory{loadModule: m, memorySize: loadModuleSize}
+	seg, err := memory.readWord(newAddressFromWord(0, word(n)*4+2))
+	if err != nil {
+		return 0, 0, errors.Wrapf(err, "failed to get interrupt vector 0x%02x", n)
+	}
+	return seg, offset, nil
+}
+
+// Return the vector of interrupt n and whether program has installed its own handler there.
+// Vectors left at their stubs are handled by the emulator, as well as null ones found in memory without the table.
+func (memory *memory) programInterruptVector(n uint8) (word, word, bool, error) {
+	// instructions which don't access memory may be executed without it
+	if memory == nil {
+		return 0, 0, false, nil
+	}
+	seg, offset, err := memory.interruptVector(n)
+	if err != nil {
+		return 0, 0, false, err
+	}
+	stub := seg == biosSegment && offset == word(n)
+	null := seg == 0 && offset == 0
+	return seg, offset, !stub && !null, nil
+}
+
+// Build PSP (Program Segment Prefix) at psp.
+// Only a few fields are filled: int 20h at 0x00, the top segment of memory at 0x02 and command tail at 0x80.
+func (memory *memory) writePSP(psp word, commandLine string) error {
+	if len(commandLine) > maxCommandTailLength {
+		return errors.Errorf("command line is too long: %d bytes", len(commandLine))
+	}
+
+	// int 20h
+	if err := memory.writeWord(newAddressFromWord(psp, 0x00), 0x20cd); err != nil {
+		return errors.Wrap(err, "failed to write int 20h to PSP")
+	}
+	if err := memory.writeWord(newAddressFromWord(psp, 0x02), word(memoryTopSegment)); err != nil {
+		return errors.Wrap(err, "failed to write top of memory to PSP")
+	}
+
+	if err := memory.writeByte(newAddressFromWord(psp, 0x80), byte(len(commandLine))); err != nil {
+		return errors.Wrap(err, "failed to write length of command tail to PSP")
+	}
+	tail := append([]byte(commandLine), 0x0d)
+	for i, b := range tail {
+		if err := memory.writeByte(newAddressFromWord(psp, word(0x81+i)), b); err != nil {
+			return errors.Wrap(err, "failed to write command tail to PSP")
+		}
+	}
+	return nil
 }
 
-// TODO: How to calculate the necessary stack size?
-func newMemoryFromHeader(loadModule []byte, header *header) *memory {
-	loadModuleSize := len(loadModule)
-	stackMaxAddress := newAddressFromWord(header.exInitSS, header.exInitSP)
-	stackSize := stackMaxAddress.realAddress()
-	memorySize := loadModuleSize + stackSize
-	m := make([]byte, memorySize)
-	for i := 0; i < loadModuleSize; i++ {
-		m[i] = loadModule[i]
+// Add load segment to each word pointed by relocation entries.
+// Both the entries and the words are relative to the start of load module.
+func (memory *memory) relocate(relocations []relocationEntry, loadSegment word) error {
+	for _, r := range relocations {
+		seg := loadSegment + r.seg
+		w, err := memory.readWord(newAddressFromWord(seg, r.offset))
+		if err != nil {
+			return errors.Wrapf(err, "failed to read relocation target 0x%04x:0x%04x", r.seg, r.offset)
+		}
+		if err := memory.writeWord(newAddressFromWord(seg, r.offset), w+loadSegment); err != nil {
+			return errors.Wrapf(err, "failed to write relocation target 0x%04x:0x%04x", r.seg, r.offset)
+		}
 	}
-	return &memory{loadModule: m, memorySize: memorySize}
+	return nil
 }
 
+// Read n bytes and advance the offset of at by n, which is convenient for decoding instructions
 func (memory *memory) readBytes(at *address, n int) ([]byte, error) {
-	if at.realAddress()+(n-1) >= memory.memorySize {
-		return nil, fmt.Errorf("illegal address: 0x%05x", at)
+	buf, err := memory.readBytesAt(at, n)
+	if err != nil {
+		return nil, err
 	}
+	at.offset += uint16(n)
+	return buf, nil
+}
 
+// Read n bytes without changing at, where offset wraps around within the segment
+func (memory *memory) readBytesAt(at *address, n int) ([]byte, error) {
 	buf := make([]byte, n)
 	for i := 0; i < n; i++ {
-		buf[i] = memory.loadModule[at.realAddress()+i]
+		realAddress := newAddress(at.seg, at.offset+uint16(i)).realAddress()
+		if realAddress >= memory.memorySize {
+			return nil, fmt.Errorf("illegal address: 0x%05x", at)
+		}
+		buf[i] = memory.loadModule[realAddress]
 	}
-	at.offset += uint16(n)
 	return buf, nil
 }
 
@@ -150,6 +310,20 @@ func (memory *memory) readInt16(at *address) (int16, error) {
 	return v, nil
 }
 
+func (memory *memory) readInt32(at *address) (int32, error) {
+	var v int32
+	bs, err := memory.readBytes(at, 4)
+	if err != nil {
+		return 0, errors.Wrap(err, "failed to read int32")
+	}
+	buf := bytes.NewReader(bs)
+	err = binary.Read(buf, binary.LittleEndian, &v)
+	if err != nil {
+		return 0, errors.Wrap(err, "failed to parse as int32")
+	}
+	return v, nil
+}
+
 func (memory *memory) writeByte(at *address, b byte) error {
 	realAddress := at.realAddress()
 	if realAddress >= memory.memorySize {
@@ -159,15 +333,17 @@ func (memory *memory) writeByte(at *address, b byte) error {
 	return nil
 }
 
+// The high byte is written at offset 0x0000 when at points to offset 0xffff
 func (memory *memory) writeWord(at *address, w word) error {
-	realAddress := at.realAddress()
-	if realAddress >= memory.memorySize {
+	lowAddress := at.realAddress()
+	highAddress := newAddress(at.seg, at.offset+1).realAddress()
+	if lowAddress >= memory.memorySize || highAddress >= memory.memorySize {
 		return fmt.Errorf("illegal address: 0x%05x", at)
 	}
 	low := byte(w & 0x00ff)
 	high := byte((w & 0xff00) >> 8)
-	memory.loadModule[realAddress] = low
-	memory.loadModule[realAddress+1] = high
+	memory.loadModule[lowAddress] = low
+	memory.loadModule[highAddress] = high
 	return nil
 }
 
@@ -277,6 +453,7 @@ func toRegisterS(x uint8) (registerS, error) {
 type operand interface {
 	read(state state, memory *memory) (int, error)
 	write(value int, state state, memory *memory) (state, error) // FIXME: state passsed as pointer (use it as mutable)
+	size() int                                                   // size in bytes of the value which operand holds (1 for byte, 2 for word)
 }
 
 type operandAddressing interface {
@@ -294,6 +471,7 @@ func newImm8(r io.Reader) (imm8, error) {
 	return imm8{value: v}, err
 }
 
+// the value is sign-extended, and instructions mask it by the size of destination
 func (imm8 imm8) read(s state, m *memory) (int, error) {
 	return int(imm8.value), nil
 }
@@ -302,6 +480,10 @@ func (imm8 imm8) write(v int, s state, m *memory) (state, error) {
 	return s, errors.Errorf("cannot write to imm8")
 }
 
+func (imm8 imm8) size() int {
+	return 1
+}
+
 type imm16 struct {
 	value int16
 }
@@ -320,6 +502,10 @@ func (imm16 imm16) write(v int, s state, m *memory) (state, error) {
 	return s, errors.Errorf("cannot write to imm8")
 }
 
+func (imm16 imm16) size() int {
+	return 2
+}
+
 type reg8 struct {
 	value registerB
 }
@@ -338,6 +524,10 @@ func (reg8 reg8) write(v int, s state, m *memory) (state, error) {
 	return s.writeByteGeneralReg(reg8.value, uint8(v))
 }
 
+func (reg8 reg8) size() int {
+	return 1
+}
+
 type reg16 struct {
 	value registerW
 }
@@ -356,6 +546,10 @@ func (reg16 reg16) write(v int, s state, m *memory) (state, error) {
 	return s.writeWordGeneralReg(reg16.value, word(v))
 }
 
+func (reg16 reg16) size() int {
+	return 2
+}
+
 // [reg] + disp8 as byte
 type mem8BaseDisp8 struct {
 	base  registerW // it should be SI, DI, BP, or BX in x86 as shown in Table 2-1. 16-Bit Addressing Forms with the ModR/M Byte
@@ -386,17 +580,101 @@ func (operand mem8BaseDisp8) write(v int, s state, m *memory) (state, error) {
 	return s, nil
 }
 
+func (operand mem8BaseDisp8) size() int {
+	return 1
+}
+
 func (operand mem8BaseDisp8) address(s state) (*address, error) {
 	return s.addressFromBaseAndDisp(operand.base, int(operand.disp8))
 }
 
+// [reg] + disp16 as byte
+type mem8BaseDisp16 struct {
+	base   registerW // it should be SI, DI, BP, or BX in x86 as shown in Table 2-1. 16-Bit Addressing Forms with the ModR/M Byte
+	disp16 int16
+}
+
+func (operand mem8BaseDisp16) read(s state, m *memory) (int, error) {
+	address, err := operand.address(s)
+	if err != nil {
+		return 0, errors.Wrap(err, "failed to read mem8BaseDisp16")
+	}
+	v, err := m.readInt8(address)
+	if err != nil {
+		return 0, errors.Wrap(err, "failed to read mem8BaseDisp16")
+	}
+	return int(v), nil
+}
+
+func (operand mem8BaseDisp16) write(v int, s state, m *memory) (state, error) {
+	address, err := operand.address(s)
+	if err != nil {
+		return s, errors.Wrap(err, "failed to write to mem8BaseDisp16")
+	}
+	err = m.writeByte(address, byte(v))
+	if err != nil {
+		return s, errors.Wrap(err, "failed to write to mem8BaseDisp16")
+	}
+	return s, nil
+}
+
+func (operand mem8BaseDisp16) size() int {
+	return 1
+}
+
+func (operand mem8BaseDisp16) address(s state) (*address, error) {
+	return s.addressFromBaseAndDisp(operand.base, int(operand.disp16))
+}
+
+// [reg] + [reg] + disp as byte
+type mem8BaseIndexDisp struct {
+	base  registerW // it should be BX or BP
+	index registerW // it should be SI or DI
+	disp  int16
+}
+
+func (operand mem8BaseIndexDisp) read(s state, m *memory) (int, error) {
+	address, err := operand.address(s)
+	if err != nil {
+		return 0, errors.Wrap(err, "failed to read mem8BaseIndexDisp")
+	}
+	v, err := m.readInt8(address)
+	if err != nil {
+		return 0, errors.Wrap(err, "failed to read mem8BaseIndexDisp")
+	}
+	return int(v), nil
+}
+
+func (operand mem8BaseIndexDisp) write(v int, s state, m *memory) (state, error) {
+	address, err := operand.address(s)
+	if err != nil {
+		return s, errors.Wrap(err, "failed to write to mem8BaseIndexDisp")
+	}
+	err = m.writeByte(address, byte(v))
+	if err != nil {
+		return s, errors.Wrap(err, "failed to write to mem8BaseIndexDisp")
+	}
+	return s, nil
+}
+
+func (operand mem8BaseIndexDisp) size() int {
+	return 1
+}
+
+func (operand mem8BaseIndexDisp) address(s state) (*address, error) {
+	return s.addressFromBaseIndexAndDisp(operand.base, operand.index, int(operand.disp))
+}
+
 // [disp16] as byte
 type mem8Disp16 struct {
 	offset word // this can be minus?
 }
 
 func (operand mem8Disp16) read(s state, m *memory) (int, error) {
-	address, _ := operand.address(s)
+	address, err := operand.address(s)
+	if err != nil {
+		return 0, errors.Wrap(err, "failed to read mem8Disp16")
+	}
 	v, err := m.readInt8(address)
 	if err != nil {
 		return 0, errors.Wrap(err, "failed to read mem8Disp16")
@@ -405,17 +683,27 @@ func (operand mem8Disp16) read(s state, m *memory) (int, error) {
 }
 
 func (operand mem8Disp16) write(v int, s state, m *memory) (state, error) {
-	address, _ := operand.address(s)
-	err := m.writeByte(address, byte(v))
+	address, err := operand.address(s)
+	if err != nil {
+		return s, errors.Wrap(err, "failed to write to mem8Disp16")
+	}
+	err = m.writeByte(address, byte(v))
 	if err != nil {
 		return s, errors.Wrap(err, "failed to write to mem8BaseDisp8")
 	}
 	return s, nil
 }
 
+func (operand mem8Disp16) size() int {
+	return 1
+}
+
 func (operand mem8Disp16) address(s state) (*address, error) {
-	address := newAddressFromWord(s.ds, operand.offset)
-	return address, nil
+	seg, err := s.segmentFor(DS)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to get address of mem8Disp16")
+	}
+	return newAddressFromWord(seg, operand.offset), nil
 }
 
 // [reg] + disp8 as word
@@ -448,109 +736,411 @@ func (operand mem16BaseDisp8) write(v int, s state, m *memory) (state, error) {
 	return s, nil
 }
 
+func (operand mem16BaseDisp8) size() int {
+	return 2
+}
+
 func (operand mem16BaseDisp8) address(s state) (*address, error) {
 	return s.addressFromBaseAndDisp(operand.base, int(operand.disp8))
 }
 
-// [disp16] as word
-type mem16Disp16 struct {
-	offset word // this can be minus?
+// [reg] + disp16 as word
+type mem16BaseDisp16 struct {
+	base   registerW // it should be SI, DI, BP, or BX in x86 as shown in Table 2-1. 16-Bit Addressing Forms with the ModR/M Byte
+	disp16 int16
 }
 
-func (operand mem16Disp16) read(s state, m *memory) (int, error) {
-	address, _ := operand.address(s)
+func (operand mem16BaseDisp16) read(s state, m *memory) (int, error) {
+	address, err := operand.address(s)
+	if err != nil {
+		return 0, errors.Wrap(err, "failed to read mem16BaseDisp16")
+	}
 	v, err := m.readInt16(address)
 	if err != nil {
-		return 0, errors.Wrap(err, "failed to read mem8Disp16")
+		return 0, errors.Wrap(err, "failed to read mem16BaseDisp16")
 	}
 	return int(v), nil
 }
 
-func (operand mem16Disp16) write(v int, s state, m *memory) (state, error) {
-	address, _ := operand.address(s)
-	err := m.writeWord(address, word(v))
+func (operand mem16BaseDisp16) write(v int, s state, m *memory) (state, error) {
+	address, err := operand.address(s)
 	if err != nil {
-		return s, errors.Wrap(err, "failed to write to mem8BaseDisp8")
+		return s, errors.Wrap(err, "failed to write to mem16BaseDisp16")
+	}
+	err = m.writeWord(address, word(v))
+	if err != nil {
+		return s, errors.Wrap(err, "failed to write to mem16BaseDisp16")
 	}
 	return s, nil
 }
 
-func (operand mem16Disp16) address(s state) (*address, error) {
-	address := newAddressFromWord(s.ds, operand.offset)
-	return address, nil
+func (operand mem16BaseDisp16) size() int {
+	return 2
 }
 
-// sreg
-type sreg struct {
-	value registerS
+func (operand mem16BaseDisp16) address(s state) (*address, error) {
+	return s.addressFromBaseAndDisp(operand.base, int(operand.disp16))
 }
 
-func newSreg(b byte) (operand, error) {
-	reg, err := toRegisterS(b)
-	return sreg{value: reg}, err
+// [reg] + [reg] + disp as word
+type mem16BaseIndexDisp struct {
+	base  registerW // it should be BX or BP
+	index registerW // it should be SI or DI
+	disp  int16
 }
 
-func (operand sreg) read(s state, m *memory) (int, error) {
-	v, err := s.readWordSreg(operand.value)
-	return int(v), err
+func (operand mem16BaseIndexDisp) read(s state, m *memory) (int, error) {
+	address, err := operand.address(s)
+	if err != nil {
+		return 0, errors.Wrap(err, "failed to read mem16BaseIndexDisp")
+	}
+	v, err := m.readInt16(address)
+	if err != nil {
+		return 0, errors.Wrap(err, "failed to read mem16BaseIndexDisp")
+	}
+	return int(v), nil
 }
 
-func (operand sreg) write(v int, s state, m *memory) (state, error) {
-	return s.writeWordSreg(operand.value, word(v))
+func (operand mem16BaseIndexDisp) write(v int, s state, m *memory) (state, error) {
+	address, err := operand.address(s)
+	if err != nil {
+		return s, errors.Wrap(err, "failed to write to mem16BaseIndexDisp")
+	}
+	err = m.writeWord(address, word(v))
+	if err != nil {
+		return s, errors.Wrap(err, "failed to write to mem16BaseIndexDisp")
+	}
+	return s, nil
 }
 
-// ----------------
-// instruction
-// ----------------
-
-type instAdd struct {
-	dest operand
-	src  operand
+func (operand mem16BaseIndexDisp) size() int {
+	return 2
 }
 
-type instAnd struct {
-	dest operand
-	src  operand
+func (operand mem16BaseIndexDisp) address(s state) (*address, error) {
+	return s.addressFromBaseIndexAndDisp(operand.base, operand.index, int(operand.disp))
 }
 
-type instCall struct {
-	rel int16
+// [disp16] as word
+type mem16Disp16 struct {
+	offset word // this can be minus?
 }
 
-type instCallAbsoluteIndirectMem16 struct {
-	operand operand
+func (operand mem16Disp16) read(s state, m *memory) (int, error) {
+	address, err := operand.address(s)
+	if err != nil {
+		return 0, errors.Wrap(err, "failed to read mem16Disp16")
+	}
+	v, err := m.readInt16(address)
+	if err != nil {
+		return 0, errors.Wrap(err, "failed to read mem8Disp16")
+	}
+	return int(v), nil
 }
 
-type instCld struct {
+func (operand mem16Disp16) write(v int, s state, m *memory) (state, error) {
+	address, err := operand.address(s)
+	if err != nil {
+		return s, errors.Wrap(err, "failed to write to mem16Disp16")
+	}
+	err = m.writeWord(address, word(v))
+	if err != nil {
+		return s, errors.Wrap(err, "failed to write to mem8BaseDisp8")
+	}
+	return s, nil
 }
 
-type instCmp struct {
-	dest operand
-	src  operand
+func (operand mem16Disp16) size() int {
+	return 2
 }
 
-type instDec struct {
-	dest registerW
+func (operand mem16Disp16) address(s state) (*address, error) {
+	seg, err := s.segmentFor(DS)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to get address of mem16Disp16")
+	}
+	return newAddressFromWord(seg, operand.offset), nil
 }
 
-type instInc struct {
-	dest registerW
+// [base] + [index] * scale + disp in 32-bit addressing forms.
+// Only 16-bit registers exist here, so base and index are read as zero-extended
+// and the effective address wraps around within the segment.
+type addressing32 struct {
+	base     registerW
+	hasBase  bool
+	index    registerW
+	hasIndex bool
+	scale    uint8 // 1, 2, 4 or 8
+	disp     int32
 }
 
-type instInt struct {
-	operand uint8
-}
+func (addressing addressing32) address(s state) (*address, error) {
+	ea := int64(addressing.disp)
+	defaultSreg := DS
+	if addressing.hasBase {
+		vBase, err := s.readWordGeneralReg(addressing.base)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to get address of addressing32")
+		}
+		ea += int64(vBase)
+		if addressing.base == BP || addressing.base == SP {
+			defaultSreg = SS
+		}
+	}
+	if addressing.hasIndex {
+		vIndex, err := s.readWordGeneralReg(addressing.index)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to get address of addressing32")
+		}
+		ea += int64(vIndex) * int64(addressing.scale)
+	}
 
-type instJae struct {
-	rel8 int8
+	seg, err := s.segmentFor(defaultSreg)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to get address of addressing32")
+	}
+	return newAddressFromWord(seg, word(ea)), nil
 }
 
-type instJb struct {
-	rel8 int8
+// 32-bit addressing form as byte
+type mem8Addr32 struct {
+	addressing32
 }
 
-type instJeRel8 struct {
-	rel8 int8
+func (operand mem8Addr32) read(s state, m *memory) (int, error) {
+	address, err := operand.address(s)
+	if err != nil {
+		return 0, errors.Wrap(err, "failed to read mem8Addr32")
+	}
+	v, err := m.readInt8(address)
+	if err != nil {
+		return 0, errors.Wrap(err, "failed to read mem8Addr32")
+	}
+	return int(v), nil
+}
+
+func (operand mem8Addr32) write(v int, s state, m *memory) (state, error) {
+	address, err := operand.address(s)
+	if err != nil {
+		return s, errors.Wrap(err, "failed to write to mem8Addr32")
+	}
+	err = m.writeByte(address, byte(v))
+	if err != nil {
+		return s, errors.Wrap(err, "failed to write to mem8Addr32")
+	}
+	return s, nil
+}
+
+func (operand mem8Addr32) size() int {
+	return 1
+}
+
+// 32-bit addressing form as word
+type mem16Addr32 struct {
+	addressing32
+}
+
+func (operand mem16Addr32) read(s state, m *memory) (int, error) {
+	address, err := operand.address(s)
+	if err != nil {
+		return 0, errors.Wrap(err, "failed to read mem16Addr32")
+	}
+	v, err := m.readInt16(address)
+	if err != nil {
+		return 0, errors.Wrap(err, "failed to read mem16Addr32")
+	}
+	return int(v), nil
+}
+
+func (operand mem16Addr32) write(v int, s state, m *memory) (state, error) {
+	address, err := operand.address(s)
+	if err != nil {
+		return s, errors.Wrap(err, "failed to write to mem16Addr32")
+	}
+	err = m.writeWord(address, word(v))
+	if err != nil {
+		return s, errors.Wrap(err, "failed to write to mem16Addr32")
+	}
+	return s, nil
+}
+
+func (operand mem16Addr32) size() int {
+	return 2
+}
+
+func maskOf(size int) int {
+	if size == 1 {
+		return 0xff
+	}
+	return 0xffff
+}
+
+func signBitOf(size int) int {
+	if size == 1 {
+		return 0x80
+	}
+	return 0x8000
+}
+
+// return true if the number of set bits in the low byte of v is even
+func parityOf(v int) bool {
+	count := 0
+	for b := uint8(v); b != 0; b >>= 1 {
+		count += int(b & 1)
+	}
+	return count%2 == 0
+}
+
+// return true if l + r = result overflows as signed value of the size
+func overflowAdd(l, r, result, size int) bool {
+	return (l^result)&(r^result)&signBitOf(size) != 0
+}
+
+// return true if l - r = result overflows as signed value of the size
+func overflowSub(l, r, result, size int) bool {
+	return (l^r)&(l^result)&signBitOf(size) != 0
+}
+
+// sreg
+type sreg struct {
+	value registerS
+}
+
+func newSreg(b byte) (operand, error) {
+	reg, err := toRegisterS(b)
+	return sreg{value: reg}, err
+}
+
+func (operand sreg) read(s state, m *memory) (int, error) {
+	v, err := s.readWordSreg(operand.value)
+	return int(v), err
+}
+
+func (operand sreg) write(v int, s state, m *memory) (state, error) {
+	return s.writeWordSreg(operand.value, word(v))
+}
+
+func (operand sreg) size() int {
+	return 2
+}
+
+// ----------------
+// instruction
+// ----------------
+
+type instAaa struct {
+}
+
+// base is 10 for decimal in the usual encoding
+type instAad struct {
+	base uint8
+}
+
+type instAam struct {
+	base uint8
+}
+
+type instAas struct {
+}
+
+type instAdd struct {
+	dest operand
+	src  operand
+}
+
+type instAdc struct {
+	dest operand
+	src  operand
+}
+
+type instAnd struct {
+	dest operand
+	src  operand
+}
+
+// index is compared with the signed lower and upper bounds stored at bounds
+type instBound struct {
+	index  operand
+	bounds operandAddressing
+}
+
+type instCall struct {
+	rel int16
+}
+
+type instCallAbsoluteIndirectMem16 struct {
+	operand operand
+}
+
+// far call to m16:16, which has offset followed by segment
+type instCallFarIndirect struct {
+	operand operandAddressing
+}
+
+type instCld struct {
+}
+
+type instCmp struct {
+	dest operand
+	src  operand
+}
+
+type instDaa struct {
+}
+
+type instDas struct {
+}
+
+type instDec struct {
+	dest registerW
+}
+
+type instDiv struct {
+	src operand
+}
+
+type instIdiv struct {
+	src operand
+}
+
+type instInc struct {
+	dest registerW
+}
+
+type instInt struct {
+	operand uint8
+}
+
+type instInto struct{}
+
+type instIret struct{}
+
+// conditional jump with 16-bit displacement
+type instJccRel16 struct {
+	cond condition
+	rel  int16
+}
+
+type instJae struct {
+	rel8 int8
+}
+
+type instJb struct {
+	rel8 int8
+}
+
+type instJeRel8 struct {
+	rel8 int8
+}
+
+// far jump to m16:16, which has offset followed by segment
+type instJmpFarIndirect struct {
+	operand operandAddressing
+}
+
+// near jump to the offset in r/m16
+type instJmpIndirect struct {
+	operand operand
 }
 
 type instJmpRel16 struct {
@@ -566,11 +1156,41 @@ type instLea struct {
 	src  operandAddressing
 }
 
+type instLodsb struct {
+}
+
+// decrement CX and jump if it is not zero
+type instLoop struct {
+	rel8 int8
+}
+
 type instMov struct {
 	dest operand
 	src  operand
 }
 
+type instMovsb struct {
+}
+
+type instMovsx struct {
+	dest operand
+	src  operand
+}
+
+type instMovzx struct {
+	dest operand
+	src  operand
+}
+
+type instNeg struct {
+	dest operand
+}
+
+type instOr struct {
+	dest operand
+	src  operand
+}
+
 type instPop struct {
 	dest registerW
 }
@@ -579,6 +1199,8 @@ type instPopSreg struct {
 	dest registerS
 }
 
+type instPopf struct{}
+
 type instPush struct {
 	src registerW
 }
@@ -587,6 +1209,13 @@ type instPushSreg struct {
 	src registerS
 }
 
+type instPushf struct{}
+
+// REP prefix on instruction which has no dedicated repeated form
+type instRep struct {
+	inst interface{}
+}
+
 type instRepeScasb struct {
 }
 
@@ -602,6 +1231,26 @@ type instRepStosb struct {
 type instRet struct {
 }
 
+type instRetFar struct {
+	imm16 uint16
+}
+
+type instSbb struct {
+	dest operand
+	src  operand
+}
+
+type instScasb struct {
+}
+
+type instScasw struct {
+}
+
+type instSetcc struct {
+	cond condition
+	dest operand
+}
+
 type instShl struct {
 	dest operand
 	src  operand
@@ -623,6 +1272,16 @@ type instSub struct {
 	src  operand
 }
 
+type instTest struct {
+	dest operand
+	src  operand
+}
+
+type instXchg struct {
+	dest operand
+	src  operand
+}
+
 type instXor struct {
 	dest operand
 	src  operand
@@ -634,13 +1293,16 @@ type instXor struct {
 // symbols such as Eb, Gb come from Table A-2. One-byte Opcode Map
 // -----------
 
+// In 16-bit addressing, rm selects [bx+si], [bx+di], [bp+si], [bp+di], [si], [di], [bp] (or disp16 when mod is 0) and [bx].
+// There is no [sp] form, so rm 4 always means [si] and SP is never used as a base.
 type modRM struct {
-	mod byte
-	reg byte
-	rm  byte
+	mod       byte
+	reg       byte
+	rm        byte
+	address32 bool // decoded under the address-size prefix 0x67
 }
 
-func newModRM(at *address, mem *memory) (modRM, error) {
+func newModRM(at *address, mem *memory, address32 bool) (modRM, error) {
 	decodeModRegRM := func(a *address, m *memory) (byte, byte, byte, error) {
 		buf, err := m.readByte(a)
 		if err != nil {
@@ -655,19 +1317,87 @@ func newModRM(at *address, mem *memory) (modRM, error) {
 	}
 
 	mod, reg, rm, err := decodeModRegRM(at, mem)
-	return modRM{mod: mod, reg: reg, rm: rm}, err
+	return modRM{mod: mod, reg: reg, rm: rm, address32: address32}, err
+}
+
+// getAddressing32 decodes the memory forms of 32-bit addressing,
+// which follow ModR/M with an optional SIB byte and a disp8 or disp32.
+func (modRM modRM) getAddressing32(address *address, memory *memory) (addressing32, error) {
+	var addressing addressing32
+	if modRM.rm == 4 {
+		sib, err := memory.readByte(address)
+		if err != nil {
+			return addressing, errors.Wrap(err, "failed to parse sib")
+		}
+		scale := (sib & 0xc0) >> 6 // 0b11000000
+		index := (sib & 0x38) >> 3 // 0b00111000
+		base := sib & 0x07         // 0b00000111
+		// index 4 means no index
+		if index != 4 {
+			addressing.index = registerW(index)
+			addressing.hasIndex = true
+			addressing.scale = 1 << scale
+		}
+		// mod 0 with base 5 is not [ebp] but disp32 without base
+		if !(modRM.mod == 0 && base == 5) {
+			addressing.base = registerW(base)
+			addressing.hasBase = true
+		}
+	} else if !(modRM.mod == 0 && modRM.rm == 5) {
+		// mod 0 with rm 5 is not [ebp] but direct addressing by disp32
+		addressing.base = registerW(modRM.rm)
+		addressing.hasBase = true
+	}
+
+	switch {
+	case modRM.mod == 1:
+		disp8, err := memory.readInt8(address)
+		if err != nil {
+			return addressing, errors.Wrap(err, "failed to parse disp8")
+		}
+		addressing.disp = int32(disp8)
+	case modRM.mod == 2 || !addressing.hasBase:
+		disp32, err := memory.readInt32(address)
+		if err != nil {
+			return addressing, errors.Wrap(err, "failed to parse disp32")
+		}
+		addressing.disp = disp32
+	}
+	return addressing, nil
 }
 
 func (modRM modRM) getEb(address *address, memory *memory) (operand, error) {
+	if modRM.address32 && modRM.mod != 3 {
+		addressing, err := modRM.getAddressing32(address, memory)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to getEb")
+		}
+		return mem8Addr32{addressing}, nil
+	}
 	switch modRM.mod {
 	case 0:
 		switch modRM.rm {
+		case 0:
+			return mem8BaseIndexDisp{base: BX, index: SI, disp: 0}, nil
+		case 1:
+			return mem8BaseIndexDisp{base: BX, index: DI, disp: 0}, nil
+		case 2:
+			return mem8BaseIndexDisp{base: BP, index: SI, disp: 0}, nil
+		case 3:
+			return mem8BaseIndexDisp{base: BP, index: DI, disp: 0}, nil
+		case 4:
+			return mem8BaseDisp8{base: SI, disp8: 0}, nil
+		case 5:
+			return mem8BaseDisp8{base: DI, disp8: 0}, nil
 		case 6:
+			// mod 0 with rm 6 is not [bp] but direct addressing by disp16
 			offset, err := memory.readWord(address)
 			if err != nil {
 				return nil, errors.Wrap(err, "failed to getEb")
 			}
 			return mem8Disp16{offset: offset}, nil
+		case 7:
+			return mem8BaseDisp8{base: BX, disp8: 0}, nil
 		default:
 			return nil, errors.Errorf("illegal or not yet implemeted for rm: %d", modRM.rm)
 		}
@@ -677,6 +1407,14 @@ func (modRM modRM) getEb(address *address, memory *memory) (operand, error) {
 			return nil, errors.Wrap(err, "failed to getEb")
 		}
 		switch modRM.rm {
+		case 0:
+			return mem8BaseIndexDisp{base: BX, index: SI, disp: int16(disp8)}, nil
+		case 1:
+			return mem8BaseIndexDisp{base: BX, index: DI, disp: int16(disp8)}, nil
+		case 2:
+			return mem8BaseIndexDisp{base: BP, index: SI, disp: int16(disp8)}, nil
+		case 3:
+			return mem8BaseIndexDisp{base: BP, index: DI, disp: int16(disp8)}, nil
 		case 4:
 			return mem8BaseDisp8{base: SI, disp8: disp8}, nil
 		case 5:
@@ -688,6 +1426,31 @@ func (modRM modRM) getEb(address *address, memory *memory) (operand, error) {
 		default:
 			return nil, errors.Errorf("illegal or not yet implemeted for rm: %d", modRM.rm)
 		}
+	case 2:
+		disp16, err := memory.readInt16(address)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to getEb")
+		}
+		switch modRM.rm {
+		case 0:
+			return mem8BaseIndexDisp{base: BX, index: SI, disp: disp16}, nil
+		case 1:
+			return mem8BaseIndexDisp{base: BX, index: DI, disp: disp16}, nil
+		case 2:
+			return mem8BaseIndexDisp{base: BP, index: SI, disp: disp16}, nil
+		case 3:
+			return mem8BaseIndexDisp{base: BP, index: DI, disp: disp16}, nil
+		case 4:
+			return mem8BaseDisp16{base: SI, disp16: disp16}, nil
+		case 5:
+			return mem8BaseDisp16{base: DI, disp16: disp16}, nil
+		case 6:
+			return mem8BaseDisp16{base: BP, disp16: disp16}, nil
+		case 7:
+			return mem8BaseDisp16{base: BX, disp16: disp16}, nil
+		default:
+			return nil, errors.Errorf("illegal or not yet implemeted for rm: %d", modRM.rm)
+		}
 	case 3:
 		return newReg8(modRM.rm)
 	default:
@@ -700,15 +1463,37 @@ func (modRM modRM) getGb() (operand, error) {
 }
 
 func (modRM modRM) getEv(address *address, memory *memory) (operand, error) {
+	if modRM.address32 && modRM.mod != 3 {
+		addressing, err := modRM.getAddressing32(address, memory)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to getEv")
+		}
+		return mem16Addr32{addressing}, nil
+	}
 	switch modRM.mod {
 	case 0:
 		switch modRM.rm {
+		case 0:
+			return mem16BaseIndexDisp{base: BX, index: SI, disp: 0}, nil
+		case 1:
+			return mem16BaseIndexDisp{base: BX, index: DI, disp: 0}, nil
+		case 2:
+			return mem16BaseIndexDisp{base: BP, index: SI, disp: 0}, nil
+		case 3:
+			return mem16BaseIndexDisp{base: BP, index: DI, disp: 0}, nil
+		case 4:
+			return mem16BaseDisp8{base: SI, disp8: 0}, nil
+		case 5:
+			return mem16BaseDisp8{base: DI, disp8: 0}, nil
 		case 6:
+			// mod 0 with rm 6 is not [bp] but direct addressing by disp16
 			offset, err := memory.readWord(address)
 			if err != nil {
 				return nil, errors.Wrap(err, "failed to getEv")
 			}
 			return mem16Disp16{offset: offset}, nil
+		case 7:
+			return mem16BaseDisp8{base: BX, disp8: 0}, nil
 		default:
 			return nil, errors.Errorf("illegal or not yet implemeted for rm: %d", modRM.rm)
 		}
@@ -718,6 +1503,14 @@ func (modRM modRM) getEv(address *address, memory *memory) (operand, error) {
 			return nil, errors.Wrap(err, "failed to getEv")
 		}
 		switch modRM.rm {
+		case 0:
+			return mem16BaseIndexDisp{base: BX, index: SI, disp: int16(disp8)}, nil
+		case 1:
+			return mem16BaseIndexDisp{base: BX, index: DI, disp: int16(disp8)}, nil
+		case 2:
+			return mem16BaseIndexDisp{base: BP, index: SI, disp: int16(disp8)}, nil
+		case 3:
+			return mem16BaseIndexDisp{base: BP, index: DI, disp: int16(disp8)}, nil
 		case 4:
 			return mem16BaseDisp8{base: SI, disp8: disp8}, nil
 		case 5:
@@ -729,11 +1522,36 @@ func (modRM modRM) getEv(address *address, memory *memory) (operand, error) {
 		default:
 			return nil, errors.Errorf("illegal or not yet implemeted for rm: %d", modRM.rm)
 		}
-	case 3:
-		return newReg16(modRM.rm)
-	default:
-		return nil, errors.Errorf("illegal or not yet implemented for mod: %d", modRM.mod)
-	}
+	case 2:
+		disp16, err := memory.readInt16(address)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to getEv")
+		}
+		switch modRM.rm {
+		case 0:
+			return mem16BaseIndexDisp{base: BX, index: SI, disp: disp16}, nil
+		case 1:
+			return mem16BaseIndexDisp{base: BX, index: DI, disp: disp16}, nil
+		case 2:
+			return mem16BaseIndexDisp{base: BP, index: SI, disp: disp16}, nil
+		case 3:
+			return mem16BaseIndexDisp{base: BP, index: DI, disp: disp16}, nil
+		case 4:
+			return mem16BaseDisp16{base: SI, disp16: disp16}, nil
+		case 5:
+			return mem16BaseDisp16{base: DI, disp16: disp16}, nil
+		case 6:
+			return mem16BaseDisp16{base: BP, disp16: disp16}, nil
+		case 7:
+			return mem16BaseDisp16{base: BX, disp16: disp16}, nil
+		default:
+			return nil, errors.Errorf("illegal or not yet implemeted for rm: %d", modRM.rm)
+		}
+	case 3:
+		return newReg16(modRM.rm)
+	default:
+		return nil, errors.Errorf("illegal or not yet implemented for mod: %d", modRM.mod)
+	}
 }
 
 func (modRM modRM) getEw(address *address, memory *memory) (operand, error) {
@@ -750,15 +1568,37 @@ func (modRM modRM) getSw() (operand, error) {
 
 // based on mem8, but size is not necessary
 func (modRM modRM) getM(address *address, memory *memory) (operandAddressing, error) {
+	if modRM.address32 && modRM.mod != 3 {
+		addressing, err := modRM.getAddressing32(address, memory)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to getM")
+		}
+		return mem8Addr32{addressing}, nil
+	}
 	switch modRM.mod {
 	case 0:
 		switch modRM.rm {
+		case 0:
+			return mem8BaseIndexDisp{base: BX, index: SI, disp: 0}, nil
+		case 1:
+			return mem8BaseIndexDisp{base: BX, index: DI, disp: 0}, nil
+		case 2:
+			return mem8BaseIndexDisp{base: BP, index: SI, disp: 0}, nil
+		case 3:
+			return mem8BaseIndexDisp{base: BP, index: DI, disp: 0}, nil
+		case 4:
+			return mem8BaseDisp8{base: SI, disp8: 0}, nil
+		case 5:
+			return mem8BaseDisp8{base: DI, disp8: 0}, nil
 		case 6:
+			// mod 0 with rm 6 is not [bp] but direct addressing by disp16
 			offset, err := memory.readWord(address)
 			if err != nil {
 				return nil, errors.Wrap(err, "failed to getEb")
 			}
 			return mem8Disp16{offset: offset}, nil
+		case 7:
+			return mem8BaseDisp8{base: BX, disp8: 0}, nil
 		default:
 			return nil, errors.Errorf("illegal or not yet implemeted for rm: %d", modRM.rm)
 		}
@@ -768,6 +1608,14 @@ func (modRM modRM) getM(address *address, memory *memory) (operandAddressing, er
 			return nil, errors.Wrap(err, "failed to getEb")
 		}
 		switch modRM.rm {
+		case 0:
+			return mem8BaseIndexDisp{base: BX, index: SI, disp: int16(disp8)}, nil
+		case 1:
+			return mem8BaseIndexDisp{base: BX, index: DI, disp: int16(disp8)}, nil
+		case 2:
+			return mem8BaseIndexDisp{base: BP, index: SI, disp: int16(disp8)}, nil
+		case 3:
+			return mem8BaseIndexDisp{base: BP, index: DI, disp: int16(disp8)}, nil
 		case 4:
 			return mem8BaseDisp8{base: SI, disp8: disp8}, nil
 		case 5:
@@ -779,6 +1627,31 @@ func (modRM modRM) getM(address *address, memory *memory) (operandAddressing, er
 		default:
 			return nil, errors.Errorf("illegal or not yet implemeted for rm: %d", modRM.rm)
 		}
+	case 2:
+		disp16, err := memory.readInt16(address)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to getEb")
+		}
+		switch modRM.rm {
+		case 0:
+			return mem8BaseIndexDisp{base: BX, index: SI, disp: disp16}, nil
+		case 1:
+			return mem8BaseIndexDisp{base: BX, index: DI, disp: disp16}, nil
+		case 2:
+			return mem8BaseIndexDisp{base: BP, index: SI, disp: disp16}, nil
+		case 3:
+			return mem8BaseIndexDisp{base: BP, index: DI, disp: disp16}, nil
+		case 4:
+			return mem8BaseDisp16{base: SI, disp16: disp16}, nil
+		case 5:
+			return mem8BaseDisp16{base: DI, disp16: disp16}, nil
+		case 6:
+			return mem8BaseDisp16{base: BP, disp16: disp16}, nil
+		case 7:
+			return mem8BaseDisp16{base: BX, disp16: disp16}, nil
+		default:
+			return nil, errors.Errorf("illegal or not yet implemeted for rm: %d", modRM.rm)
+		}
 	default:
 		return nil, errors.Errorf("illegal or not yet implemented for mod: %d", modRM.mod)
 	}
@@ -795,804 +1668,2072 @@ func decodeInst(reader io.Reader) (interface{}, int, *segmentOverride, error) {
 	if err != nil {
 		return nil, 0, nil, err
 	}
-	memory := newMemory(bytes)
-	address := newAddress(0, 0)
-	return decodeInstWithMemory(address, memory)
+	return newDecoder(bytes).decode()
+}
+
+// decoder decodes a stream of instructions placed at 0000:0000 one by one.
+// Memory is not extended to 1MB, so reading beyond the code fails.
+type decoder struct {
+	memory  *memory
+	address *address
+}
+
+func newDecoder(code []byte) *decoder {
+	return &decoder{
+		memory:  &memory{loadModule: code, memorySize: len(code)},
+		address: newAddress(0, 0),
+	}
+}
+
+// decode the next instruction, where decoder advances by read bytes
+func (decoder *decoder) decode() (interface{}, int, *segmentOverride, error) {
+	return decodeInstWithMemory(decoder.address, decoder.memory)
 }
 
 // inst, read bytes, register overriding, error
 func decodeInstWithMemory(initialAddress *address, memory *memory) (interface{}, int, *segmentOverride, error) {
-	failureFunc := func(opcode byte, err error) (interface{}, int, *segmentOverride, error) {
-		msg := fmt.Sprintf("failed to decode %02x", opcode)
-		return nil, -1, nil, errors.Wrap(err, msg)
+	return decodeInstWithAddressSize(initialAddress, memory, false)
+}
+
+// decodeInstWithAddressSize decodes an instruction with 32-bit addressing forms if address32 is true
+func decodeInstWithAddressSize(initialAddress *address, memory *memory, address32 bool) (interface{}, int, *segmentOverride, error) {
+	initialSeg, initialOffset := initialAddress.seg, initialAddress.offset
+
+	opcode, err := memory.readByte(initialAddress)
+	if err != nil {
+		return nil, -1, nil, errors.Wrap(err, "failed to parse opcode")
+	}
+	ctx := decodeContext{
+		opcode:    opcode,
+		address:   initialAddress,
+		memory:    memory,
+		address32: address32,
+		seg:       initialSeg,
+		offset:    initialOffset,
 	}
 
+	// prefixes are not in decoders since they decode the following instruction
 	var inst interface{}
-	currentAddress := initialAddress
-	initialRealAddress := initialAddress.realAddress()
+	var override *segmentOverride
+	switch opcode {
+	// segment override prefix
+	case 0x26, 0x2e, 0x36, 0x3e, 0x64, 0x65:
+		inst, _, err = decodePrefixed(ctx, address32)
+		override = &segmentOverride{sreg: segmentOverridePrefixes[opcode]}
+
+	// address-size prefix
+	// 67
+	case 0x67:
+		inst, override, err = decodePrefixed(ctx, true)
+
+	// rep or repe prefix
+	// f3
+	case 0xf3:
+		inst, override, err = decodePrefixed(ctx, address32)
+		inst = withRep(inst)
 
-	rawOpcode, err := memory.readByte(currentAddress)
+	default:
+		decode := oneByteDecoders[opcode]
+		if decode == nil {
+			return nil, -1, nil, errors.WithStack(newDecodeError(ctx.seg, ctx.offset, opcode, memory))
+		}
+		inst, err = decode(ctx)
+	}
 	if err != nil {
-		return inst, -1, nil, errors.Wrap(err, "failed to parse opcode")
+		return nil, -1, nil, errors.Wrapf(err, "failed to decode %02x", opcode)
 	}
+	// offset may wrap around within the segment
+	return inst, int(initialAddress.offset - initialOffset), override, nil
+}
 
-	switch rawOpcode {
-	// add r16,r/m16
-	// 03 /r
-	case 0x03:
-		modRM, err := newModRM(currentAddress, memory)
-		if err != nil {
-			return failureFunc(rawOpcode, err)
-		}
-		dest, err := modRM.getGv()
-		if err != nil {
-			return failureFunc(rawOpcode, err)
-		}
-		src, err := modRM.getEv(currentAddress, memory)
-		if err != nil {
-			return failureFunc(rawOpcode, err)
+// decode instruction following prefix
+func decodePrefixed(ctx decodeContext, address32 bool) (interface{}, *segmentOverride, error) {
+	inst, _, override, err := decodeInstWithAddressSize(ctx.address, ctx.memory, address32)
+	if err != nil {
+		if decodeError, ok := errors.Cause(err).(*DecodeError); ok {
+			// report the start of instruction including the prefix
+			*decodeError = *newDecodeError(ctx.seg, ctx.offset, decodeError.Opcode, ctx.memory)
 		}
-		inst = instAdd{dest: dest, src: src}
+		return nil, nil, err
+	}
+	return inst, override, nil
+}
+
+// decodeContext is passed to decodeFunc for an instruction being decoded
+type decodeContext struct {
+	opcode    byte     // the second byte for two-byte opcodes
+	address   *address // just after bytes read so far
+	memory    *memory
+	address32 bool
+	// start of instruction for error
+	seg, offset uint16
+}
+
+// decodeFunc decodes the rest of instruction after its opcode
+type decodeFunc func(ctx decodeContext) (interface{}, error)
+
+// decodeAs is decodeFunc for instruction which consists only of its opcode
+func decodeAs(inst interface{}) decodeFunc {
+	return func(ctx decodeContext) (interface{}, error) {
+		return inst, nil
+	}
+}
+
+// decoders indexed by opcode, where nil is for unknown opcode
+var oneByteDecoders [256]decodeFunc
+
+// decoders indexed by the second byte of opcode after 0f
+var twoByteDecoders [256]decodeFunc
+
+// tables are filled in init so that a range of opcodes can be registered by loop
+func init() {
+	oneByteDecoders[0x03] = decode03                        // add r16,r/m16
+	oneByteDecoders[0x08] = decode08                        // or r/m8,r8
+	oneByteDecoders[0x09] = decode09                        // or r/m16,r16
+	oneByteDecoders[0x0a] = decode0A                        // or r8,r/m8
+	oneByteDecoders[0x0b] = decode0B                        // or r16,r/m16
+	oneByteDecoders[0x0c] = decode0C                        // or al,imm8
+	oneByteDecoders[0x0d] = decode0D                        // or ax,imm16
+	oneByteDecoders[0x0f] = decodeTwoByteInst               // two-byte opcodes
+	oneByteDecoders[0x1e] = decodeAs(instPushSreg{src: DS}) // push ds
+	oneByteDecoders[0x1f] = decodeAs(instPopSreg{dest: DS}) // pop ds
+	oneByteDecoders[0x20] = decode20                        // and r/m8,r8
+	oneByteDecoders[0x21] = decode21                        // and r/m16,r16
+	oneByteDecoders[0x22] = decode22                        // and r8,r/m8
+	oneByteDecoders[0x24] = decode24                        // and al,imm8
+	oneByteDecoders[0x25] = decode25                        // and ax,imm16
+	oneByteDecoders[0x27] = decodeAs(instDaa{})             // daa
+	oneByteDecoders[0x2a] = decode2A                        // sub r8,r/m8
+	oneByteDecoders[0x2b] = decode2B                        // sub r16,r/m16
+	oneByteDecoders[0x2f] = decodeAs(instDas{})             // das
+	oneByteDecoders[0x30] = decode30                        // xor r/m8,r8
+	oneByteDecoders[0x31] = decode31                        // xor r/m16,r16
+	oneByteDecoders[0x32] = decode32                        // xor r8,r/m8
+	oneByteDecoders[0x33] = decode33                        // xor r16,r/m16
+	oneByteDecoders[0x34] = decode34                        // xor al,imm8
+	oneByteDecoders[0x35] = decode35                        // xor ax,imm16
+	oneByteDecoders[0x37] = decodeAs(instAaa{})             // aaa
+	oneByteDecoders[0x38] = decode38                        // cmp r/m8,r8
+	oneByteDecoders[0x3a] = decode3A                        // cmp r8,r/m8
+	oneByteDecoders[0x3b] = decode3B                        // cmp r16,r/m16
+	oneByteDecoders[0x3c] = decode3C                        // cmp al,imm8
+	oneByteDecoders[0x3d] = decode3D                        // cmp ax,imm16
+	oneByteDecoders[0x3f] = decodeAs(instAas{})             // aas
+	oneByteDecoders[0x40] = decodeAs(instInc{dest: AX})     // inc ax
+	oneByteDecoders[0x41] = decodeAs(instInc{dest: CX})     // inc cx
+	oneByteDecoders[0x42] = decodeAs(instInc{dest: DX})     // inc dx
+	oneByteDecoders[0x43] = decodeAs(instInc{dest: BX})     // inc bx
+	oneByteDecoders[0x44] = decodeAs(instInc{dest: SP})     // inc sp
+	oneByteDecoders[0x45] = decodeAs(instInc{dest: BP})     // inc bp
+	oneByteDecoders[0x46] = decodeAs(instInc{dest: SI})     // inc si
+	oneByteDecoders[0x47] = decodeAs(instInc{dest: DI})     // inc di
+	oneByteDecoders[0x48] = decodeAs(instDec{dest: AX})     // dec ax
+	oneByteDecoders[0x49] = decodeAs(instDec{dest: CX})     // dec cx
+	oneByteDecoders[0x4a] = decodeAs(instDec{dest: DX})     // dec dx
+	oneByteDecoders[0x4b] = decodeAs(instDec{dest: BX})     // dec bx
+	oneByteDecoders[0x4c] = decodeAs(instDec{dest: SP})     // dec sp
+	oneByteDecoders[0x4d] = decodeAs(instDec{dest: BP})     // dec bp
+	oneByteDecoders[0x4e] = decodeAs(instDec{dest: SI})     // dec si
+	oneByteDecoders[0x4f] = decodeAs(instDec{dest: DI})     // dec di
+	oneByteDecoders[0x50] = decodeAs(instPush{src: AX})     // push ax
+	oneByteDecoders[0x51] = decodeAs(instPush{src: CX})     // push cx
+	oneByteDecoders[0x52] = decodeAs(instPush{src: DX})     // push dx
+	oneByteDecoders[0x53] = decodeAs(instPush{src: BX})     // push bx
+	oneByteDecoders[0x54] = decodeAs(instPush{src: SP})     // push sp
+	oneByteDecoders[0x55] = decodeAs(instPush{src: BP})     // push bp
+	oneByteDecoders[0x56] = decodeAs(instPush{src: SI})     // push si
+	oneByteDecoders[0x57] = decodeAs(instPush{src: DI})     // push di
+	oneByteDecoders[0x58] = decodeAs(instPop{dest: AX})     // pop ax
+	oneByteDecoders[0x59] = decodeAs(instPop{dest: CX})     // pop cx
+	oneByteDecoders[0x5a] = decodeAs(instPop{dest: DX})     // pop dx
+	oneByteDecoders[0x5b] = decodeAs(instPop{dest: BX})     // pop bx
+	oneByteDecoders[0x5c] = decodeAs(instPop{dest: SP})     // pop sp
+	oneByteDecoders[0x5d] = decodeAs(instPop{dest: BP})     // pop bp
+	oneByteDecoders[0x5e] = decodeAs(instPop{dest: SI})     // pop si
+	oneByteDecoders[0x5f] = decodeAs(instPop{dest: DI})     // pop di
+	oneByteDecoders[0x62] = decode62                        // bound r16,m16&16
+	oneByteDecoders[0x72] = decode72                        // jb rel8
+	oneByteDecoders[0x73] = decode73                        // jae rel8
+	oneByteDecoders[0x74] = decode74                        // je rel8
+	oneByteDecoders[0x75] = decode75                        // jne rel8
+	oneByteDecoders[0x80] = decode80                        // add, or, adc, sbb, and, sub, xor or cmp r/m8,imm8
+	oneByteDecoders[0x81] = decode81                        // add, or, adc, sbb, and, sub, xor or cmp r/m16,imm16
+	oneByteDecoders[0x83] = decode83                        // add, or, adc, sbb, and, sub, xor or cmp r/m16,imm8
+	oneByteDecoders[0x84] = decode84                        // test r/m8,r8
+	oneByteDecoders[0x85] = decode85                        // test r/m16,r16
+	oneByteDecoders[0x86] = decode86                        // xchg r/m8,r8
+	oneByteDecoders[0x87] = decode87                        // xchg r/m16,r16
+	oneByteDecoders[0x88] = decode88                        // mov r/m8,r8
+	oneByteDecoders[0x89] = decode89                        // mov r/m16,r16
+	oneByteDecoders[0x8a] = decode8A                        // mov r8,r/m8
+	oneByteDecoders[0x8b] = decode8B                        // mov r16,r/m16
+	oneByteDecoders[0x8c] = decode8C                        // mov r/m16,Sreg
+	oneByteDecoders[0x8d] = decode8D                        // lea r16,m
+	oneByteDecoders[0x8e] = decode8E                        // mov Sreg,r/m16
+	oneByteDecoders[0x90] = decodeAs(xchgAX(AX))            // nop (xchg ax,ax)
+	oneByteDecoders[0x91] = decodeAs(xchgAX(CX))            // xchg ax,cx
+	oneByteDecoders[0x92] = decodeAs(xchgAX(DX))            // xchg ax,dx
+	oneByteDecoders[0x93] = decodeAs(xchgAX(BX))            // xchg ax,bx
+	oneByteDecoders[0x94] = decodeAs(xchgAX(SP))            // xchg ax,sp
+	oneByteDecoders[0x95] = decodeAs(xchgAX(BP))            // xchg ax,bp
+	oneByteDecoders[0x96] = decodeAs(xchgAX(SI))            // xchg ax,si
+	oneByteDecoders[0x97] = decodeAs(xchgAX(DI))            // xchg ax,di
+	oneByteDecoders[0x9c] = decodeAs(instPushf{})           // pushf
+	oneByteDecoders[0x9d] = decodeAs(instPopf{})            // popf
+	oneByteDecoders[0xa0] = decodeA0                        // mov al,moffs8
+	oneByteDecoders[0xa1] = decodeA1                        // mov ax,moffs16
+	oneByteDecoders[0xa2] = decodeA2                        // mov moffs8,al
+	oneByteDecoders[0xa3] = decodeA3                        // mov moffs16,ax
+	oneByteDecoders[0xa4] = decodeAs(instMovsb{})           // movsb
+	oneByteDecoders[0xa8] = decodeA8                        // test al,imm8
+	oneByteDecoders[0xa9] = decodeA9                        // test ax,imm16
+	oneByteDecoders[0xaa] = decodeAs(instStosb{})           // stosb
+	oneByteDecoders[0xac] = decodeAs(instLodsb{})           // lodsb
+	oneByteDecoders[0xae] = decodeAs(instScasb{})           // scasb
+	oneByteDecoders[0xaf] = decodeAs(instScasw{})           // scasw
+	// mov r8,imm8
+	for opcode := 0xb0; opcode <= 0xb7; opcode++ {
+		oneByteDecoders[opcode] = decodeMovR8Imm8
+	}
+	// mov r16,imm16
+	for opcode := 0xb8; opcode <= 0xbf; opcode++ {
+		oneByteDecoders[opcode] = decodeMovR16Imm16
+	}
+	oneByteDecoders[0xc1] = decodeC1               // shl r/m16,imm8
+	oneByteDecoders[0xc3] = decodeAs(instRet{})    // ret (near return)
+	oneByteDecoders[0xc6] = decodeC6               // mov r/m8,imm8
+	oneByteDecoders[0xc7] = decodeC7               // mov r/m16,imm16
+	oneByteDecoders[0xca] = decodeCA               // retf imm16
+	oneByteDecoders[0xcb] = decodeAs(instRetFar{}) // retf
+	oneByteDecoders[0xcd] = decodeCD               // int imm8
+	oneByteDecoders[0xce] = decodeAs(instInto{})   // into
+	oneByteDecoders[0xcf] = decodeAs(instIret{})   // iret
+	oneByteDecoders[0xd1] = decodeD1               // shift r/m16,1
+	oneByteDecoders[0xd4] = decodeD4               // aam imm8
+	oneByteDecoders[0xd5] = decodeD5               // aad imm8
+	oneByteDecoders[0xe2] = decodeE2               // loop rel8
+	oneByteDecoders[0xe8] = decodeE8               // call rel16
+	oneByteDecoders[0xe9] = decodeE9               // jmp rel16
+	oneByteDecoders[0xeb] = decodeEB               // jmp rel8
+	oneByteDecoders[0xf6] = decodeF6               // test, not, neg, mul, imul, div or idiv r/m8
+	oneByteDecoders[0xf7] = decodeF7               // test, not, neg, mul, imul, div or idiv r/m16
+	oneByteDecoders[0xfb] = decodeAs(instSti{})    // sti
+	oneByteDecoders[0xfc] = decodeAs(instCld{})    // cld
+	oneByteDecoders[0xff] = decodeFF               // inc, dec, call, jmp or push r/m16
+
+	// jcc rel16
+	for opcode := 0x80; opcode <= 0x8f; opcode++ {
+		twoByteDecoders[opcode] = decodeJccRel16
+	}
+	// setcc r/m8
+	for opcode := 0x90; opcode <= 0x9f; opcode++ {
+		twoByteDecoders[opcode] = decodeSetcc
+	}
+	twoByteDecoders[0xa0] = decodeAs(instPushSreg{src: FS}) // push fs
+	twoByteDecoders[0xa1] = decodeAs(instPopSreg{dest: FS}) // pop fs
+	twoByteDecoders[0xa8] = decodeAs(instPushSreg{src: GS}) // push gs
+	twoByteDecoders[0xa9] = decodeAs(instPopSreg{dest: GS}) // pop gs
+	twoByteDecoders[0xb6] = decode0FB6                      // movzx r16,r/m8
+	twoByteDecoders[0xbe] = decode0FBE                      // movsx r16,r/m8
+}
+
+// add r16,r/m16
+// 03 /r
+func decode03(ctx decodeContext) (interface{}, error) {
+	modRM, err := newModRM(ctx.address, ctx.memory, ctx.address32)
+	if err != nil {
+		return nil, err
+	}
+	dest, err := modRM.getGv()
+	if err != nil {
+		return nil, err
+	}
+	src, err := modRM.getEv(ctx.address, ctx.memory)
+	if err != nil {
+		return nil, err
+	}
+	return instAdd{dest: dest, src: src}, nil
+}
 
-	// push ds
-	// 1e
-	case 0x1e:
-		inst = instPushSreg{src: DS}
+// or r/m8,r8
+// 08 /r
+func decode08(ctx decodeContext) (interface{}, error) {
+	modRM, err := newModRM(ctx.address, ctx.memory, ctx.address32)
+	if err != nil {
+		return nil, err
+	}
+	dest, err := modRM.getEb(ctx.address, ctx.memory)
+	if err != nil {
+		return nil, err
+	}
+	src, err := modRM.getGb()
+	if err != nil {
+		return nil, err
+	}
+	return instOr{dest: dest, src: src}, nil
+}
 
-	case 0x1f:
-		inst = instPopSreg{dest: DS}
+// or r/m16,r16
+// 09 /r
+func decode09(ctx decodeContext) (interface{}, error) {
+	modRM, err := newModRM(ctx.address, ctx.memory, ctx.address32)
+	if err != nil {
+		return nil, err
+	}
+	dest, err := modRM.getEv(ctx.address, ctx.memory)
+	if err != nil {
+		return nil, err
+	}
+	src, err := modRM.getGv()
+	if err != nil {
+		return nil, err
+	}
+	return instOr{dest: dest, src: src}, nil
+}
 
-	// and r/m8,r8
-	// 20 /r
-	case 0x20:
-		modRM, err := newModRM(currentAddress, memory)
-		if err != nil {
-			return failureFunc(rawOpcode, err)
-		}
-		dest, err := modRM.getEb(currentAddress, memory)
-		if err != nil {
-			return failureFunc(rawOpcode, err)
-		}
-		src, err := modRM.getGb()
-		if err != nil {
-			return failureFunc(rawOpcode, err)
-		}
-		inst = instAnd{dest: dest, src: src}
+// or r8,r/m8
+// 0a /r
+func decode0A(ctx decodeContext) (interface{}, error) {
+	modRM, err := newModRM(ctx.address, ctx.memory, ctx.address32)
+	if err != nil {
+		return nil, err
+	}
+	dest, err := modRM.getGb()
+	if err != nil {
+		return nil, err
+	}
+	src, err := modRM.getEb(ctx.address, ctx.memory)
+	if err != nil {
+		return nil, err
+	}
+	return instOr{dest: dest, src: src}, nil
+}
 
-	// segment override by ES
-	case 0x26:
-		inst, _, _, err := decodeInstWithMemory(currentAddress, memory)
-		if err != nil {
-			return failureFunc(rawOpcode, err)
-		}
-		return inst, currentAddress.realAddress() - initialRealAddress, &segmentOverride{sreg: ES}, nil
+// or r16,r/m16
+// 0b /r
+func decode0B(ctx decodeContext) (interface{}, error) {
+	modRM, err := newModRM(ctx.address, ctx.memory, ctx.address32)
+	if err != nil {
+		return nil, err
+	}
+	dest, err := modRM.getGv()
+	if err != nil {
+		return nil, err
+	}
+	src, err := modRM.getEv(ctx.address, ctx.memory)
+	if err != nil {
+		return nil, err
+	}
+	return instOr{dest: dest, src: src}, nil
+}
 
-	// sub r8,r/m8
-	// 2a /r
-	case 0x2a:
-		modRM, err := newModRM(currentAddress, memory)
-		if err != nil {
-			return failureFunc(rawOpcode, err)
-		}
-		dest, err := modRM.getGb()
-		if err != nil {
-			return failureFunc(rawOpcode, err)
-		}
-		src, err := modRM.getEb(currentAddress, memory)
-		if err != nil {
-			return failureFunc(rawOpcode, err)
-		}
-		inst = instSub{dest: dest, src: src}
+// or al,imm8
+// 0c ib
+func decode0C(ctx decodeContext) (interface{}, error) {
+	b, err := ctx.memory.readBytes(ctx.address, 1)
+	if err != nil {
+		return nil, err
+	}
+	src, err := newImm8(bytes.NewReader(b))
+	if err != nil {
+		return nil, err
+	}
+	return instOr{dest: reg8{value: AL}, src: src}, nil
+}
 
-	// sub r16,r/m16
-	// 2b /r
-	case 0x2b:
-		modRM, err := newModRM(currentAddress, memory)
-		if err != nil {
-			return failureFunc(rawOpcode, err)
-		}
-		dest, err := modRM.getGv()
-		if err != nil {
-			return failureFunc(rawOpcode, err)
-		}
-		src, err := modRM.getEv(currentAddress, memory)
-		if err != nil {
-			return failureFunc(rawOpcode, err)
-		}
-		inst = instSub{dest: dest, src: src}
+// or ax,imm16
+// 0d iw
+func decode0D(ctx decodeContext) (interface{}, error) {
+	b, err := ctx.memory.readBytes(ctx.address, 2)
+	if err != nil {
+		return nil, err
+	}
+	src, err := newImm16(bytes.NewReader(b))
+	if err != nil {
+		return nil, err
+	}
+	return instOr{dest: reg16{value: AX}, src: src}, nil
+}
 
-	// xor r16,r/m16
-	// 33 /r
-	case 0x33:
-		modRM, err := newModRM(currentAddress, memory)
-		if err != nil {
-			return failureFunc(rawOpcode, err)
-		}
-		dest, err := modRM.getGv()
-		if err != nil {
-			return failureFunc(rawOpcode, err)
-		}
-		src, err := modRM.getEv(currentAddress, memory)
-		if err != nil {
-			return failureFunc(rawOpcode, err)
-		}
-		inst = instXor{dest: dest, src: src}
+// two-byte opcodes
+// seg and offset of ctx are the start of instruction for error.
+func decodeTwoByteInst(ctx decodeContext) (interface{}, error) {
+	opcode, err := ctx.memory.readByte(ctx.address)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to parse second byte of opcode")
+	}
 
-	// cmp r16,r/m16
-	// 3b /r
-	case 0x3b:
-		modRM, err := newModRM(currentAddress, memory)
-		if err != nil {
-			return failureFunc(rawOpcode, err)
-		}
-		dest, err := modRM.getGv()
-		if err != nil {
-			return failureFunc(rawOpcode, err)
-		}
-		src, err := modRM.getEv(currentAddress, memory)
-		if err != nil {
-			return failureFunc(rawOpcode, err)
-		}
-		inst = instCmp{dest: dest, src: src}
+	decode := twoByteDecoders[opcode]
+	if decode == nil {
+		return nil, errors.WithStack(newDecodeError(ctx.seg, ctx.offset, 0x0f, ctx.memory))
+	}
+	ctx.opcode = opcode
+	return decode(ctx)
+}
 
-	// cmp al,imm8
-	// 3c ib
-	case 0x3c:
-		b, err := memory.readBytes(currentAddress, 1)
-		if err != nil {
-			return failureFunc(rawOpcode, err)
-		}
-		src, err := newImm8(bytes.NewReader(b))
-		if err != nil {
-			return failureFunc(rawOpcode, err)
-		}
-		inst = instCmp{dest: reg8{value: AL}, src: src}
-
-	// inc ax
-	case 0x40:
-		inst = instInc{dest: AX}
-	// inc cx
-	case 0x41:
-		inst = instInc{dest: CX}
-	// inc dx
-	case 0x42:
-		inst = instInc{dest: DX}
-	// inc bx
-	case 0x43:
-		inst = instInc{dest: BX}
-	// inc sp
-	case 0x44:
-		inst = instInc{dest: SP}
-	// inc bp
-	case 0x45:
-		inst = instInc{dest: BP}
-	// inc si
-	case 0x46:
-		inst = instInc{dest: SI}
-	// inc di
-	case 0x47:
-		inst = instInc{dest: DI}
-
-	// dec ax
-	case 0x48:
-		inst = instDec{dest: AX}
-	// dec cx
-	case 0x49:
-		inst = instDec{dest: CX}
-	// dec dx
-	case 0x4a:
-		inst = instDec{dest: DX}
-	// dec bx
-	case 0x4b:
-		inst = instDec{dest: BX}
-	// dec sp
-	case 0x4c:
-		inst = instDec{dest: SP}
-	// dec bp
-	case 0x4d:
-		inst = instDec{dest: BP}
-	// dec si
-	case 0x4e:
-		inst = instDec{dest: SI}
-	// dec di
-	case 0x4f:
-		inst = instDec{dest: DI}
-
-	// push ax
-	case 0x50:
-		inst = instPush{src: AX}
-	// push cx
-	case 0x51:
-		inst = instPush{src: CX}
-	// push dx
-	case 0x52:
-		inst = instPush{src: DX}
-	// push bx
-	case 0x53:
-		inst = instPush{src: BX}
-	// push sp
-	case 0x54:
-		inst = instPush{src: SP}
-	// push bp
-	case 0x55:
-		inst = instPush{src: BP}
-	// push si
-	case 0x56:
-		inst = instPush{src: SI}
-	// push di
-	case 0x57:
-		inst = instPush{src: DI}
-
-	// pop ax
-	case 0x58:
-		inst = instPop{dest: AX}
-	// pop cx
-	case 0x59:
-		inst = instPop{dest: CX}
-	// pop dx
-	case 0x5a:
-		inst = instPop{dest: DX}
-	// pop bx
-	case 0x5b:
-		inst = instPop{dest: BX}
-	// pop sp
-	case 0x5c:
-		inst = instPop{dest: SP}
-	// pop bp
-	case 0x5d:
-		inst = instPop{dest: BP}
-	// pop si
-	case 0x5e:
-		inst = instPop{dest: SI}
-	// pop di
-	case 0x5f:
-		inst = instPop{dest: DI}
-
-	case 0x72:
-		offset, err := memory.readInt8(currentAddress)
-		if err != nil {
-			return failureFunc(rawOpcode, err)
-		}
-		inst = instJb{rel8: offset}
+// and r/m8,r8
+// 20 /r
+func decode20(ctx decodeContext) (interface{}, error) {
+	modRM, err := newModRM(ctx.address, ctx.memory, ctx.address32)
+	if err != nil {
+		return nil, err
+	}
+	dest, err := modRM.getEb(ctx.address, ctx.memory)
+	if err != nil {
+		return nil, err
+	}
+	src, err := modRM.getGb()
+	if err != nil {
+		return nil, err
+	}
+	return instAnd{dest: dest, src: src}, nil
+}
 
-	case 0x73:
-		imm8, err := memory.readInt8(currentAddress)
-		if err != nil {
-			return failureFunc(rawOpcode, err)
-		}
-		inst = instJae{rel8: imm8}
+// and r/m16,r16
+// 21 /r
+func decode21(ctx decodeContext) (interface{}, error) {
+	modRM, err := newModRM(ctx.address, ctx.memory, ctx.address32)
+	if err != nil {
+		return nil, err
+	}
+	dest, err := modRM.getEv(ctx.address, ctx.memory)
+	if err != nil {
+		return nil, err
+	}
+	src, err := modRM.getGv()
+	if err != nil {
+		return nil, err
+	}
+	return instAnd{dest: dest, src: src}, nil
+}
 
-	// je rel8
-	// 74 cb
-	case 0x74:
-		imm8, err := memory.readInt8(currentAddress)
-		if err != nil {
-			return failureFunc(rawOpcode, err)
-		}
-		inst = instJeRel8{rel8: imm8}
+// and r8,r/m8
+// 22 /r
+func decode22(ctx decodeContext) (interface{}, error) {
+	modRM, err := newModRM(ctx.address, ctx.memory, ctx.address32)
+	if err != nil {
+		return nil, err
+	}
+	dest, err := modRM.getGb()
+	if err != nil {
+		return nil, err
+	}
+	src, err := modRM.getEb(ctx.address, ctx.memory)
+	if err != nil {
+		return nil, err
+	}
+	return instAnd{dest: dest, src: src}, nil
+}
 
-	// jne rel8
-	// 75 cb
-	case 0x75:
-		imm8, err := memory.readInt8(currentAddress)
-		if err != nil {
-			return failureFunc(rawOpcode, err)
-		}
-		inst = instJneRel8{rel8: imm8}
+// and al,imm8
+// 24 ib
+func decode24(ctx decodeContext) (interface{}, error) {
+	b, err := ctx.memory.readBytes(ctx.address, 1)
+	if err != nil {
+		return nil, err
+	}
+	src, err := newImm8(bytes.NewReader(b))
+	if err != nil {
+		return nil, err
+	}
+	return instAnd{dest: reg8{value: AL}, src: src}, nil
+}
 
-	case 0x80:
-		modRM, err := newModRM(currentAddress, memory)
-		if err != nil {
-			return failureFunc(rawOpcode, err)
-		}
-		dest, err := modRM.getEb(currentAddress, memory)
-		if err != nil {
-			return failureFunc(rawOpcode, err)
-		}
-		b, err := memory.readBytes(currentAddress, 1)
-		if err != nil {
-			return failureFunc(rawOpcode, err)
-		}
-		src, err := newImm8(bytes.NewReader(b))
-		if err != nil {
-			return failureFunc(rawOpcode, err)
-		}
+// and ax,imm16
+// 25 iw
+func decode25(ctx decodeContext) (interface{}, error) {
+	b, err := ctx.memory.readBytes(ctx.address, 2)
+	if err != nil {
+		return nil, err
+	}
+	src, err := newImm16(bytes.NewReader(b))
+	if err != nil {
+		return nil, err
+	}
+	return instAnd{dest: reg16{value: AX}, src: src}, nil
+}
 
-		switch modRM.reg {
-		// and r/m8, imm8
-		case 4:
-			inst = instAnd{dest: dest, src: src}
+// sub r8,r/m8
+// 2a /r
+func decode2A(ctx decodeContext) (interface{}, error) {
+	modRM, err := newModRM(ctx.address, ctx.memory, ctx.address32)
+	if err != nil {
+		return nil, err
+	}
+	dest, err := modRM.getGb()
+	if err != nil {
+		return nil, err
+	}
+	src, err := modRM.getEb(ctx.address, ctx.memory)
+	if err != nil {
+		return nil, err
+	}
+	return instSub{dest: dest, src: src}, nil
+}
 
-		// cmp r/m8,imm8
-		// 80 /7 ib
-		case 7:
-			inst = instCmp{dest: dest, src: src}
+// sub r16,r/m16
+// 2b /r
+func decode2B(ctx decodeContext) (interface{}, error) {
+	modRM, err := newModRM(ctx.address, ctx.memory, ctx.address32)
+	if err != nil {
+		return nil, err
+	}
+	dest, err := modRM.getGv()
+	if err != nil {
+		return nil, err
+	}
+	src, err := modRM.getEv(ctx.address, ctx.memory)
+	if err != nil {
+		return nil, err
+	}
+	return instSub{dest: dest, src: src}, nil
+}
 
-		default:
-			return failureFunc(rawOpcode, err)
-		}
+// xor r/m8,r8
+// 30 /r
+func decode30(ctx decodeContext) (interface{}, error) {
+	modRM, err := newModRM(ctx.address, ctx.memory, ctx.address32)
+	if err != nil {
+		return nil, err
+	}
+	dest, err := modRM.getEb(ctx.address, ctx.memory)
+	if err != nil {
+		return nil, err
+	}
+	src, err := modRM.getGb()
+	if err != nil {
+		return nil, err
+	}
+	return instXor{dest: dest, src: src}, nil
+}
 
-	case 0x81:
-		modRM, err := newModRM(currentAddress, memory)
-		if err != nil {
-			return failureFunc(rawOpcode, err)
-		}
+// xor r/m16,r16
+// 31 /r
+func decode31(ctx decodeContext) (interface{}, error) {
+	modRM, err := newModRM(ctx.address, ctx.memory, ctx.address32)
+	if err != nil {
+		return nil, err
+	}
+	dest, err := modRM.getEv(ctx.address, ctx.memory)
+	if err != nil {
+		return nil, err
+	}
+	src, err := modRM.getGv()
+	if err != nil {
+		return nil, err
+	}
+	return instXor{dest: dest, src: src}, nil
+}
 
-		switch modRM.reg {
-		case 5:
-			// sub r/m16,imm16
-			// 81 /5 iw
-			dest, err := modRM.getEv(currentAddress, memory)
-			if err != nil {
-				return failureFunc(rawOpcode, err)
-			}
-			b, err := memory.readBytes(currentAddress, 2)
-			if err != nil {
-				return failureFunc(rawOpcode, err)
-			}
-			src, err := newImm16(bytes.NewReader(b))
-			if err != nil {
-				return failureFunc(rawOpcode, err)
-			}
-			inst = instSub{dest: dest, src: src}
+// xor r8,r/m8
+// 32 /r
+func decode32(ctx decodeContext) (interface{}, error) {
+	modRM, err := newModRM(ctx.address, ctx.memory, ctx.address32)
+	if err != nil {
+		return nil, err
+	}
+	dest, err := modRM.getGb()
+	if err != nil {
+		return nil, err
+	}
+	src, err := modRM.getEb(ctx.address, ctx.memory)
+	if err != nil {
+		return nil, err
+	}
+	return instXor{dest: dest, src: src}, nil
+}
 
-		case 7:
-			// cmp r/m16,imm16
-			// 81 /7 iw
-			dest, err := modRM.getEv(currentAddress, memory)
-			if err != nil {
-				return failureFunc(rawOpcode, err)
-			}
-			b, err := memory.readBytes(currentAddress, 2)
-			if err != nil {
-				return failureFunc(rawOpcode, err)
-			}
-			src, err := newImm16(bytes.NewReader(b))
-			if err != nil {
-				return failureFunc(rawOpcode, err)
-			}
-			inst = instCmp{dest: dest, src: src}
+// xor r16,r/m16
+// 33 /r
+func decode33(ctx decodeContext) (interface{}, error) {
+	modRM, err := newModRM(ctx.address, ctx.memory, ctx.address32)
+	if err != nil {
+		return nil, err
+	}
+	dest, err := modRM.getGv()
+	if err != nil {
+		return nil, err
+	}
+	src, err := modRM.getEv(ctx.address, ctx.memory)
+	if err != nil {
+		return nil, err
+	}
+	return instXor{dest: dest, src: src}, nil
+}
 
-		default:
-			return failureFunc(rawOpcode, err)
-		}
+// xor al,imm8
+// 34 ib
+func decode34(ctx decodeContext) (interface{}, error) {
+	b, err := ctx.memory.readBytes(ctx.address, 1)
+	if err != nil {
+		return nil, err
+	}
+	src, err := newImm8(bytes.NewReader(b))
+	if err != nil {
+		return nil, err
+	}
+	return instXor{dest: reg8{value: AL}, src: src}, nil
+}
 
-	// add r/m16, imm8
-	// 83 /5 -> sub r/m16, imm8
-	// 83 /7 ib ->  cmp r/m16,imm8
-	case 0x83:
-		modRM, err := newModRM(currentAddress, memory)
-		if err != nil {
-			return failureFunc(rawOpcode, err)
-		}
-		dest, err := modRM.getEv(currentAddress, memory)
-		if err != nil {
-			return failureFunc(rawOpcode, err)
-		}
-		b, err := memory.readBytes(currentAddress, 1)
+// xor ax,imm16
+// 35 iw
+func decode35(ctx decodeContext) (interface{}, error) {
+	b, err := ctx.memory.readBytes(ctx.address, 2)
+	if err != nil {
+		return nil, err
+	}
+	src, err := newImm16(bytes.NewReader(b))
+	if err != nil {
+		return nil, err
+	}
+	return instXor{dest: reg16{value: AX}, src: src}, nil
+}
+
+// cmp r/m8,r8
+// 38 /r
+func decode38(ctx decodeContext) (interface{}, error) {
+	modRM, err := newModRM(ctx.address, ctx.memory, ctx.address32)
+	if err != nil {
+		return nil, err
+	}
+	dest, err := modRM.getEb(ctx.address, ctx.memory)
+	if err != nil {
+		return nil, err
+	}
+	src, err := modRM.getGb()
+	if err != nil {
+		return nil, err
+	}
+	return instCmp{dest: dest, src: src}, nil
+}
+
+// cmp r8,r/m8
+// 3a /r
+func decode3A(ctx decodeContext) (interface{}, error) {
+	modRM, err := newModRM(ctx.address, ctx.memory, ctx.address32)
+	if err != nil {
+		return nil, err
+	}
+	dest, err := modRM.getGb()
+	if err != nil {
+		return nil, err
+	}
+	src, err := modRM.getEb(ctx.address, ctx.memory)
+	if err != nil {
+		return nil, err
+	}
+	return instCmp{dest: dest, src: src}, nil
+}
+
+// cmp r16,r/m16
+// 3b /r
+func decode3B(ctx decodeContext) (interface{}, error) {
+	modRM, err := newModRM(ctx.address, ctx.memory, ctx.address32)
+	if err != nil {
+		return nil, err
+	}
+	dest, err := modRM.getGv()
+	if err != nil {
+		return nil, err
+	}
+	src, err := modRM.getEv(ctx.address, ctx.memory)
+	if err != nil {
+		return nil, err
+	}
+	return instCmp{dest: dest, src: src}, nil
+}
+
+// cmp al,imm8
+// 3c ib
+func decode3C(ctx decodeContext) (interface{}, error) {
+	b, err := ctx.memory.readBytes(ctx.address, 1)
+	if err != nil {
+		return nil, err
+	}
+	src, err := newImm8(bytes.NewReader(b))
+	if err != nil {
+		return nil, err
+	}
+	return instCmp{dest: reg8{value: AL}, src: src}, nil
+}
+
+// cmp ax,imm16
+// 3d iw
+func decode3D(ctx decodeContext) (interface{}, error) {
+	b, err := ctx.memory.readBytes(ctx.address, 2)
+	if err != nil {
+		return nil, err
+	}
+	src, err := newImm16(bytes.NewReader(b))
+	if err != nil {
+		return nil, err
+	}
+	return instCmp{dest: reg16{value: AX}, src: src}, nil
+}
+
+// bound r16,m16&16
+// 62 /r
+func decode62(ctx decodeContext) (interface{}, error) {
+	modRM, err := newModRM(ctx.address, ctx.memory, ctx.address32)
+	if err != nil {
+		return nil, err
+	}
+	index, err := modRM.getGv()
+	if err != nil {
+		return nil, err
+	}
+	bounds, err := modRM.getM(ctx.address, ctx.memory)
+	if err != nil {
+		return nil, err
+	}
+	return instBound{index: index, bounds: bounds}, nil
+}
+
+// jb rel8
+func decode72(ctx decodeContext) (interface{}, error) {
+	offset, err := ctx.memory.readInt8(ctx.address)
+	if err != nil {
+		return nil, err
+	}
+	return instJb{rel8: offset}, nil
+}
+
+// jae rel8
+func decode73(ctx decodeContext) (interface{}, error) {
+	imm8, err := ctx.memory.readInt8(ctx.address)
+	if err != nil {
+		return nil, err
+	}
+	return instJae{rel8: imm8}, nil
+}
+
+// je rel8
+// 74 cb
+func decode74(ctx decodeContext) (interface{}, error) {
+	imm8, err := ctx.memory.readInt8(ctx.address)
+	if err != nil {
+		return nil, err
+	}
+	return instJeRel8{rel8: imm8}, nil
+}
+
+// jne rel8
+// 75 cb
+func decode75(ctx decodeContext) (interface{}, error) {
+	imm8, err := ctx.memory.readInt8(ctx.address)
+	if err != nil {
+		return nil, err
+	}
+	return instJneRel8{rel8: imm8}, nil
+}
+
+// add, or, adc, sbb, and, sub, xor or cmp r/m8,imm8
+func decode80(ctx decodeContext) (interface{}, error) {
+	modRM, err := newModRM(ctx.address, ctx.memory, ctx.address32)
+	if err != nil {
+		return nil, err
+	}
+	dest, err := modRM.getEb(ctx.address, ctx.memory)
+	if err != nil {
+		return nil, err
+	}
+	b, err := ctx.memory.readBytes(ctx.address, 1)
+	if err != nil {
+		return nil, err
+	}
+	src, err := newImm8(bytes.NewReader(b))
+	if err != nil {
+		return nil, err
+	}
+
+	return immediateGroupInst(modRM.reg, dest, src), nil
+}
+
+// instruction of group 1 (80, 81 and 83) selected by reg of ModR/M
+func immediateGroupInst(reg byte, dest operand, src operand) interface{} {
+	switch reg {
+	case 0:
+		return instAdd{dest: dest, src: src}
+	case 1:
+		return instOr{dest: dest, src: src}
+	case 2:
+		return instAdc{dest: dest, src: src}
+	case 3:
+		return instSbb{dest: dest, src: src}
+	case 4:
+		return instAnd{dest: dest, src: src}
+	case 5:
+		return instSub{dest: dest, src: src}
+	case 6:
+		return instXor{dest: dest, src: src}
+	default:
+		return instCmp{dest: dest, src: src}
+	}
+}
+
+// add, or, adc, sbb, and, sub, xor or cmp r/m16,imm16
+func decode81(ctx decodeContext) (interface{}, error) {
+	modRM, err := newModRM(ctx.address, ctx.memory, ctx.address32)
+	if err != nil {
+		return nil, err
+	}
+	dest, err := modRM.getEv(ctx.address, ctx.memory)
+	if err != nil {
+		return nil, err
+	}
+	b, err := ctx.memory.readBytes(ctx.address, 2)
+	if err != nil {
+		return nil, err
+	}
+	src, err := newImm16(bytes.NewReader(b))
+	if err != nil {
+		return nil, err
+	}
+
+	return immediateGroupInst(modRM.reg, dest, src), nil
+}
+
+// add, or, adc, sbb, and, sub, xor or cmp r/m16,imm8
+// imm8 is sign-extended to 16 bits
+func decode83(ctx decodeContext) (interface{}, error) {
+	modRM, err := newModRM(ctx.address, ctx.memory, ctx.address32)
+	if err != nil {
+		return nil, err
+	}
+	dest, err := modRM.getEv(ctx.address, ctx.memory)
+	if err != nil {
+		return nil, err
+	}
+	b, err := ctx.memory.readBytes(ctx.address, 1)
+	if err != nil {
+		return nil, err
+	}
+	src, err := newImm8(bytes.NewReader(b))
+	if err != nil {
+		return nil, err
+	}
+
+	return immediateGroupInst(modRM.reg, dest, src), nil
+}
+
+// test r/m8,r8
+// 84 /r
+func decode84(ctx decodeContext) (interface{}, error) {
+	modRM, err := newModRM(ctx.address, ctx.memory, ctx.address32)
+	if err != nil {
+		return nil, err
+	}
+	dest, err := modRM.getEb(ctx.address, ctx.memory)
+	if err != nil {
+		return nil, err
+	}
+	src, err := modRM.getGb()
+	if err != nil {
+		return nil, err
+	}
+	return instTest{dest: dest, src: src}, nil
+}
+
+// test r/m16,r16
+// 85 /r
+func decode85(ctx decodeContext) (interface{}, error) {
+	modRM, err := newModRM(ctx.address, ctx.memory, ctx.address32)
+	if err != nil {
+		return nil, err
+	}
+	dest, err := modRM.getEv(ctx.address, ctx.memory)
+	if err != nil {
+		return nil, err
+	}
+	src, err := modRM.getGv()
+	if err != nil {
+		return nil, err
+	}
+	return instTest{dest: dest, src: src}, nil
+}
+
+// xchg ax,r16
+// 90+rw
+func xchgAX(r registerW) instXchg {
+	return instXchg{dest: reg16{value: AX}, src: reg16{value: r}}
+}
+
+// 86 /r
+// xchg r/m8,r8
+func decode86(ctx decodeContext) (interface{}, error) {
+	modRM, err := newModRM(ctx.address, ctx.memory, ctx.address32)
+	if err != nil {
+		return nil, err
+	}
+	dest, err := modRM.getEb(ctx.address, ctx.memory)
+	if err != nil {
+		return nil, err
+	}
+	src, err := modRM.getGb()
+	if err != nil {
+		return nil, err
+	}
+	return instXchg{dest: dest, src: src}, nil
+}
+
+// 87 /r
+// xchg r/m16,r16
+func decode87(ctx decodeContext) (interface{}, error) {
+	modRM, err := newModRM(ctx.address, ctx.memory, ctx.address32)
+	if err != nil {
+		return nil, err
+	}
+	dest, err := modRM.getEv(ctx.address, ctx.memory)
+	if err != nil {
+		return nil, err
+	}
+	src, err := modRM.getGv()
+	if err != nil {
+		return nil, err
+	}
+	return instXchg{dest: dest, src: src}, nil
+}
+
+// 88 /r
+// mov r/m8,r8
+func decode88(ctx decodeContext) (interface{}, error) {
+	modRM, err := newModRM(ctx.address, ctx.memory, ctx.address32)
+	if err != nil {
+		return nil, err
+	}
+	dest, err := modRM.getEb(ctx.address, ctx.memory)
+	if err != nil {
+		return nil, err
+	}
+	src, err := modRM.getGb()
+	if err != nil {
+		return nil, err
+	}
+	return instMov{dest: dest, src: src}, nil
+}
+
+// 89 /r
+// mov r/m16,r16
+func decode89(ctx decodeContext) (interface{}, error) {
+	modRM, err := newModRM(ctx.address, ctx.memory, ctx.address32)
+	if err != nil {
+		return nil, err
+	}
+	dest, err := modRM.getEv(ctx.address, ctx.memory)
+	if err != nil {
+		return nil, err
+	}
+	src, err := modRM.getGv()
+	if err != nil {
+		return nil, err
+	}
+	return instMov{dest: dest, src: src}, nil
+}
+
+// mov r8,r/m8
+// 8A /r
+func decode8A(ctx decodeContext) (interface{}, error) {
+	modRM, err := newModRM(ctx.address, ctx.memory, ctx.address32)
+	if err != nil {
+		return nil, err
+	}
+	dest, err := modRM.getGb()
+	if err != nil {
+		return nil, err
+	}
+	src, err := modRM.getEb(ctx.address, ctx.memory)
+	if err != nil {
+		return nil, err
+	}
+	return instMov{dest: dest, src: src}, nil
+}
+
+// 8b /r (/r indicates that the ModR/M byte of the instruction contains a register operand and an r/m operand)
+// mov r16,r/m16
+func decode8B(ctx decodeContext) (interface{}, error) {
+	modRM, err := newModRM(ctx.address, ctx.memory, ctx.address32)
+	if err != nil {
+		return nil, err
+	}
+	dest, err := modRM.getGv()
+	if err != nil {
+		return nil, err
+	}
+	src, err := modRM.getEv(ctx.address, ctx.memory)
+	if err != nil {
+		return nil, err
+	}
+	return instMov{dest: dest, src: src}, nil
+}
+
+// 8c /r
+// mov r/m16,Sreg
+func decode8C(ctx decodeContext) (interface{}, error) {
+	modRM, err := newModRM(ctx.address, ctx.memory, ctx.address32)
+	if err != nil {
+		return nil, err
+	}
+	dest, err := modRM.getEv(ctx.address, ctx.memory)
+	if err != nil {
+		return nil, err
+	}
+	src, err := modRM.getSw()
+	if err != nil {
+		return nil, err
+	}
+	return instMov{dest: dest, src: src}, nil
+}
+
+// lea r16,m
+// 8d /r
+func decode8D(ctx decodeContext) (interface{}, error) {
+	modRM, err := newModRM(ctx.address, ctx.memory, ctx.address32)
+	if err != nil {
+		return nil, err
+	}
+	dest, err := modRM.getGv()
+	if err != nil {
+		return nil, err
+	}
+	src, err := modRM.getM(ctx.address, ctx.memory)
+	if err != nil {
+		return nil, err
+	}
+	return instLea{dest: dest, src: src}, nil
+}
+
+// 8e /r
+// mov Sreg,r/m16
+// Sreg ES=0, CS=1, SS=2, DS=3, FS=4, GS=5
+func decode8E(ctx decodeContext) (interface{}, error) {
+	modRM, err := newModRM(ctx.address, ctx.memory, ctx.address32)
+	if err != nil {
+		return nil, err
+	}
+	dest, err := modRM.getSw()
+	if err != nil {
+		return nil, err
+	}
+	src, err := modRM.getEw(ctx.address, ctx.memory)
+	if err != nil {
+		return nil, err
+	}
+	return instMov{dest: dest, src: src}, nil
+}
+
+// mov al,moffs8
+// A0
+func decodeA0(ctx decodeContext) (interface{}, error) {
+	offset, err := ctx.memory.readWord(ctx.address)
+	if err != nil {
+		return nil, err
+	}
+	dest := reg8{value: AL}
+	src := mem8Disp16{offset: offset}
+	return instMov{dest: dest, src: src}, nil
+}
+
+// mov ax,moffs16
+// A1
+func decodeA1(ctx decodeContext) (interface{}, error) {
+	imm, err := ctx.memory.readWord(ctx.address)
+	if err != nil {
+		return nil, err
+	}
+	dest := reg16{value: AX}
+	src := mem16Disp16{offset: imm}
+	return instMov{dest: dest, src: src}, nil
+}
+
+// mov moffs8,al
+// A2
+func decodeA2(ctx decodeContext) (interface{}, error) {
+	offset, err := ctx.memory.readWord(ctx.address)
+	if err != nil {
+		return nil, err
+	}
+	dest := mem8Disp16{offset: offset}
+	src := reg8{value: AL}
+	return instMov{dest: dest, src: src}, nil
+}
+
+// mov moffs16,ax
+// A3
+func decodeA3(ctx decodeContext) (interface{}, error) {
+	offset, err := ctx.memory.readWord(ctx.address)
+	if err != nil {
+		return nil, err
+	}
+	dest := mem16Disp16{offset: offset}
+	src := reg16{value: AX}
+	return instMov{dest: dest, src: src}, nil
+}
+
+// test al,imm8
+// a8 ib
+func decodeA8(ctx decodeContext) (interface{}, error) {
+	b, err := ctx.memory.readBytes(ctx.address, 1)
+	if err != nil {
+		return nil, err
+	}
+	src, err := newImm8(bytes.NewReader(b))
+	if err != nil {
+		return nil, err
+	}
+	return instTest{dest: reg8{value: AL}, src: src}, nil
+}
+
+// test ax,imm16
+// a9 iw
+func decodeA9(ctx decodeContext) (interface{}, error) {
+	b, err := ctx.memory.readBytes(ctx.address, 2)
+	if err != nil {
+		return nil, err
+	}
+	src, err := newImm16(bytes.NewReader(b))
+	if err != nil {
+		return nil, err
+	}
+	return instTest{dest: reg16{value: AX}, src: src}, nil
+}
+
+// b0+ rb ib
+// mov r8,imm8
+func decodeMovR8Imm8(ctx decodeContext) (interface{}, error) {
+	imm, err := ctx.memory.readBytes(ctx.address, 1)
+	if err != nil {
+		return nil, err
+	}
+	dest, err := newReg8(ctx.opcode - 0xb0)
+	if err != nil {
+		return nil, err
+	}
+	src, err := newImm8(bytes.NewReader(imm))
+	if err != nil {
+		return nil, err
+	}
+	return instMov{dest: dest, src: src}, nil
+}
+
+// b8+ rw iw
+// mov r16,imm16
+func decodeMovR16Imm16(ctx decodeContext) (interface{}, error) {
+	// ax
+	bs, err := ctx.memory.readBytes(ctx.address, 2)
+	if err != nil {
+		return nil, err
+	}
+	dest, err := newReg16(ctx.opcode - 0xb8)
+	if err != nil {
+		return nil, err
+	}
+	src, err := newImm16(bytes.NewReader(bs))
+	if err != nil {
+		return nil, err
+	}
+	return instMov{dest: dest, src: src}, nil
+}
+
+// shl r/m16,imm8
+func decodeC1(ctx decodeContext) (interface{}, error) {
+	modRM, err := newModRM(ctx.address, ctx.memory, ctx.address32)
+	if err != nil {
+		return nil, err
+	}
+	dest, err := modRM.getEv(ctx.address, ctx.memory)
+	if err != nil {
+		return nil, err
+	}
+	bs, err := ctx.memory.readBytes(ctx.address, 1)
+	if err != nil {
+		return nil, err
+	}
+	src, err := newImm8(bytes.NewReader(bs))
+	if err != nil {
+		return nil, err
+	}
+
+	switch modRM.reg {
+	case 4:
+		return instShl{dest: dest, src: src}, nil
+	default:
+		return nil, errors.Errorf("illegal or not yet implemented for reg: %d", modRM.reg)
+	}
+}
+
+// mov r/m8,imm8
+// c6 /0 ib
+func decodeC6(ctx decodeContext) (interface{}, error) {
+	modRM, err := newModRM(ctx.address, ctx.memory, ctx.address32)
+	if err != nil {
+		return nil, err
+	}
+
+	if modRM.reg != 0 {
+		return nil, errors.Errorf("illegal or not yet implemented for reg: %d", modRM.reg)
+	}
+
+	dest, err := modRM.getEb(ctx.address, ctx.memory)
+	if err != nil {
+		return nil, err
+	}
+	bs, err := ctx.memory.readBytes(ctx.address, 1)
+	if err != nil {
+		return nil, err
+	}
+	src, err := newImm8(bytes.NewReader(bs))
+	if err != nil {
+		return nil, err
+	}
+	return instMov{dest: dest, src: src}, nil
+}
+
+// mov r/m16,imm16
+// c7 /0 iw
+func decodeC7(ctx decodeContext) (interface{}, error) {
+	modRM, err := newModRM(ctx.address, ctx.memory, ctx.address32)
+	if err != nil {
+		return nil, err
+	}
+
+	if modRM.reg != 0 {
+		return nil, err
+	}
+
+	dest, err := modRM.getEv(ctx.address, ctx.memory)
+	if err != nil {
+		return nil, err
+	}
+	bs, err := ctx.memory.readBytes(ctx.address, 2)
+	if err != nil {
+		return nil, err
+	}
+	src, err := newImm16(bytes.NewReader(bs))
+	if err != nil {
+		return nil, err
+	}
+	return instMov{dest: dest, src: src}, nil
+}
+
+// retf imm16
+func decodeCA(ctx decodeContext) (interface{}, error) {
+	imm16, err := ctx.memory.readWord(ctx.address)
+	if err != nil {
+		return nil, err
+	}
+	return instRetFar{imm16: uint16(imm16)}, nil
+}
+
+// int imm8
+func decodeCD(ctx decodeContext) (interface{}, error) {
+	operand, err := ctx.memory.readByte(ctx.address)
+	if err != nil {
+		return nil, err
+	}
+	return instInt{operand: operand}, nil
+}
+
+// shift r/m16,1
+func decodeD1(ctx decodeContext) (interface{}, error) {
+	modRM, err := newModRM(ctx.address, ctx.memory, ctx.address32)
+	if err != nil {
+		return nil, err
+	}
+	dest, err := modRM.getEv(ctx.address, ctx.memory)
+	if err != nil {
+		return nil, err
+	}
+	src := imm8{value: 1}
+
+	switch modRM.reg {
+	// shl r/m16,1
+	// d1 /4
+	case 4:
+		return instShl{dest: dest, src: src}, nil
+
+	// shr r/m16,1
+	// d1 /4
+	case 5:
+		return instShr{dest: dest, src: src}, nil
+
+	default:
+		return nil, errors.Errorf("illegal or not yet implemented for reg: %d", modRM.reg)
+	}
+}
+
+// aam imm8
+// d4 ib
+func decodeD4(ctx decodeContext) (interface{}, error) {
+	base, err := ctx.memory.readByte(ctx.address)
+	if err != nil {
+		return nil, err
+	}
+	return instAam{base: base}, nil
+}
+
+// aad imm8
+// d5 ib
+func decodeD5(ctx decodeContext) (interface{}, error) {
+	base, err := ctx.memory.readByte(ctx.address)
+	if err != nil {
+		return nil, err
+	}
+	return instAad{base: base}, nil
+}
+
+// loop rel8
+// e2 cb
+func decodeE2(ctx decodeContext) (interface{}, error) {
+	// counter is ECX under the address-size prefix, but only 16-bit registers exist
+	if ctx.address32 {
+		return nil, errors.New("loop with ecx is not implemented")
+	}
+	rel8, err := ctx.memory.readInt8(ctx.address)
+	if err != nil {
+		return nil, err
+	}
+	return instLoop{rel8: rel8}, nil
+}
+
+// call rel16
+func decodeE8(ctx decodeContext) (interface{}, error) {
+	rel, err := ctx.memory.readInt16(ctx.address)
+	if err != nil {
+		return nil, err
+	}
+	return instCall{rel: rel}, nil
+}
+
+// jmp rel16
+func decodeE9(ctx decodeContext) (interface{}, error) {
+	rel, err := ctx.memory.readInt16(ctx.address)
+	if err != nil {
+		return nil, err
+	}
+	return instJmpRel16{rel: rel}, nil
+}
+
+// jmp rel8
+func decodeEB(ctx decodeContext) (interface{}, error) {
+	rel, err := ctx.memory.readInt8(ctx.address)
+	if err != nil {
+		return nil, err
+	}
+	return instJmpRel16{rel: int16(rel)}, nil
+}
+
+// Attach REP prefix to the following instruction.
+// String instructions have their repeated forms, and others are left to execRep.
+func withRep(inst interface{}) interface{} {
+	switch inst.(type) {
+	case nil:
+		return nil
+	case instMovsb:
+		return instRepMovsb{}
+	case instStosb:
+		return instRepStosb{}
+	case instScasb:
+		return instRepeScasb{}
+	case instScasw:
+		return instRepeScasw{}
+	default:
+		return instRep{inst: inst}
+	}
+}
+
+// test, not, neg, mul, imul, div or idiv r/m8
+func decodeF6(ctx decodeContext) (interface{}, error) {
+	modRM, err := newModRM(ctx.address, ctx.memory, ctx.address32)
+	if err != nil {
+		return nil, err
+	}
+	dest, err := modRM.getEb(ctx.address, ctx.memory)
+	if err != nil {
+		return nil, err
+	}
+
+	switch modRM.reg {
+	// test r/m8,imm8
+	// f6 /0 ib
+	case 0:
+		b, err := ctx.memory.readBytes(ctx.address, 1)
 		if err != nil {
-			return failureFunc(rawOpcode, err)
+			return nil, err
 		}
 		src, err := newImm8(bytes.NewReader(b))
 		if err != nil {
-			return failureFunc(rawOpcode, err)
+			return nil, err
 		}
+		return instTest{dest: dest, src: src}, nil
 
-		switch modRM.reg {
-		// add
-		case 0:
-			inst = instAdd{dest: dest, src: src}
+	// neg r/m8
+	// f6 /3
+	case 3:
+		return instNeg{dest: dest}, nil
 
-		// sub
-		case 5:
-			inst = instSub{dest: dest, src: src}
+	// div r/m8
+	// f6 /6
+	case 6:
+		return instDiv{src: dest}, nil
 
-		// cmp
-		case 7:
-			inst = instCmp{dest: dest, src: src}
+	// idiv r/m8
+	// f6 /7
+	case 7:
+		return instIdiv{src: dest}, nil
+	default:
+		return nil, errors.Errorf("illegal or not yet implemented for reg: %d", modRM.reg)
+	}
+}
 
-		default:
-			return failureFunc(rawOpcode, err)
-		}
+// test, not, neg, mul, imul, div or idiv r/m16
+func decodeF7(ctx decodeContext) (interface{}, error) {
+	modRM, err := newModRM(ctx.address, ctx.memory, ctx.address32)
+	if err != nil {
+		return nil, err
+	}
+	dest, err := modRM.getEv(ctx.address, ctx.memory)
+	if err != nil {
+		return nil, err
+	}
 
-	// 88 /r
-	// mov r/m8,r8
-	case 0x88:
-		modRM, err := newModRM(currentAddress, memory)
-		if err != nil {
-			return failureFunc(rawOpcode, err)
-		}
-		dest, err := modRM.getEb(currentAddress, memory)
+	switch modRM.reg {
+	// test r/m16,imm16
+	// f7 /0 iw
+	case 0:
+		b, err := ctx.memory.readBytes(ctx.address, 2)
 		if err != nil {
-			return failureFunc(rawOpcode, err)
+			return nil, err
 		}
-		src, err := modRM.getGb()
+		src, err := newImm16(bytes.NewReader(b))
 		if err != nil {
-			return failureFunc(rawOpcode, err)
+			return nil, err
 		}
-		inst = instMov{dest: dest, src: src}
+		return instTest{dest: dest, src: src}, nil
 
-	// 89 /r
-	// mov r/m16,r16
-	case 0x89:
-		modRM, err := newModRM(currentAddress, memory)
-		if err != nil {
-			return failureFunc(rawOpcode, err)
-		}
-		dest, err := modRM.getEv(currentAddress, memory)
-		if err != nil {
-			return failureFunc(rawOpcode, err)
-		}
-		src, err := modRM.getGv()
-		if err != nil {
-			return failureFunc(rawOpcode, err)
-		}
-		inst = instMov{dest: dest, src: src}
+	// neg r/m16
+	// f7 /3
+	case 3:
+		return instNeg{dest: dest}, nil
 
-	// mov r8,r/m8
-	// 8A /r
-	case 0x8a:
-		modRM, err := newModRM(currentAddress, memory)
-		if err != nil {
-			return failureFunc(rawOpcode, err)
-		}
-		dest, err := modRM.getGb()
-		if err != nil {
-			return failureFunc(rawOpcode, err)
-		}
-		src, err := modRM.getEb(currentAddress, memory)
-		if err != nil {
-			return failureFunc(rawOpcode, err)
-		}
-		inst = instMov{dest: dest, src: src}
+	// div r/m16
+	// f7 /6
+	case 6:
+		return instDiv{src: dest}, nil
 
-	// 8b /r (/r indicates that the ModR/M byte of the instruction contains a register operand and an r/m operand)
-	// mov r16,r/m16
-	case 0x8b:
-		modRM, err := newModRM(currentAddress, memory)
-		if err != nil {
-			return failureFunc(rawOpcode, err)
-		}
-		dest, err := modRM.getGv()
+	// idiv r/m16
+	// f7 /7
+	case 7:
+		return instIdiv{src: dest}, nil
+	default:
+		return nil, errors.Errorf("illegal or not yet implemented for reg: %d", modRM.reg)
+	}
+}
+
+// inc, dec, call, jmp or push r/m16
+func decodeFF(ctx decodeContext) (interface{}, error) {
+	modRM, err := newModRM(ctx.address, ctx.memory, ctx.address32)
+	if err != nil {
+		return nil, err
+	}
+
+	switch modRM.reg {
+	// call r/m16
+	// ff /2
+	case 2:
+		operand, err := modRM.getEv(ctx.address, ctx.memory)
 		if err != nil {
-			return failureFunc(rawOpcode, err)
+			return nil, err
 		}
-		src, err := modRM.getEv(currentAddress, memory)
+		return instCallAbsoluteIndirectMem16{operand: operand}, nil
+
+	// call m16:16
+	// ff /3
+	case 3:
+		operand, err := modRM.getM(ctx.address, ctx.memory)
 		if err != nil {
-			return failureFunc(rawOpcode, err)
+			return nil, err
 		}
-		inst = instMov{dest: dest, src: src}
+		return instCallFarIndirect{operand: operand}, nil
 
-	// 8c /r
-	// mov r/m16,Sreg
-	case 0x8c:
-		modRM, err := newModRM(currentAddress, memory)
+	// jmp r/m16
+	// ff /4
+	case 4:
+		operand, err := modRM.getEv(ctx.address, ctx.memory)
 		if err != nil {
-			return failureFunc(rawOpcode, err)
+			return nil, err
 		}
-		dest, err := modRM.getEv(currentAddress, memory)
+		return instJmpIndirect{operand: operand}, nil
+
+	// jmp m16:16
+	// ff /5
+	case 5:
+		operand, err := modRM.getM(ctx.address, ctx.memory)
 		if err != nil {
-			return failureFunc(rawOpcode, err)
+			return nil, err
 		}
-		src, err := modRM.getSw()
-		if err != nil {
-			return failureFunc(rawOpcode, err)
+		return instJmpFarIndirect{operand: operand}, nil
+	default:
+		return nil, errors.Errorf("illegal or not yet implemented for reg: %d", modRM.reg)
+	}
+}
+
+// jcc rel16
+// 0f 80+cc cw
+func decodeJccRel16(ctx decodeContext) (interface{}, error) {
+	rel, err := ctx.memory.readInt16(ctx.address)
+	if err != nil {
+		return nil, err
+	}
+	return instJccRel16{cond: condition(ctx.opcode & 0x0f), rel: rel}, nil
+}
+
+// setcc r/m8
+// 0f 90+cc /r
+func decodeSetcc(ctx decodeContext) (interface{}, error) {
+	modRM, err := newModRM(ctx.address, ctx.memory, ctx.address32)
+	if err != nil {
+		return nil, err
+	}
+	dest, err := modRM.getEb(ctx.address, ctx.memory)
+	if err != nil {
+		return nil, err
+	}
+	return instSetcc{cond: condition(ctx.opcode & 0x0f), dest: dest}, nil
+}
+
+// movzx r16,r/m8
+// 0f b6 /r
+func decode0FB6(ctx decodeContext) (interface{}, error) {
+	modRM, err := newModRM(ctx.address, ctx.memory, ctx.address32)
+	if err != nil {
+		return nil, err
+	}
+	dest, err := modRM.getGv()
+	if err != nil {
+		return nil, err
+	}
+	src, err := modRM.getEb(ctx.address, ctx.memory)
+	if err != nil {
+		return nil, err
+	}
+	return instMovzx{dest: dest, src: src}, nil
+}
+
+// movsx r16,r/m8
+// 0f be /r
+func decode0FBE(ctx decodeContext) (interface{}, error) {
+	modRM, err := newModRM(ctx.address, ctx.memory, ctx.address32)
+	if err != nil {
+		return nil, err
+	}
+	dest, err := modRM.getGv()
+	if err != nil {
+		return nil, err
+	}
+	src, err := modRM.getEb(ctx.address, ctx.memory)
+	if err != nil {
+		return nil, err
+	}
+	return instMovsx{dest: dest, src: src}, nil
+}
+
+// the number of bytes from unknown opcode kept in DecodeError
+const decodeErrorBytesCount = 6
+
+// DecodeError is the cause of error from decoder for undefined or not yet supported opcode
+type DecodeError struct {
+	// address where decoding started
+	Seg, Off uint16
+	Opcode   byte
+	// bytes from the opcode, which may be shorter near the end of memory
+	Bytes []byte
+}
+
+func newDecodeError(seg, off uint16, opcode byte, memory *memory) *DecodeError {
+	at := newAddress(seg, off)
+	n := decodeErrorBytesCount
+	if rest := memory.memorySize - at.realAddress(); rest < n {
+		n = rest
+	}
+	bs, _ := memory.readBytesAt(at, n)
+	return &DecodeError{Seg: seg, Off: off, Opcode: opcode, Bytes: bs}
+}
+
+func (e *DecodeError) Error() string {
+	return fmt.Sprintf("unknown opcode: 0x%02x at 0x%04x:0x%04x (% x)", e.Opcode, e.Seg, e.Off, e.Bytes)
+}
+
+// -------------
+// for int 21
+// -------------
+
+type dosVersion struct {
+	major, minor uint8
+}
+
+// version reported by int 21h 30h unless specified
+var defaultDOSVersion = dosVersion{major: 5, minor: 0}
+
+type intHandler func(*state, *memory) error
+
+// handlers of functions of an interrupt keyed by AH
+type intHandlers map[uint8]intHandler
+
+// handlers keyed by interrupt number
+type interruptHandlers map[uint8]intHandler
+
+// int 20h terminates program with exit code 0
+func intHandler20(s *state, memory *memory) error {
+	s.exitCode = 0
+	s.shouldExit = true
+	return nil
+}
+
+// int 10h 0eh writes character in AL as teletype. Page and color in BX are ignored.
+func int10Handler0e(s *state, memory *memory) error {
+	if _, err := s.output().Write([]byte{s.al()}); err != nil {
+		return errors.Wrap(err, "failed to write character")
+	}
+	return nil
+}
+
+// scan codes of US keyboard for ASCII characters, where shifted characters share scan codes of unshifted ones
+var scanCodes = func() map[byte]byte {
+	rows := []struct {
+		first byte
+		keys  string
+	}{
+		{0x02, "1234567890-="},
+		{0x02, "!@#$%^&*()_+"},
+		{0x10, "qwertyuiop[]"},
+		{0x10, "QWERTYUIOP{}"},
+		{0x1e, "asdfghjkl;'`"},
+		{0x1e, "ASDFGHJKL:\"~"},
+		{0x2b, "\\zxcvbnm,./"},
+		{0x2b, "|ZXCVBNM<>?"},
+	}
+	codes := map[byte]byte{0x1b: 0x01, 0x08: 0x0e, '\t': 0x0f, '\r': 0x1c, ' ': 0x39}
+	for _, row := range rows {
+		for i := 0; i < len(row.keys); i++ {
+			codes[row.keys[i]] = row.first + byte(i)
 		}
-		inst = instMov{dest: dest, src: src}
+	}
+	return codes
+}()
+
+// Return key as scan code in high byte and ASCII in low byte
+func keyFromASCII(c byte) word {
+	// Enter key gives CR
+	if c == '\n' {
+		c = '\r'
+	}
+	return word(scanCodes[c])<<8 | word(c)
+}
+
+// int 16h 00h waits for key and returns scan code in AH and ASCII in AL
+func int16Handler00(s *state, memory *memory) error {
+	c, err := s.input().ReadByte()
+	if err != nil {
+		return errors.Wrap(err, "failed to read key")
+	}
+	s.ax = keyFromASCII(c)
+	return nil
+}
 
-	// lea r16,m
-	// 8d /r
-	case 0x8d:
-		modRM, err := newModRM(currentAddress, memory)
-		if err != nil {
-			return failureFunc(rawOpcode, err)
-		}
-		dest, err := modRM.getGv()
-		if err != nil {
-			return failureFunc(rawOpcode, err)
-		}
-		src, err := modRM.getM(currentAddress, memory)
-		if err != nil {
-			return failureFunc(rawOpcode, err)
+// int 16h 01h checks key, which is returned in AX without removing from buffer.
+// ZF is set if no key is available, which is the case at the end of input.
+// It waits for input when nothing is buffered, since input can't be polled.
+func int16Handler01(s *state, memory *memory) error {
+	b, err := s.input().Peek(1)
+	if err != nil {
+		if err == io.EOF {
+			*s = s.setZF()
+			return nil
 		}
-		inst = instLea{dest: dest, src: src}
+		return errors.Wrap(err, "failed to check key")
+	}
+	*s = s.resetZF()
+	s.ax = keyFromASCII(b[0])
+	return nil
+}
 
-	// 8e /r
-	// mov Sreg,r/m16
-	// Sreg ES=0, CS=1, SS=2, DS=3, FS=4, GS=5
-	case 0x8e:
-		modRM, err := newModRM(currentAddress, memory)
-		if err != nil {
-			return failureFunc(rawOpcode, err)
-		}
-		dest, err := modRM.getSw()
-		if err != nil {
-			return failureFunc(rawOpcode, err)
-		}
-		src, err := modRM.getEw(currentAddress, memory)
-		if err != nil {
-			return failureFunc(rawOpcode, err)
+// Return handler of interrupt which calls handler of function specified in AH
+func dispatchByAH(interrupt uint8, handlers intHandlers) intHandler {
+	return func(s *state, memory *memory) error {
+		handler, ok := handlers[s.ah()]
+		if !ok {
+			return errors.Errorf("int %x with unknown value of ax: %04x", interrupt, s.ax)
 		}
-		inst = instMov{dest: dest, src: src}
+		return handler(s, memory)
+	}
+}
 
-	// mov ax,moffs16
-	// A1
-	case 0xa1:
-		imm, err := memory.readWord(currentAddress)
-		if err != nil {
-			return failureFunc(rawOpcode, err)
-		}
-		dest := reg16{value: AX}
-		src := mem16Disp16{offset: imm}
-		inst = instMov{dest: dest, src: src}
+// Return DOS version, major in AL and minor in AH, with OEM number in BH and serial number in BL:CX
+func intHandler30(s *state, memory *memory) error {
+	s.ax = word(s.dosVersion.minor)<<8 | word(s.dosVersion.major)
+	// OEM of MS-DOS and no serial number
+	s.bx = 0xff00
+	s.cx = 0x0000
+	return nil
+}
 
-	// mov moffs8,al
-	// A2
-	case 0xa2:
-		offset, err := memory.readWord(currentAddress)
-		if err != nil {
-			return failureFunc(rawOpcode, err)
-		}
-		dest := mem8Disp16{offset: offset}
-		src := reg8{value: AL}
-		inst = instMov{dest: dest, src: src}
+func intHandler4a(s *state, memory *memory) error {
+	// do nothing for now
+	return nil
+}
 
-	// mov moffs16,ax
-	// A3
-	case 0xa3:
-		offset, err := memory.readWord(currentAddress)
-		if err != nil {
-			return failureFunc(rawOpcode, err)
-		}
-		dest := mem16Disp16{offset: offset}
-		src := reg16{value: AX}
-		inst = instMov{dest: dest, src: src}
+// Load or execute program whose name is at DS:DX.
+// Child programs are not supported, so it always fails as if the file were not found.
+func intHandler4b(s *state, memory *memory) error {
+	s.dosError(dosErrorFileNotFound)
+	return nil
+}
 
-	// stosb
-	case 0xaa:
-		inst = instStosb{}
+func intHandler4c(s *state, memory *memory) error {
+	s.exitCode = exitCode(s.al())
+	s.shouldExit = true
+	return nil
+}
 
-	// b0+ rb ib
-	// mov r8,imm8
-	case 0xb0, 0xb1, 0xb2, 0xb3, 0xb4, 0xb5, 0xb6, 0xb7:
-		imm, err := memory.readBytes(currentAddress, 1)
-		if err != nil {
-			return failureFunc(rawOpcode, err)
+// DS:DX has the address of string
+// string should be ended with '$', which must be found before the end of segment
+func intHandler09(s *state, memory *memory) error {
+	var bs []byte
+	for offset := int(s.dx); ; offset++ {
+		if offset > 0xffff {
+			return errors.Errorf("string at %04x:%04x is not terminated by '$'", s.ds, s.dx)
 		}
-		dest, err := newReg8(rawOpcode - 0xb0)
+		b, err := memory.readBytesAt(newAddressFromWord(s.ds, word(offset)), 1)
 		if err != nil {
-			return failureFunc(rawOpcode, err)
+			return err
 		}
-		src, err := newImm8(bytes.NewReader(imm))
-		if err != nil {
-			return failureFunc(rawOpcode, err)
+		if b[0] == '$' {
+			break
 		}
-		inst = instMov{dest: dest, src: src}
+		bs = append(bs, b[0])
+	}
+	if _, err := fmt.Fprint(s.output(), string(bs)); err != nil {
+		return errors.Wrap(err, "failed to write string")
+	}
+	return nil
+}
 
-	// b8+ rw iw
-	// mov r16,imm16
-	case 0xb8, 0xb9, 0xba, 0xbb, 0xbc, 0xbd, 0xbe, 0xbf:
-		// ax
-		bs, err := memory.readBytes(currentAddress, 2)
-		if err != nil {
-			return failureFunc(rawOpcode, err)
-		}
-		dest, err := newReg16(rawOpcode - 0xb8)
-		if err != nil {
-			return failureFunc(rawOpcode, err)
-		}
-		src, err := newImm16(bytes.NewReader(bs))
-		if err != nil {
-			return failureFunc(rawOpcode, err)
-		}
-		inst = instMov{dest: dest, src: src}
+// Read a character into AL and echo it
+func intHandler01(s *state, memory *memory) error {
+	buf := make([]byte, 1)
+	if _, err := io.ReadFull(s.input(), buf); err != nil {
+		return errors.Wrap(err, "failed to read character")
+	}
+	s.ax = (s.ax & 0xff00) | word(buf[0])
+	if _, err := s.output().Write(buf); err != nil {
+		return errors.Wrap(err, "failed to echo character")
+	}
+	return nil
+}
 
-	// shl r/m16,imm8
-	case 0xc1:
-		modRM, err := newModRM(currentAddress, memory)
-		if err != nil {
-			return failureFunc(rawOpcode, err)
-		}
-		dest, err := modRM.getEv(currentAddress, memory)
-		if err != nil {
-			return failureFunc(rawOpcode, err)
-		}
-		bs, err := memory.readBytes(currentAddress, 1)
-		if err != nil {
-			return failureFunc(rawOpcode, err)
+// DS:DX has the address of input buffer,
+// where the first byte is the maximum number of characters including CR,
+// the second byte receives the number of characters read excluding CR,
+// and the line terminated by CR is stored from the third byte.
+// Input is read until newline or the buffer is full.
+func intHandler0a(s *state, memory *memory) error {
+	max, err := memory.readByte(newAddressFromWord(s.ds, s.dx))
+	if err != nil {
+		return errors.Wrap(err, "failed to read buffer size")
+	}
+	if max == 0 {
+		return nil
+	}
+
+	var line []byte
+	buf := make([]byte, 1)
+	for len(line) < int(max)-1 {
+		if _, err := io.ReadFull(s.input(), buf); err != nil {
+			if err == io.EOF {
+				break
+			}
+			return errors.Wrap(err, "failed to read line")
 		}
-		src, err := newImm8(bytes.NewReader(bs))
-		if err != nil {
-			return failureFunc(rawOpcode, err)
+		if buf[0] == '\n' {
+			break
 		}
-
-		switch modRM.reg {
-		case 4:
-			inst = instShl{dest: dest, src: src}
-		default:
-			return failureFunc(rawOpcode, err)
+		if buf[0] == '\r' {
+			continue
 		}
+		line = append(line, buf[0])
+	}
+	if _, err := s.output().Write(line); err != nil {
+		return errors.Wrap(err, "failed to echo line")
+	}
 
-	// ret (near return)
-	case 0xc3:
-		inst = instRet{}
-
-	// mov r/m16,imm16
-	// c7 /0 iw
-	case 0xc7:
-		modRM, err := newModRM(currentAddress, memory)
-		if err != nil {
-			return failureFunc(rawOpcode, err)
+	if err := memory.writeByte(newAddressFromWord(s.ds, s.dx+1), byte(len(line))); err != nil {
+		return errors.Wrap(err, "failed to write count of characters")
+	}
+	for i, b := range append(line, '\r') {
+		if err := memory.writeByte(newAddressFromWord(s.ds, s.dx+2+word(i)), b); err != nil {
+			return errors.Wrap(err, "failed to write line")
 		}
+	}
+	return nil
+}
 
-		if modRM.reg != 0 {
-			return failureFunc(rawOpcode, err)
-		}
+// Set interrupt vector of AL to DS:DX
+func intHandler25(s *state, memory *memory) error {
+	return memory.setInterruptVector(s.al(), s.ds, s.dx)
+}
 
-		dest, err := modRM.getEv(currentAddress, memory)
-		if err != nil {
-			return failureFunc(rawOpcode, err)
-		}
-		bs, err := memory.readBytes(currentAddress, 2)
-		if err != nil {
-			return failureFunc(rawOpcode, err)
-		}
-		src, err := newImm16(bytes.NewReader(bs))
-		if err != nil {
-			return failureFunc(rawOpcode, err)
-		}
-		inst = instMov{dest: dest, src: src}
+// Get interrupt vector of AL into ES:BX
+func intHandler35(s *state, memory *memory) error {
+	seg, offset, err := memory.interruptVector(s.al())
+	if err != nil {
+		return err
+	}
+	s.es = seg
+	s.bx = offset
+	return nil
+}
 
-	// int imm8
-	case 0xcd:
-		operand, err := memory.readByte(currentAddress)
-		if err != nil {
-			return failureFunc(rawOpcode, err)
-		}
-		inst = instInt{operand: operand}
+// Get date, year in CX, month in DH, day in DL and day of week (0 is Sunday) in AL
+func intHandler2a(s *state, memory *memory) error {
+	now := s.now()
+	s.cx = word(now.Year())
+	s.dx = word(now.Month())<<8 | word(now.Day())
+	s.ax = (s.ax & 0xff00) | word(now.Weekday())
+	return nil
+}
 
-	case 0xd1:
-		modRM, err := newModRM(currentAddress, memory)
-		if err != nil {
-			return failureFunc(rawOpcode, err)
-		}
-		dest, err := modRM.getEv(currentAddress, memory)
-		if err != nil {
-			return failureFunc(rawOpcode, err)
-		}
-		src := imm8{value: 1}
+// Get time, hour in CH, minute in CL, second in DH and 1/100 second in DL
+func intHandler2c(s *state, memory *memory) error {
+	now := s.now()
+	s.cx = word(now.Hour())<<8 | word(now.Minute())
+	s.dx = word(now.Second())<<8 | word(now.Nanosecond()/10000000)
+	return nil
+}
 
-		switch modRM.reg {
-		// shl r/m16,1
-		// d1 /4
-		case 4:
-			inst = instShl{dest: dest, src: src}
+// DL has the character to be displayed
+func intHandler02(s *state, memory *memory) error {
+	if _, err := s.output().Write([]byte{s.dl()}); err != nil {
+		return errors.Wrap(err, "failed to write character")
+	}
+	return nil
+}
 
-		// shr r/m16,1
-		// d1 /4
-		case 5:
-			inst = instShr{dest: dest, src: src}
+// --- file handles
 
-		default:
-			return failureFunc(rawOpcode, err)
-		}
+// DOS error codes returned in AX with CF set
+const (
+	dosErrorInvalidFunction   word = 0x01
+	dosErrorFileNotFound      word = 0x02
+	dosErrorTooManyOpenFiles  word = 0x04
+	dosErrorAccessDenied      word = 0x05
+	dosErrorInvalidHandle     word = 0x06
+	dosErrorInvalidAccessMode word = 0x0c
+)
 
-	// call rel16
-	case 0xe8:
-		rel, err := memory.readInt16(currentAddress)
-		if err != nil {
-			return failureFunc(rawOpcode, err)
-		}
-		inst = instCall{rel: rel}
+const (
+	// handles 0-4 are reserved for standard devices
+	firstFileHandle word = 5
+	maxFileHandles       = 20
+)
 
-	// jmp rel16
-	case 0xe9:
-		rel, err := memory.readInt16(currentAddress)
-		if err != nil {
-			return failureFunc(rawOpcode, err)
-		}
-		inst = instJmpRel16{rel: rel}
+// Map DOS file handles to files opened by host
+type fileTable map[word]*os.File
 
-	// jmp rel8
-	case 0xeb:
-		rel, err := memory.readInt8(currentAddress)
-		if err != nil {
-			return failureFunc(rawOpcode, err)
-		}
-		inst = instJmpRel16{rel: int16(rel)}
+func (s *state) fileTable() fileTable {
+	if s.files == nil {
+		s.files = make(fileTable)
+	}
+	return s.files
+}
 
-	case 0xf3:
-		stringOperation, err := memory.readByte(currentAddress)
-		if err != nil {
-			return failureFunc(rawOpcode, err)
-		}
-		switch stringOperation {
-		case 0xa4:
-			// rep movsb
-			inst = instRepMovsb{}
-		case 0xaa:
-			// rep stosb
-			inst = instRepStosb{}
-		case 0xae:
-			// repe scasb
-			inst = instRepeScasb{}
-		case 0xaf:
-			// repe scasw
-			inst = instRepeScasw{}
-		default:
-			return failureFunc(rawOpcode, err)
+// Register file to the lowest free handle
+func (files fileTable) add(f *os.File) (word, bool) {
+	for h := firstFileHandle; h < maxFileHandles; h++ {
+		if _, ok := files[h]; !ok {
+			files[h] = f
+			return h, true
 		}
+	}
+	return 0, false
+}
 
-	// sti
-	case 0xfb:
-		inst = instSti{}
+// Set CF and error code in AX as DOS functions do on failure
+func (s *state) dosError(code word) {
+	*s = s.setCF()
+	s.ax = code
+}
 
-	// cld
-	case 0xfc:
-		inst = instCld{}
+func dosErrorFromHostError(err error) word {
+	if os.IsNotExist(err) {
+		return dosErrorFileNotFound
+	}
+	return dosErrorAccessDenied
+}
 
-	case 0xff:
-		modRM, err := newModRM(currentAddress, memory)
+// Read ASCIIZ string such as file name
+func readASCIIZ(memory *memory, at *address) (string, error) {
+	var bs []byte
+	for {
+		b, err := memory.readByte(at)
 		if err != nil {
-			return failureFunc(rawOpcode, err)
+			return "", err
 		}
-
-		switch modRM.reg {
-		case 2:
-			operand, err := modRM.getEv(currentAddress, memory)
-			if err != nil {
-				return failureFunc(rawOpcode, err)
-			}
-			inst = instCallAbsoluteIndirectMem16{operand: operand}
-		default:
-			return failureFunc(rawOpcode, err)
+		if b == 0 {
+			break
 		}
+		bs = append(bs, b)
+	}
+	return string(bs), nil
+}
 
-	default:
-		return inst, -1, nil, errors.Errorf("unknown opcode: 0x%02x", rawOpcode)
+func openFile(s *state, memory *memory, flag int) error {
+	name, err := readASCIIZ(memory, newAddressFromWord(s.ds, s.dx))
+	if err != nil {
+		return errors.Wrap(err, "failed to read file name")
+	}
+	f, err := os.OpenFile(name, flag, 0666)
+	if err != nil {
+		s.dosError(dosErrorFromHostError(err))
+		return nil
 	}
-	return inst, currentAddress.realAddress() - initialRealAddress, nil, nil
+	handle, ok := s.fileTable().add(f)
+	if !ok {
+		f.Close()
+		s.dosError(dosErrorTooManyOpenFiles)
+		return nil
+	}
+	*s = s.resetCF()
+	s.ax = handle
+	return nil
 }
 
-// -------------
-// for int 21
-// -------------
+// Create or truncate file whose name is at DS:DX and return its handle in AX.
+// Attributes in CX are ignored.
+func intHandler3c(s *state, memory *memory) error {
+	return openFile(s, memory, os.O_RDWR|os.O_CREATE|os.O_TRUNC)
+}
 
-type intHandler func(*state, *memory) error
-type intHandlers map[uint8]intHandler
+// Open existing file whose name is at DS:DX with access mode in AL and return its handle in AX
+func intHandler3d(s *state, memory *memory) error {
+	var flag int
+	switch s.al() & 0x07 {
+	case 0:
+		flag = os.O_RDONLY
+	case 1:
+		flag = os.O_WRONLY
+	case 2:
+		flag = os.O_RDWR
+	default:
+		s.dosError(dosErrorInvalidAccessMode)
+		return nil
+	}
+	return openFile(s, memory, flag)
+}
 
-func intHandler30(s *state, memory *memory) error {
-	// do nothing for now
+// Close file of handle in BX
+func intHandler3e(s *state, memory *memory) error {
+	files := s.fileTable()
+	f, ok := files[s.bx]
+	if !ok {
+		s.dosError(dosErrorInvalidHandle)
+		return nil
+	}
+	delete(files, s.bx)
+	if err := f.Close(); err != nil {
+		s.dosError(dosErrorFromHostError(err))
+		return nil
+	}
+	*s = s.resetCF()
 	return nil
 }
 
-func intHandler4a(s *state, memory *memory) error {
-	// do nothing for now
+// Read CX bytes from handle in BX into DS:DX and return the number of bytes read in AX.
+// Handle 0 reads from console input.
+func intHandler3f(s *state, memory *memory) error {
+	buf := make([]byte, s.cx)
+	var n int
+	var err error
+	if s.bx == 0 {
+		// console input returns what is available, usually a line
+		n, err = s.input().Read(buf)
+	} else {
+		f, ok := s.fileTable()[s.bx]
+		if !ok {
+			s.dosError(dosErrorInvalidHandle)
+			return nil
+		}
+		n, err = io.ReadFull(f, buf)
+	}
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		s.dosError(dosErrorFromHostError(err))
+		return nil
+	}
+
+	for i := 0; i < n; i++ {
+		if err := memory.writeByte(newAddressFromWord(s.ds, s.dx+word(i)), buf[i]); err != nil {
+			return errors.Wrap(err, "failed to write data read")
+		}
+	}
+	*s = s.resetCF()
+	s.ax = word(n)
 	return nil
 }
 
-func intHandler4c(s *state, memory *memory) error {
-	s.exitCode = exitCode(s.al())
-	s.shouldExit = true
+// Write CX bytes at DS:DX to handle in BX and return the number of bytes written in AX.
+// Handle 1 writes to console output.
+func intHandler40(s *state, memory *memory) error {
+	var w io.Writer
+	if s.bx == 1 {
+		w = s.output()
+	} else {
+		f, ok := s.fileTable()[s.bx]
+		if !ok {
+			s.dosError(dosErrorInvalidHandle)
+			return nil
+		}
+		w = f
+	}
+
+	buf, err := memory.readBytesAt(newAddressFromWord(s.ds, s.dx), int(s.cx))
+	if err != nil {
+		return errors.Wrap(err, "failed to read data to be written")
+	}
+	n, err := w.Write(buf)
+	if err != nil {
+		s.dosError(dosErrorFromHostError(err))
+		return nil
+	}
+	*s = s.resetCF()
+	s.ax = word(n)
 	return nil
 }
 
-// DS:DX has the address of string
-// string should be ended with '$'
-func intHandler09(s *state, memory *memory) error {
-	var bs []byte
-	startAddress := newAddressFromWord(s.ds, s.dx)
-	for {
-		b, err := memory.readByte(startAddress)
-		if err != nil {
-			return err
-		}
-		if b == '$' {
-			break
-		}
-		bs = append(bs, b)
+// Move file pointer of handle in BX by CX:DX from the origin in AL (0: start, 1: current, 2: end)
+// and return the new position in DX:AX
+func intHandler42(s *state, memory *memory) error {
+	f, ok := s.fileTable()[s.bx]
+	if !ok {
+		s.dosError(dosErrorInvalidHandle)
+		return nil
+	}
+	if s.al() > 2 {
+		s.dosError(dosErrorInvalidFunction)
+		return nil
+	}
+
+	// offset is signed for origins other than start
+	offset := int64(int32(uint32(s.cx)<<16 | uint32(s.dx)))
+	if s.al() == 0 {
+		offset = int64(uint32(s.cx)<<16 | uint32(s.dx))
+	}
+	pos, err := f.Seek(offset, int(s.al()))
+	if err != nil {
+		s.dosError(dosErrorFromHostError(err))
+		return nil
 	}
-	fmt.Print(string(bs))
+	*s = s.resetCF()
+	s.dx = word(pos >> 16)
+	s.ax = word(pos)
 	return nil
 }
 
@@ -1602,11 +3743,57 @@ func intHandler09(s *state, memory *memory) error {
 
 // FIXME: Type general registers, segment registers respectively
 type state struct {
-	ax, cx, dx, bx, sp, bp, si, di, ss, cs, ip, ds, es word
-	eflags                                             dword
-	exitCode                                           exitCode
-	shouldExit                                         bool
-	intHandlers                                        intHandlers
+	ax, cx, dx, bx, sp, bp, si, di, ss, cs, ip, ds, es, fs, gs word
+	eflags                                                     dword
+	exitCode                                                   exitCode
+	shouldExit                                                 bool
+	interruptHandlers                                          interruptHandlers
+	segmentOverride                                            *segmentOverride // active only while executing an instruction with prefix
+	stdout                                                     io.Writer        // console output of DOS functions, os.Stdout if nil
+	stdin                                                      *bufio.Reader    // console input of DOS and BIOS functions, os.Stdin if nil
+	files                                                      fileTable        // files opened by DOS functions, shared among copies of state
+	dosVersion                                                 dosVersion       // reported by int 21h 30h
+	clock                                                      func() time.Time // current time for DOS functions, time.Now if nil
+	stack                                                      *stackBounds     // pushWord and popWord are checked against it if not nil
+	syscallFunc                                                SyscallFunc      // called before handler of INT if not nil
+}
+
+// Range of SP allowed for the initial stack segment, where top can be 0x10000
+type stackBounds struct {
+	ss          word
+	bottom, top int
+}
+
+// Return current SP as an offset in the range of stack, where SP 0 means the end of segment
+func (bounds stackBounds) position(sp word) int {
+	if sp == 0 && bounds.top == 0x10000 {
+		return 0x10000
+	}
+	return int(sp)
+}
+
+func (s state) now() time.Time {
+	if s.clock == nil {
+		return time.Now()
+	}
+	return s.clock()
+}
+
+// buffered so that keyboard functions can look ahead input
+var defaultStdin = bufio.NewReader(os.Stdin)
+
+func (s state) input() *bufio.Reader {
+	if s.stdin == nil {
+		return defaultStdin
+	}
+	return s.stdin
+}
+
+func (s state) output() io.Writer {
+	if s.stdout == nil {
+		return os.Stdout
+	}
+	return s.stdout
 }
 
 const (
@@ -1614,44 +3801,161 @@ const (
 	EFLAGS_ZF_INV = 0xffffffbf
 	EFLAGS_CF     = 0x00000001
 	EFLAGS_CF_INV = 0xfffffffe
-	EFLAGS_DF     = 0x00000200
-	EFLAGS_DF_INV = 0xfffffdff
+	EFLAGS_DF     = 0x00000400
+	EFLAGS_DF_INV = 0xfffffbff
+	EFLAGS_SF     = 0x00000080
+	EFLAGS_SF_INV = 0xffffff7f
+	EFLAGS_OF     = 0x00000800
+	EFLAGS_OF_INV = 0xfffff7ff
+	EFLAGS_PF     = 0x00000004
+	EFLAGS_PF_INV = 0xfffffffb
+	EFLAGS_AF     = 0x00000010
+	EFLAGS_AF_INV = 0xffffffef
+	EFLAGS_TF     = 0x00000100
+	EFLAGS_TF_INV = 0xfffffeff
+	EFLAGS_IF     = 0x00000200
+	EFLAGS_IF_INV = 0xfffffdff
+	// bit 1 is reserved and always 1, which is also the value of flags at reset
+	EFLAGS_RESERVED = 0x00000002
+	// CF, PF, AF, ZF, SF, TF, IF, DF and OF, which POPF can change
+	EFLAGS_POPF_MASK = 0x00000fd5
+	// CF, PF, AF, ZF, SF and OF, which handlers of the emulator return to the caller
+	EFLAGS_STATUS_MASK = 0x000008d5
+)
+
+// Flag is a bit of FLAGS which can be read and written by CPU.Flag and CPU.SetFlag
+type Flag dword
+
+const (
+	CF = Flag(EFLAGS_CF)
+	PF = Flag(EFLAGS_PF)
+	AF = Flag(EFLAGS_AF)
+	ZF = Flag(EFLAGS_ZF)
+	SF = Flag(EFLAGS_SF)
+	DF = Flag(EFLAGS_DF)
+	OF = Flag(EFLAGS_OF)
 )
 
-func newState(header *header, customIntHandlers intHandlers) state {
-	// --- Prepare interrupted handlers
+// Prepare state at the entry point of EXE program whose load module is placed at loadSeg.
+// CS and SS in header are relative to the load segment.
+func newState(header *header, loadSeg word, interruptHandlers interruptHandlers) state {
+	return state{
+		sp:                header.exInitSP,
+		ss:                loadSeg + header.exInitSS,
+		ip:                header.exInitIP,
+		cs:                loadSeg + header.exInitCS,
+		eflags:            EFLAGS_RESERVED,
+		interruptHandlers: interruptHandlers}
+}
+
+// Prepare handlers for each interrupt number, where custom ones take precedence over the default ones.
+// customIntHandlers are for functions of int 21h.
+func newInterruptHandlers(customIntHandlers intHandlers, customInterruptHandlers interruptHandlers) interruptHandlers {
+	handlers := interruptHandlers{
+		0x10: dispatchByAH(0x10, intHandlers{
+			0x0e: int10Handler0e,
+		}),
+		0x16: dispatchByAH(0x16, intHandlers{
+			0x00: int16Handler00,
+			0x01: int16Handler01,
+		}),
+		0x20: intHandler20,
+		0x21: dispatchByAH(0x21, newIntHandlers(customIntHandlers)),
+	}
+	for k, v := range customInterruptHandlers {
+		handlers[k] = v
+	}
+	return handlers
+}
+
+// Prepare handlers of int 21h, where custom ones take precedence over the default ones
+func newIntHandlers(customIntHandlers intHandlers) intHandlers {
+	intHandlers := make(intHandlers)
+	for k, v := range customIntHandlers {
+		intHandlers[k] = v
+	}
+
+	// int 21 30h
+	if _, ok := intHandlers[0x30]; !ok {
+		intHandlers[0x30] = intHandler30
+	}
+
+	// int 21 4ah
+	if _, ok := intHandlers[0x4a]; !ok {
+		intHandlers[0x4a] = intHandler4a
+	}
+
+	// int 21 4bh
+	if _, ok := intHandlers[0x4b]; !ok {
+		intHandlers[0x4b] = intHandler4b
+	}
+
+	// int 21 4ch
+	if _, ok := intHandlers[0x4c]; !ok {
+		intHandlers[0x4c] = intHandler4c
+	}
+
+	// int 21 09h
+	if _, ok := intHandlers[0x09]; !ok {
+		intHandlers[0x09] = intHandler09
+	}
+
+	// int 21 01h
+	if _, ok := intHandlers[0x01]; !ok {
+		intHandlers[0x01] = intHandler01
+	}
+
+	// int 21 0ah
+	if _, ok := intHandlers[0x0a]; !ok {
+		intHandlers[0x0a] = intHandler0a
+	}
+
+	// int 21 3ch, 3dh and 3eh
+	if _, ok := intHandlers[0x3c]; !ok {
+		intHandlers[0x3c] = intHandler3c
+	}
+	if _, ok := intHandlers[0x3d]; !ok {
+		intHandlers[0x3d] = intHandler3d
+	}
+	if _, ok := intHandlers[0x3e]; !ok {
+		intHandlers[0x3e] = intHandler3e
+	}
 
-	intHandlers := make(intHandlers)
-	for k, v := range customIntHandlers {
-		intHandlers[k] = v
+	// int 21 3fh and 40h
+	if _, ok := intHandlers[0x3f]; !ok {
+		intHandlers[0x3f] = intHandler3f
+	}
+	if _, ok := intHandlers[0x40]; !ok {
+		intHandlers[0x40] = intHandler40
 	}
 
-	// int 21 30h
-	if _, ok := intHandlers[0x30]; !ok {
-		intHandlers[0x30] = intHandler30
+	// int 21 42h
+	if _, ok := intHandlers[0x42]; !ok {
+		intHandlers[0x42] = intHandler42
 	}
 
-	// int 21 4ah
-	if _, ok := intHandlers[0x4a]; !ok {
-		intHandlers[0x4a] = intHandler4a
+	// int 21 25h and 35h
+	if _, ok := intHandlers[0x25]; !ok {
+		intHandlers[0x25] = intHandler25
+	}
+	if _, ok := intHandlers[0x35]; !ok {
+		intHandlers[0x35] = intHandler35
 	}
 
-	// int 21 4ch
-	if _, ok := intHandlers[0x4c]; !ok {
-		intHandlers[0x4c] = intHandler4c
+	// int 21 2ah and 2ch
+	if _, ok := intHandlers[0x2a]; !ok {
+		intHandlers[0x2a] = intHandler2a
+	}
+	if _, ok := intHandlers[0x2c]; !ok {
+		intHandlers[0x2c] = intHandler2c
 	}
 
-	// int 21 09h
-	if _, ok := intHandlers[0x09]; !ok {
-		intHandlers[0x09] = intHandler09
+	// int 21 02h
+	if _, ok := intHandlers[0x02]; !ok {
+		intHandlers[0x02] = intHandler02
 	}
 
-	return state{
-		sp:          header.exInitSP,
-		ss:          header.exInitSS,
-		ip:          header.exInitIP,
-		cs:          header.exInitCS,
-		intHandlers: intHandlers}
+	return intHandlers
 }
 
 func (s state) al() uint8 {
@@ -1701,16 +4005,50 @@ func (s state) addressFromBaseAndDisp(base registerW, disp int) (*address, error
 		return nil, errors.Wrap(err, "failed to get address from base and disp")
 	}
 
-	var address *address
-	if base == BP {
-		address = newAddressFromWord(s.ss, vBase)
-	} else {
-		address = newAddressFromWord(s.ds, vBase)
+	seg, err := s.segmentFor(defaultSregForBase(base))
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to get address from base and disp")
 	}
+	address := newAddressFromWord(seg, vBase)
 	address.plus(disp)
 	return address, nil
 }
 
+func (s state) addressFromBaseIndexAndDisp(base registerW, index registerW, disp int) (*address, error) {
+	var vBase, vIndex word
+	var err error
+	if vBase, err = s.readWordGeneralReg(base); err != nil {
+		return nil, errors.Wrap(err, "failed to get address from base, index and disp")
+	}
+	if vIndex, err = s.readWordGeneralReg(index); err != nil {
+		return nil, errors.Wrap(err, "failed to get address from base, index and disp")
+	}
+
+	seg, err := s.segmentFor(defaultSregForBase(base))
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to get address from base, index and disp")
+	}
+	address := newAddressFromWord(seg, vBase)
+	address.plus(int(vIndex) + disp)
+	return address, nil
+}
+
+// BP addresses the stack segment and other registers address the data segment by default
+func defaultSregForBase(base registerW) registerS {
+	if base == BP {
+		return SS
+	}
+	return DS
+}
+
+// segment register value to address memory, which is defaultSreg unless overridden by prefix
+func (s state) segmentFor(defaultSreg registerS) (word, error) {
+	if s.segmentOverride != nil {
+		return s.readWordSreg(s.segmentOverride.sreg)
+	}
+	return s.readWordSreg(defaultSreg)
+}
+
 // return true if zf == 1
 func (s state) isActiveZF() bool {
 	zf := s.eflags & EFLAGS_ZF
@@ -1774,6 +4112,214 @@ func (s state) resetDF() state {
 	return s
 }
 
+// return true if sf == 1
+func (s state) isActiveSF() bool {
+	sf := s.eflags & EFLAGS_SF
+	return sf != 0
+}
+
+func (s state) setSF() state {
+	s.eflags = s.eflags | EFLAGS_SF
+	return s
+}
+
+func (s state) resetSF() state {
+	s.eflags = s.eflags & EFLAGS_SF_INV
+	return s
+}
+
+// return true if of == 1
+func (s state) isActiveOF() bool {
+	of := s.eflags & EFLAGS_OF
+	return of != 0
+}
+
+func (s state) setOF() state {
+	s.eflags = s.eflags | EFLAGS_OF
+	return s
+}
+
+func (s state) resetOF() state {
+	s.eflags = s.eflags & EFLAGS_OF_INV
+	return s
+}
+
+// return true if pf == 1
+func (s state) isActivePF() bool {
+	pf := s.eflags & EFLAGS_PF
+	return pf != 0
+}
+
+func (s state) setPF() state {
+	s.eflags = s.eflags | EFLAGS_PF
+	return s
+}
+
+func (s state) resetPF() state {
+	s.eflags = s.eflags & EFLAGS_PF_INV
+	return s
+}
+
+// return true if af == 1
+func (s state) isActiveAF() bool {
+	af := s.eflags & EFLAGS_AF
+	return af != 0
+}
+
+func (s state) setAF() state {
+	s.eflags = s.eflags | EFLAGS_AF
+	return s
+}
+
+func (s state) resetAF() state {
+	s.eflags = s.eflags & EFLAGS_AF_INV
+	return s
+}
+
+// Condition of Jcc and SETcc, whose value is the low 4 bits of their opcodes
+type condition uint8
+
+const (
+	condO condition = iota
+	condNO
+	condB
+	condAE
+	condE
+	condNE
+	condBE
+	condA
+	condS
+	condNS
+	condP
+	condNP
+	condL
+	condGE
+	condLE
+	condG
+)
+
+// return true if flags satisfy cond
+func (s state) satisfies(cond condition) bool {
+	switch cond {
+	case condO:
+		return s.isActiveOF()
+	case condNO:
+		return !s.isActiveOF()
+	case condB:
+		return s.isActiveCF()
+	case condAE:
+		return !s.isActiveCF()
+	case condE:
+		return s.isActiveZF()
+	case condNE:
+		return !s.isActiveZF()
+	case condBE:
+		return s.isActiveCF() || s.isActiveZF()
+	case condA:
+		return !s.isActiveCF() && !s.isActiveZF()
+	case condS:
+		return s.isActiveSF()
+	case condNS:
+		return !s.isActiveSF()
+	case condP:
+		return s.isActivePF()
+	case condNP:
+		return !s.isActivePF()
+	case condL:
+		return s.isActiveSF() != s.isActiveOF()
+	case condGE:
+		return s.isActiveSF() == s.isActiveOF()
+	case condLE:
+		return s.isActiveZF() || s.isActiveSF() != s.isActiveOF()
+	default:
+		return !s.isActiveZF() && s.isActiveSF() == s.isActiveOF()
+	}
+}
+
+// update flags by result of logical operations (AND, OR, XOR and TEST)
+// CF and OF are cleared, and AF is left undefined (unchanged)
+func (s state) updateFlagsLogical(result, size int) state {
+	s = s.resetCF()
+	s = s.resetOF()
+	return s.updateFlagsSZP(result, size)
+}
+
+// update ZF, SF and PF by result
+func (s state) updateFlagsSZP(result, size int) state {
+	if result == 0 {
+		s = s.setZF()
+	} else {
+		s = s.resetZF()
+	}
+	if result&signBitOf(size) != 0 {
+		s = s.setSF()
+	} else {
+		s = s.resetSF()
+	}
+	if parityOf(result) {
+		s = s.setPF()
+	} else {
+		s = s.resetPF()
+	}
+	return s
+}
+
+// update CF, OF, AF, ZF, SF and PF by result = l + r
+// l and r should be masked by the size
+func (s state) updateFlagsAdd(l, r, result, size int) state {
+	return s.updateFlagsAddWithCarry(l, r, 0, result, size)
+}
+
+// update CF, OF, AF, ZF, SF and PF by result = l + r + carry, where carry is 0 or 1
+func (s state) updateFlagsAddWithCarry(l, r, carry, result, size int) state {
+	// carry as unsigned value
+	if l+r+carry > maskOf(size) {
+		s = s.setCF()
+	} else {
+		s = s.resetCF()
+	}
+	if overflowAdd(l, r, result, size) {
+		s = s.setOF()
+	} else {
+		s = s.resetOF()
+	}
+	// carry or borrow out of bit 3
+	if (l^r^result)&0x10 != 0 {
+		s = s.setAF()
+	} else {
+		s = s.resetAF()
+	}
+	return s.updateFlagsSZP(result, size)
+}
+
+// update CF, OF, AF, ZF, SF and PF by result = l - r
+// l and r should be masked by the size
+func (s state) updateFlagsSub(l, r, result, size int) state {
+	return s.updateFlagsSubWithBorrow(l, r, 0, result, size)
+}
+
+// update CF, OF, AF, ZF, SF and PF by result = l - r - borrow, where borrow is 0 or 1
+func (s state) updateFlagsSubWithBorrow(l, r, borrow, result, size int) state {
+	// borrow as unsigned value
+	if l < r+borrow {
+		s = s.setCF()
+	} else {
+		s = s.resetCF()
+	}
+	if overflowSub(l, r, result, size) {
+		s = s.setOF()
+	} else {
+		s = s.resetOF()
+	}
+	// carry or borrow out of bit 3
+	if (l^r^result)&0x10 != 0 {
+		s = s.setAF()
+	} else {
+		s = s.resetAF()
+	}
+	return s.updateFlagsSZP(result, size)
+}
+
 func (s state) readWordGeneralReg(r registerW) (word, error) {
 	switch r {
 	case AX:
@@ -1830,12 +4376,10 @@ func (s state) readWordSreg(r registerS) (word, error) {
 		return s.ss, nil
 	case DS:
 		return s.ds, nil
-		/*
-			case FS:
-				return s.fs, nil
-			case GS:
-				return s.gs, nil
-		*/
+	case FS:
+		return s.fs, nil
+	case GS:
+		return s.gs, nil
 	default:
 		return 0, errors.Errorf("illegal number for registerS:%d", r)
 	}
@@ -1910,639 +4454,1323 @@ func (s state) writeWordSreg(r registerS, w word) (state, error) {
 	case DS:
 		s.ds = w
 		return s, nil
-		/*
-			case FS:
-				return s.fs, nil
-			case GS:
-				return s.gs, nil
-		*/
+	case FS:
+		s.fs = w
+		return s, nil
+	case GS:
+		s.gs = w
+		return s, nil
 	default:
 		return s, errors.Errorf("illegal number for registerS:%d", r)
 	}
 }
 
-func (s state) pushWord(w word, memory *memory) (state, error) {
-	s.sp -= 2
-	err := memory.writeWord(s.addressSP(), w)
+func (s *state) pushWord(w word, memory *memory) error {
+	if s.stack != nil && s.ss == s.stack.ss && s.stack.position(s.sp)-2 < s.stack.bottom {
+		return errors.Errorf("stack overflow at %04x:%04x", s.ss, s.sp)
+	}
+	s.sp -= 2
+	err := memory.writeWord(s.addressSP(), w)
+	if err != nil {
+		return errors.Wrap(err, "failed to push word")
+	}
+	return nil
+}
+
+func (s *state) popWord(memory *memory) (word, error) {
+	if s.stack != nil && s.ss == s.stack.ss && s.stack.position(s.sp)+2 > s.stack.top {
+		return 0, errors.Errorf("stack underflow at %04x:%04x", s.ss, s.sp)
+	}
+	w, err := memory.readWord(s.addressSP())
+	if err != nil {
+		return 0, errors.Wrap(err, "failed in execPop")
+	}
+	s.sp += 2
+	return w, nil
+}
+
+// ------------------------
+// execute instruction
+// ------------------------
+
+func execMov(inst instMov, state *state, memory *memory) error {
+	var v int
+	var err error
+
+	if v, err = inst.src.read(*state, memory); err != nil {
+		return err
+	}
+
+	*state, err = inst.dest.write(v, *state, memory)
+	return err
+}
+
+// Move byte into word zero-extended
+func execMovzx(inst instMovzx, state *state, memory *memory) error {
+	v, err := inst.src.read(*state, memory)
+	if err != nil {
+		return err
+	}
+	*state, err = inst.dest.write(v&0xff, *state, memory)
+	return err
+}
+
+// Move byte into word sign-extended
+func execMovsx(inst instMovsx, state *state, memory *memory) error {
+	v, err := inst.src.read(*state, memory)
+	if err != nil {
+		return err
+	}
+	*state, err = inst.dest.write(int(uint16(int8(v))), *state, memory)
+	return err
+}
+
+func execShl(inst instShl, state *state, memory *memory) error {
+	var l, r int
+	var err error
+
+	if r, err = inst.src.read(*state, memory); err != nil {
+		return err
+	}
+	if l, err = inst.dest.read(*state, memory); err != nil {
+		return err
+	}
+
+	// the count is masked to 5 bits as 186 and later do, and a shift by 0 affects neither the operand nor flags
+	r = int(uint8(r)) & 0x1f
+	if r == 0 {
+		return nil
+	}
+
+	size := inst.dest.size()
+	l = l & maskOf(size)
+	result := (l << uint(r)) & maskOf(size)
+	// CF is the last bit shifted out of the most significant bit
+	if (l>>uint(size*8-r))&1 != 0 {
+		*state = state.setCF()
+	} else {
+		*state = state.resetCF()
+	}
+	// OF is defined only for 1-bit shifts: whether the sign bit has changed
+	if r == 1 {
+		if (l^result)&signBitOf(size) != 0 {
+			*state = state.setOF()
+		} else {
+			*state = state.resetOF()
+		}
+	}
+	*state = state.updateFlagsSZP(result, size)
+
+	*state, err = inst.dest.write(result, *state, memory)
+	return err
+}
+
+func execShr(inst instShr, state *state, memory *memory) error {
+	var l, r int
+	var err error
+
+	if r, err = inst.src.read(*state, memory); err != nil {
+		return err
+	}
+	if l, err = inst.dest.read(*state, memory); err != nil {
+		return err
+	}
+
+	// the count is masked to 5 bits as 186 and later do, and a shift by 0 affects neither the operand nor flags
+	r = int(uint8(r)) & 0x1f
+	if r == 0 {
+		return nil
+	}
+
+	size := inst.dest.size()
+	l = l & maskOf(size)
+	result := l >> uint(r)
+	// CF is the last bit shifted out of the least significant bit
+	if (l>>uint(r-1))&1 != 0 {
+		*state = state.setCF()
+	} else {
+		*state = state.resetCF()
+	}
+	// OF is defined only for 1-bit shifts: the most significant bit of the original operand
+	if r == 1 {
+		if l&signBitOf(size) != 0 {
+			*state = state.setOF()
+		} else {
+			*state = state.resetOF()
+		}
+	}
+	*state = state.updateFlagsSZP(result, size)
+
+	*state, err = inst.dest.write(result, *state, memory)
+	return err
+}
+
+func execSub(inst instSub, state *state, memory *memory) error {
+	var l, r int
+	var err error
+	if r, err = inst.src.read(*state, memory); err != nil {
+		return err
+	}
+	if l, err = inst.dest.read(*state, memory); err != nil {
+		return err
+	}
+
+	size := inst.dest.size()
+	l, r = l&maskOf(size), r&maskOf(size)
+	result := (l - r) & maskOf(size)
+	*state = state.updateFlagsSub(l, r, result, size)
+
+	*state, err = inst.dest.write(result, *state, memory)
+	return err
+}
+
+func execSbb(inst instSbb, state *state, memory *memory) error {
+	var l, r int
+	var err error
+	if r, err = inst.src.read(*state, memory); err != nil {
+		return err
+	}
+	if l, err = inst.dest.read(*state, memory); err != nil {
+		return err
+	}
+
+	borrow := 0
+	if state.isActiveCF() {
+		borrow = 1
+	}
+	size := inst.dest.size()
+	l, r = l&maskOf(size), r&maskOf(size)
+	result := (l - r - borrow) & maskOf(size)
+	*state = state.updateFlagsSubWithBorrow(l, r, borrow, result, size)
+
+	*state, err = inst.dest.write(result, *state, memory)
+	return err
+}
+
+func execLea(inst instLea, state *state, memory *memory) error {
+	var address *address
+	var err error
+	if address, err = inst.src.address(*state); err != nil {
+		return err
+	}
+	*state, err = inst.dest.write(int(address.offset), *state, memory)
+	return err
+}
+
+func execInt(inst instInt, state *state, memory *memory) error {
+	if state.syscallFunc != nil {
+		state.syscallFunc(inst.operand, state.ah(), state.registers())
+	}
+	return raiseInterrupt(inst.operand, state, memory)
+}
+
+// return from interrupt handler by popping IP, CS and FLAGS
+func execIret(inst instIret, state *state, memory *memory) error {
+	ip, err := state.popWord(memory)
+	if err != nil {
+		return errors.Wrap(err, "failed in execIret")
+	}
+	cs, err := state.popWord(memory)
+	if err != nil {
+		return errors.Wrap(err, "failed in execIret")
+	}
+	flags, err := state.popWord(memory)
+	if err != nil {
+		return errors.Wrap(err, "failed in execIret")
+	}
+	state.ip = ip
+	state.cs = cs
+	state.eflags = state.eflags&^0xffff | dword(flags)&EFLAGS_POPF_MASK | EFLAGS_RESERVED
+	return nil
+}
+
+// raise interrupt 4 (overflow) if OF is set
+func execInto(inst instInto, state *state, memory *memory) error {
+	if !state.isActiveOF() {
+		return nil
+	}
+	if err := raiseInterrupt(0x04, state, memory); err != nil {
+		return errors.Wrap(err, "overflow")
+	}
+	return nil
+}
+
+// raise interrupt 5 (bound range exceeded) if index is out of [lower, upper]
+func execBound(inst instBound, state *state, memory *memory) error {
+	v, err := inst.index.read(*state, memory)
+	if err != nil {
+		return err
+	}
+	address, err := inst.bounds.address(*state)
+	if err != nil {
+		return err
+	}
+	// lower bound is followed by upper bound
+	lower, err := memory.readInt16(newAddress(address.seg, address.offset))
+	if err != nil {
+		return err
+	}
+	upper, err := memory.readInt16(newAddress(address.seg, address.offset+2))
+	if err != nil {
+		return err
+	}
+	if index := int16(v); index >= lower && index <= upper {
+		return nil
+	}
+	if err := raiseInterrupt(0x05, state, memory); err != nil {
+		return errors.Wrap(err, "bound range exceeded")
+	}
+	return nil
+}
+
+// Call handler of interrupt n, which is used for exceptions such as divide error as well as INT.
+// When program has installed its handler in interrupt vector table, FLAGS, CS and IP are pushed
+// and CS:IP is set to the handler, which returns by IRET. Otherwise the handler of emulator is called.
+func raiseInterrupt(n uint8, state *state, memory *memory) error {
+	seg, offset, installed, err := memory.programInterruptVector(n)
+	if err != nil {
+		return err
+	}
+	if installed {
+		for _, w := range []word{word(state.eflags), state.cs, state.ip} {
+			if err := state.pushWord(w, memory); err != nil {
+				return errors.Wrapf(err, "failed to call handler of interrupt 0x%02x", n)
+			}
+		}
+		state.cs = seg
+		state.ip = offset
+		state.eflags &= EFLAGS_IF_INV & EFLAGS_TF_INV
+		return nil
+	}
+
+	handler, ok := state.interruptHandlers[n]
+	if !ok {
+		return errors.Errorf("no handler for interrupt 0x%02x", n)
+	}
+	if err := handler(state, memory); err != nil {
+		return errors.Wrap(err, "failed in handler")
+	}
+	return nil
+}
+
+// Run the handler of the emulator for the stub at biosSegment:n, which programs reach by chaining to the original vector.
+// The stub returns as iret does, but keeps status flags set by the handler as DOS does with retf 2.
+func runInterruptStub(n uint8, state *state, memory *memory) error {
+	handler, ok := state.interruptHandlers[n]
+	if !ok {
+		return errors.Errorf("no handler for interrupt 0x%02x", n)
+	}
+	if err := handler(state, memory); err != nil {
+		return errors.Wrap(err, "failed in handler")
+	}
+	if state.shouldExit {
+		return nil
+	}
+	ip, err := state.popWord(memory)
+	if err != nil {
+		return errors.Wrap(err, "failed to return from interrupt stub")
+	}
+	cs, err := state.popWord(memory)
+	if err != nil {
+		return errors.Wrap(err, "failed to return from interrupt stub")
+	}
+	flags, err := state.popWord(memory)
+	if err != nil {
+		return errors.Wrap(err, "failed to return from interrupt stub")
+	}
+	state.ip = ip
+	state.cs = cs
+	status := state.eflags & EFLAGS_STATUS_MASK
+	state.eflags = state.eflags&^0xffff | dword(flags)&EFLAGS_POPF_MASK&^EFLAGS_STATUS_MASK | status | EFLAGS_RESERVED
+	return nil
+}
+
+func execPush(inst instPush, state *state, memory *memory) error {
+	v, err := state.readWordGeneralReg(inst.src)
 	if err != nil {
-		return s, errors.Wrap(err, "failed to push word")
+		return errors.Wrap(err, "failed in execPush")
 	}
-	return s, nil
-}
-
-func (s state) popWord(memory *memory) (word, state, error) {
-	w, err := memory.readWord(s.addressSP())
+	err = state.pushWord(v, memory)
 	if err != nil {
-		return 0, s, errors.Wrap(err, "failed in execPop")
+		return errors.Wrap(err, "failed in execPush")
 	}
-	s.sp += 2
-	return w, s, nil
+	return nil
 }
 
-// ------------------------
-// execute instruction
-// ------------------------
-
-func execMov(inst instMov, state state, memory *memory, segmentOverride *segmentOverride) (state, error) {
-	var v int
-	var err error
-
-	// FIXME
-	initDS := state.ds
-	if segmentOverride != nil {
-		switch segmentOverride.sreg {
-		case ES:
-			state.ds = state.es
-		default:
-			return state, errors.Errorf("not yet implemented or illegal sreg: %#v", segmentOverride.sreg)
-		}
-	}
-
-	if v, err = inst.src.read(state, memory); err != nil {
-		state.ds = initDS
-		return state, err
+func execPushSreg(inst instPushSreg, state *state, memory *memory) error {
+	v, err := state.readWordSreg(inst.src)
+	if err != nil {
+		return errors.Wrap(err, "failed in execPushSreg")
 	}
-
-	state, err = inst.dest.write(v, state, memory)
-	if segmentOverride != nil {
-		state.ds = initDS
+	err = state.pushWord(v, memory)
+	if err != nil {
+		return errors.Wrap(err, "failed in execPushSreg")
 	}
-	return state, err
+	return nil
 }
 
-func execShl(inst instShl, state state, memory *memory) (state, error) {
-	var l, r int
-	var err error
-
-	if r, err = inst.src.read(state, memory); err != nil {
-		return state, err
+func execPop(inst instPop, state *state, memory *memory) error {
+	w, err := state.popWord(memory)
+	if err != nil {
+		return errors.Wrap(err, "failed in execPop")
 	}
-	if l, err = inst.dest.read(state, memory); err != nil {
-		return state, err
+	*state, err = state.writeWordGeneralReg(inst.dest, w)
+	if err != nil {
+		return errors.Wrap(err, "failed in execPop")
 	}
-
-	state, err = inst.dest.write(l<<uint(r), state, memory)
-	return state, err
+	return nil
 }
 
-func execShr(inst instShr, state state, memory *memory) (state, error) {
-	var l, r int
-	var err error
-
-	if r, err = inst.src.read(state, memory); err != nil {
-		return state, err
+func execPopSreg(inst instPopSreg, state *state, memory *memory) error {
+	w, err := state.popWord(memory)
+	if err != nil {
+		return errors.Wrap(err, "failed in execPopSreg")
 	}
-	if l, err = inst.dest.read(state, memory); err != nil {
-		return state, err
+	*state, err = state.writeWordSreg(inst.dest, w)
+	if err != nil {
+		return errors.Wrap(err, "failed in execPopSreg")
 	}
-
-	state, err = inst.dest.write(l>>uint(r), state, memory)
-	return state, err
+	return nil
 }
 
-func execSub(inst instSub, state state, memory *memory) (state, error) {
-	var l, r int
-	var err error
-	if r, err = inst.src.read(state, memory); err != nil {
-		return state, err
-	}
-	if l, err = inst.dest.read(state, memory); err != nil {
-		return state, err
+func execPushf(inst instPushf, state *state, memory *memory) error {
+	err := state.pushWord(word(state.eflags), memory)
+	if err != nil {
+		return errors.Wrap(err, "failed in execPushf")
 	}
-	state, err = inst.dest.write(l-r, state, memory)
-	return state, err
+	return nil
 }
 
-func execLea(inst instLea, state state, memory *memory) (state, error) {
-	var address *address
-	var err error
-	if address, err = inst.src.address(state); err != nil {
-		return state, err
+// reserved bits of flags are kept regardless of the popped value
+func execPopf(inst instPopf, state *state, memory *memory) error {
+	w, err := state.popWord(memory)
+	if err != nil {
+		return errors.Wrap(err, "failed in execPopf")
 	}
-	state, err = inst.dest.write(int(address.offset), state, memory)
-	return state, err
+	state.eflags = state.eflags&^0xffff | dword(w)&EFLAGS_POPF_MASK | EFLAGS_RESERVED
+	return nil
 }
 
-func execInt(inst instInt, state state, memory *memory) (state, error) {
-	switch inst.operand {
-	case 0x21:
-		if handler, ok := state.intHandlers[state.ah()]; ok {
-			err := handler(&state, memory)
-			if err != nil {
-				return state, errors.Wrap(err, "failed in handler")
-			}
-		} else {
-			return state, errors.Errorf("int 21 with unknown value of ax: %04x", state.ax)
-		}
-	default:
-		return state, errors.Errorf("unknown operand: %v", inst.operand)
+func execCall(inst instCall, state *state, memory *memory) error {
+	// IP is the address of the next instruction here
+	err := state.pushWord(state.ip, memory)
+	if err != nil {
+		return errors.Wrap(err, "failed in execCall")
 	}
-	return state, nil
+	state.ip = word(int16(state.ip) + inst.rel)
+	return nil
 }
 
-func execPush(inst instPush, state state, memory *memory) (state, error) {
-	v, err := state.readWordGeneralReg(inst.src)
+// Near call to the offset in r/m16.
+// The target is read before pushing the return address since the operand may depend on SP.
+func execCallAbsoluteIndirectMem16(inst instCallAbsoluteIndirectMem16, state *state, memory *memory) error {
+	v, err := inst.operand.read(*state, memory)
 	if err != nil {
-		return state, errors.Wrap(err, "failed in execPush")
+		return err
 	}
-	state, err = state.pushWord(v, memory)
-	if err != nil {
-		return state, errors.Wrap(err, "failed in execPush")
+	if err := state.pushWord(state.ip, memory); err != nil {
+		return errors.Wrap(err, "failed in execCallAbsoluteIndirectMem16")
 	}
-	return state, nil
+	state.ip = word(v)
+	return nil
 }
 
-func execPushSreg(inst instPushSreg, state state, memory *memory) (state, error) {
-	v, err := state.readWordSreg(inst.src)
+// Read far pointer (segment, offset) from m16:16
+func readFarPointer(operand operandAddressing, state state, memory *memory) (word, word, error) {
+	address, err := operand.address(state)
+	if err != nil {
+		return 0, 0, err
+	}
+	// offset is followed by segment
+	offset, err := memory.readWord(newAddress(address.seg, address.offset))
 	if err != nil {
-		return state, errors.Wrap(err, "failed in execPushSreg")
+		return 0, 0, errors.Wrap(err, "failed to read offset of far pointer")
 	}
-	state, err = state.pushWord(v, memory)
+	seg, err := memory.readWord(newAddress(address.seg, address.offset+2))
 	if err != nil {
-		return state, errors.Wrap(err, "failed in execPushSreg")
+		return 0, 0, errors.Wrap(err, "failed to read segment of far pointer")
 	}
-	return state, nil
+	return seg, offset, nil
 }
 
-func execPop(inst instPop, state state, memory *memory) (state, error) {
-	w, state, err := state.popWord(memory)
+func execCallFarIndirect(inst instCallFarIndirect, state *state, memory *memory) error {
+	seg, offset, err := readFarPointer(inst.operand, *state, memory)
 	if err != nil {
-		return state, errors.Wrap(err, "failed in execPop")
+		return errors.Wrap(err, "failed in execCallFarIndirect")
 	}
-	state, err = state.writeWordGeneralReg(inst.dest, w)
+	if err := state.pushWord(state.cs, memory); err != nil {
+		return errors.Wrap(err, "failed in execCallFarIndirect")
+	}
+	if err := state.pushWord(state.ip, memory); err != nil {
+		return errors.Wrap(err, "failed in execCallFarIndirect")
+	}
+	state.cs = seg
+	state.ip = offset
+	return nil
+}
+
+func execRet(inst instRet, state *state, memory *memory) error {
+	returnAddress, err := state.popWord(memory)
 	if err != nil {
-		return state, errors.Wrap(err, "failed in execPop")
+		return errors.Wrap(err, "failed in execRet")
 	}
-	return state, nil
+	state.ip = returnAddress
+	return nil
 }
 
-func execPopSreg(inst instPopSreg, state state, memory *memory) (state, error) {
-	w, state, err := state.popWord(memory)
+func execRetFar(inst instRetFar, state *state, memory *memory) error {
+	ip, err := state.popWord(memory)
 	if err != nil {
-		return state, errors.Wrap(err, "failed in execPopSreg")
+		return errors.Wrap(err, "failed in execRetFar")
 	}
-	state, err = state.writeWordSreg(inst.dest, w)
+	cs, err := state.popWord(memory)
 	if err != nil {
-		return state, errors.Wrap(err, "failed in execPopSreg")
+		return errors.Wrap(err, "failed in execRetFar")
 	}
-	return state, nil
+	state.ip = ip
+	state.cs = cs
+	// release parameters pushed by the caller
+	state.sp += word(inst.imm16)
+	return nil
 }
 
-func execCall(inst instCall, state state, memory *memory) (state, error) {
-	state, err := state.pushWord(state.ip, memory)
-	if err != nil {
-		return state, errors.Wrap(err, "failed in execCall")
-	}
+func execJmpRel16(inst instJmpRel16, state *state, memory *memory) error {
 	state.ip = word(int16(state.ip) + inst.rel)
-	return state, nil
+	return nil
 }
 
-func execCallAbsoluteIndirectMem16(inst instCallAbsoluteIndirectMem16, state state, memory *memory) (state, error) {
-	var v int
-	state, err := state.pushWord(state.ip, memory)
+func execJmpFarIndirect(inst instJmpFarIndirect, state *state, memory *memory) error {
+	seg, offset, err := readFarPointer(inst.operand, *state, memory)
 	if err != nil {
-		return state, errors.Wrap(err, "failed in execCallAbsoluteIndirectMem16")
+		return errors.Wrap(err, "failed in execJmpFarIndirect")
 	}
-	if v, err = inst.operand.read(state, memory); err != nil {
-		return state, err
-	}
-	state.ip = word(v)
-	return state, nil
+	state.cs = seg
+	state.ip = offset
+	return nil
 }
 
-func execRet(inst instRet, state state, memory *memory) (state, error) {
-	returnAddress, state, err := state.popWord(memory)
+func execJmpIndirect(inst instJmpIndirect, state *state, memory *memory) error {
+	v, err := inst.operand.read(*state, memory)
 	if err != nil {
-		return state, errors.Wrap(err, "failed in execRet")
+		return errors.Wrap(err, "failed in execJmpIndirect")
 	}
-	state.ip = returnAddress
-	return state, nil
+	state.ip = word(v)
+	return nil
 }
 
-func execJmpRel16(inst instJmpRel16, state state, memory *memory) (state, error) {
-	state.ip = word(int16(state.ip) + inst.rel)
-	return state, nil
+func execSti(inst instSti, state *state, memory *memory) error {
+	// do nothing now
+	return nil
 }
 
-func execSti(inst instSti, state state, memory *memory) (state, error) {
-	// do nothing now
-	return state, nil
+func execAnd(inst instAnd, state *state, memory *memory) error {
+	var l, r int
+	var err error
+	if r, err = inst.src.read(*state, memory); err != nil {
+		return err
+	}
+	if l, err = inst.dest.read(*state, memory); err != nil {
+		return err
+	}
+
+	size := inst.dest.size()
+	result := (l & r) & maskOf(size)
+	*state = state.updateFlagsLogical(result, size)
+
+	*state, err = inst.dest.write(result, *state, memory)
+	return err
+}
+
+func execOr(inst instOr, state *state, memory *memory) error {
+	var l, r int
+	var err error
+	if r, err = inst.src.read(*state, memory); err != nil {
+		return err
+	}
+	if l, err = inst.dest.read(*state, memory); err != nil {
+		return err
+	}
+
+	size := inst.dest.size()
+	result := (l | r) & maskOf(size)
+	*state = state.updateFlagsLogical(result, size)
+
+	*state, err = inst.dest.write(result, *state, memory)
+	return err
 }
 
-func execAnd(inst instAnd, state state, memory *memory) (state, error) {
+// same as AND except that the result is not written
+func execTest(inst instTest, state *state, memory *memory) error {
 	var l, r int
 	var err error
-	if r, err = inst.src.read(state, memory); err != nil {
-		return state, err
+	if r, err = inst.src.read(*state, memory); err != nil {
+		return err
 	}
-	if l, err = inst.dest.read(state, memory); err != nil {
-		return state, err
+	if l, err = inst.dest.read(*state, memory); err != nil {
+		return err
 	}
-	state, err = inst.dest.write(l&r, state, memory)
-	return state, err
+
+	size := inst.dest.size()
+	result := (l & r) & maskOf(size)
+	*state = state.updateFlagsLogical(result, size)
+	return nil
 }
 
-func execAdd(inst instAdd, state state, memory *memory) (state, error) {
+func execAdd(inst instAdd, state *state, memory *memory) error {
 	var l, r int
 	var err error
 
-	if r, err = inst.src.read(state, memory); err != nil {
-		return state, err
+	if r, err = inst.src.read(*state, memory); err != nil {
+		return err
 	}
-	if l, err = inst.dest.read(state, memory); err != nil {
-		return state, err
+	if l, err = inst.dest.read(*state, memory); err != nil {
+		return err
 	}
 
-	state, err = inst.dest.write(l+r, state, memory)
-	return state, err
+	size := inst.dest.size()
+	l, r = l&maskOf(size), r&maskOf(size)
+	result := (l + r) & maskOf(size)
+	*state = state.updateFlagsAdd(l, r, result, size)
+
+	*state, err = inst.dest.write(result, *state, memory)
+	return err
 }
 
-func execCmp(inst instCmp, state state, memory *memory, segmentOverride *segmentOverride) (state, error) {
+func execAdc(inst instAdc, state *state, memory *memory) error {
 	var l, r int
 	var err error
 
-	// FIXME
-	initDS := state.ds
-	if segmentOverride != nil {
-		switch segmentOverride.sreg {
-		case ES:
-			state.ds = state.es
-		default:
-			return state, errors.Errorf("not yet implemented or illegal sreg: %#v", segmentOverride.sreg)
-		}
+	if r, err = inst.src.read(*state, memory); err != nil {
+		return err
+	}
+	if l, err = inst.dest.read(*state, memory); err != nil {
+		return err
 	}
 
-	if r, err = inst.src.read(state, memory); err != nil {
-		state.ds = initDS
-		return state, err
+	carry := 0
+	if state.isActiveCF() {
+		carry = 1
 	}
-	if l, err = inst.dest.read(state, memory); err != nil {
-		state.ds = initDS
-		return state, err
+	size := inst.dest.size()
+	l, r = l&maskOf(size), r&maskOf(size)
+	result := (l + r + carry) & maskOf(size)
+	*state = state.updateFlagsAddWithCarry(l, r, carry, result, size)
+
+	*state, err = inst.dest.write(result, *state, memory)
+	return err
+}
+
+func execCmp(inst instCmp, state *state, memory *memory) error {
+	var l, r int
+	var err error
+
+	if r, err = inst.src.read(*state, memory); err != nil {
+		return err
 	}
-	if l == r {
-		state = state.setZF()
-		state = state.resetCF()
-	} else if l < r {
-		state = state.resetZF()
-		state = state.setCF()
-	} else {
-		state = state.resetZF()
-		state = state.resetCF()
+	if l, err = inst.dest.read(*state, memory); err != nil {
+		return err
 	}
 
-	if segmentOverride != nil {
-		state.ds = initDS
+	// compare as subtraction at the width of operands
+	// so that both unsigned (CF) and signed (SF, OF) conditions are available
+	size := inst.dest.size()
+	l, r = l&maskOf(size), r&maskOf(size)
+	*state = state.updateFlagsSub(l, r, (l-r)&maskOf(size), size)
+	return nil
+}
+
+// CX is decremented with 16-bit wraparound, so loop starting with CX 0 iterates 65536 times
+func execLoop(inst instLoop, state *state) error {
+	state.cx--
+	if state.cx != 0 {
+		state.ip = word(int16(state.ip) + int16(inst.rel8))
 	}
-	return state, err
+	return nil
 }
 
-func execJneRel8(inst instJneRel8, state state) (state, error) {
-	if state.isNotActiveZF() {
+func execJneRel8(inst instJneRel8, state *state) error {
+	if state.satisfies(condNE) {
 		state.ip = word(int16(state.ip) + int16(inst.rel8))
 	}
-	return state, nil
+	return nil
 }
 
-func execJb(inst instJb, state state) (state, error) {
-	if state.isActiveCF() {
+func execJb(inst instJb, state *state) error {
+	if state.satisfies(condB) {
 		state.ip = word(int16(state.ip) + int16(inst.rel8))
 	}
-	return state, nil
+	return nil
 }
 
-func execCld(inst instCld, state state) (state, error) {
-	state = state.resetDF()
-	return state, nil
+func execCld(inst instCld, state *state) error {
+	*state = state.resetDF()
+	return nil
 }
 
-func execScasb(state state, memory *memory) (state, error) {
+func execScasb(state *state, memory *memory) error {
 	vAL, err := state.readByteGeneralReg(AL)
 	if err != nil {
-		return state, errors.Wrap(err, "failed in execScasb")
+		return errors.Wrap(err, "failed in execScasb")
 	}
 	vSeg, err := state.readWordSreg(ES) // use ES for DI in string instructions
 	if err != nil {
-		return state, errors.Wrap(err, "failed in execScasb")
+		return errors.Wrap(err, "failed in execScasb")
 	}
 	vDI, err := state.readWordGeneralReg(DI)
 	if err != nil {
-		return state, errors.Wrap(err, "failed in execScasb")
+		return errors.Wrap(err, "failed in execScasb")
 	}
 	address := newAddressFromWord(vSeg, vDI)
 	vMem, err := memory.readByte(address)
 	if err != nil {
-		return state, errors.Wrap(err, "failed in execScasb")
+		return errors.Wrap(err, "failed in execScasb")
 	}
 	if vAL == vMem {
-		state = state.setZF()
+		*state = state.setZF()
 	} else {
-		state = state.resetZF()
+		*state = state.resetZF()
 	}
 	if state.isNotActiveDF() {
-		state, err = state.writeWordGeneralReg(DI, vDI+1)
+		*state, err = state.writeWordGeneralReg(DI, vDI+1)
 		if err != nil {
-			return state, errors.Wrap(err, "failed in execScasb")
+			return errors.Wrap(err, "failed in execScasb")
 		}
 	} else {
-		state, err = state.writeWordGeneralReg(DI, vDI-1)
+		*state, err = state.writeWordGeneralReg(DI, vDI-1)
 		if err != nil {
-			return state, errors.Wrap(err, "failed in execScasb")
+			return errors.Wrap(err, "failed in execScasb")
 		}
 	}
-	return state, nil
+	return nil
 }
 
-func execScasw(state state, memory *memory) (state, error) {
+func execScasw(state *state, memory *memory) error {
 	vAX, err := state.readWordGeneralReg(AX)
 	if err != nil {
-		return state, errors.Wrap(err, "failed in execScasb")
+		return errors.Wrap(err, "failed in execScasb")
 	}
 	vSeg, err := state.readWordSreg(ES) // use ES for DI in string instructions
 	if err != nil {
-		return state, errors.Wrap(err, "failed in execScasb")
+		return errors.Wrap(err, "failed in execScasb")
 	}
 	vDI, err := state.readWordGeneralReg(DI)
 	if err != nil {
-		return state, errors.Wrap(err, "failed in execScasb")
+		return errors.Wrap(err, "failed in execScasb")
 	}
 	address := newAddressFromWord(vSeg, vDI)
 	vMem, err := memory.readWord(address)
 	if err != nil {
-		return state, errors.Wrap(err, "failed in execScasb")
+		return errors.Wrap(err, "failed in execScasb")
 	}
 	if vAX == vMem {
-		state = state.setZF()
+		*state = state.setZF()
 	} else {
-		state = state.resetZF()
+		*state = state.resetZF()
 	}
 	if state.isNotActiveDF() {
-		state, err = state.writeWordGeneralReg(DI, vDI+2)
+		*state, err = state.writeWordGeneralReg(DI, vDI+2)
 		if err != nil {
-			return state, errors.Wrap(err, "failed in execScasb")
+			return errors.Wrap(err, "failed in execScasb")
 		}
 	} else {
-		state, err = state.writeWordGeneralReg(DI, vDI-2)
+		*state, err = state.writeWordGeneralReg(DI, vDI-2)
 		if err != nil {
-			return state, errors.Wrap(err, "failed in execScasb")
+			return errors.Wrap(err, "failed in execScasb")
 		}
 	}
-	return state, nil
+	return nil
 }
 
-func execMovsb(state state, memory *memory) (state, error) {
-	vDS, err := state.readWordSreg(DS) // use DS for SI in string instructions
+func execMovsb(state *state, memory *memory) error {
+	vDS, err := state.segmentFor(DS) // use DS for SI in string instructions unless overridden
 	if err != nil {
-		return state, errors.Wrap(err, "failed in execScasb")
+		return errors.Wrap(err, "failed in execScasb")
 	}
 	vES, err := state.readWordSreg(ES) // use ES for DI in string instructions
 	if err != nil {
-		return state, errors.Wrap(err, "failed in execScasb")
+		return errors.Wrap(err, "failed in execScasb")
 	}
 	vSI, err := state.readWordGeneralReg(SI)
 	if err != nil {
-		return state, errors.Wrap(err, "failed in execScasb")
+		return errors.Wrap(err, "failed in execScasb")
 	}
 	vDI, err := state.readWordGeneralReg(DI)
 	if err != nil {
-		return state, errors.Wrap(err, "failed in execScasb")
+		return errors.Wrap(err, "failed in execScasb")
 	}
 	vMem, err := memory.readByte(newAddressFromWord(vDS, vSI))
 	if err != nil {
-		return state, errors.Wrap(err, "failed in execScasb")
+		return errors.Wrap(err, "failed in execScasb")
 	}
 	err = memory.writeByte(newAddressFromWord(vES, vDI), vMem)
 	if err != nil {
-		return state, errors.Wrap(err, "failed in execScasb")
+		return errors.Wrap(err, "failed in execScasb")
 	}
 	if state.isNotActiveDF() {
-		state, err = state.writeWordGeneralReg(SI, vSI+1)
+		*state, err = state.writeWordGeneralReg(SI, vSI+1)
 		if err != nil {
-			return state, errors.Wrap(err, "failed in execScasb")
+			return errors.Wrap(err, "failed in execScasb")
 		}
-		state, err = state.writeWordGeneralReg(DI, vDI+1)
+		*state, err = state.writeWordGeneralReg(DI, vDI+1)
 		if err != nil {
-			return state, errors.Wrap(err, "failed in execScasb")
+			return errors.Wrap(err, "failed in execScasb")
 		}
 	} else {
-		state, err = state.writeWordGeneralReg(SI, vSI-1)
+		*state, err = state.writeWordGeneralReg(SI, vSI-1)
 		if err != nil {
-			return state, errors.Wrap(err, "failed in execScasb")
+			return errors.Wrap(err, "failed in execScasb")
 		}
-		state, err = state.writeWordGeneralReg(DI, vDI-1)
+		*state, err = state.writeWordGeneralReg(DI, vDI-1)
 		if err != nil {
-			return state, errors.Wrap(err, "failed in execScasb")
+			return errors.Wrap(err, "failed in execScasb")
 		}
 	}
-	return state, nil
+	return nil
+}
+
+func execLodsb(state *state, memory *memory) error {
+	vDS, err := state.segmentFor(DS) // use DS for SI in string instructions unless overridden
+	if err != nil {
+		return errors.Wrap(err, "failed in execLodsb")
+	}
+	vSI, err := state.readWordGeneralReg(SI)
+	if err != nil {
+		return errors.Wrap(err, "failed in execLodsb")
+	}
+	vMem, err := memory.readByte(newAddressFromWord(vDS, vSI))
+	if err != nil {
+		return errors.Wrap(err, "failed in execLodsb")
+	}
+	*state, err = state.writeByteGeneralReg(AL, vMem)
+	if err != nil {
+		return errors.Wrap(err, "failed in execLodsb")
+	}
+	if state.isNotActiveDF() {
+		*state, err = state.writeWordGeneralReg(SI, vSI+1)
+	} else {
+		*state, err = state.writeWordGeneralReg(SI, vSI-1)
+	}
+	if err != nil {
+		return errors.Wrap(err, "failed in execLodsb")
+	}
+	return nil
 }
 
-func execStosb(state state, memory *memory) (state, error) {
+func execStosb(state *state, memory *memory) error {
 	vES, err := state.readWordSreg(ES)
 	if err != nil {
-		return state, errors.Wrap(err, "failed in execStosb")
+		return errors.Wrap(err, "failed in execStosb")
 	}
 	vDI, err := state.readWordGeneralReg(DI)
 	if err != nil {
-		return state, errors.Wrap(err, "failed in execStosb")
+		return errors.Wrap(err, "failed in execStosb")
 	}
 	vAL, err := state.readByteGeneralReg(AL)
 	if err != nil {
-		return state, errors.Wrap(err, "failed in execStosb")
+		return errors.Wrap(err, "failed in execStosb")
 	}
 	err = memory.writeByte(newAddressFromWord(vES, vDI), vAL)
 	if err != nil {
-		return state, errors.Wrap(err, "failed in execStosb")
+		return errors.Wrap(err, "failed in execStosb")
 	}
 	if state.isNotActiveDF() {
-		state, err = state.writeWordGeneralReg(DI, vDI+1)
+		*state, err = state.writeWordGeneralReg(DI, vDI+1)
+		if err != nil {
+			return errors.Wrap(err, "failed in execStosb")
+		}
+	} else {
+		*state, err = state.writeWordGeneralReg(DI, vDI-1)
+		if err != nil {
+			return errors.Wrap(err, "failed in execStosb")
+		}
+	}
+	return nil
+}
+
+// ref. https://www.csc.depauw.edu/~bhoward/asmtut/asmtut7.html
+// ref. http://hp.vector.co.jp/authors/VA014520/asmhsp/chap6.html
+func execRepeScasb(inst instRepeScasb, state *state, memory *memory) error {
+	count, err := state.readWordGeneralReg(CX)
+	if err != nil {
+		return errors.Wrap(err, "failed in execRepeScasb")
+	}
+	for count > 0 && state.isActiveZF() {
+		err = execScasb(state, memory)
+		if err != nil {
+			return errors.Wrap(err, "failed in execRepeScasb")
+		}
+		count--
+	}
+	*state, err = state.writeWordGeneralReg(CX, count)
+	if err != nil {
+		return errors.Wrap(err, "failed in execRepeScasb")
+	}
+	return nil
+}
+
+func execRepeScasw(inst instRepeScasw, state *state, memory *memory) error {
+	count, err := state.readWordGeneralReg(CX)
+	if err != nil {
+		return errors.Wrap(err, "failed in execRepeScasw")
+	}
+	for count > 0 && state.isActiveZF() {
+		err = execScasw(state, memory)
+		if err != nil {
+			return errors.Wrap(err, "failed in execRepeScasw")
+		}
+		count--
+	}
+	*state, err = state.writeWordGeneralReg(CX, count)
+	if err != nil {
+		return errors.Wrap(err, "failed in execRepeScasw")
+	}
+	return nil
+}
+
+func execRepMovsb(inst instRepMovsb, state *state, memory *memory) error {
+	count, err := state.readWordGeneralReg(CX)
+	if err != nil {
+		return errors.Wrap(err, "failed in execRepeScasb")
+	}
+	for count > 0 {
+		err = execMovsb(state, memory)
+		if err != nil {
+			return errors.Wrap(err, "failed in execRepeScasb")
+		}
+		count--
+	}
+	*state, err = state.writeWordGeneralReg(CX, count)
+	if err != nil {
+		return errors.Wrap(err, "failed in execRepeScasb")
+	}
+	return nil
+}
+
+func execRepStosb(inst instRepStosb, state *state, memory *memory) error {
+	count, err := state.readWordGeneralReg(CX)
+	if err != nil {
+		return errors.Wrap(err, "failed in execRepeScasb")
+	}
+	for count > 0 {
+		err = execStosb(state, memory)
 		if err != nil {
-			return state, errors.Wrap(err, "failed in execStosb")
+			return errors.Wrap(err, "failed in execRepeScasb")
+		}
+		count--
+	}
+	*state, err = state.writeWordGeneralReg(CX, count)
+	if err != nil {
+		return errors.Wrap(err, "failed in execRepeScasb")
+	}
+	return nil
+}
+
+// REP repeats lodsb CX times though only the last byte remains in AL,
+// and it has no effect on instructions other than string ones.
+func execRep(inst instRep, state *state, memory *memory) error {
+	if _, ok := inst.inst.(instLodsb); !ok {
+		debug.printf("rep prefix is ignored for %v\n", inst.inst)
+		return executeInst(inst.inst, state, memory)
+	}
+	for state.cx > 0 {
+		if err := executeInst(inst.inst, state, memory); err != nil {
+			return errors.Wrap(err, "failed in execRep")
+		}
+		state.cx--
+	}
+	return nil
+}
+
+func execJeRel8(inst instJeRel8, state *state) error {
+	if state.satisfies(condE) {
+		state.ip = word(int16(state.ip) + int16(inst.rel8))
+	}
+	return nil
+}
+
+func execInc(inst instInc, state *state) error {
+	v, err := state.readWordGeneralReg(inst.dest)
+	if err != nil {
+		return errors.Wrap(err, "failed in execInc")
+	}
+	result := v + 1
+	*state, err = state.writeWordGeneralReg(inst.dest, result)
+	if err != nil {
+		return errors.Wrap(err, "failed in execInc")
+	}
+
+	// INC does not affect CF
+	cf := state.isActiveCF()
+	*state = state.updateFlagsAdd(int(v), 1, int(result), 2)
+	if cf {
+		*state = state.setCF()
+	} else {
+		*state = state.resetCF()
+	}
+	return nil
+}
+
+func execDec(inst instDec, state *state) error {
+	v, err := state.readWordGeneralReg(inst.dest)
+	if err != nil {
+		return errors.Wrap(err, "failed in execDec")
+	}
+	result := v - 1
+	*state, err = state.writeWordGeneralReg(inst.dest, result)
+	if err != nil {
+		return errors.Wrap(err, "failed in execDec")
+	}
+
+	// DEC does not affect CF
+	cf := state.isActiveCF()
+	*state = state.updateFlagsSub(int(v), 1, int(result), 2)
+	if cf {
+		*state = state.setCF()
+	} else {
+		*state = state.resetCF()
+	}
+	return nil
+}
+
+func execXor(inst instXor, state *state, memory *memory) error {
+	var l, r int
+	var err error
+
+	if r, err = inst.src.read(*state, memory); err != nil {
+		return err
+	}
+	if l, err = inst.dest.read(*state, memory); err != nil {
+		return err
+	}
+
+	size := inst.dest.size()
+	result := (l ^ r) & maskOf(size)
+	*state = state.updateFlagsLogical(result, size)
+
+	*state, err = inst.dest.write(result, *state, memory)
+	return err
+}
+
+// Swap dest and src without changing flags
+func execXchg(inst instXchg, state *state, memory *memory) error {
+	var l, r int
+	var err error
+
+	if r, err = inst.src.read(*state, memory); err != nil {
+		return err
+	}
+	if l, err = inst.dest.read(*state, memory); err != nil {
+		return err
+	}
+
+	if *state, err = inst.dest.write(r, *state, memory); err != nil {
+		return err
+	}
+	*state, err = inst.src.write(l, *state, memory)
+	return err
+}
+
+// Divide AX by r/m8 into AL (quotient) and AH (remainder), or DX:AX by r/m16 into AX and DX.
+// Division by zero or too large quotient raises int 0.
+func execDiv(inst instDiv, state *state, memory *memory) error {
+	v, err := inst.src.read(*state, memory)
+	if err != nil {
+		return errors.Wrap(err, "failed in execDiv")
+	}
+	size := inst.src.size()
+	divisor := uint32(v & maskOf(size))
+	if size == 1 {
+		dividend := uint32(state.ax)
+		if divisor == 0 || dividend/divisor > 0xff {
+			return divideError(state, memory)
 		}
+		state.ax = word(dividend%divisor)<<8 | word(dividend/divisor)
 	} else {
-		state, err = state.writeWordGeneralReg(DI, vDI-1)
-		if err != nil {
-			return state, errors.Wrap(err, "failed in execStosb")
+		dividend := uint32(state.dx)<<16 | uint32(state.ax)
+		if divisor == 0 || dividend/divisor > 0xffff {
+			return divideError(state, memory)
 		}
+		state.ax = word(dividend / divisor)
+		state.dx = word(dividend % divisor)
 	}
-	return state, nil
+	return nil
 }
 
-// ref. https://www.csc.depauw.edu/~bhoward/asmtut/asmtut7.html
-// ref. http://hp.vector.co.jp/authors/VA014520/asmhsp/chap6.html
-func execRepeScasb(inst instRepeScasb, state state, memory *memory) (state, error) {
-	count, err := state.readWordGeneralReg(CX)
+// Signed version of execDiv, where quotient is truncated toward zero
+func execIdiv(inst instIdiv, state *state, memory *memory) error {
+	v, err := inst.src.read(*state, memory)
 	if err != nil {
-		return state, errors.Wrap(err, "failed in execRepeScasb")
+		return errors.Wrap(err, "failed in execIdiv")
 	}
-	for count > 0 && state.isActiveZF() {
-		state, err = execScasb(state, memory)
-		if err != nil {
-			return state, errors.Wrap(err, "failed in execRepeScasb")
+	if inst.src.size() == 1 {
+		divisor := int32(int8(v))
+		dividend := int32(int16(state.ax))
+		if divisor == 0 || dividend/divisor > math.MaxInt8 || dividend/divisor < math.MinInt8 {
+			return divideError(state, memory)
 		}
-		count--
-	}
-	state, err = state.writeWordGeneralReg(CX, count)
-	if err != nil {
-		return state, errors.Wrap(err, "failed in execRepeScasb")
+		state.ax = word(uint8(dividend%divisor))<<8 | word(uint8(dividend/divisor))
+	} else {
+		divisor := int64(int16(v))
+		dividend := int64(int32(uint32(state.dx)<<16 | uint32(state.ax)))
+		if divisor == 0 || dividend/divisor > math.MaxInt16 || dividend/divisor < math.MinInt16 {
+			return divideError(state, memory)
+		}
+		state.ax = word(uint16(dividend / divisor))
+		state.dx = word(uint16(dividend % divisor))
 	}
-	return state, nil
+	return nil
 }
 
-func execRepeScasw(inst instRepeScasw, state state, memory *memory) (state, error) {
-	count, err := state.readWordGeneralReg(CX)
+func divideError(state *state, memory *memory) error {
+	err := raiseInterrupt(0x00, state, memory)
 	if err != nil {
-		return state, errors.Wrap(err, "failed in execRepeScasw")
+		return errors.Wrap(err, "divide error")
 	}
-	for count > 0 && state.isActiveZF() {
-		state, err = execScasw(state, memory)
-		if err != nil {
-			return state, errors.Wrap(err, "failed in execRepeScasw")
-		}
-		count--
-	}
-	state, err = state.writeWordGeneralReg(CX, count)
+	return nil
+}
+
+func execNeg(inst instNeg, state *state, memory *memory) error {
+	v, err := inst.dest.read(*state, memory)
 	if err != nil {
-		return state, errors.Wrap(err, "failed in execRepeScasw")
+		return err
 	}
-	return state, nil
+
+	size := inst.dest.size()
+	v = v & maskOf(size)
+	result := (0 - v) & maskOf(size)
+	// flags are the same as 0 - v, so CF is set unless the operand is 0
+	*state = state.updateFlagsSub(0, v, result, size)
+
+	*state, err = inst.dest.write(result, *state, memory)
+	return err
 }
 
-func execRepMovsb(inst instRepMovsb, state state, memory *memory) (state, error) {
-	count, err := state.readWordGeneralReg(CX)
-	if err != nil {
-		return state, errors.Wrap(err, "failed in execRepeScasb")
+func execJae(inst instJae, state *state) error {
+	if state.satisfies(condAE) {
+		state.ip = word(int16(state.ip) + int16(inst.rel8))
 	}
-	for count > 0 {
-		state, err = execMovsb(state, memory)
-		if err != nil {
-			return state, errors.Wrap(err, "failed in execRepeScasb")
+	return nil
+}
+
+// --- BCD adjustment
+
+// Adjust AL after addition of packed BCD
+func execDaa(inst instDaa, state *state) error {
+	al := int(state.al())
+	oldAL, oldCF := al, state.isActiveCF()
+	*state = state.resetCF()
+	if al&0x0f > 9 || state.isActiveAF() {
+		al += 0x06
+		if oldCF || al > 0xff {
+			*state = state.setCF()
 		}
-		count--
+		*state = state.setAF()
+	} else {
+		*state = state.resetAF()
 	}
-	state, err = state.writeWordGeneralReg(CX, count)
-	if err != nil {
-		return state, errors.Wrap(err, "failed in execRepeScasb")
+	if oldAL > 0x99 || oldCF {
+		al += 0x60
+		*state = state.setCF()
+	} else {
+		*state = state.resetCF()
 	}
-	return state, nil
+	al &= 0xff
+	state.ax = (state.ax & 0xff00) | word(al)
+	*state = state.updateFlagsSZP(al, 1)
+	return nil
 }
 
-func execRepStosb(inst instRepStosb, state state, memory *memory) (state, error) {
-	count, err := state.readWordGeneralReg(CX)
-	if err != nil {
-		return state, errors.Wrap(err, "failed in execRepeScasb")
-	}
-	for count > 0 {
-		state, err = execStosb(state, memory)
-		if err != nil {
-			return state, errors.Wrap(err, "failed in execRepeScasb")
+// Adjust AL after subtraction of packed BCD
+func execDas(inst instDas, state *state) error {
+	al := int(state.al())
+	oldAL, oldCF := al, state.isActiveCF()
+	*state = state.resetCF()
+	if al&0x0f > 9 || state.isActiveAF() {
+		if oldCF || al < 0x06 {
+			*state = state.setCF()
 		}
-		count--
+		al -= 0x06
+		*state = state.setAF()
+	} else {
+		*state = state.resetAF()
 	}
-	state, err = state.writeWordGeneralReg(CX, count)
-	if err != nil {
-		return state, errors.Wrap(err, "failed in execRepeScasb")
+	if oldAL > 0x99 || oldCF {
+		al -= 0x60
+		*state = state.setCF()
 	}
-	return state, nil
+	al &= 0xff
+	state.ax = (state.ax & 0xff00) | word(al)
+	*state = state.updateFlagsSZP(al, 1)
+	return nil
 }
 
-func execJeRel8(inst instJeRel8, state state) (state, error) {
-	if state.isActiveZF() {
-		state.ip = word(int16(state.ip) + int16(inst.rel8))
+// Adjust AX after addition of unpacked BCD
+func execAaa(inst instAaa, state *state) error {
+	if state.al()&0x0f > 9 || state.isActiveAF() {
+		state.ax += 0x0106
+		*state = state.setAF().setCF()
+	} else {
+		*state = state.resetAF().resetCF()
 	}
-	return state, nil
+	state.ax &= 0xff0f
+	return nil
 }
 
-func execInc(inst instInc, state state) (state, error) {
-	v, err := state.readWordGeneralReg(inst.dest)
-	if err != nil {
-		return state, errors.Wrap(err, "failed in execInc")
-	}
-	state, err = state.writeWordGeneralReg(inst.dest, v+1)
-	// TODO: Set ZF (so it is necessary to handle overflow...)
-	if err != nil {
-		return state, errors.Wrap(err, "failed in execInc")
+// Adjust AX after subtraction of unpacked BCD
+func execAas(inst instAas, state *state) error {
+	if state.al()&0x0f > 9 || state.isActiveAF() {
+		al := state.al() - 0x06
+		ah := state.ah() - 1
+		state.ax = word(ah)<<8 | word(al)
+		*state = state.setAF().setCF()
+	} else {
+		*state = state.resetAF().resetCF()
 	}
-	return state, nil
+	state.ax &= 0xff0f
+	return nil
 }
 
-func execDec(inst instDec, state state) (state, error) {
-	v, err := state.readWordGeneralReg(inst.dest)
-	if err != nil {
-		return state, errors.Wrap(err, "failed in execInc")
+// Split AL into digits of base, AH for the quotient and AL for the remainder
+func execAam(inst instAam, state *state, memory *memory) error {
+	if inst.base == 0 {
+		return divideError(state, memory)
 	}
-	state, err = state.writeWordGeneralReg(inst.dest, v-1)
-	// TODO: Set ZF (so it is necessary to handle overflow...)
-	if err != nil {
-		return state, errors.Wrap(err, "failed in execInc")
-	}
-	return state, nil
+	al := state.al()
+	state.ax = word(al/inst.base)<<8 | word(al%inst.base)
+	*state = state.updateFlagsSZP(int(state.al()), 1)
+	return nil
 }
 
-func execXor(inst instXor, state state, memory *memory) (state, error) {
-	var l, r int
-	var err error
+// Combine digits of base in AH and AL into AL
+func execAad(inst instAad, state *state) error {
+	al := (int(state.al()) + int(state.ah())*int(inst.base)) & 0xff
+	state.ax = word(al)
+	*state = state.updateFlagsSZP(al, 1)
+	return nil
+}
 
-	if r, err = inst.src.read(state, memory); err != nil {
-		return state, err
-	}
-	if l, err = inst.dest.read(state, memory); err != nil {
-		return state, err
+func execJccRel16(inst instJccRel16, state *state) error {
+	if state.satisfies(inst.cond) {
+		state.ip = word(int16(state.ip) + inst.rel)
 	}
-
-	state, err = inst.dest.write(l^r, state, memory)
-	return state, err
+	return nil
 }
 
-func execJae(inst instJae, state state) (state, error) {
-	if state.isNotActiveCF() {
-		state.ip = word(int16(state.ip) + int16(inst.rel8))
+// Set r/m8 to 1 if condition is satisfied, otherwise 0
+func execSetcc(inst instSetcc, state *state, memory *memory) error {
+	v := 0
+	if state.satisfies(inst.cond) {
+		v = 1
 	}
-	return state, nil
+	var err error
+	*state, err = inst.dest.write(v, *state, memory)
+	return err
 }
 
-func execute(shouldBeInst interface{}, state state, memory *memory, segmentOverride *segmentOverride) (state, error) {
+// IP already points past the current instruction when executing it,
+// so it is the return address of call and the base of relative jumps.
+func execute(shouldBeInst interface{}, state *state, memory *memory, segmentOverride *segmentOverride) error {
+	// segment override prefix affects memory operands only during this instruction
+	state.segmentOverride = segmentOverride
+	err := executeInst(shouldBeInst, state, memory)
+	state.segmentOverride = nil
+	return err
+}
+
+func executeInst(shouldBeInst interface{}, state *state, memory *memory) error {
 	switch inst := shouldBeInst.(type) {
+	case instAaa:
+		return execAaa(inst, state)
+	case instAad:
+		return execAad(inst, state)
+	case instAam:
+		return execAam(inst, state, memory)
+	case instAas:
+		return execAas(inst, state)
+	case instAdc:
+		return execAdc(inst, state, memory)
 	case instAdd:
 		return execAdd(inst, state, memory)
 	case instAnd:
 		return execAnd(inst, state, memory)
+	case instBound:
+		return execBound(inst, state, memory)
 	case instCall:
 		return execCall(inst, state, memory)
 	case instCallAbsoluteIndirectMem16:
 		return execCallAbsoluteIndirectMem16(inst, state, memory)
+	case instCallFarIndirect:
+		return execCallFarIndirect(inst, state, memory)
 	case instCld:
 		return execCld(inst, state)
 	case instCmp:
-		return execCmp(inst, state, memory, segmentOverride)
+		return execCmp(inst, state, memory)
+	case instDaa:
+		return execDaa(inst, state)
+	case instDas:
+		return execDas(inst, state)
 	case instDec:
 		return execDec(inst, state)
+	case instDiv:
+		return execDiv(inst, state, memory)
+	case instIdiv:
+		return execIdiv(inst, state, memory)
 	case instInc:
 		return execInc(inst, state)
 	case instInt:
 		return execInt(inst, state, memory)
+	case instInto:
+		return execInto(inst, state, memory)
+	case instIret:
+		return execIret(inst, state, memory)
 	case instJae:
 		return execJae(inst, state)
 	case instJb:
 		return execJb(inst, state)
+	case instJccRel16:
+		return execJccRel16(inst, state)
 	case instJeRel8:
 		return execJeRel8(inst, state)
+	case instJmpFarIndirect:
+		return execJmpFarIndirect(inst, state, memory)
+	case instJmpIndirect:
+		return execJmpIndirect(inst, state, memory)
 	case instJmpRel16:
 		return execJmpRel16(inst, state, memory)
 	case instJneRel8:
 		return execJneRel8(inst, state)
 	case instLea:
 		return execLea(inst, state, memory)
+	case instLodsb:
+		return execLodsb(state, memory)
+	case instLoop:
+		return execLoop(inst, state)
 	case instMov:
-		return execMov(inst, state, memory, segmentOverride)
+		return execMov(inst, state, memory)
+	case instMovsb:
+		return execMovsb(state, memory)
+	case instMovsx:
+		return execMovsx(inst, state, memory)
+	case instMovzx:
+		return execMovzx(inst, state, memory)
+	case instNeg:
+		return execNeg(inst, state, memory)
+	case instOr:
+		return execOr(inst, state, memory)
 	case instPop:
 		return execPop(inst, state, memory)
 	case instPopSreg:
 		return execPopSreg(inst, state, memory)
+	case instPopf:
+		return execPopf(inst, state, memory)
 	case instPush:
 		return execPush(inst, state, memory)
 	case instPushSreg:
 		return execPushSreg(inst, state, memory)
+	case instPushf:
+		return execPushf(inst, state, memory)
+	case instRep:
+		return execRep(inst, state, memory)
 	case instRepeScasb:
 		return execRepeScasb(inst, state, memory)
 	case instRepeScasw:
@@ -2553,6 +5781,16 @@ func execute(shouldBeInst interface{}, state state, memory *memory, segmentOverr
 		return execRepStosb(inst, state, memory)
 	case instRet:
 		return execRet(inst, state, memory)
+	case instRetFar:
+		return execRetFar(inst, state, memory)
+	case instSbb:
+		return execSbb(inst, state, memory)
+	case instScasb:
+		return execScasb(state, memory)
+	case instScasw:
+		return execScasw(state, memory)
+	case instSetcc:
+		return execSetcc(inst, state, memory)
 	case instShl:
 		return execShl(inst, state, memory)
 	case instShr:
@@ -2563,10 +5801,14 @@ func execute(shouldBeInst interface{}, state state, memory *memory, segmentOverr
 		return execStosb(state, memory)
 	case instSub:
 		return execSub(inst, state, memory)
+	case instTest:
+		return execTest(inst, state, memory)
+	case instXchg:
+		return execXchg(inst, state, memory)
 	case instXor:
 		return execXor(inst, state, memory)
 	default:
-		return state, errors.Errorf("unknown inst: %T", shouldBeInst)
+		return errors.Errorf("unknown inst: %T", shouldBeInst)
 	}
 }
 
@@ -2574,46 +5816,658 @@ func execute(shouldBeInst interface{}, state state, memory *memory, segmentOverr
 // Run x86 machine codes
 // -------------------------
 
-func runExeWithCustomIntHandlers(reader io.Reader, intHandlers intHandlers) (state, error) {
+// CPU runs a program on the emulated machine.
+// It can be executed to completion by Run or instruction by instruction by Step.
+type CPU struct {
+	state       state
+	memory      *memory
+	intHandlers intHandlers // custom handlers of int 21h
+	commandLine string
+	stdout      io.Writer
+	stdin       *bufio.Reader
+	dosVersion  dosVersion
+	clock       func() time.Time
+	traceFunc   TraceFunc
+	syscallFunc SyscallFunc
+	breakpoints map[int]struct{} // keyed by real address
+	// Run stopped at the breakpoint at CS:IP, which is skipped once so that Run can resume from there
+	resumeBreakpoint bool
+	// the number of instructions allowed to execute, unlimited if 0
+	instructionLimit int
+	executedCount    int
+	// custom handlers keyed by interrupt number, which take precedence over intHandlers
+	interruptHandlers interruptHandlers
+	// return error on unknown opcode even if handler of int 6 is available
+	strictDecode bool
+	// instructions are executed only in this range
+	image loadedImage
+	// detect stack overflow and underflow of program
+	stackGuard bool
+	// linear addresses of executed instructions, nil if coverage is disabled
+	coverage map[uint32]struct{}
+	// state and memory just after loading program, which are restored by Reset
+	initialState  state
+	initialMemory []byte
+	// segment where load module of EXE is placed, just after its PSP
+	loadSegment word
+}
+
+// Range of linear addresses where program is loaded, including PSP
+type loadedImage struct {
+	start, end int
+}
+
+func (cpu *CPU) saveInitialImage() {
+	cpu.initialState = cpu.state
+	cpu.initialMemory = make([]byte, len(cpu.memory.loadModule))
+	copy(cpu.initialMemory, cpu.memory.loadModule)
+	cpu.executedCount = 0
+	cpu.resumeBreakpoint = false
+}
+
+// Restore registers, flags and memory to those just after loading program so that it can run again.
+// Handlers, breakpoints and other settings are kept, and files left open by program are closed.
+func (cpu *CPU) Reset() error {
+	if cpu.initialMemory == nil {
+		return errors.New("no program is loaded")
+	}
+	cpu.closeFiles()
+	copy(cpu.memory.loadModule, cpu.initialMemory)
+	cpu.state = cpu.initialState
+	cpu.executedCount = 0
+	cpu.resumeBreakpoint = false
+	return nil
+}
+
+// Close files left open by program
+func (cpu *CPU) closeFiles() {
+	for h, f := range cpu.state.files {
+		f.Close()
+		delete(cpu.state.files, h)
+	}
+}
+
+// Return true if the program has exited, closing files left open by it
+func (cpu *CPU) exited() bool {
+	if cpu.state.shouldExit {
+		cpu.closeFiles()
+	}
+	return cpu.state.shouldExit
+}
+
+// Restore state saved before a failed instruction.
+// Files opened by the instruction are kept so that they can be closed later.
+func (cpu *CPU) rollback(saved state) {
+	files := cpu.state.files
+	cpu.state = saved
+	cpu.state.files = files
+}
+
+// Initial SP as the top of stack, where SP 0 means the end of segment
+func stackTop(sp word) int {
+	if sp == 0 {
+		return 0x10000
+	}
+	return int(sp)
+}
+
+// Guard the stack of loaded program if enabled.
+// Stack grows down to the end of image when image ends inside the stack, otherwise down to SS:0000.
+func (cpu *CPU) guardStack(top int) {
+	if !cpu.stackGuard {
+		return
+	}
+	bottom := cpu.image.end - int(cpu.state.ss)<<4
+	if bottom < 0 || bottom >= top {
+		bottom = 0
+	}
+	cpu.state.stack = &stackBounds{ss: cpu.state.ss, bottom: bottom, top: top}
+}
+
+func (image loadedImage) contains(start, end int) bool {
+	return image.start <= start && end <= image.end
+}
+
+// whether n bytes from seg:offset are in image, where offset wraps around within the segment
+func (image loadedImage) containsInSegment(seg, offset word, n int) bool {
+	start := newAddressFromWord(seg, offset).realAddress()
+	if int(offset)+n <= 0x10000 {
+		return image.contains(start, start+n)
+	}
+	head := 0x10000 - int(offset)
+	segStart := int(seg) << 4
+	return image.contains(start, start+head) && image.contains(segStart, segStart+n-head)
+}
+
+// ErrBreakpoint is returned by Run when it stops at a breakpoint
+var ErrBreakpoint = errors.New("hit breakpoint")
+
+// TraceFunc is called with CS:IP and the decoded instruction before each instruction is executed
+type TraceFunc func(cs, ip uint16, inst interface{})
+
+// SyscallFunc is called with the interrupt number, AH and registers before INT calls its handler
+type SyscallFunc func(intNo uint8, ah uint8, regs Registers)
+
+// Create CPU with no program loaded yet
+func NewCPU() *CPU {
+	return newCPUWithCustomIntHandlers(make(intHandlers))
+}
+
+func newCPUWithCustomIntHandlers(intHandlers intHandlers) *CPU {
+	return &CPU{intHandlers: intHandlers, stdout: os.Stdout, stdin: defaultStdin, dosVersion: defaultDOSVersion, clock: time.Now, loadSegment: loadSegment}
+}
+
+// Set segment where load module of EXE program is placed. PSP is placed in 256 bytes just before it.
+// It is 0x0110 by default.
+func (cpu *CPU) SetLoadSegment(seg uint16) {
+	cpu.loadSegment = word(seg)
+}
+
+// Set DOS version reported to program. It is 5.0 by default.
+func (cpu *CPU) SetDOSVersion(major, minor uint8) {
+	cpu.dosVersion = dosVersion{major: major, minor: minor}
+}
+
+// Set function returning current time, which is used by date and time functions of DOS.
+// It is time.Now by default.
+func (cpu *CPU) SetClock(clock func() time.Time) {
+	cpu.clock = clock
+}
+
+// Set reader which console input of program comes from. It is os.Stdin by default.
+func (cpu *CPU) SetStdin(r io.Reader) {
+	cpu.stdin = bufio.NewReader(r)
+}
+
+// Set writer which console output of program goes to. It is os.Stdout by default.
+func (cpu *CPU) SetStdout(w io.Writer) {
+	cpu.stdout = w
+}
+
+// Set handler of interrupt n. It should be called before loading program.
+func (cpu *CPU) setInterruptHandler(n uint8, handler intHandler) {
+	if cpu.interruptHandlers == nil {
+		cpu.interruptHandlers = make(interruptHandlers)
+	}
+	cpu.interruptHandlers[n] = handler
+}
+
+// InterruptHandler handles interrupt raised by program, reading and writing its registers and memory through cpu
+type InterruptHandler func(cpu *CPU) error
+
+// Set handler of interrupt n such as 0 (divide error), 4 (overflow), 5 (bound range exceeded) and 6 (invalid opcode).
+// It replaces the handler of the emulator, though a handler which program installs in interrupt vector table is called instead.
+// CS:IP is left at the invalid opcode for interrupt 6, so its handler must move CS:IP, or the interrupt is raised again.
+// It should be called before loading program.
+func (cpu *CPU) SetInterruptHandler(n uint8, handler InterruptHandler) {
+	cpu.setInterruptHandler(n, func(s *state, memory *memory) error {
+		// handler accesses state through cpu, so keep it in sync with s
+		cpu.state = *s
+		err := handler(cpu)
+		*s = cpu.state
+		return err
+	})
+}
+
+// Set command line passed to program as command tail in PSP.
+// It should be called before LoadExe.
+func (cpu *CPU) SetCommandLine(commandLine string) {
+	cpu.commandLine = commandLine
+}
+
+// Set whether unknown opcode stops execution with error.
+// Otherwise it raises int 6 (invalid opcode) if the handler is set by SetInterruptHandler or installed by program.
+func (cpu *CPU) SetStrictDecode(strict bool) {
+	cpu.strictDecode = strict
+}
+
+// Set function to trace instructions. nil disables tracing.
+func (cpu *CPU) SetTraceFunc(f TraceFunc) {
+	cpu.traceFunc = f
+}
+
+// Set function to trace system calls by INT. nil disables tracing.
+// It should be called before loading program.
+func (cpu *CPU) SetSyscallFunc(f SyscallFunc) {
+	cpu.syscallFunc = f
+}
+
+// Set whether linear addresses of executed instructions are recorded for Coverage.
+// Enabling it clears addresses recorded so far.
+func (cpu *CPU) SetCoverage(enabled bool) {
+	if enabled {
+		cpu.coverage = make(map[uint32]struct{})
+	} else {
+		cpu.coverage = nil
+	}
+}
+
+// Return linear addresses of instructions executed since coverage is enabled, in ascending order.
+// They are kept across Reset.
+func (cpu *CPU) Coverage() []uint32 {
+	addresses := make([]uint32, 0, len(cpu.coverage))
+	for address := range cpu.coverage {
+		addresses = append(addresses, address)
+	}
+	sort.Slice(addresses, func(i, j int) bool { return addresses[i] < addresses[j] })
+	return addresses
+}
+
+// Set whether push and pop beyond the initial stack stop execution with error.
+// It should be called before loading program.
+func (cpu *CPU) SetStackGuard(enabled bool) {
+	cpu.stackGuard = enabled
+}
+
+// Set the maximum number of instructions to execute, which stops runaway programs.
+// 0 means unlimited.
+func (cpu *CPU) SetInstructionLimit(limit int) {
+	cpu.instructionLimit = limit
+}
+
+// Add breakpoint at seg:off where Run stops before executing the instruction
+func (cpu *CPU) AddBreakpoint(seg, off uint16) {
+	if cpu.breakpoints == nil {
+		cpu.breakpoints = make(map[int]struct{})
+	}
+	cpu.breakpoints[newAddress(seg, off).realAddress()] = struct{}{}
+}
+
+func (cpu *CPU) isAtBreakpoint() bool {
+	_, ok := cpu.breakpoints[cpu.state.addressIP().realAddress()]
+	return ok
+}
+
+// Load exe and prepare memory and registers to start it
+func (cpu *CPU) LoadExe(reader io.Reader) error {
 	parser := newParser(reader)
 	header, loadModule, err := parseHeaderWithParser(parser)
 	if err != nil {
-		return state{}, errors.Wrap(err, "error to parse header")
+		return errors.Wrap(err, "error to parse header")
+	}
+	// an overlay is loaded by its root program, not executed by itself
+	if header.exOverlayNumber != 0 {
+		return errors.Errorf("overlay %d cannot be loaded as a program", header.exOverlayNumber)
 	}
 
-	memory := newMemoryFromHeader(loadModule, header)
+	if cpu.loadSegment < minLoadSegment {
+		return errors.Errorf("load segment 0x%04x overlaps interrupt vector table or BIOS data area", cpu.loadSegment)
+	}
+	psp := cpu.loadSegment - pspParagraphs
 
-	s := newState(header, intHandlers)
+	memory, err := newMemoryFromHeader(loadModule, header, cpu.loadSegment)
+	if err != nil {
+		return errors.Wrap(err, "error to prepare memory")
+	}
+	if err := memory.initInterruptVectors(); err != nil {
+		return errors.Wrap(err, "error to prepare interrupt vectors")
+	}
+	if err := memory.writePSP(psp, cpu.commandLine); err != nil {
+		return errors.Wrap(err, "error to prepare PSP")
+	}
+
+	s := newState(header, cpu.loadSegment, newInterruptHandlers(cpu.intHandlers, cpu.interruptHandlers))
+	// DS and ES point to PSP at startup
+	s.ds = psp
+	s.es = psp
+	s.stdout = cpu.stdout
+	s.stdin = cpu.stdin
+	s.dosVersion = cpu.dosVersion
+	s.clock = cpu.clock
+	s.syscallFunc = cpu.syscallFunc
+
+	cpu.state = s
+	cpu.memory = memory
+	cpu.image = loadedImage{start: int(psp) << 4, end: int(cpu.loadSegment)<<4 + len(loadModule)}
+	cpu.guardStack(stackTop(s.sp))
+	cpu.saveInitialImage()
+	return nil
+}
 
-	for {
-		inst, readBytesCount, segmentOverride, err := decodeInstWithMemory(s.addressIP(), memory)
-		if err != nil {
-			if errors.Cause(err) == io.EOF {
-				break
+// Registers is a snapshot of registers of CPU
+type Registers struct {
+	AX, CX, DX, BX, SP, BP, SI, DI uint16
+	CS, DS, ES, SS, FS, GS         uint16
+	IP                             uint16
+	FLAGS                          uint16
+}
+
+// Return a copy of current registers
+func (cpu *CPU) Registers() Registers {
+	return cpu.state.registers()
+}
+
+func (s state) registers() Registers {
+	return Registers{
+		AX: uint16(s.ax), CX: uint16(s.cx), DX: uint16(s.dx), BX: uint16(s.bx),
+		SP: uint16(s.sp), BP: uint16(s.bp), SI: uint16(s.si), DI: uint16(s.di),
+		CS: uint16(s.cs), DS: uint16(s.ds), ES: uint16(s.es), SS: uint16(s.ss), FS: uint16(s.fs), GS: uint16(s.gs),
+		IP:    uint16(s.ip),
+		FLAGS: uint16(s.eflags),
+	}
+}
+
+// Overwrite registers of loaded program, which takes effect from the next instruction.
+// It should be called after loading program. The reserved bit of FLAGS is always set.
+func (cpu *CPU) SetRegisters(r Registers) error {
+	if _, err := cpu.loadedMemory(); err != nil {
+		return err
+	}
+	s := &cpu.state
+	s.ax, s.cx, s.dx, s.bx = word(r.AX), word(r.CX), word(r.DX), word(r.BX)
+	s.sp, s.bp, s.si, s.di = word(r.SP), word(r.BP), word(r.SI), word(r.DI)
+	s.cs, s.ds, s.es, s.ss, s.fs, s.gs = word(r.CS), word(r.DS), word(r.ES), word(r.SS), word(r.FS), word(r.GS)
+	s.ip = word(r.IP)
+	s.eflags = s.eflags&^0xffff | dword(r.FLAGS) | EFLAGS_RESERVED
+	return nil
+}
+
+// Return whether flag f is set
+func (cpu *CPU) Flag(f Flag) bool {
+	return cpu.state.eflags&dword(f) != 0
+}
+
+// Set or reset flag f, which takes effect from the next instruction
+func (cpu *CPU) SetFlag(f Flag, v bool) {
+	if v {
+		cpu.state.eflags |= dword(f)
+	} else {
+		cpu.state.eflags &^= dword(f)
+	}
+}
+
+func (cpu *CPU) loadedMemory() (*memory, error) {
+	if cpu.memory == nil {
+		return nil, errors.New("no program is loaded")
+	}
+	return cpu.memory, nil
+}
+
+// Read a byte at seg:off of guest memory
+func (cpu *CPU) ReadByteAt(seg, off uint16) (byte, error) {
+	memory, err := cpu.loadedMemory()
+	if err != nil {
+		return 0, err
+	}
+	return memory.readByte(newAddress(seg, off))
+}
+
+// Read a little-endian word at seg:off of guest memory
+func (cpu *CPU) ReadWordAt(seg, off uint16) (uint16, error) {
+	memory, err := cpu.loadedMemory()
+	if err != nil {
+		return 0, err
+	}
+	w, err := memory.readWord(newAddress(seg, off))
+	return uint16(w), err
+}
+
+// Read n bytes from seg:off of guest memory
+func (cpu *CPU) ReadBytesAt(seg, off uint16, n int) ([]byte, error) {
+	memory, err := cpu.loadedMemory()
+	if err != nil {
+		return nil, err
+	}
+	return memory.readBytesAt(newAddress(seg, off), n)
+}
+
+// Write a byte at seg:off of guest memory
+func (cpu *CPU) WriteByteAt(seg, off uint16, b byte) error {
+	memory, err := cpu.loadedMemory()
+	if err != nil {
+		return err
+	}
+	return memory.writeByte(newAddress(seg, off), b)
+}
+
+// Write a little-endian word at seg:off of guest memory
+func (cpu *CPU) WriteWordAt(seg, off uint16, w uint16) error {
+	memory, err := cpu.loadedMemory()
+	if err != nil {
+		return err
+	}
+	return memory.writeWord(newAddress(seg, off), word(w))
+}
+
+const dumpBytesPerLine = 16
+
+// Write hex and ASCII dump of n bytes from seg:off of guest memory to w, 16 bytes per line.
+// Offset wraps around within the segment and bytes beyond memory are shown as "??".
+func (cpu *CPU) Dump(seg, off uint16, n int, w io.Writer) error {
+	memory, err := cpu.loadedMemory()
+	if err != nil {
+		return err
+	}
+
+	for lineStart := 0; lineStart < n; lineStart += dumpBytesPerLine {
+		lineOffset := off + uint16(lineStart)
+		hexText := make([]string, dumpBytesPerLine)
+		var asciiText []byte
+		for i := 0; i < dumpBytesPerLine; i++ {
+			if lineStart+i >= n {
+				hexText[i] = "  "
+				continue
+			}
+			b, err := memory.readByte(newAddress(seg, lineOffset+uint16(i)))
+			if err != nil {
+				hexText[i] = "??"
+				asciiText = append(asciiText, '.')
+				continue
+			}
+			hexText[i] = fmt.Sprintf("%02X", b)
+			if b >= 0x20 && b < 0x7f {
+				asciiText = append(asciiText, b)
 			} else {
-				return state{}, errors.Wrap(err, "error to decode inst")
+				asciiText = append(asciiText, '.')
 			}
 		}
-		debug.printf("decode inst %#v at 0x%04x:0x%04x\n", inst, s.cs, s.ip)
+		if _, err := fmt.Fprintf(w, "%04X:%04X  %s  |%s|\n", seg, lineOffset, strings.Join(hexText, " "), asciiText); err != nil {
+			return errors.Wrap(err, "failed to write dump")
+		}
+	}
+	return nil
+}
+
+// Load COM program, which is raw code placed just after PSP at offset 0x100 of a segment.
+// CS, DS, ES and SS all point to the segment of PSP, and the stack starts from the end of the segment.
+func (cpu *CPU) LoadCom(reader io.Reader) error {
+	code, err := ioutil.ReadAll(reader)
+	if err != nil {
+		return errors.Wrap(err, "error to read COM program")
+	}
+	// keep a word at the end of segment for the initial stack
+	if len(code) > 0x10000-comEntryOffset-2 {
+		return errors.Errorf("COM program is too large: %d bytes", len(code))
+	}
+
+	memory := newMemory([]byte{})
+	copy(memory.loadModule[int(pspSegment)<<4+comEntryOffset:], code)
+	if err := memory.initInterruptVectors(); err != nil {
+		return errors.Wrap(err, "error to prepare interrupt vectors")
+	}
+	if err := memory.writePSP(pspSegment, cpu.commandLine); err != nil {
+		return errors.Wrap(err, "error to prepare PSP")
+	}
+
+	s := state{
+		cs:                pspSegment,
+		ds:                pspSegment,
+		es:                pspSegment,
+		ss:                pspSegment,
+		ip:                comEntryOffset,
+		sp:                0xfffe,
+		eflags:            EFLAGS_RESERVED,
+		interruptHandlers: newInterruptHandlers(cpu.intHandlers, cpu.interruptHandlers),
+		stdout:            cpu.stdout,
+		stdin:             cpu.stdin,
+		dosVersion:        cpu.dosVersion,
+		clock:             cpu.clock,
+		syscallFunc:       cpu.syscallFunc,
+	}
+	// return address 0 lets ret terminate the program by int 20h at the start of PSP
+	if err := memory.writeWord(s.addressSP(), 0x0000); err != nil {
+		return errors.Wrap(err, "error to prepare stack")
+	}
+
+	cpu.state = s
+	cpu.memory = memory
+	cpu.image = loadedImage{start: int(pspSegment) << 4, end: int(pspSegment)<<4 + comEntryOffset + len(code)}
+	// the return address to PSP is a part of the stack
+	cpu.guardStack(0x10000)
+	cpu.saveInitialImage()
+	return nil
+}
 
-		s.ip = s.ip + word(readBytesCount)
-		s, err = execute(inst, s, memory, segmentOverride)
+// Load raw machine codes at loadSeg:0000 and start from loadSeg:entryIP, without any header or PSP.
+// All segment registers point to loadSeg and the stack starts from the end of the segment.
+// loadSeg must be above interrupt vector table, which is prepared as LoadCom and LoadExe do.
+func (cpu *CPU) LoadFlat(data []byte, loadSeg uint16, entryIP uint16) error {
+	start := int(loadSeg) << 4
+	if start < interruptVectorCount*4 {
+		return errors.Errorf("load segment 0x%04x overlaps interrupt vector table", loadSeg)
+	}
+	if start+len(data) > realModeMemorySize {
+		return errors.Errorf("binary of %d bytes doesn't fit at segment 0x%04x", len(data), loadSeg)
+	}
+
+	memory := newMemory([]byte{})
+	if err := memory.initInterruptVectors(); err != nil {
+		return errors.Wrap(err, "error to prepare interrupt vectors")
+	}
+	copy(memory.loadModule[start:], data)
+
+	seg := word(loadSeg)
+	cpu.state = state{
+		cs:                seg,
+		ds:                seg,
+		es:                seg,
+		ss:                seg,
+		ip:                word(entryIP),
+		sp:                0x0000,
+		eflags:            EFLAGS_RESERVED,
+		interruptHandlers: newInterruptHandlers(cpu.intHandlers, cpu.interruptHandlers),
+		stdout:            cpu.stdout,
+		stdin:             cpu.stdin,
+		dosVersion:        cpu.dosVersion,
+		clock:             cpu.clock,
+		syscallFunc:       cpu.syscallFunc,
+	}
+	cpu.memory = memory
+	cpu.image = loadedImage{start: start, end: start + len(data)}
+	cpu.guardStack(stackTop(cpu.state.sp))
+	cpu.saveInitialImage()
+	return nil
+}
+
+// Execute one instruction at CS:IP.
+// Return true if the program has exited.
+func (cpu *CPU) Step() (bool, error) {
+	if _, err := cpu.loadedMemory(); err != nil {
+		return false, err
+	}
+	cpu.resumeBreakpoint = false
+	if cpu.state.shouldExit {
+		return true, nil
+	}
+	if cpu.instructionLimit > 0 && cpu.executedCount >= cpu.instructionLimit {
+		return false, errors.Errorf("instruction limit exceeded: %d", cpu.instructionLimit)
+	}
+
+	// state is updated in place and restored if the instruction fails
+	s := &cpu.state
+	saved := cpu.state
+	if s.cs == biosSegment && s.ip < interruptVectorCount {
+		err := runInterruptStub(uint8(s.ip), s, cpu.memory)
+		cpu.executedCount++
 		if err != nil {
-			return state{}, errors.Wrap(err, "errors to execute")
+			cpu.rollback(saved)
+			return false, errors.Wrapf(err, "error in interrupt stub at 0x%04x:0x%04x", saved.cs, saved.ip)
 		}
-		if s.shouldExit {
-			break
+		return cpu.exited(), nil
+	}
+	if !cpu.image.containsInSegment(s.cs, s.ip, 1) {
+		return false, errors.Errorf("execution ran out of the loaded image at 0x%04x:0x%04x", s.cs, s.ip)
+	}
+	inst, readBytesCount, segmentOverride, err := decodeInstWithMemory(s.addressIP(), cpu.memory)
+	if err != nil {
+		if _, ok := errors.Cause(err).(*DecodeError); ok && cpu.canRaiseInvalidOpcode() {
+			// CS:IP is left at the invalid opcode as 286 and later do
+			err = raiseInterrupt(0x06, s, cpu.memory)
+			cpu.executedCount++
+			if err != nil {
+				cpu.rollback(saved)
+				return false, errors.Wrap(err, "error in handler of invalid opcode")
+			}
+			return cpu.exited(), nil
+		}
+		return false, errors.Wrap(err, "error to decode inst")
+	}
+	if !cpu.image.containsInSegment(s.cs, s.ip, readBytesCount) {
+		return false, errors.Errorf("instruction at 0x%04x:0x%04x is truncated by the end of the loaded image", s.cs, s.ip)
+	}
+	debug.printf("decode inst %#v at 0x%04x:0x%04x\n", inst, s.cs, s.ip)
+	if cpu.traceFunc != nil {
+		cpu.traceFunc(uint16(s.cs), uint16(s.ip), inst)
+	}
+	if cpu.coverage != nil {
+		cpu.coverage[uint32(s.addressIP().realAddress())] = struct{}{}
+	}
+
+	s.ip = s.ip + word(readBytesCount)
+	err = execute(inst, s, cpu.memory, segmentOverride)
+	cpu.executedCount++
+	if err != nil {
+		cpu.rollback(saved)
+		return false, errors.Wrap(err, "errors to execute")
+	}
+	return cpu.exited(), nil
+}
+
+func (cpu *CPU) canRaiseInvalidOpcode() bool {
+	if cpu.strictDecode {
+		return false
+	}
+	if _, ok := cpu.state.interruptHandlers[0x06]; ok {
+		return true
+	}
+	_, _, installed, err := cpu.memory.programInterruptVector(0x06)
+	return err == nil && installed
+}
+
+// Execute instructions until the program exits or reaches a breakpoint.
+// Return exit code of the program, or ErrBreakpoint when stopped at a breakpoint.
+// When the previous Run stopped at a breakpoint, Run resumes by executing the instruction there.
+func (cpu *CPU) Run() (uint8, error) {
+	for {
+		if !cpu.resumeBreakpoint && cpu.isAtBreakpoint() {
+			cpu.resumeBreakpoint = true
+			return 0, ErrBreakpoint
+		}
+		exited, err := cpu.Step()
+		if err != nil {
+			cpu.closeFiles()
+			return 0, err
+		}
+		if exited {
+			return uint8(cpu.state.exitCode), nil
 		}
-		// x, _ := s.readWordGeneralReg(DX)
-		// debug.printf("0x%04x\n", x)
-		// debug.printf("0x%08x\n", s.eflags)
-		// y, _ := s.readWordSreg(DS)
-		// debug.printf("0x%04x\n", y)
-		// z, _ := memory.readWord(s.realAddress(s.ds, x - 2))
-		// debug.printf("0x%04x\n", z)
 	}
+}
 
-	return s, nil
+func runExeWithCustomIntHandlers(reader io.Reader, intHandlers intHandlers) (state, error) {
+	return runExe(reader, intHandlers, "")
+}
+
+func runExe(reader io.Reader, intHandlers intHandlers, commandLine string) (state, error) {
+	cpu := newCPUWithCustomIntHandlers(intHandlers)
+	cpu.SetCommandLine(commandLine)
+	if err := cpu.LoadExe(reader); err != nil {
+		return state{}, err
+	}
+	if _, err := cpu.Run(); err != nil {
+		return state{}, err
+	}
+	return cpu.state, nil
 }
 
 // (exit code, state, error)
@@ -2621,3 +6475,24 @@ func RunExe(reader io.Reader) (uint8, state, error) {
 	state, err := runExeWithCustomIntHandlers(reader, make(intHandlers))
 	return uint8(state.exitCode), state, err
 }
+
+// Run COM program
+// (exit code, state, error)
+func RunCom(reader io.Reader) (uint8, state, error) {
+	cpu := NewCPU()
+	if err := cpu.LoadCom(reader); err != nil {
+		return 0, state{}, err
+	}
+	exitCode, err := cpu.Run()
+	if err != nil {
+		return 0, state{}, err
+	}
+	return exitCode, cpu.state, nil
+}
+
+// Run exe with command line, which is passed to program as command tail in PSP
+// (exit code, state, error)
+func RunExeWithCommandLine(reader io.Reader, commandLine string) (uint8, state, error) {
+	state, err := runExe(reader, make(intHandlers), commandLine)
+	return uint8(state.exitCode), state, err
+}
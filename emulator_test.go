@@ -2,10 +2,15 @@ package x86_emulator
 
 import (
 	"bytes"
+	"fmt"
+	"github.com/pkg/errors"
 	"io"
 	"io/ioutil"
 	"os"
+	"path/filepath"
+	"strings"
 	"testing"
+	"time"
 )
 
 type machineCode []byte
@@ -20,6 +25,163 @@ func TestRealAddress(t *testing.T) {
 	}
 }
 
+// memory
+
+func TestMemoryNearEndOfAddressSpace(t *testing.T) {
+	memory := newMemory([]byte{})
+	// f000:fff0 is 0xffff0
+	at := newAddress(0xf000, 0xfff0)
+	if err := memory.writeWord(at, 0x1234); err != nil {
+		t.Errorf("%+v", err)
+	}
+	actual, err := memory.readWord(newAddress(0xf000, 0xfff0))
+	if err != nil {
+		t.Errorf("%+v", err)
+	}
+	if actual != 0x1234 {
+		t.Errorf("expected 0x1234 but actual 0x%04x", actual)
+	}
+
+	// ffff:0010 is beyond 1MB
+	if err := memory.writeByte(newAddress(0xffff, 0x0010), 0x12); err == nil {
+		t.Errorf("expected error for address beyond 1MB")
+	}
+}
+
+func TestWriteWordAtLastByte(t *testing.T) {
+	memory := newMemory([]byte{})
+	// ffff:000f is the last byte of memory, so the high byte doesn't fit
+	if err := memory.writeWord(newAddress(0xffff, 0x000f), 0x1234); err == nil {
+		t.Errorf("expected error for word at the last byte of memory")
+	}
+	if err := memory.writeWord(newAddress(0xffff, 0x000e), 0x1234); err != nil {
+		t.Errorf("%+v", err)
+	}
+}
+
+func TestWordWrapsAroundSegment(t *testing.T) {
+	memory := newMemory([]byte{})
+	// the high byte of a word at offset 0xffff is at offset 0x0000 of the same segment
+	if err := memory.writeWord(newAddress(0x1000, 0xffff), 0x1234); err != nil {
+		t.Errorf("%+v", err)
+	}
+	high, err := memory.readByte(newAddress(0x1000, 0x0000))
+	if err != nil {
+		t.Errorf("%+v", err)
+	}
+	if high != 0x12 {
+		t.Errorf("expected 0x12 but actual 0x%02x", high)
+	}
+	actual, err := memory.readWord(newAddress(0x1000, 0xffff))
+	if err != nil {
+		t.Errorf("%+v", err)
+	}
+	if actual != 0x1234 {
+		t.Errorf("expected 0x1234 but actual 0x%04x", actual)
+	}
+}
+
+func TestAddressFromBaseAndDispWraps(t *testing.T) {
+	s := state{bx: 0x0000, ds: 0x1000}
+	address, err := s.addressFromBaseAndDisp(BX, -2)
+	if err != nil {
+		t.Errorf("%+v", err)
+	}
+	if address.seg != 0x1000 || address.offset != 0xfffe {
+		t.Errorf("expected 1000:fffe but actual %04x:%04x", address.seg, address.offset)
+	}
+
+	// mov ax,[bx-2] reads offset 0xfffe of the same segment, not 0x1fffe
+	memory := newMemory([]byte{})
+	if err := memory.writeWord(newAddress(0x1000, 0xfffe), 0xbeef); err != nil {
+		t.Errorf("%+v", err)
+	}
+	inst := instMov{dest: reg16{value: AX}, src: mem16BaseDisp8{base: BX, disp8: -2}}
+	if err := execMov(inst, &s, memory); err != nil {
+		t.Errorf("%+v", err)
+	}
+	if s.ax != 0xbeef {
+		t.Errorf("expected 0xbeef but actual 0x%04x", s.ax)
+	}
+}
+
+func TestReadBytesAtKeepsAddress(t *testing.T) {
+	memory := newMemory([]byte{0x01, 0x02, 0x03, 0x04})
+	at := newAddress(0x0000, 0x0001)
+	actual, err := memory.readBytesAt(at, 2)
+	if err != nil {
+		t.Errorf("%+v", err)
+	}
+	if !bytes.Equal(actual, []byte{0x02, 0x03}) {
+		t.Errorf("expected %v but actual %v", []byte{0x02, 0x03}, actual)
+	}
+	if at.offset != 0x0001 {
+		t.Errorf("expected offset to be unchanged but actual 0x%04x", at.offset)
+	}
+
+	// readBytes advances the address instead
+	if _, err := memory.readBytes(at, 2); err != nil {
+		t.Errorf("%+v", err)
+	}
+	if at.offset != 0x0003 {
+		t.Errorf("expected offset 0x0003 but actual 0x%04x", at.offset)
+	}
+}
+
+func TestRelocate(t *testing.T) {
+	memory := newMemory([]byte{})
+	if err := memory.writeWord(newAddress(0x1000, 0x0001), 0x0002); err != nil {
+		t.Errorf("%+v", err)
+	}
+	relocations := []relocationEntry{{offset: 0x0001, seg: 0x0000}}
+	if err := memory.relocate(relocations, 0x1000); err != nil {
+		t.Errorf("%+v", err)
+	}
+	actual, err := memory.readWord(newAddress(0x1000, 0x0001))
+	if err != nil {
+		t.Errorf("%+v", err)
+	}
+	if actual != 0x1002 {
+		t.Errorf("expected 0x1002 but actual 0x%04x", actual)
+	}
+}
+
+func TestNewMemoryFromHeaderWithRelocation(t *testing.T) {
+	// mov ax,0x0002 where 0x0002 is a segment relative to load module
+	b := append(rawHeaderWithRelocation(), []byte{0xb8, 0x02, 0x00}...)
+	header, loadModule, err := parseHeader(bytes.NewReader(b))
+	if err != nil {
+		t.Errorf("%+v", err)
+	}
+	memory, err := newMemoryFromHeader(loadModule, header, loadSegment)
+	if err != nil {
+		t.Errorf("%+v", err)
+	}
+	actual, err := memory.readWord(newAddressFromWord(loadSegment, 0x0001))
+	if err != nil {
+		t.Errorf("%+v", err)
+	}
+	if actual != loadSegment+0x0002 {
+		t.Errorf("expected 0x%04x but actual 0x%04x", loadSegment+0x0002, actual)
+	}
+}
+
+func TestNewMemoryFromHeaderMinAlloc(t *testing.T) {
+	header, loadModule, err := parseHeader(bytes.NewReader(rawHeader()))
+	if err != nil {
+		t.Errorf("%+v", err)
+	}
+	if _, err := newMemoryFromHeader(loadModule, header, loadSegment); err != nil {
+		t.Errorf("%+v", err)
+	}
+
+	// the minimum allocation of 0xffff paragraphs does not fit in memory after load module
+	header.exMinAlloc = 0xffff
+	if _, err := newMemoryFromHeader(loadModule, header, loadSegment); err == nil {
+		t.Errorf("expected error for too large minimum allocation")
+	}
+}
+
 // operand
 
 func TestNewImm8(t *testing.T) {
@@ -44,6 +206,17 @@ func TestNewImm8(t *testing.T) {
 	}
 }
 
+func TestParityOf(t *testing.T) {
+	fixtures := []int{0x00, 0x01, 0x03, 0x07, 0xff, 0x80, 0x0100, 0x0103}
+	expecteds := []bool{true, false, true, false, true, false, true, true}
+	for i := 0; i < len(fixtures); i++ {
+		actual := parityOf(fixtures[i])
+		if actual != expecteds[i] {
+			t.Errorf("expect %v as parity of 0x%04x but actual %v", expecteds[i], fixtures[i], actual)
+		}
+	}
+}
+
 // decode
 
 func TestDecodeInstInt(t *testing.T) {
@@ -104,6 +277,28 @@ func TestDecodeMovDs(t *testing.T) {
 	}
 }
 
+func TestDecodeMovSregMemoryOperands(t *testing.T) {
+	// mov [bx+si],ds
+	actual, _, _, err := decodeInst(bytes.NewReader([]byte{0x8c, 0x18}))
+	if err != nil {
+		t.Errorf("%+v", err)
+	}
+	expected := instMov{dest: mem16BaseIndexDisp{base: BX, index: SI}, src: sreg{value: DS}}
+	if actual != expected {
+		t.Errorf("expected %v but actual %v", expected, actual)
+	}
+
+	// mov es,[bp+4]
+	actual, _, _, err = decodeInst(bytes.NewReader([]byte{0x8e, 0x46, 0x04}))
+	if err != nil {
+		t.Errorf("%+v", err)
+	}
+	expected = instMov{dest: sreg{value: ES}, src: mem16BaseDisp8{base: BP, disp8: 4}}
+	if actual != expected {
+		t.Errorf("expected %v but actual %v", expected, actual)
+	}
+}
+
 func TestDecodeMovReg8Imm8(t *testing.T) {
 	// mov ah,09h
 	var reader io.Reader = bytes.NewReader([]byte{0xb4, 0x09})
@@ -119,6 +314,33 @@ func TestDecodeMovReg8Imm8(t *testing.T) {
 	}
 }
 
+func TestDecodeSegmentOverridePrefixes(t *testing.T) {
+	prefixes := []struct {
+		prefix byte
+		sreg   registerS
+	}{
+		{0x26, ES}, {0x2e, CS}, {0x36, SS}, {0x3e, DS}, {0x64, FS}, {0x65, GS},
+	}
+	for _, p := range prefixes {
+		// mov ax,word ptr sreg:[bx]
+		var reader io.Reader = bytes.NewReader([]byte{p.prefix, 0x8b, 0x07})
+		actual, readBytesCount, override, err := decodeInst(reader)
+		if err != nil {
+			t.Errorf("%+v", err)
+		}
+		expected := instMov{dest: reg16{value: AX}, src: mem16BaseDisp8{base: BX, disp8: 0}}
+		if actual != expected {
+			t.Errorf("expected %v but actual %v", expected, actual)
+		}
+		if readBytesCount != 3 {
+			t.Errorf("expected 3 bytes to be read but actual %d", readBytesCount)
+		}
+		if override == nil || override.sreg != p.sreg {
+			t.Errorf("expected override by %d for 0x%02x but actual %v", p.sreg, p.prefix, override)
+		}
+	}
+}
+
 func TestDecodeMovMem16Reg16WithSegmentOverride(t *testing.T) {
 	// mov word ptr es:0038, bx
 	var reader io.Reader = bytes.NewReader([]byte{0x26, 0x89, 0x1e, 0x38, 0x00})
@@ -164,6 +386,43 @@ func TestDecodeMovMem16SregWithSegmentOverride(t *testing.T) {
 	}
 }
 
+func TestDecodeMovAlMoffs8(t *testing.T) {
+	// mov al,byte ptr 0042
+	var reader io.Reader = bytes.NewReader([]byte{0xa0, 0x42, 0x00})
+	actual, _, _, err := decodeInst(reader)
+	if err != nil {
+		t.Errorf("%+v", err)
+	}
+	dest := reg8{value: AL}
+	src := mem8Disp16{offset: 0x0042}
+	expected := instMov{dest: dest, src: src}
+	if actual != expected {
+		t.Errorf("expected %v but actual %v", expected, actual)
+	}
+}
+
+func TestMovAlMoffs8(t *testing.T) {
+	var b machineCode
+	b = append(b, []byte{0xb8, 0x34, 0x12}...) // mov ax,0x1234
+	b = append(b, []byte{0xa0, 0x42, 0x00}...) // mov al,[0x0042]
+
+	cpu := NewCPU()
+	if err := cpu.LoadFlat(b, 0x2000, 0x0000); err != nil {
+		t.Errorf("%+v", err)
+	}
+	if err := cpu.WriteByteAt(0x2000, 0x0042, 0xab); err != nil {
+		t.Errorf("%+v", err)
+	}
+	for i := 0; i < 2; i++ {
+		if _, err := cpu.Step(); err != nil {
+			t.Errorf("%+v", err)
+		}
+	}
+	if cpu.state.ax != 0x12ab {
+		t.Errorf("expected ax 0x12ab but actual 0x%04x", cpu.state.ax)
+	}
+}
+
 func TestDecodeMovAxMoffs16WithSegmentOverride(t *testing.T) {
 	// mov ax,word ptr es:0032
 	var reader io.Reader = bytes.NewReader([]byte{0x26, 0xa1, 0x32, 0x00})
@@ -179,6 +438,54 @@ func TestDecodeMovAxMoffs16WithSegmentOverride(t *testing.T) {
 	}
 }
 
+func TestMovMoffsWithSegmentOverride(t *testing.T) {
+	var b machineCode
+	b = append(b, []byte{0x26, 0xa1, 0x32, 0x00}...) // mov ax,es:[0x0032]
+	b = append(b, []byte{0x26, 0xa2, 0x34, 0x00}...) // mov es:[0x0034],al
+	b = append(b, []byte{0x26, 0xa0, 0x33, 0x00}...) // mov al,es:[0x0033]
+	b = append(b, []byte{0x26, 0xa3, 0x36, 0x00}...) // mov es:[0x0036],ax
+
+	cpu := NewCPU()
+	if err := cpu.LoadFlat(b, 0x2000, 0x0000); err != nil {
+		t.Errorf("%+v", err)
+	}
+	r := cpu.Registers()
+	r.ES = 0x3000
+	if err := cpu.SetRegisters(r); err != nil {
+		t.Errorf("%+v", err)
+	}
+	// the same offset in DS has a different value
+	if err := cpu.WriteWordAt(0x2000, 0x0032, 0x1111); err != nil {
+		t.Errorf("%+v", err)
+	}
+	if err := cpu.WriteWordAt(0x3000, 0x0032, 0xbeef); err != nil {
+		t.Errorf("%+v", err)
+	}
+
+	for i := 0; i < 4; i++ {
+		if _, err := cpu.Step(); err != nil {
+			t.Errorf("%+v", err)
+		}
+	}
+	if cpu.state.ax != 0xbebe {
+		t.Errorf("expected ax 0xbebe but actual 0x%04x", cpu.state.ax)
+	}
+	actual, err := cpu.ReadBytesAt(0x3000, 0x0032, 6)
+	if err != nil {
+		t.Errorf("%+v", err)
+	}
+	if !bytes.Equal(actual, []byte{0xef, 0xbe, 0xef, 0x00, 0xbe, 0xbe}) {
+		t.Errorf("unexpected bytes in ES: % x", actual)
+	}
+	inDS, err := cpu.ReadBytesAt(0x2000, 0x0032, 6)
+	if err != nil {
+		t.Errorf("%+v", err)
+	}
+	if !bytes.Equal(inDS, []byte{0x11, 0x11, 0x00, 0x00, 0x00, 0x00}) {
+		t.Errorf("expected DS to be untouched but % x", inDS)
+	}
+}
+
 func TestDecodeMovMoffs16AlWithSegmentOverride(t *testing.T) {
 	// mov byte ptr es:0034,al
 	var reader io.Reader = bytes.NewReader([]byte{0x26, 0xa2, 0x34, 0x00})
@@ -254,6 +561,48 @@ func TestDecodeMovMem16Disp8Imm16(t *testing.T) {
 	}
 }
 
+func TestDecodeMovMem8Disp8Imm8(t *testing.T) {
+	// mov byte [bp-1],0x0a
+	var reader io.Reader = bytes.NewReader([]byte{0xc6, 0x46, 0xff, 0x0a})
+	actual, _, _, err := decodeInst(reader)
+	if err != nil {
+		t.Errorf("%+v", err)
+	}
+	dest := mem8BaseDisp8{base: BP, disp8: -1}
+	src := imm8{value: 0x0a}
+	expected := instMov{dest: dest, src: src}
+	if actual != expected {
+		t.Errorf("expected %v but actual %v", expected, actual)
+	}
+}
+
+func TestMovMem8Imm8(t *testing.T) {
+	var b machineCode
+	b = append(b, []byte{0xbb, 0x10, 0x00}...)       // mov bx,0x0010
+	b = append(b, []byte{0xc6, 0x07, 0xff}...)       // mov byte [bx],0xff
+	b = append(b, []byte{0xc6, 0x47, 0x01, 0x0a}...) // mov byte [bx+1],0x0a
+
+	cpu := NewCPU()
+	if err := cpu.LoadFlat(b, 0x2000, 0x0000); err != nil {
+		t.Errorf("%+v", err)
+	}
+	if err := cpu.WriteWordAt(0x2000, 0x0010, 0x5555); err != nil {
+		t.Errorf("%+v", err)
+	}
+	for i := 0; i < 3; i++ {
+		if _, err := cpu.Step(); err != nil {
+			t.Errorf("%+v", err)
+		}
+	}
+	actual, err := cpu.ReadBytesAt(0x2000, 0x0010, 3)
+	if err != nil {
+		t.Errorf("%+v", err)
+	}
+	if !bytes.Equal(actual, []byte{0xff, 0x0a, 0x00}) {
+		t.Errorf("expected ff 0a 00 but actual % x", actual)
+	}
+}
+
 func TestDecodeMovMem16Disp8Reg16(t *testing.T) {
 	// mov word ptr -4[bp], ax
 	var reader io.Reader = bytes.NewReader([]byte{0x89, 0x46, 0xfc})
@@ -329,6 +678,36 @@ func TestDecodeSubReg16Imm8(t *testing.T) {
 	}
 }
 
+func TestDecodeAndReg16Imm8(t *testing.T) {
+	// and sp,-16
+	var reader io.Reader = bytes.NewReader([]byte{0x83, 0xe4, 0xf0})
+	actual, _, _, err := decodeInst(reader)
+	if err != nil {
+		t.Errorf("%+v", err)
+	}
+	dest := reg16{value: SP}
+	src := imm8{value: -16}
+	expected := instAnd{dest: dest, src: src}
+	if actual != expected {
+		t.Errorf("expected %v but actual %v", expected, actual)
+	}
+}
+
+func TestDecodeOrMem16Imm8(t *testing.T) {
+	// or word [bx],0x01
+	var reader io.Reader = bytes.NewReader([]byte{0x83, 0x0f, 0x01})
+	actual, _, _, err := decodeInst(reader)
+	if err != nil {
+		t.Errorf("%+v", err)
+	}
+	dest := mem16BaseDisp8{base: BX, disp8: 0}
+	src := imm8{value: 0x01}
+	expected := instOr{dest: dest, src: src}
+	if actual != expected {
+		t.Errorf("expected %v but actual %v", expected, actual)
+	}
+}
+
 func TestDecodeSubReg16Reg16(t *testing.T) {
 	// sub cx,ax
 	var reader io.Reader = bytes.NewReader([]byte{0x2b, 0xc8})
@@ -374,6 +753,36 @@ func TestDecodeSubReg16Imm16(t *testing.T) {
 	}
 }
 
+func TestDecodeAddMem16Imm16(t *testing.T) {
+	// add word [bp-2],0x1234
+	var reader io.Reader = bytes.NewReader([]byte{0x81, 0x46, 0xfe, 0x34, 0x12})
+	actual, _, _, err := decodeInst(reader)
+	if err != nil {
+		t.Errorf("%+v", err)
+	}
+	dest := mem16BaseDisp8{base: BP, disp8: -2}
+	src := imm16{value: 0x1234}
+	expected := instAdd{dest: dest, src: src}
+	if actual != expected {
+		t.Errorf("expected %v but actual %v", expected, actual)
+	}
+}
+
+func TestDecodeAndReg16Imm16(t *testing.T) {
+	// and ax,0xff00
+	var reader io.Reader = bytes.NewReader([]byte{0x81, 0xe0, 0x00, 0xff})
+	actual, _, _, err := decodeInst(reader)
+	if err != nil {
+		t.Errorf("%+v", err)
+	}
+	dest := reg16{value: AX}
+	src := imm16{value: -0x0100}
+	expected := instAnd{dest: dest, src: src}
+	if actual != expected {
+		t.Errorf("expected %v but actual %v", expected, actual)
+	}
+}
+
 func TestDecodeLeaDx(t *testing.T) {
 	// lea dx,msg
 	var reader io.Reader = bytes.NewReader([]byte{0x8d, 0x16, 0x02, 0x00}) // 0b00010110
@@ -525,6 +934,77 @@ func TestDecodeCallAbsoluteIndirectMem16(t *testing.T) {
 	}
 }
 
+func TestDecodeCallIndirect(t *testing.T) {
+	cases := []struct {
+		code     []byte
+		expected instCallAbsoluteIndirectMem16
+	}{
+		// call bx
+		{[]byte{0xff, 0xd3}, instCallAbsoluteIndirectMem16{operand: reg16{value: BX}}},
+		// call [bp-2]
+		{[]byte{0xff, 0x56, 0xfe}, instCallAbsoluteIndirectMem16{operand: mem16BaseDisp8{base: BP, disp8: -2}}},
+		// call [bx+si+0x0100]
+		{[]byte{0xff, 0x90, 0x00, 0x01}, instCallAbsoluteIndirectMem16{operand: mem16BaseIndexDisp{base: BX, index: SI, disp: 0x0100}}},
+	}
+	for _, c := range cases {
+		actual, _, _, err := decodeInst(bytes.NewReader(c.code))
+		if err != nil {
+			t.Errorf("%+v", err)
+		}
+		if actual != c.expected {
+			t.Errorf("expected %v but actual %v", c.expected, actual)
+		}
+	}
+}
+
+func TestDecodeJmpIndirect(t *testing.T) {
+	cases := []struct {
+		code     []byte
+		expected instJmpIndirect
+	}{
+		// jmp ax
+		{[]byte{0xff, 0xe0}, instJmpIndirect{operand: reg16{value: AX}}},
+		// jmp [bx]
+		{[]byte{0xff, 0x27}, instJmpIndirect{operand: mem16BaseDisp8{base: BX, disp8: 0}}},
+	}
+	for _, c := range cases {
+		actual, _, _, err := decodeInst(bytes.NewReader(c.code))
+		if err != nil {
+			t.Errorf("%+v", err)
+		}
+		if actual != c.expected {
+			t.Errorf("expected %v but actual %v", c.expected, actual)
+		}
+	}
+}
+
+func TestDecodeFarIndirect(t *testing.T) {
+	// call far [0x0052]
+	actual, _, _, err := decodeInst(bytes.NewReader([]byte{0xff, 0x1e, 0x52, 0x00}))
+	if err != nil {
+		t.Errorf("%+v", err)
+	}
+	var expected interface{} = instCallFarIndirect{operand: mem8Disp16{offset: 0x0052}}
+	if actual != expected {
+		t.Errorf("expected %v but actual %v", expected, actual)
+	}
+
+	// jmp far [bx+0x0010]
+	actual, _, _, err = decodeInst(bytes.NewReader([]byte{0xff, 0xaf, 0x10, 0x00}))
+	if err != nil {
+		t.Errorf("%+v", err)
+	}
+	expected = instJmpFarIndirect{operand: mem8BaseDisp16{base: BX, disp16: 0x0010}}
+	if actual != expected {
+		t.Errorf("expected %v but actual %v", expected, actual)
+	}
+
+	// far pointer must be in memory
+	if _, _, _, err := decodeInst(bytes.NewReader([]byte{0xff, 0xe8})); err == nil {
+		t.Errorf("expected error for jmp far with register operand")
+	}
+}
+
 func TestDecodeRet(t *testing.T) {
 	// ret (near return)
 	var reader io.Reader = bytes.NewReader([]byte{0xc3})
@@ -553,547 +1033,4302 @@ func TestDecodeMovWithDisp(t *testing.T) {
 	}
 }
 
-func TestDecodeJmpRel16(t *testing.T) {
-	// jmp rel16
-	var reader io.Reader = bytes.NewReader([]byte{0xe9, 0x8a, 0x00})
+func TestDecodeMovWithDisp16(t *testing.T) {
+	// mov ax,[bp+0x0120]
+	var reader io.Reader = bytes.NewReader([]byte{0x8b, 0x86, 0x20, 0x01})
 	actual, _, _, err := decodeInst(reader)
 	if err != nil {
 		t.Errorf("%+v", err)
 	}
-	expected := instJmpRel16{rel: 0x008a}
+	dest := reg16{value: AX}
+	src := mem16BaseDisp16{base: BP, disp16: 0x0120}
+	expected := instMov{dest: dest, src: src}
 	if actual != expected {
 		t.Errorf("expected %v but actual %v", expected, actual)
 	}
 }
 
-func TestDecodeJmpRel8(t *testing.T) {
-	// jmp rel8
-	var reader io.Reader = bytes.NewReader([]byte{0xeb, 0xfd})
+func TestDecodeMovReg8WithDisp16(t *testing.T) {
+	// mov bl,[bx+0x1000]
+	var reader io.Reader = bytes.NewReader([]byte{0x8a, 0x9f, 0x00, 0x10})
 	actual, _, _, err := decodeInst(reader)
 	if err != nil {
 		t.Errorf("%+v", err)
 	}
-	expected := instJmpRel16{rel: -3}
+	dest := reg8{value: BL}
+	src := mem8BaseDisp16{base: BX, disp16: 0x1000}
+	expected := instMov{dest: dest, src: src}
 	if actual != expected {
 		t.Errorf("expected %v but actual %v", expected, actual)
 	}
 }
 
-func TestDecodeSti(t *testing.T) {
-	// sti
-	var reader io.Reader = bytes.NewReader([]byte{0xfb})
+func TestDecodeMovWithBaseIndex(t *testing.T) {
+	// mov ax,[bx+si+0x00]
+	var reader io.Reader = bytes.NewReader([]byte{0x8b, 0x40, 0x00})
 	actual, _, _, err := decodeInst(reader)
 	if err != nil {
 		t.Errorf("%+v", err)
 	}
-	expected := instSti{}
+	dest := reg16{value: AX}
+	src := mem16BaseIndexDisp{base: BX, index: SI, disp: 0}
+	expected := instMov{dest: dest, src: src}
 	if actual != expected {
 		t.Errorf("expected %v but actual %v", expected, actual)
 	}
 }
 
-func TestDecodeAndReg8Imm8(t *testing.T) {
-	// and r/m8 imm8
-	var reader io.Reader = bytes.NewReader([]byte{0x80, 0xe3, 0xf0})
+func TestDecodeMovWithBaseIndexDisp8(t *testing.T) {
+	// mov byte ptr [bp+di-2],cl
+	var reader io.Reader = bytes.NewReader([]byte{0x88, 0x4b, 0xfe})
 	actual, _, _, err := decodeInst(reader)
 	if err != nil {
 		t.Errorf("%+v", err)
 	}
-	dest := reg8{value: BL}
-	src := imm8{value: -16}
-	expected := instAnd{dest: dest, src: src}
+	dest := mem8BaseIndexDisp{base: BP, index: DI, disp: -2}
+	src := reg8{value: CL}
+	expected := instMov{dest: dest, src: src}
 	if actual != expected {
 		t.Errorf("expected %v but actual %v", expected, actual)
 	}
 }
 
-func TestDecodeAndMem8Reg8(t *testing.T) {
-	// and r/m8,r8
-	var reader io.Reader = bytes.NewReader([]byte{0x20, 0x26, 0x5a, 0x00})
+func TestDecodeMovWithSi(t *testing.T) {
+	// mov al,[si]
+	var reader io.Reader = bytes.NewReader([]byte{0x8a, 0x04})
 	actual, _, _, err := decodeInst(reader)
 	if err != nil {
 		t.Errorf("%+v", err)
 	}
-	dest := mem8Disp16{offset: 0x005a}
-	src := reg8{value: AH}
-	expected := instAnd{dest: dest, src: src}
+	dest := reg8{value: AL}
+	src := mem8BaseDisp8{base: SI, disp8: 0}
+	expected := instMov{dest: dest, src: src}
 	if actual != expected {
 		t.Errorf("expected %v but actual %v", expected, actual)
 	}
 }
 
-func TestDecodeAddReg16Reg16(t *testing.T) {
-	// add r16,r/m16
-	var reader io.Reader = bytes.NewReader([]byte{0x03, 0xdc})
+func TestDecodeMovWithBx(t *testing.T) {
+	// mov [bx],dx
+	var reader io.Reader = bytes.NewReader([]byte{0x89, 0x17})
 	actual, _, _, err := decodeInst(reader)
 	if err != nil {
 		t.Errorf("%+v", err)
 	}
-	dest := reg16{value: BX}
-	src := reg16{value: SP}
-	expected := instAdd{dest: dest, src: src}
+	dest := mem16BaseDisp8{base: BX, disp8: 0}
+	src := reg16{value: DX}
+	expected := instMov{dest: dest, src: src}
 	if actual != expected {
 		t.Errorf("expected %v but actual %v", expected, actual)
 	}
 }
 
-func TestDecodeShrReg16_1(t *testing.T) {
-	// shr r/m16,1
-	var reader io.Reader = bytes.NewReader([]byte{0xd1, 0xea})
+func TestDecodeLeaWithBxSi(t *testing.T) {
+	// lea di,[bx+si]
+	var reader io.Reader = bytes.NewReader([]byte{0x8d, 0x38})
 	actual, _, _, err := decodeInst(reader)
 	if err != nil {
 		t.Errorf("%+v", err)
 	}
-	dest := reg16{value: DX}
-	src := imm8{value: 1}
-	expected := instShr{dest: dest, src: src}
+	dest := reg16{value: DI}
+	src := mem8BaseIndexDisp{base: BX, index: SI, disp: 0}
+	expected := instLea{dest: dest, src: src}
 	if actual != expected {
 		t.Errorf("expected %v but actual %v", expected, actual)
 	}
 }
 
-func TestDecodeShlReg16_1(t *testing.T) {
-	// shl r/m16,1
-	var reader io.Reader = bytes.NewReader([]byte{0xd1, 0xe3})
+func TestDecodeJmpRel16(t *testing.T) {
+	// jmp rel16
+	var reader io.Reader = bytes.NewReader([]byte{0xe9, 0x8a, 0x00})
 	actual, _, _, err := decodeInst(reader)
 	if err != nil {
 		t.Errorf("%+v", err)
 	}
-	dest := reg16{value: BX}
-	src := imm8{value: 1}
-	expected := instShl{dest: dest, src: src}
+	expected := instJmpRel16{rel: 0x008a}
 	if actual != expected {
 		t.Errorf("expected %v but actual %v", expected, actual)
 	}
 }
 
-func TestDecodeCmpWithSegmentOverride(t *testing.T) {
-	// cmp es:0036, 0x00
-	var reader io.Reader = bytes.NewReader([]byte{0x26, 0x80, 0x3e, 0x36, 0x00, 0x00})
+func TestDecodeJmpRel8(t *testing.T) {
+	// jmp rel8
+	var reader io.Reader = bytes.NewReader([]byte{0xeb, 0xfd})
 	actual, _, _, err := decodeInst(reader)
 	if err != nil {
 		t.Errorf("%+v", err)
 	}
-	dest := mem8Disp16{offset: 0x0036}
-	src := imm8{value: 0x00}
-	expected := instCmp{dest: dest, src: src}
+	expected := instJmpRel16{rel: -3}
 	if actual != expected {
 		t.Errorf("expected %v but actual %v", expected, actual)
 	}
 }
 
-func TestDecodeJneRel8(t *testing.T) {
-	// jne 0x3d
-	var reader io.Reader = bytes.NewReader([]byte{0x75, 0x3d})
+func TestDecodeSti(t *testing.T) {
+	// sti
+	var reader io.Reader = bytes.NewReader([]byte{0xfb})
 	actual, _, _, err := decodeInst(reader)
 	if err != nil {
 		t.Errorf("%+v", err)
 	}
-	expected := instJneRel8{rel8: 0x3d}
+	expected := instSti{}
 	if actual != expected {
 		t.Errorf("expected %v but actual %v", expected, actual)
 	}
 }
 
-func TestDecodeMovReg16Sreg(t *testing.T) {
-	// mov ax,es
-	var reader io.Reader = bytes.NewReader([]byte{0x8c, 0xc0})
+func TestDecodeAndReg8Imm8(t *testing.T) {
+	// and r/m8 imm8
+	var reader io.Reader = bytes.NewReader([]byte{0x80, 0xe3, 0xf0})
 	actual, _, _, err := decodeInst(reader)
 	if err != nil {
 		t.Errorf("%+v", err)
 	}
-	dest := reg16{value: AX}
-	src := sreg{value: ES}
-	expected := instMov{dest: dest, src: src}
+	dest := reg8{value: BL}
+	src := imm8{value: -16}
+	expected := instAnd{dest: dest, src: src}
 	if actual != expected {
 		t.Errorf("expected %v but actual %v", expected, actual)
 	}
 }
 
-func TestDecodeCmpReg16Reg16(t *testing.T) {
-	// cmp dx,cx
-	var reader io.Reader = bytes.NewReader([]byte{0x3b, 0xd1})
+func TestDecodeAddMem8Imm8(t *testing.T) {
+	// add byte [bx],1
+	var reader io.Reader = bytes.NewReader([]byte{0x80, 0x07, 0x01})
 	actual, _, _, err := decodeInst(reader)
 	if err != nil {
 		t.Errorf("%+v", err)
 	}
-	dest := reg16{value: DX}
-	src := reg16{value: CX}
-	expected := instCmp{dest: dest, src: src}
+	dest := mem8BaseDisp8{base: BX, disp8: 0}
+	src := imm8{value: 1}
+	expected := instAdd{dest: dest, src: src}
 	if actual != expected {
 		t.Errorf("expected %v but actual %v", expected, actual)
 	}
 }
 
-func TestDecodeCmpAlImm8(t *testing.T) {
-	// cmp al,0x03
-	var reader io.Reader = bytes.NewReader([]byte{0x3c, 0x03})
+func TestDecodeSubReg8Imm8(t *testing.T) {
+	// sub cl,5
+	var reader io.Reader = bytes.NewReader([]byte{0x80, 0xe9, 0x05})
 	actual, _, _, err := decodeInst(reader)
 	if err != nil {
 		t.Errorf("%+v", err)
 	}
-	dest := reg8{value: AL}
-	src := imm8{value: 0x03}
-	expected := instCmp{dest: dest, src: src}
+	dest := reg8{value: CL}
+	src := imm8{value: 5}
+	expected := instSub{dest: dest, src: src}
 	if actual != expected {
 		t.Errorf("expected %v but actual %v", expected, actual)
 	}
 }
 
-func TestDecodeCmpReg16Imm16(t *testing.T) {
-	// cmp bx,0x0064
-	var reader io.Reader = bytes.NewReader([]byte{0x81, 0xfb, 0x64, 0x00})
+func TestDecodeAndMem8Reg8(t *testing.T) {
+	// and r/m8,r8
+	var reader io.Reader = bytes.NewReader([]byte{0x20, 0x26, 0x5a, 0x00})
 	actual, _, _, err := decodeInst(reader)
 	if err != nil {
 		t.Errorf("%+v", err)
 	}
-	dest := reg16{value: BX}
-	src := imm16{value: 0x0064}
-	expected := instCmp{dest: dest, src: src}
+	dest := mem8Disp16{offset: 0x005a}
+	src := reg8{value: AH}
+	expected := instAnd{dest: dest, src: src}
 	if actual != expected {
 		t.Errorf("expected %v but actual %v", expected, actual)
 	}
 }
 
-func TestDecodeJb(t *testing.T) {
-	// jb 0x0b
-	var reader io.Reader = bytes.NewReader([]byte{0x72, 0x0b})
+func TestDecodeAndMem16Reg16(t *testing.T) {
+	// and word ptr 0x005a,cx
+	var reader io.Reader = bytes.NewReader([]byte{0x21, 0x0e, 0x5a, 0x00})
 	actual, _, _, err := decodeInst(reader)
 	if err != nil {
 		t.Errorf("%+v", err)
 	}
-	expected := instJb{rel8: 0x0b}
+	dest := mem16Disp16{offset: 0x005a}
+	src := reg16{value: CX}
+	expected := instAnd{dest: dest, src: src}
 	if actual != expected {
-		t.Errorf("expeted %v but actual %v", expected, actual)
+		t.Errorf("expected %v but actual %v", expected, actual)
 	}
 }
 
-func TestDecodeCld(t *testing.T) {
-	// cld
-	var reader io.Reader = bytes.NewReader([]byte{0xfc})
+func TestDecodeAndReg8Mem8(t *testing.T) {
+	// and dl,byte ptr -02[bp]
+	var reader io.Reader = bytes.NewReader([]byte{0x22, 0x56, 0xfe})
 	actual, _, _, err := decodeInst(reader)
 	if err != nil {
 		t.Errorf("%+v", err)
 	}
-	expected := instCld{}
+	dest := reg8{value: DL}
+	src := mem8BaseDisp8{base: BP, disp8: -2}
+	expected := instAnd{dest: dest, src: src}
 	if actual != expected {
 		t.Errorf("expected %v but actual %v", expected, actual)
 	}
 }
 
-func TestDecodeRepeScasb(t *testing.T) {
-	// repe scasb
-	var reader io.Reader = bytes.NewReader([]byte{0xf3, 0xae})
+func TestDecodeAndAlImm8(t *testing.T) {
+	// and al,0x0f
+	var reader io.Reader = bytes.NewReader([]byte{0x24, 0x0f})
 	actual, _, _, err := decodeInst(reader)
 	if err != nil {
 		t.Errorf("%+v", err)
 	}
-	expected := instRepeScasb{}
+	dest := reg8{value: AL}
+	src := imm8{value: 0x0f}
+	expected := instAnd{dest: dest, src: src}
 	if actual != expected {
 		t.Errorf("expected %v but actual %v", expected, actual)
 	}
 }
 
-func TestDecodeRepeScasw(t *testing.T) {
-	// repe scasw
-	var reader io.Reader = bytes.NewReader([]byte{0xf3, 0xaf})
+func TestDecodeAndAxImm16(t *testing.T) {
+	// and ax,0x00ff
+	var reader io.Reader = bytes.NewReader([]byte{0x25, 0xff, 0x00})
 	actual, _, _, err := decodeInst(reader)
 	if err != nil {
 		t.Errorf("%+v", err)
 	}
-	expected := instRepeScasw{}
+	dest := reg16{value: AX}
+	src := imm16{value: 0x00ff}
+	expected := instAnd{dest: dest, src: src}
 	if actual != expected {
 		t.Errorf("expected %v but actual %v", expected, actual)
 	}
 }
 
-func TestDecodeRepMovsb(t *testing.T) {
-	// rep movsb
-	var reader io.Reader = bytes.NewReader([]byte{0xf3, 0xa4})
+func TestDecodeOrReg16Reg16(t *testing.T) {
+	// or ax,dx
+	var reader io.Reader = bytes.NewReader([]byte{0x0b, 0xc2})
 	actual, _, _, err := decodeInst(reader)
 	if err != nil {
 		t.Errorf("%+v", err)
 	}
-	expected := instRepMovsb{}
+	dest := reg16{value: AX}
+	src := reg16{value: DX}
+	expected := instOr{dest: dest, src: src}
 	if actual != expected {
 		t.Errorf("expected %v but actual %v", expected, actual)
 	}
 }
 
-func TestDecodeRepStosb(t *testing.T) {
-	// rep stosb
-	var reader io.Reader = bytes.NewReader([]byte{0xf3, 0xaa})
+func TestDecodeOrAlImm8(t *testing.T) {
+	// or al,0x20
+	var reader io.Reader = bytes.NewReader([]byte{0x0c, 0x20})
 	actual, _, _, err := decodeInst(reader)
 	if err != nil {
 		t.Errorf("%+v", err)
 	}
-	expected := instRepStosb{}
+	dest := reg8{value: AL}
+	src := imm8{value: 0x20}
+	expected := instOr{dest: dest, src: src}
 	if actual != expected {
 		t.Errorf("expected %v but actual %v", expected, actual)
 	}
 }
 
-func TestDecodeJe(t *testing.T) {
-	// je 0x03
-	var reader io.Reader = bytes.NewReader([]byte{0x74, 0x03})
+func TestDecodeTestReg8Reg8(t *testing.T) {
+	// test al,al
+	var reader io.Reader = bytes.NewReader([]byte{0x84, 0xc0})
 	actual, _, _, err := decodeInst(reader)
 	if err != nil {
 		t.Errorf("%+v", err)
 	}
-	expected := instJeRel8{rel8: 0x03}
+	dest := reg8{value: AL}
+	src := reg8{value: AL}
+	expected := instTest{dest: dest, src: src}
 	if actual != expected {
 		t.Errorf("expected %v but actual %v", expected, actual)
 	}
 }
 
-func TestDecodeInc(t *testing.T) {
-	// inc cx
-	var reader io.Reader = bytes.NewReader([]byte{0x41})
+func TestDecodeTestMem16Imm16(t *testing.T) {
+	// test word ptr [bx],0x8000
+	var reader io.Reader = bytes.NewReader([]byte{0xf7, 0x07, 0x00, 0x80})
 	actual, _, _, err := decodeInst(reader)
 	if err != nil {
 		t.Errorf("%+v", err)
 	}
-	expected := instInc{dest: CX}
+	dest := mem16BaseDisp8{base: BX, disp8: 0}
+	src := imm16{value: -0x8000}
+	expected := instTest{dest: dest, src: src}
 	if actual != expected {
 		t.Errorf("expected %v but actual %v", expected, actual)
 	}
 }
 
-func TestDecodeStosb(t *testing.T) {
-	// stos m8
-	var reader io.Reader = bytes.NewReader([]byte{0xaa})
+func TestDecodeAddReg16Reg16(t *testing.T) {
+	// add r16,r/m16
+	var reader io.Reader = bytes.NewReader([]byte{0x03, 0xdc})
 	actual, _, _, err := decodeInst(reader)
 	if err != nil {
 		t.Errorf("%+v", err)
 	}
-	expected := instStosb{}
+	dest := reg16{value: BX}
+	src := reg16{value: SP}
+	expected := instAdd{dest: dest, src: src}
 	if actual != expected {
 		t.Errorf("expected %v but actual %v", expected, actual)
 	}
 }
 
-func TestDecodeDec(t *testing.T) {
-	// dec di
-	var reader io.Reader = bytes.NewReader([]byte{0x4f})
+func TestDecodeShrReg16_1(t *testing.T) {
+	// shr r/m16,1
+	var reader io.Reader = bytes.NewReader([]byte{0xd1, 0xea})
 	actual, _, _, err := decodeInst(reader)
 	if err != nil {
 		t.Errorf("%+v", err)
 	}
-	expected := instDec{dest: DI}
+	dest := reg16{value: DX}
+	src := imm8{value: 1}
+	expected := instShr{dest: dest, src: src}
 	if actual != expected {
 		t.Errorf("expected %v but actual %v", expected, actual)
 	}
 }
 
-func TestDecodeXorReg16Reg16(t *testing.T) {
-	// xor bp,bp
-	var reader io.Reader = bytes.NewReader([]byte{0x33, 0xed})
+func TestDecodeShlReg16_1(t *testing.T) {
+	// shl r/m16,1
+	var reader io.Reader = bytes.NewReader([]byte{0xd1, 0xe3})
 	actual, _, _, err := decodeInst(reader)
 	if err != nil {
 		t.Errorf("%+v", err)
 	}
-	dest := reg16{value: BP}
-	src := reg16{value: BP}
-	expected := instXor{dest: dest, src: src}
+	dest := reg16{value: BX}
+	src := imm8{value: 1}
+	expected := instShl{dest: dest, src: src}
 	if actual != expected {
 		t.Errorf("expected %v but actual %v", expected, actual)
 	}
 }
 
-func TestDecodeJae(t *testing.T) {
-	// jae rel8
-	var reader io.Reader = bytes.NewReader([]byte{0x73, 0x16})
+func TestDecodeCmpWithSegmentOverride(t *testing.T) {
+	// cmp es:0036, 0x00
+	var reader io.Reader = bytes.NewReader([]byte{0x26, 0x80, 0x3e, 0x36, 0x00, 0x00})
 	actual, _, _, err := decodeInst(reader)
 	if err != nil {
 		t.Errorf("%+v", err)
 	}
-	expected := instJae{rel8: 0x16}
+	dest := mem8Disp16{offset: 0x0036}
+	src := imm8{value: 0x00}
+	expected := instCmp{dest: dest, src: src}
 	if actual != expected {
 		t.Errorf("expected %v but actual %v", expected, actual)
 	}
 }
 
-// run
-
-func (code machineCode) withMov() machineCode {
-	// mov ax,1
-	mov := []byte{0xb8, 0x01, 0x00}
-	return append(code, mov...)
-}
-
-func (code machineCode) withInt21_4c() machineCode {
-	// mov ah, 4c
-	// int 21h
-	int21 := []byte{0xb4, 0x4c, 0xcd, 0x21}
-	return append(code, int21...)
+func TestDecodeJneRel8(t *testing.T) {
+	// jne 0x3d
+	var reader io.Reader = bytes.NewReader([]byte{0x75, 0x3d})
+	actual, _, _, err := decodeInst(reader)
+	if err != nil {
+		t.Errorf("%+v", err)
+	}
+	expected := instJneRel8{rel8: 0x3d}
+	if actual != expected {
+		t.Errorf("expected %v but actual %v", expected, actual)
+	}
 }
 
-func rawHeaderForRunExe() machineCode {
-	return []byte{
-		0x4d, 0x5a, 0x2b, 0x00, 0x01, 0x00, 0x00, 0x00, 0x02, 0x00, 0x01, 0x01, 0xff, 0xff, 0x01, 0x00,
-		0x00, 0x10, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x20, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00,
+func TestDecodeMovReg16Sreg(t *testing.T) {
+	// mov ax,es
+	var reader io.Reader = bytes.NewReader([]byte{0x8c, 0xc0})
+	actual, _, _, err := decodeInst(reader)
+	if err != nil {
+		t.Errorf("%+v", err)
+	}
+	dest := reg16{value: AX}
+	src := sreg{value: ES}
+	expected := instMov{dest: dest, src: src}
+	if actual != expected {
+		t.Errorf("expected %v but actual %v", expected, actual)
 	}
 }
 
-func TestRunExe(t *testing.T) {
-	_, _, err := RunExe(bytes.NewReader(rawHeaderForRunExe().withMov().withInt21_4c()))
+func TestDecodeCmpReg16Reg16(t *testing.T) {
+	// cmp dx,cx
+	var reader io.Reader = bytes.NewReader([]byte{0x3b, 0xd1})
+	actual, _, _, err := decodeInst(reader)
 	if err != nil {
 		t.Errorf("%+v", err)
 	}
+	dest := reg16{value: DX}
+	src := reg16{value: CX}
+	expected := instCmp{dest: dest, src: src}
+	if actual != expected {
+		t.Errorf("expected %v but actual %v", expected, actual)
+	}
 }
 
-func TestInt21_4c_ax(t *testing.T) {
-	// exit status 1
-	b := rawHeaderForRunExe()
+func TestDecodeCmpMem8Reg8(t *testing.T) {
+	// cmp byte [si],al
+	actual, _, _, err := decodeInst(bytes.NewReader([]byte{0x38, 0x04}))
+	if err != nil {
+		t.Errorf("%+v", err)
+	}
+	expected := instCmp{dest: mem8BaseDisp8{base: SI, disp8: 0}, src: reg8{value: AL}}
+	if actual != expected {
+		t.Errorf("expected %v but actual %v", expected, actual)
+	}
+
+	// cmp al,byte [si]
+	actual, _, _, err = decodeInst(bytes.NewReader([]byte{0x3a, 0x04}))
+	if err != nil {
+		t.Errorf("%+v", err)
+	}
+	expected = instCmp{dest: reg8{value: AL}, src: mem8BaseDisp8{base: SI, disp8: 0}}
+	if actual != expected {
+		t.Errorf("expected %v but actual %v", expected, actual)
+	}
+}
+
+func TestCmpMem8Reg8(t *testing.T) {
+	var b machineCode
+	b = append(b, []byte{0xbe, 0x20, 0x00}...) // mov si,0x0020
+	b = append(b, []byte{0xb8, 0x78, 0x12}...) // mov ax,0x1278
+	b = append(b, []byte{0x38, 0x04}...)       // cmp byte [si],al
+	b = append(b, 0x46)                        // inc si
+	b = append(b, []byte{0x3a, 0x04}...)       // cmp al,byte [si]
+
+	cpu := NewCPU()
+	if err := cpu.LoadFlat(b, 0x2000, 0x0000); err != nil {
+		t.Errorf("%+v", err)
+	}
+	// 0x78 ('x') equals al, and 0x80 is compared at byte width
+	if err := cpu.WriteWordAt(0x2000, 0x0020, 0x8078); err != nil {
+		t.Errorf("%+v", err)
+	}
+
+	for i := 0; i < 3; i++ {
+		if _, err := cpu.Step(); err != nil {
+			t.Errorf("%+v", err)
+		}
+	}
+	if !cpu.Flag(ZF) || cpu.Flag(CF) {
+		t.Errorf("expected byte [si] to equal al but FLAGS 0x%04x", cpu.Registers().FLAGS)
+	}
+
+	for i := 0; i < 2; i++ {
+		if _, err := cpu.Step(); err != nil {
+			t.Errorf("%+v", err)
+		}
+	}
+	// 0x78 - 0x80 borrows and overflows as signed byte
+	if cpu.Flag(ZF) || !cpu.Flag(CF) || !cpu.Flag(OF) || !cpu.Flag(SF) {
+		t.Errorf("expected CF, OF and SF by byte comparison but FLAGS 0x%04x", cpu.Registers().FLAGS)
+	}
+}
+
+func TestDecodeXchg(t *testing.T) {
+	cases := []struct {
+		code     []byte
+		expected instXchg
+	}{
+		// nop
+		{[]byte{0x90}, instXchg{dest: reg16{value: AX}, src: reg16{value: AX}}},
+		// xchg ax,sp
+		{[]byte{0x94}, instXchg{dest: reg16{value: AX}, src: reg16{value: SP}}},
+		// xchg sp,bx
+		{[]byte{0x87, 0xdc}, instXchg{dest: reg16{value: SP}, src: reg16{value: BX}}},
+		// xchg [si],sp (rm 4 is [si] because there is no [sp] addressing in 16-bit mode)
+		{[]byte{0x87, 0x24}, instXchg{dest: mem16BaseDisp8{base: SI, disp8: 0}, src: reg16{value: SP}}},
+		// xchg [bp+2],al
+		{[]byte{0x86, 0x46, 0x02}, instXchg{dest: mem8BaseDisp8{base: BP, disp8: 2}, src: reg8{value: AL}}},
+	}
+	for _, c := range cases {
+		actual, _, _, err := decodeInst(bytes.NewReader(c.code))
+		if err != nil {
+			t.Errorf("%+v", err)
+		}
+		if actual != c.expected {
+			t.Errorf("expected %v but actual %v", c.expected, actual)
+		}
+	}
+}
+
+func TestXchg(t *testing.T) {
+	var b machineCode
+	b = append(b, []byte{0xb8, 0x34, 0x12}...) // mov ax,0x1234
+	b = append(b, 0x94)                        // xchg ax,sp
+	b = append(b, []byte{0xbe, 0x20, 0x00}...) // mov si,0x0020
+	b = append(b, []byte{0x87, 0x24}...)       // xchg [si],sp
+	b = append(b, 0x90)                        // nop
+
+	cpu := NewCPU()
+	if err := cpu.LoadFlat(b, 0x2000, 0x0000); err != nil {
+		t.Errorf("%+v", err)
+	}
+	if err := cpu.WriteWordAt(0x2000, 0x0020, 0xabcd); err != nil {
+		t.Errorf("%+v", err)
+	}
+	sp := cpu.Registers().SP
+
+	for i := 0; i < 2; i++ {
+		if _, err := cpu.Step(); err != nil {
+			t.Errorf("%+v", err)
+		}
+	}
+	if r := cpu.Registers(); r.AX != sp || r.SP != 0x1234 {
+		t.Errorf("expected ax 0x%04x and sp 0x1234 but ax 0x%04x and sp 0x%04x", sp, r.AX, r.SP)
+	}
+
+	for i := 0; i < 3; i++ {
+		if _, err := cpu.Step(); err != nil {
+			t.Errorf("%+v", err)
+		}
+	}
+	if r := cpu.Registers(); r.SP != 0xabcd || r.AX != sp {
+		t.Errorf("expected sp 0xabcd and ax unchanged but sp 0x%04x and ax 0x%04x", r.SP, r.AX)
+	}
+	if v, err := cpu.ReadWordAt(0x2000, 0x0020); err != nil || v != 0x1234 {
+		t.Errorf("expected [si] to be 0x1234 but 0x%04x (%v)", v, err)
+	}
+}
+
+func TestDecodeLoop(t *testing.T) {
+	// loop -3
+	actual, _, _, err := decodeInst(bytes.NewReader([]byte{0xe2, 0xfd}))
+	if err != nil {
+		t.Errorf("%+v", err)
+	}
+	expected := instLoop{rel8: -3}
+	if actual != expected {
+		t.Errorf("expected %v but actual %v", expected, actual)
+	}
+
+	// loop with ecx as counter is not supported
+	if _, _, _, err := decodeInst(bytes.NewReader([]byte{0x67, 0xe2, 0xfd})); err == nil {
+		t.Errorf("expected error for loop under address-size prefix")
+	}
+}
+
+func TestLoop(t *testing.T) {
+	run := func(cx uint16) Registers {
+		b := machineCode{}.
+			movImm16(AX, 0x0000).
+			movImm16(DX, 0x0000).
+			movImm16(CX, cx).
+			with(0x83, 0xc0, 0x01). // add ax,1
+			with(0x83, 0xd2, 0x00). // adc dx,0
+			with(0xe2, 0xf8).       // loop -8
+			with(0xcd, 0x20)        // int 20h
+
+		cpu := NewCPU()
+		runCom(t, cpu, b)
+		return cpu.Registers()
+	}
+
+	if r := run(3); r.AX != 3 || r.DX != 0 || r.CX != 0 {
+		t.Errorf("expected 3 iterations but dx:ax %04x:%04x and cx 0x%04x", r.DX, r.AX, r.CX)
+	}
+	// CX wraps around from 0 to 0xffff
+	if r := run(0); r.AX != 0 || r.DX != 1 || r.CX != 0 {
+		t.Errorf("expected 65536 iterations but dx:ax %04x:%04x and cx 0x%04x", r.DX, r.AX, r.CX)
+	}
+}
+
+func TestFarJumpTable(t *testing.T) {
+	// table of far pointers (offset, segment) at 0x0020
+	table := []uint16{0x0100, 0x3000, 0x0200, 0x4000}
+
+	cases := []struct {
+		code        []byte
+		index       uint16
+		expectedCS  uint16
+		expectedIP  uint16
+		expectedRet bool
+	}{
+		// jmp far [cs:bx+0x0020]
+		{[]byte{0x2e, 0xff, 0xaf, 0x20, 0x00}, 0, 0x3000, 0x0100, false},
+		{[]byte{0x2e, 0xff, 0xaf, 0x20, 0x00}, 1, 0x4000, 0x0200, false},
+		// call far [cs:bx+0x0020]
+		{[]byte{0x2e, 0xff, 0x9f, 0x20, 0x00}, 1, 0x4000, 0x0200, true},
+	}
+	for _, c := range cases {
+		b := machineCode{}.movImm16(BX, c.index*4).with(c.code...)
+
+		cpu := NewCPU()
+		if err := cpu.LoadFlat(b, 0x2000, 0x0000); err != nil {
+			t.Errorf("%+v", err)
+		}
+		for i, w := range table {
+			if err := cpu.WriteWordAt(0x2000, uint16(0x0020+i*2), w); err != nil {
+				t.Errorf("%+v", err)
+			}
+		}
+		for i := 0; i < 2; i++ {
+			if _, err := cpu.Step(); err != nil {
+				t.Errorf("%+v", err)
+			}
+		}
+
+		r := cpu.Registers()
+		if r.CS != c.expectedCS || r.IP != c.expectedIP {
+			t.Errorf("expected %04x:%04x but %04x:%04x", c.expectedCS, c.expectedIP, r.CS, r.IP)
+		}
+		if !c.expectedRet {
+			continue
+		}
+		// return address is pushed as CS then IP
+		ip, _ := cpu.ReadWordAt(r.SS, r.SP)
+		cs, _ := cpu.ReadWordAt(r.SS, r.SP+2)
+		if cs != 0x2000 || ip != uint16(len(b)) {
+			t.Errorf("expected return address 2000:%04x but %04x:%04x", len(b), cs, ip)
+		}
+	}
+}
+
+func TestFarCallAndReturn(t *testing.T) {
+	// table of far pointers (offset, segment) at 0x0020
+	table := []uint16{0x0040, 0x2000, 0x0050, 0x2000}
+	// mov ax,0x1234; retf
+	retf := []byte{0xb8, 0x34, 0x12, 0xcb}
+	// mov ax,0x1234; retf 2
+	retfImm16 := []byte{0xb8, 0x34, 0x12, 0xca, 0x02, 0x00}
+
+	cases := []struct {
+		index uint16
+	}{
+		{0},
+		{1},
+	}
+	for _, c := range cases {
+		// push cx; call far [cs:bx+0x0020]
+		caller := machineCode{}.movImm16(BX, c.index*4).with(0x51, 0x2e, 0xff, 0x9f, 0x20, 0x00)
+		b := caller.with(make([]byte, 0x40-len(caller))...).with(retf...)
+		b = b.with(make([]byte, 0x50-len(b))...).with(retfImm16...)
+
+		cpu := NewCPU()
+		if err := cpu.LoadFlat(b, 0x2000, 0x0000); err != nil {
+			t.Errorf("%+v", err)
+		}
+		for i, w := range table {
+			if err := cpu.WriteWordAt(0x2000, uint16(0x0020+i*2), w); err != nil {
+				t.Errorf("%+v", err)
+			}
+		}
+		initialSP := cpu.Registers().SP
+		for i := 0; i < 5; i++ {
+			if _, err := cpu.Step(); err != nil {
+				t.Errorf("%+v", err)
+			}
+		}
+
+		r := cpu.Registers()
+		if r.CS != 0x2000 || r.IP != uint16(len(caller)) {
+			t.Errorf("expected 2000:%04x but %04x:%04x", len(caller), r.CS, r.IP)
+		}
+		if r.AX != 0x1234 {
+			t.Errorf("expected 0x1234 but 0x%04x", r.AX)
+		}
+		// retf imm16 also releases the pushed argument
+		expectedSP := initialSP - 2 + c.index*2
+		if r.SP != expectedSP {
+			t.Errorf("expected SP 0x%04x but 0x%04x", expectedSP, r.SP)
+		}
+	}
+}
+
+func TestDecodeCmpAlImm8(t *testing.T) {
+	// cmp al,0x03
+	var reader io.Reader = bytes.NewReader([]byte{0x3c, 0x03})
+	actual, _, _, err := decodeInst(reader)
+	if err != nil {
+		t.Errorf("%+v", err)
+	}
+	dest := reg8{value: AL}
+	src := imm8{value: 0x03}
+	expected := instCmp{dest: dest, src: src}
+	if actual != expected {
+		t.Errorf("expected %v but actual %v", expected, actual)
+	}
+}
+
+func TestDecodeCmpAxImm16(t *testing.T) {
+	// cmp ax,0x1234
+	var reader io.Reader = bytes.NewReader([]byte{0x3d, 0x34, 0x12})
+	actual, _, _, err := decodeInst(reader)
+	if err != nil {
+		t.Errorf("%+v", err)
+	}
+	dest := reg16{value: AX}
+	src := imm16{value: 0x1234}
+	expected := instCmp{dest: dest, src: src}
+	if actual != expected {
+		t.Errorf("expected %v but actual %v", expected, actual)
+	}
+}
+
+func TestDecodeCmpReg16Imm16(t *testing.T) {
+	// cmp bx,0x0064
+	var reader io.Reader = bytes.NewReader([]byte{0x81, 0xfb, 0x64, 0x00})
+	actual, _, _, err := decodeInst(reader)
+	if err != nil {
+		t.Errorf("%+v", err)
+	}
+	dest := reg16{value: BX}
+	src := imm16{value: 0x0064}
+	expected := instCmp{dest: dest, src: src}
+	if actual != expected {
+		t.Errorf("expected %v but actual %v", expected, actual)
+	}
+}
+
+func TestDecodeJb(t *testing.T) {
+	// jb 0x0b
+	var reader io.Reader = bytes.NewReader([]byte{0x72, 0x0b})
+	actual, _, _, err := decodeInst(reader)
+	if err != nil {
+		t.Errorf("%+v", err)
+	}
+	expected := instJb{rel8: 0x0b}
+	if actual != expected {
+		t.Errorf("expeted %v but actual %v", expected, actual)
+	}
+}
+
+func TestDecodeCld(t *testing.T) {
+	// cld
+	var reader io.Reader = bytes.NewReader([]byte{0xfc})
+	actual, _, _, err := decodeInst(reader)
+	if err != nil {
+		t.Errorf("%+v", err)
+	}
+	expected := instCld{}
+	if actual != expected {
+		t.Errorf("expected %v but actual %v", expected, actual)
+	}
+}
+
+func TestDecodeRepeScasb(t *testing.T) {
+	// repe scasb
+	var reader io.Reader = bytes.NewReader([]byte{0xf3, 0xae})
+	actual, _, _, err := decodeInst(reader)
+	if err != nil {
+		t.Errorf("%+v", err)
+	}
+	expected := instRepeScasb{}
+	if actual != expected {
+		t.Errorf("expected %v but actual %v", expected, actual)
+	}
+}
+
+func TestDecodeRepeScasw(t *testing.T) {
+	// repe scasw
+	var reader io.Reader = bytes.NewReader([]byte{0xf3, 0xaf})
+	actual, _, _, err := decodeInst(reader)
+	if err != nil {
+		t.Errorf("%+v", err)
+	}
+	expected := instRepeScasw{}
+	if actual != expected {
+		t.Errorf("expected %v but actual %v", expected, actual)
+	}
+}
+
+func TestDecodeRepMovsb(t *testing.T) {
+	// rep movsb
+	var reader io.Reader = bytes.NewReader([]byte{0xf3, 0xa4})
+	actual, _, _, err := decodeInst(reader)
+	if err != nil {
+		t.Errorf("%+v", err)
+	}
+	expected := instRepMovsb{}
+	if actual != expected {
+		t.Errorf("expected %v but actual %v", expected, actual)
+	}
+}
+
+func TestDecodeRepStosb(t *testing.T) {
+	// rep stosb
+	var reader io.Reader = bytes.NewReader([]byte{0xf3, 0xaa})
+	actual, _, _, err := decodeInst(reader)
+	if err != nil {
+		t.Errorf("%+v", err)
+	}
+	expected := instRepStosb{}
+	if actual != expected {
+		t.Errorf("expected %v but actual %v", expected, actual)
+	}
+}
+
+func TestDecodeRepOnOtherInstructions(t *testing.T) {
+	cases := []struct {
+		code     []byte
+		expected interface{}
+	}{
+		// rep lodsb
+		{[]byte{0xf3, 0xac}, instRep{inst: instLodsb{}}},
+		// rep inc ax
+		{[]byte{0xf3, 0x40}, instRep{inst: instInc{dest: AX}}},
+		// rep es: movsb
+		{[]byte{0xf3, 0x26, 0xa4}, instRepMovsb{}},
+	}
+	for _, c := range cases {
+		actual, n, _, err := decodeInst(bytes.NewReader(c.code))
+		if err != nil {
+			t.Errorf("%+v", err)
+		}
+		if actual != c.expected || n != len(c.code) {
+			t.Errorf("expected %v of %d bytes but actual %v of %d bytes", c.expected, len(c.code), actual, n)
+		}
+	}
+}
+
+func TestRepLodsb(t *testing.T) {
+	memory := newMemory([]byte{})
+	for i, b := range []byte{0x11, 0x22, 0x33, 0x44} {
+		if err := memory.writeByte(newAddress(0x1000, uint16(0x0010+i)), b); err != nil {
+			t.Errorf("%+v", err)
+		}
+	}
+
+	actual := state{ds: 0x1000, si: 0x0010, cx: 3, ax: 0xff00}
+	if err := execute(instRep{inst: instLodsb{}}, &actual, memory, nil); err != nil {
+		t.Errorf("%+v", err)
+	}
+	if actual.ax != 0xff33 || actual.si != 0x0013 || actual.cx != 0 {
+		t.Errorf("expected ax 0xff33, si 0x0013 and cx 0 but actual %+v", actual)
+	}
+
+	// rep is ignored for other instructions
+	actual = state{cx: 3}
+	if err := execute(instRep{inst: instInc{dest: AX}}, &actual, memory, nil); err != nil {
+		t.Errorf("%+v", err)
+	}
+	if actual.ax != 1 || actual.cx != 3 {
+		t.Errorf("expected inc ax to be executed once but actual %+v", actual)
+	}
+}
+
+func TestDecodeJe(t *testing.T) {
+	// je 0x03
+	var reader io.Reader = bytes.NewReader([]byte{0x74, 0x03})
+	actual, _, _, err := decodeInst(reader)
+	if err != nil {
+		t.Errorf("%+v", err)
+	}
+	expected := instJeRel8{rel8: 0x03}
+	if actual != expected {
+		t.Errorf("expected %v but actual %v", expected, actual)
+	}
+}
+
+func TestDecodeInc(t *testing.T) {
+	// inc cx
+	var reader io.Reader = bytes.NewReader([]byte{0x41})
+	actual, _, _, err := decodeInst(reader)
+	if err != nil {
+		t.Errorf("%+v", err)
+	}
+	expected := instInc{dest: CX}
+	if actual != expected {
+		t.Errorf("expected %v but actual %v", expected, actual)
+	}
+}
+
+func TestDecodeStosb(t *testing.T) {
+	// stos m8
+	var reader io.Reader = bytes.NewReader([]byte{0xaa})
+	actual, _, _, err := decodeInst(reader)
+	if err != nil {
+		t.Errorf("%+v", err)
+	}
+	expected := instStosb{}
+	if actual != expected {
+		t.Errorf("expected %v but actual %v", expected, actual)
+	}
+}
+
+func TestDecodeDec(t *testing.T) {
+	// dec di
+	var reader io.Reader = bytes.NewReader([]byte{0x4f})
+	actual, _, _, err := decodeInst(reader)
+	if err != nil {
+		t.Errorf("%+v", err)
+	}
+	expected := instDec{dest: DI}
+	if actual != expected {
+		t.Errorf("expected %v but actual %v", expected, actual)
+	}
+}
+
+func TestDecodeXorReg16Reg16(t *testing.T) {
+	// xor bp,bp
+	var reader io.Reader = bytes.NewReader([]byte{0x33, 0xed})
+	actual, _, _, err := decodeInst(reader)
+	if err != nil {
+		t.Errorf("%+v", err)
+	}
+	dest := reg16{value: BP}
+	src := reg16{value: BP}
+	expected := instXor{dest: dest, src: src}
+	if actual != expected {
+		t.Errorf("expected %v but actual %v", expected, actual)
+	}
+}
+
+func TestDecodeXorMem8Reg8(t *testing.T) {
+	// xor byte ptr 0x0010,al
+	var reader io.Reader = bytes.NewReader([]byte{0x30, 0x06, 0x10, 0x00})
+	actual, _, _, err := decodeInst(reader)
+	if err != nil {
+		t.Errorf("%+v", err)
+	}
+	dest := mem8Disp16{offset: 0x0010}
+	src := reg8{value: AL}
+	expected := instXor{dest: dest, src: src}
+	if actual != expected {
+		t.Errorf("expected %v but actual %v", expected, actual)
+	}
+}
+
+func TestDecodeXorReg8Reg8(t *testing.T) {
+	// xor ah,ah (r/m8,r8 form)
+	var reader io.Reader = bytes.NewReader([]byte{0x30, 0xe4})
+	actual, _, _, err := decodeInst(reader)
+	if err != nil {
+		t.Errorf("%+v", err)
+	}
+	dest := reg8{value: AH}
+	src := reg8{value: AH}
+	expected := instXor{dest: dest, src: src}
+	if actual != expected {
+		t.Errorf("expected %v but actual %v", expected, actual)
+	}
+}
+
+func TestDecodeXorMem16Reg16(t *testing.T) {
+	// xor word ptr -04[bp],dx
+	var reader io.Reader = bytes.NewReader([]byte{0x31, 0x56, 0xfc})
+	actual, _, _, err := decodeInst(reader)
+	if err != nil {
+		t.Errorf("%+v", err)
+	}
+	dest := mem16BaseDisp8{base: BP, disp8: -4}
+	src := reg16{value: DX}
+	expected := instXor{dest: dest, src: src}
+	if actual != expected {
+		t.Errorf("expected %v but actual %v", expected, actual)
+	}
+}
+
+func TestDecodeXorReg8Mem8(t *testing.T) {
+	// xor cl,byte ptr 01[si]
+	var reader io.Reader = bytes.NewReader([]byte{0x32, 0x4c, 0x01})
+	actual, _, _, err := decodeInst(reader)
+	if err != nil {
+		t.Errorf("%+v", err)
+	}
+	dest := reg8{value: CL}
+	src := mem8BaseDisp8{base: SI, disp8: 1}
+	expected := instXor{dest: dest, src: src}
+	if actual != expected {
+		t.Errorf("expected %v but actual %v", expected, actual)
+	}
+}
+
+func TestDecodeXorAlImm8(t *testing.T) {
+	// xor al,0x20
+	var reader io.Reader = bytes.NewReader([]byte{0x34, 0x20})
+	actual, _, _, err := decodeInst(reader)
+	if err != nil {
+		t.Errorf("%+v", err)
+	}
+	dest := reg8{value: AL}
+	src := imm8{value: 0x20}
+	expected := instXor{dest: dest, src: src}
+	if actual != expected {
+		t.Errorf("expected %v but actual %v", expected, actual)
+	}
+}
+
+func TestDecodeXorAxImm16(t *testing.T) {
+	// xor ax,0x1234
+	var reader io.Reader = bytes.NewReader([]byte{0x35, 0x34, 0x12})
+	actual, _, _, err := decodeInst(reader)
+	if err != nil {
+		t.Errorf("%+v", err)
+	}
+	dest := reg16{value: AX}
+	src := imm16{value: 0x1234}
+	expected := instXor{dest: dest, src: src}
+	if actual != expected {
+		t.Errorf("expected %v but actual %v", expected, actual)
+	}
+}
+
+func TestDecodeJae(t *testing.T) {
+	// jae rel8
+	var reader io.Reader = bytes.NewReader([]byte{0x73, 0x16})
+	actual, _, _, err := decodeInst(reader)
+	if err != nil {
+		t.Errorf("%+v", err)
+	}
+	expected := instJae{rel8: 0x16}
+	if actual != expected {
+		t.Errorf("expected %v but actual %v", expected, actual)
+	}
+}
+
+func TestDecodeNegReg16(t *testing.T) {
+	// neg ax
+	var reader io.Reader = bytes.NewReader([]byte{0xf7, 0xd8})
+	actual, _, _, err := decodeInst(reader)
+	if err != nil {
+		t.Errorf("%+v", err)
+	}
+	expected := instNeg{dest: reg16{value: AX}}
+	if actual != expected {
+		t.Errorf("expected %v but actual %v", expected, actual)
+	}
+}
+
+// execute
+
+func TestImm8SignExtendedToWord(t *testing.T) {
+	var b machineCode
+	b = append(b, []byte{0xb8, 0x34, 0x12}...) // mov ax,0x1234
+	b = append(b, []byte{0x83, 0xc0, 0xff}...) // add ax,-1
+	b = append(b, []byte{0xb9, 0xfe, 0xff}...) // mov cx,0xfffe
+	b = append(b, []byte{0x83, 0xf9, 0xfe}...) // cmp cx,-2
+	b = append(b, []byte{0x83, 0xe0, 0xf0}...) // and ax,-16
+	b = append(b, []byte{0x83, 0xc8, 0x80}...) // or ax,-128
+
+	cpu := NewCPU()
+	if err := cpu.LoadFlat(b, 0x2000, 0x0000); err != nil {
+		t.Errorf("%+v", err)
+	}
+	step := func() {
+		if _, err := cpu.Step(); err != nil {
+			t.Fatalf("%+v", err)
+		}
+	}
+
+	// 0x1234 + 0xffff, not 0x1234 + 0x00ff
+	step()
+	step()
+	if cpu.state.ax != 0x1233 || !cpu.state.isActiveCF() {
+		t.Errorf("expected ax 0x1233 with CF but actual 0x%04x", cpu.state.ax)
+	}
+
+	step()
+	step()
+	if !cpu.state.isActiveZF() || cpu.state.isActiveCF() {
+		t.Errorf("expected cx to equal -2 as word")
+	}
+
+	step()
+	if cpu.state.ax != 0x1230 {
+		t.Errorf("expected ax 0x1230 but actual 0x%04x", cpu.state.ax)
+	}
+
+	step()
+	if cpu.state.ax != 0xffb0 {
+		t.Errorf("expected ax 0xffb0 but actual 0x%04x", cpu.state.ax)
+	}
+}
+
+func TestByteFlagsNearSignBoundary(t *testing.T) {
+	cases := []struct {
+		inst     interface{}
+		ax       word
+		cf       bool
+		sf       bool
+		of       bool
+		zf       bool
+		greater  bool // jg after the instruction
+		expected word
+	}{
+		// 127 > -128 as signed byte, but 0x7f < 0x80 as unsigned
+		{instCmp{dest: reg8{value: AL}, src: imm8{value: -128}}, 0x007f, true, true, true, false, true, 0x007f},
+		// -128 < 127
+		{instCmp{dest: reg8{value: AL}, src: imm8{value: 0x7f}}, 0x0080, false, false, true, false, false, 0x0080},
+		// high byte doesn't affect the byte comparison
+		{instCmp{dest: reg8{value: AL}, src: imm8{value: 0x01}}, 0xff00, true, true, false, false, false, 0xff00},
+		// 0x7f + 1 overflows into the sign bit of byte
+		{instAdd{dest: reg8{value: AL}, src: imm8{value: 1}}, 0x007f, false, true, true, false, true, 0x0080},
+		// 0xff + 1 carries out of byte without touching AH
+		{instAdd{dest: reg8{value: AL}, src: imm8{value: 1}}, 0x12ff, true, false, false, true, false, 0x1200},
+		// 0x80 - 1 overflows from negative to positive
+		{instSub{dest: reg8{value: AL}, src: imm8{value: 1}}, 0x0080, false, false, true, false, false, 0x007f},
+	}
+	for _, c := range cases {
+		actual := state{ax: c.ax}
+		if err := executeInst(c.inst, &actual, nil); err != nil {
+			t.Errorf("%+v", err)
+		}
+		if actual.ax != c.expected {
+			t.Errorf("expected ax 0x%04x for %v with 0x%04x but actual 0x%04x", c.expected, c.inst, c.ax, actual.ax)
+		}
+		if actual.isActiveCF() != c.cf || actual.isActiveSF() != c.sf || actual.isActiveOF() != c.of || actual.isActiveZF() != c.zf {
+			t.Errorf("unexpected flags for %v with 0x%04x: eflags 0x%04x", c.inst, c.ax, actual.eflags)
+		}
+		if actual.satisfies(condG) != c.greater {
+			t.Errorf("expected jg to be %v for %v with 0x%04x", c.greater, c.inst, c.ax)
+		}
+	}
+}
+
+func TestAdcSbbWithCarry(t *testing.T) {
+	// 0x7f + 0 + CF overflows as signed byte
+	actual := state{ax: 0x007f, eflags: EFLAGS_CF}
+	if err := execAdc(instAdc{dest: reg8{value: AL}, src: imm8{value: 0}}, &actual, nil); err != nil {
+		t.Errorf("%+v", err)
+	}
+	if actual.ax != 0x0080 || actual.isActiveCF() || !actual.isActiveOF() {
+		t.Errorf("expected al 0x80 with OF but actual %+v", actual)
+	}
+
+	// 0xffff + 0 + CF carries out
+	actual = state{ax: 0xffff, eflags: EFLAGS_CF}
+	if err := execAdc(instAdc{dest: reg16{value: AX}, src: imm16{value: 0}}, &actual, nil); err != nil {
+		t.Errorf("%+v", err)
+	}
+	if actual.ax != 0x0000 || !actual.isActiveCF() || !actual.isActiveZF() {
+		t.Errorf("expected ax 0x0000 with CF and ZF but actual %+v", actual)
+	}
+
+	// 0x0000 - 0 - CF borrows
+	actual = state{ax: 0x0000, eflags: EFLAGS_CF}
+	if err := execSbb(instSbb{dest: reg16{value: AX}, src: imm16{value: 0}}, &actual, nil); err != nil {
+		t.Errorf("%+v", err)
+	}
+	if actual.ax != 0xffff || !actual.isActiveCF() {
+		t.Errorf("expected ax 0xffff with CF but actual %+v", actual)
+	}
+
+	// 0x0005 - 3 without CF
+	actual = state{ax: 0x0005}
+	if err := execSbb(instSbb{dest: reg16{value: AX}, src: imm16{value: 3}}, &actual, nil); err != nil {
+		t.Errorf("%+v", err)
+	}
+	if actual.ax != 0x0002 || actual.isActiveCF() {
+		t.Errorf("expected ax 0x0002 without CF but actual %+v", actual)
+	}
+}
+
+func TestAddOverflow(t *testing.T) {
+	// 0x7fff + 1
+	inst := instAdd{dest: reg16{value: AX}, src: imm8{value: 1}}
+	actual := state{ax: 0x7fff}
+	err := execAdd(inst, &actual, nil)
+	if err != nil {
+		t.Errorf("%+v", err)
+	}
+	if actual.ax != 0x8000 {
+		t.Errorf("expected 0x%04x but actual 0x%04x", 0x8000, actual.ax)
+	}
+	if !actual.isActiveOF() {
+		t.Errorf("expected OF to be set")
+	}
+
+	// 0x7ffe + 1
+	actual = state{ax: 0x7ffe}
+	err = execAdd(inst, &actual, nil)
+	if err != nil {
+		t.Errorf("%+v", err)
+	}
+	if actual.isActiveOF() {
+		t.Errorf("expected OF to be reset")
+	}
+}
+
+func TestSubOverflow(t *testing.T) {
+	// 0x8000 - 1
+	inst := instSub{dest: reg16{value: AX}, src: imm8{value: 1}}
+	actual := state{ax: 0x8000}
+	err := execSub(inst, &actual, nil)
+	if err != nil {
+		t.Errorf("%+v", err)
+	}
+	if actual.ax != 0x7fff {
+		t.Errorf("expected 0x%04x but actual 0x%04x", 0x7fff, actual.ax)
+	}
+	if !actual.isActiveOF() {
+		t.Errorf("expected OF to be set")
+	}
+
+	// 0x8001 - 1
+	actual = state{ax: 0x8001}
+	err = execSub(inst, &actual, nil)
+	if err != nil {
+		t.Errorf("%+v", err)
+	}
+	if actual.isActiveOF() {
+		t.Errorf("expected OF to be reset")
+	}
+}
+
+func TestCmpOverflow(t *testing.T) {
+	// cmp 0x8000,1
+	inst := instCmp{dest: reg16{value: AX}, src: imm8{value: 1}}
+	actual := state{ax: 0x8000}
+	err := execCmp(inst, &actual, nil)
+	if err != nil {
+		t.Errorf("%+v", err)
+	}
+	if !actual.isActiveOF() {
+		t.Errorf("expected OF to be set")
+	}
+}
+
+func TestCmpSignedAndUnsigned(t *testing.T) {
+	inst := instCmp{dest: reg16{value: AX}, src: imm16{value: -1}}
+
+	// cmp 0x0001,0xffff: below as unsigned, greater as signed
+	actual := state{ax: 0x0001}
+	err := execCmp(inst, &actual, nil)
+	if err != nil {
+		t.Errorf("%+v", err)
+	}
+	if !actual.isActiveCF() {
+		t.Errorf("expected CF to be set")
+	}
+	if actual.isActiveZF() {
+		t.Errorf("expected ZF to be reset")
+	}
+	if actual.isActiveSF() != actual.isActiveOF() {
+		t.Errorf("expected SF == OF (greater as signed)")
+	}
+
+	// cmp 0xffff,0x0001: above as unsigned, less as signed
+	inst = instCmp{dest: reg16{value: AX}, src: imm16{value: 1}}
+	actual = state{ax: 0xffff}
+	err = execCmp(inst, &actual, nil)
+	if err != nil {
+		t.Errorf("%+v", err)
+	}
+	if actual.isActiveCF() {
+		t.Errorf("expected CF to be reset")
+	}
+	if actual.isActiveZF() {
+		t.Errorf("expected ZF to be reset")
+	}
+	if actual.isActiveSF() == actual.isActiveOF() {
+		t.Errorf("expected SF != OF (less as signed)")
+	}
+}
+
+func TestIncDecOverflow(t *testing.T) {
+	actual := state{cx: 0x7fff}
+	err := execInc(instInc{dest: CX}, &actual)
+	if err != nil {
+		t.Errorf("%+v", err)
+	}
+	if !actual.isActiveOF() {
+		t.Errorf("expected OF to be set by inc")
+	}
+
+	actual = state{cx: 0x8000}
+	err = execDec(instDec{dest: CX}, &actual)
+	if err != nil {
+		t.Errorf("%+v", err)
+	}
+	if !actual.isActiveOF() {
+		t.Errorf("expected OF to be set by dec")
+	}
+}
+
+func TestSignFlagByte(t *testing.T) {
+	// sub al,1 with al=0 leaves 0xff
+	inst := instSub{dest: reg8{value: AL}, src: imm8{value: 1}}
+	actual := state{ax: 0x1200}
+	err := execSub(inst, &actual, nil)
+	if err != nil {
+		t.Errorf("%+v", err)
+	}
+	if actual.ax != 0x12ff {
+		t.Errorf("expected 0x%04x but actual 0x%04x", 0x12ff, actual.ax)
+	}
+	if !actual.isActiveSF() {
+		t.Errorf("expected SF to be set")
+	}
+
+	// add al,1 with al=0x7e leaves 0x7f
+	actual = state{ax: 0x007e}
+	err = execAdd(instAdd{dest: reg8{value: AL}, src: imm8{value: 1}}, &actual, nil)
+	if err != nil {
+		t.Errorf("%+v", err)
+	}
+	if actual.isActiveSF() {
+		t.Errorf("expected SF to be reset")
+	}
+}
+
+func TestSignFlagWord(t *testing.T) {
+	// add ax,bx leaves 0xfffe
+	inst := instAdd{dest: reg16{value: AX}, src: reg16{value: BX}}
+	actual := state{ax: 0xffff, bx: 0xffff}
+	err := execAdd(inst, &actual, nil)
+	if err != nil {
+		t.Errorf("%+v", err)
+	}
+	if actual.ax != 0xfffe {
+		t.Errorf("expected 0x%04x but actual 0x%04x", 0xfffe, actual.ax)
+	}
+	if !actual.isActiveSF() {
+		t.Errorf("expected SF to be set")
+	}
+
+	// cmp ax,bx with ax < bx
+	actual = state{ax: 1, bx: 2}
+	err = execCmp(instCmp{dest: reg16{value: AX}, src: reg16{value: BX}}, &actual, nil)
+	if err != nil {
+		t.Errorf("%+v", err)
+	}
+	if !actual.isActiveSF() {
+		t.Errorf("expected SF to be set by cmp")
+	}
+
+	// dec cx with cx=0
+	actual = state{cx: 0}
+	err = execDec(instDec{dest: CX}, &actual)
+	if err != nil {
+		t.Errorf("%+v", err)
+	}
+	if !actual.isActiveSF() {
+		t.Errorf("expected SF to be set by dec")
+	}
+}
+
+func TestParityFlag(t *testing.T) {
+	// 0x0102 + 1 = 0x0103, whose low byte has two set bits
+	actual := state{ax: 0x0102}
+	err := execAdd(instAdd{dest: reg16{value: AX}, src: imm8{value: 1}}, &actual, nil)
+	if err != nil {
+		t.Errorf("%+v", err)
+	}
+	if !actual.isActivePF() {
+		t.Errorf("expected PF to be set")
+	}
+
+	// cmp al,0x03 with al=0x04 leaves 0x01
+	actual = state{ax: 0x0004}
+	err = execCmp(instCmp{dest: reg8{value: AL}, src: imm8{value: 3}}, &actual, nil)
+	if err != nil {
+		t.Errorf("%+v", err)
+	}
+	if actual.isActivePF() {
+		t.Errorf("expected PF to be reset")
+	}
+}
+
+func TestAuxiliaryCarryFlag(t *testing.T) {
+	// 0x0f + 0x01 carries out of the low nibble only
+	actual := state{ax: 0x000f}
+	err := execAdd(instAdd{dest: reg8{value: AL}, src: imm8{value: 1}}, &actual, nil)
+	if err != nil {
+		t.Errorf("%+v", err)
+	}
+	if actual.al() != 0x10 {
+		t.Errorf("expected 0x%02x but actual 0x%02x", 0x10, actual.al())
+	}
+	if !actual.isActiveAF() {
+		t.Errorf("expected AF to be set")
+	}
+
+	// 0x10 - 0x01 borrows from bit 4
+	actual = state{ax: 0x0010}
+	err = execSub(instSub{dest: reg8{value: AL}, src: imm8{value: 1}}, &actual, nil)
+	if err != nil {
+		t.Errorf("%+v", err)
+	}
+	if !actual.isActiveAF() {
+		t.Errorf("expected AF to be set by sub")
+	}
+
+	// 0x21 + 0x01 has no carry out of the low nibble
+	actual = state{ax: 0x0021}
+	err = execAdd(instAdd{dest: reg8{value: AL}, src: imm8{value: 1}}, &actual, nil)
+	if err != nil {
+		t.Errorf("%+v", err)
+	}
+	if actual.isActiveAF() {
+		t.Errorf("expected AF to be reset")
+	}
+
+	// inc cx from 0x000f
+	actual = state{cx: 0x000f}
+	err = execInc(instInc{dest: CX}, &actual)
+	if err != nil {
+		t.Errorf("%+v", err)
+	}
+	if !actual.isActiveAF() {
+		t.Errorf("expected AF to be set by inc")
+	}
+}
+
+func TestIncFlags(t *testing.T) {
+	// inc from 0xffff to 0x0000 keeps CF
+	actual := state{cx: 0xffff}.setCF()
+	err := execInc(instInc{dest: CX}, &actual)
+	if err != nil {
+		t.Errorf("%+v", err)
+	}
+	if actual.cx != 0x0000 {
+		t.Errorf("expected 0x%04x but actual 0x%04x", 0x0000, actual.cx)
+	}
+	if !actual.isActiveZF() {
+		t.Errorf("expected ZF to be set")
+	}
+	if !actual.isActiveCF() {
+		t.Errorf("expected CF to be unchanged")
+	}
+
+	// inc from 0x7fff to 0x8000
+	actual = state{cx: 0x7fff}
+	err = execInc(instInc{dest: CX}, &actual)
+	if err != nil {
+		t.Errorf("%+v", err)
+	}
+	if !actual.isActiveOF() {
+		t.Errorf("expected OF to be set")
+	}
+	if !actual.isActiveSF() {
+		t.Errorf("expected SF to be set")
+	}
+	if actual.isActiveCF() {
+		t.Errorf("expected CF to be unchanged")
+	}
+}
+
+func TestDecFlags(t *testing.T) {
+	// dec from 0x0001 to 0x0000
+	actual := state{si: 0x0001}
+	err := execDec(instDec{dest: SI}, &actual)
+	if err != nil {
+		t.Errorf("%+v", err)
+	}
+	if !actual.isActiveZF() {
+		t.Errorf("expected ZF to be set")
+	}
+
+	// dec from 0x0000 to 0xffff keeps CF
+	actual = state{si: 0x0000}
+	err = execDec(instDec{dest: SI}, &actual)
+	if err != nil {
+		t.Errorf("%+v", err)
+	}
+	if actual.si != 0xffff {
+		t.Errorf("expected 0x%04x but actual 0x%04x", 0xffff, actual.si)
+	}
+	if actual.isActiveCF() {
+		t.Errorf("expected CF to be unchanged")
+	}
+	if !actual.isActiveSF() {
+		t.Errorf("expected SF to be set")
+	}
+}
+
+func TestNegOverflow(t *testing.T) {
+	// neg 0x8000 stays 0x8000
+	actual := state{ax: 0x8000}
+	err := execNeg(instNeg{dest: reg16{value: AX}}, &actual, nil)
+	if err != nil {
+		t.Errorf("%+v", err)
+	}
+	if actual.ax != 0x8000 {
+		t.Errorf("expected 0x%04x but actual 0x%04x", 0x8000, actual.ax)
+	}
+	if !actual.isActiveOF() {
+		t.Errorf("expected OF to be set")
+	}
+	if !actual.isActiveCF() {
+		t.Errorf("expected CF to be set")
+	}
+}
+
+func TestDiv(t *testing.T) {
+	cases := []struct {
+		inst       interface{}
+		before     state
+		expectedAX word
+		expectedDX word
+	}{
+		// 0x0107 / 0x10 = 0x10 ... 0x07
+		{instDiv{src: reg8{value: BL}}, state{ax: 0x0107, bx: 0x0010}, 0x0710, 0x0000},
+		// 0x00012345 / 0x0100 = 0x0123 ... 0x0045
+		{instDiv{src: reg16{value: BX}}, state{ax: 0x2345, dx: 0x0001, bx: 0x0100}, 0x0123, 0x0045},
+		// -7 / 2 = -3 ... -1
+		{instIdiv{src: reg8{value: BL}}, state{ax: 0xfff9, bx: 0x0002}, 0xfffd, 0x0000},
+		// -100000 / 7 = -14285 ... -5
+		{instIdiv{src: reg16{value: BX}}, state{ax: 0x7960, dx: 0xfffe, bx: 0x0007}, 0xc833, 0xfffb},
+	}
+	for _, c := range cases {
+		actual := c.before
+		err := executeInst(c.inst, &actual, nil)
+		if err != nil {
+			t.Errorf("%+v", err)
+		}
+		if actual.ax != c.expectedAX || actual.dx != c.expectedDX {
+			t.Errorf("%T: expected ax 0x%04x, dx 0x%04x but actual ax 0x%04x, dx 0x%04x",
+				c.inst, c.expectedAX, c.expectedDX, actual.ax, actual.dx)
+		}
+	}
+}
+
+func TestDivideError(t *testing.T) {
+	cases := []struct {
+		inst   interface{}
+		before state
+	}{
+		// division by zero
+		{instDiv{src: reg8{value: BL}}, state{ax: 0x0001}},
+		// quotient 0x100 doesn't fit in AL
+		{instDiv{src: reg8{value: BL}}, state{ax: 0x0200, bx: 0x0002}},
+		// quotient 128 doesn't fit in AL as signed
+		{instIdiv{src: reg8{value: BL}}, state{ax: 0x0100, bx: 0x0002}},
+		{instIdiv{src: reg16{value: BX}}, state{ax: 0x0001}},
+	}
+	for _, c := range cases {
+		called := false
+		c.before.interruptHandlers = interruptHandlers{
+			0x00: func(s *state, m *memory) error {
+				called = true
+				return nil
+			},
+		}
+		if err := executeInst(c.inst, &c.before, nil); err != nil {
+			t.Errorf("%+v", err)
+		}
+		if !called {
+			t.Errorf("%T: expected int 0 handler to be called for %+v", c.inst, c.before)
+		}
+
+		// error without handler of int 0
+		c.before.interruptHandlers = nil
+		if err := executeInst(c.inst, &c.before, nil); err == nil {
+			t.Errorf("%T: expected divide error", c.inst)
+		}
+	}
+}
+
+func TestJccRel16(t *testing.T) {
+	inst := instJccRel16{cond: condNE, rel: -0x0200}
+	actual := state{ip: 0x1000}
+	err := execJccRel16(inst, &actual)
+	if err != nil {
+		t.Errorf("%+v", err)
+	}
+	if actual.ip != 0x0e00 {
+		t.Errorf("expected to jump to 0x0e00 but actual 0x%04x", actual.ip)
+	}
+
+	actual = state{ip: 0x1000}.setZF()
+	err = execJccRel16(inst, &actual)
+	if err != nil {
+		t.Errorf("%+v", err)
+	}
+	if actual.ip != 0x1000 {
+		t.Errorf("expected not to jump but actual 0x%04x", actual.ip)
+	}
+}
+
+func TestSetccAfterCmp(t *testing.T) {
+	cases := []struct {
+		l, r     word
+		cond     condition
+		expected word
+	}{
+		{0x0001, 0x0001, condE, 1},
+		{0x0001, 0x0002, condE, 0},
+		// -1 < 1 as signed but not as unsigned
+		{0xffff, 0x0001, condL, 1},
+		{0xffff, 0x0001, condB, 0},
+		{0x0001, 0xffff, condG, 1},
+		{0x0001, 0xffff, condA, 0},
+		{0x0002, 0x0002, condGE, 1},
+		{0x0002, 0x0002, condLE, 1},
+	}
+	for _, c := range cases {
+		s := state{ax: c.l, bx: c.r, cx: 0xffff}
+		err := execCmp(instCmp{dest: reg16{value: AX}, src: reg16{value: BX}}, &s, nil)
+		if err != nil {
+			t.Errorf("%+v", err)
+		}
+		err = execSetcc(instSetcc{cond: c.cond, dest: reg8{value: CL}}, &s, nil)
+		if err != nil {
+			t.Errorf("%+v", err)
+		}
+		if s.cx != 0xff00|c.expected {
+			t.Errorf("set%v after cmp 0x%04x,0x%04x: expected cl %d but actual cx 0x%04x", c.cond, c.l, c.r, c.expected, s.cx)
+		}
+	}
+}
+
+func TestDaaDasAfterAddSub(t *testing.T) {
+	cases := []struct {
+		op         interface{}
+		adjust     interface{}
+		al, bl     word
+		expectedAL uint8
+		expectedCF bool
+	}{
+		// 38 + 45 = 83
+		{instAdd{dest: reg8{value: AL}, src: reg8{value: BL}}, instDaa{}, 0x38, 0x45, 0x83, false},
+		// 99 + 01 = 100
+		{instAdd{dest: reg8{value: AL}, src: reg8{value: BL}}, instDaa{}, 0x99, 0x01, 0x00, true},
+		// 83 - 45 = 38
+		{instSub{dest: reg8{value: AL}, src: reg8{value: BL}}, instDas{}, 0x83, 0x45, 0x38, false},
+		// 12 - 34 = -22, which is 78 with borrow
+		{instSub{dest: reg8{value: AL}, src: reg8{value: BL}}, instDas{}, 0x12, 0x34, 0x78, true},
+	}
+	for _, c := range cases {
+		s := state{ax: c.al, bx: c.bl}
+		err := executeInst(c.op, &s, nil)
+		if err != nil {
+			t.Errorf("%+v", err)
+		}
+		err = executeInst(c.adjust, &s, nil)
+		if err != nil {
+			t.Errorf("%+v", err)
+		}
+		if s.al() != c.expectedAL || s.isActiveCF() != c.expectedCF {
+			t.Errorf("%T of 0x%02x and 0x%02x: expected 0x%02x (CF %v) but actual 0x%02x (CF %v)",
+				c.adjust, c.al, c.bl, c.expectedAL, c.expectedCF, s.al(), s.isActiveCF())
+		}
+	}
+}
+
+func TestUnpackedBCDAdjust(t *testing.T) {
+	// 9 + 8 = 17
+	s := state{ax: 0x0009, bx: 0x0008}
+	err := executeInst(instAdd{dest: reg8{value: AL}, src: reg8{value: BL}}, &s, nil)
+	if err != nil {
+		t.Errorf("%+v", err)
+	}
+	err = executeInst(instAaa{}, &s, nil)
+	if err != nil {
+		t.Errorf("%+v", err)
+	}
+	if s.ax != 0x0107 || !s.isActiveCF() {
+		t.Errorf("aaa: expected 0x0107 but actual 0x%04x", s.ax)
+	}
+
+	// 13 - 5 = 8
+	s = state{ax: 0x0103, bx: 0x0005}
+	err = executeInst(instSub{dest: reg8{value: AL}, src: reg8{value: BL}}, &s, nil)
+	if err != nil {
+		t.Errorf("%+v", err)
+	}
+	err = executeInst(instAas{}, &s, nil)
+	if err != nil {
+		t.Errorf("%+v", err)
+	}
+	if s.ax != 0x0008 || !s.isActiveCF() {
+		t.Errorf("aas: expected 0x0008 but actual 0x%04x", s.ax)
+	}
+
+	// 63 = 6 * 10 + 3
+	s = state{ax: 0x003f}
+	err = executeInst(instAam{base: 10}, &s, nil)
+	if err != nil {
+		t.Errorf("%+v", err)
+	}
+	if s.ax != 0x0603 {
+		t.Errorf("aam: expected 0x0603 but actual 0x%04x", s.ax)
+	}
+	err = executeInst(instAad{base: 10}, &s, nil)
+	if err != nil {
+		t.Errorf("%+v", err)
+	}
+	if s.ax != 0x003f {
+		t.Errorf("aad: expected 0x003f but actual 0x%04x", s.ax)
+	}
+
+	// aam with base 0 is divide error
+	if err := executeInst(instAam{base: 0}, &state{ax: 0x003f}, nil); err == nil {
+		t.Errorf("aam: expected divide error")
+	}
+}
+
+func TestMovzxMovsx(t *testing.T) {
+	cases := []struct {
+		inst     interface{}
+		expected word
+	}{
+		{instMovzx{dest: reg16{value: AX}, src: reg8{value: BL}}, 0x0080},
+		{instMovsx{dest: reg16{value: AX}, src: reg8{value: BL}}, 0xff80},
+		{instMovsx{dest: reg16{value: AX}, src: reg8{value: BH}}, 0x007f},
+	}
+	for _, c := range cases {
+		actual := state{ax: 0x1234, bx: 0x7f80}
+		err := executeInst(c.inst, &actual, nil)
+		if err != nil {
+			t.Errorf("%+v", err)
+		}
+		if actual.ax != c.expected {
+			t.Errorf("%T: expected 0x%04x but actual 0x%04x", c.inst, c.expected, actual.ax)
+		}
+	}
+}
+
+func TestShlOverflow(t *testing.T) {
+	// shl 0x4000,1 changes the sign bit
+	inst := instShl{dest: reg16{value: AX}, src: imm8{value: 1}}
+	actual := state{ax: 0x4000}
+	err := execShl(inst, &actual, nil)
+	if err != nil {
+		t.Errorf("%+v", err)
+	}
+	if !actual.isActiveOF() {
+		t.Errorf("expected OF to be set")
+	}
+}
+
+func TestShlCarry(t *testing.T) {
+	// shl al,1 shifts the top bit out into CF
+	inst := instShl{dest: reg8{value: AL}, src: imm8{value: 1}}
+	actual := state{ax: 0x0081}
+	err := execShl(inst, &actual, nil)
+	if err != nil {
+		t.Errorf("%+v", err)
+	}
+	if actual.ax != 0x0002 {
+		t.Errorf("expected 0x0002 but actual 0x%04x", actual.ax)
+	}
+	if !actual.isActiveCF() {
+		t.Errorf("expected CF to be set")
+	}
+	if !actual.isActiveOF() {
+		t.Errorf("expected OF to be set")
+	}
+
+	// shl ax,4 leaves in CF the last bit shifted out, which is bit 12
+	inst = instShl{dest: reg16{value: AX}, src: imm8{value: 4}}
+	actual = state{ax: 0x1000}
+	err = execShl(inst, &actual, nil)
+	if err != nil {
+		t.Errorf("%+v", err)
+	}
+	if actual.ax != 0x0000 {
+		t.Errorf("expected 0x0000 but actual 0x%04x", actual.ax)
+	}
+	if !actual.isActiveCF() {
+		t.Errorf("expected CF to be set")
+	}
+	if !actual.isActiveZF() {
+		t.Errorf("expected ZF to be set")
+	}
+
+	// shl ax,4 with bit 12 clear resets CF
+	actual = state{ax: 0x8fff, eflags: EFLAGS_CF}
+	err = execShl(inst, &actual, nil)
+	if err != nil {
+		t.Errorf("%+v", err)
+	}
+	if actual.isActiveCF() {
+		t.Errorf("expected CF to be reset")
+	}
+	if !actual.isActiveSF() {
+		t.Errorf("expected SF to be set")
+	}
+}
+
+func TestShiftCountMask(t *testing.T) {
+	// counts are masked to 5 bits, so 0x20, 0x80 and 0xff shift by 0, 0 and 31
+	cases := []struct {
+		inst     interface{}
+		count    int8
+		expected word
+	}{
+		{instShl{}, 0x20, 0x1234},
+		{instShl{}, -0x80, 0x1234},
+		{instShl{}, -0x01, 0x0000},
+		{instShr{}, 0x20, 0x1234},
+		{instShr{}, -0x01, 0x0000},
+	}
+	for _, c := range cases {
+		dest, src := reg16{value: AX}, imm8{value: c.count}
+		actual := state{ax: 0x1234, eflags: EFLAGS_RESERVED}
+		var err error
+		switch c.inst.(type) {
+		case instShl:
+			err = execShl(instShl{dest: dest, src: src}, &actual, nil)
+		case instShr:
+			err = execShr(instShr{dest: dest, src: src}, &actual, nil)
+		}
+		if err != nil {
+			t.Errorf("%+v", err)
+		}
+		if actual.ax != c.expected {
+			t.Errorf("%T by 0x%02x: expected 0x%04x but actual 0x%04x", c.inst, uint8(c.count), c.expected, actual.ax)
+		}
+		if c.expected != 0 && actual.eflags != EFLAGS_RESERVED {
+			t.Errorf("%T by 0x%02x: expected flags to be unchanged but 0x%04x", c.inst, uint8(c.count), actual.eflags)
+		}
+	}
+}
+
+func TestShrCarry(t *testing.T) {
+	// shr ax,1 shifts the bottom bit out into CF and OF is the old MSB
+	inst := instShr{dest: reg16{value: AX}, src: imm8{value: 1}}
+	actual := state{ax: 0x8001}
+	err := execShr(inst, &actual, nil)
+	if err != nil {
+		t.Errorf("%+v", err)
+	}
+	if actual.ax != 0x4000 {
+		t.Errorf("expected 0x4000 but actual 0x%04x", actual.ax)
+	}
+	if !actual.isActiveCF() {
+		t.Errorf("expected CF to be set")
+	}
+	if !actual.isActiveOF() {
+		t.Errorf("expected OF to be set")
+	}
+	if actual.isActiveSF() {
+		t.Errorf("expected SF to be reset")
+	}
+
+	// shr al,3 leaves in CF the last bit shifted out, which is bit 2
+	inst = instShr{dest: reg8{value: AL}, src: imm8{value: 3}}
+	actual = state{ax: 0x0004}
+	err = execShr(inst, &actual, nil)
+	if err != nil {
+		t.Errorf("%+v", err)
+	}
+	if actual.ax != 0x0000 {
+		t.Errorf("expected 0x0000 but actual 0x%04x", actual.ax)
+	}
+	if !actual.isActiveCF() {
+		t.Errorf("expected CF to be set")
+	}
+	if !actual.isActiveZF() {
+		t.Errorf("expected ZF to be set")
+	}
+
+	// shr al,3 with bit 2 clear resets CF
+	actual = state{ax: 0x00fb, eflags: EFLAGS_CF}
+	err = execShr(inst, &actual, nil)
+	if err != nil {
+		t.Errorf("%+v", err)
+	}
+	if actual.isActiveCF() {
+		t.Errorf("expected CF to be reset")
+	}
+}
+
+func TestMovRoundTripMemoryOperands(t *testing.T) {
+	initState := state{ds: 0x1000, ss: 0x2000, es: 0x3000, bp: 0x0010, di: 0x0020, ax: 0xbeef}
+
+	cases := []struct {
+		dest     operand
+		src      operand
+		tmp      operand
+		override *segmentOverride
+		address  *address
+		expected []byte
+	}{
+		// word through [bp-2] in SS
+		{mem16BaseDisp8{base: BP, disp8: -2}, reg16{value: AX}, reg16{value: CX}, nil, newAddress(0x2000, 0x000e), []byte{0xef, 0xbe}},
+		{mem16BaseDisp8{base: BP, disp8: -2}, reg16{value: AX}, reg16{value: CX}, &segmentOverride{sreg: ES}, newAddress(0x3000, 0x000e), []byte{0xef, 0xbe}},
+		// byte through [di+3] in DS
+		{mem8BaseDisp8{base: DI, disp8: 3}, reg8{value: AL}, reg8{value: CL}, nil, newAddress(0x1000, 0x0023), []byte{0xef}},
+		{mem8BaseDisp8{base: DI, disp8: 3}, reg8{value: AL}, reg8{value: CL}, &segmentOverride{sreg: ES}, newAddress(0x3000, 0x0023), []byte{0xef}},
+		// word through [bp+di+0x100] in SS
+		{mem16BaseIndexDisp{base: BP, index: DI, disp: 0x100}, reg16{value: AX}, reg16{value: CX}, nil, newAddress(0x2000, 0x0130), []byte{0xef, 0xbe}},
+	}
+	for _, c := range cases {
+		memory := newMemory([]byte{})
+		actual := initState
+		if err := execute(instMov{dest: c.dest, src: c.src}, &actual, memory, c.override); err != nil {
+			t.Errorf("%+v", err)
+		}
+		stored, err := memory.readBytesAt(c.address, len(c.expected))
+		if err != nil {
+			t.Errorf("%+v", err)
+		}
+		if !bytes.Equal(stored, c.expected) {
+			t.Errorf("expected % x at %04x:%04x for %v with %v but actual % x", c.expected, c.address.seg, c.address.offset, c.dest, c.override, stored)
+		}
+
+		if err := execute(instMov{dest: c.tmp, src: c.dest}, &actual, memory, c.override); err != nil {
+			t.Errorf("%+v", err)
+		}
+		v, _ := c.tmp.read(actual, memory)
+		w, _ := c.src.read(actual, memory)
+		if v != w {
+			t.Errorf("expected 0x%x to be read back from %v with %v but actual 0x%x", w, c.dest, c.override, v)
+		}
+	}
+}
+
+func TestSegmentOverrideOnAddressingForms(t *testing.T) {
+	memory := newMemory([]byte{})
+	for seg, v := range map[uint16]word{0x1000: 0x1111, 0x2000: 0x2222, 0x3000: 0x3333} {
+		if err := memory.writeWord(newAddress(seg, 0x0010), v); err != nil {
+			t.Errorf("%+v", err)
+		}
+	}
+	initState := state{ds: 0x1000, ss: 0x2000, cs: 0x3000, es: 0x3000, bx: 0x0010, bp: 0x0010}
+
+	cases := []struct {
+		src      operand
+		override *segmentOverride
+		expected int
+	}{
+		// [bx] addresses DS by default
+		{mem16BaseDisp8{base: BX, disp8: 0}, nil, 0x1111},
+		{mem16BaseDisp8{base: BX, disp8: 0}, &segmentOverride{sreg: CS}, 0x3333},
+		// [bp] addresses SS by default
+		{mem16BaseDisp16{base: BP, disp16: 0}, nil, 0x2222},
+		{mem16BaseDisp16{base: BP, disp16: 0}, &segmentOverride{sreg: DS}, 0x1111},
+		// [bp+si]
+		{mem16BaseIndexDisp{base: BP, index: SI, disp: 0}, &segmentOverride{sreg: ES}, 0x3333},
+		// moffs
+		{mem16Disp16{offset: 0x0010}, &segmentOverride{sreg: SS}, 0x2222},
+	}
+	for _, c := range cases {
+		inst := instMov{dest: reg16{value: AX}, src: c.src}
+		actual := initState
+		err := execute(inst, &actual, memory, c.override)
+		if err != nil {
+			t.Errorf("%+v", err)
+		}
+		if int(actual.ax) != c.expected {
+			t.Errorf("expected 0x%04x for %v with %v but actual 0x%04x", c.expected, c.src, c.override, actual.ax)
+		}
+		if actual.segmentOverride != nil {
+			t.Errorf("expected segment override to be cleared after execution")
+		}
+	}
+}
+
+// run
+
+func (code machineCode) withMov() machineCode {
+	// mov ax,1
+	mov := []byte{0xb8, 0x01, 0x00}
+	return append(code, mov...)
+}
+
+func (code machineCode) withInt21_4c() machineCode {
+	// mov ah, 4c
+	// int 21h
+	int21 := []byte{0xb4, 0x4c, 0xcd, 0x21}
+	return append(code, int21...)
+}
+
+// small assembler for tests, which appends the encoding of one instruction
+
+// mov r8,imm8
+func (code machineCode) movImm8(reg registerB, v uint8) machineCode {
+	return append(code, 0xb0+byte(reg), v)
+}
+
+// mov r16,imm16
+func (code machineCode) movImm16(reg registerW, v uint16) machineCode {
+	return append(code, 0xb8+byte(reg), byte(v), byte(v>>8))
+}
+
+// cmp al,imm8
+func (code machineCode) cmpAlImm8(v uint8) machineCode {
+	return append(code, 0x3c, v)
+}
+
+// jmp short rel8, relative to the next instruction
+func (code machineCode) jmp(rel int8) machineCode {
+	return append(code, 0xeb, byte(rel))
+}
+
+// je short rel8, relative to the next instruction
+func (code machineCode) je(rel int8) machineCode {
+	return append(code, 0x74, byte(rel))
+}
+
+// mov ah,function and int 21h
+func (code machineCode) int21(ah uint8) machineCode {
+	return code.movImm8(AH, ah).with(0xcd, 0x21)
+}
+
+// raw bytes
+func (code machineCode) with(bs ...byte) machineCode {
+	return append(code, bs...)
+}
+
+// load code as a COM program and run it until exit
+func runCom(t *testing.T, cpu *CPU, code machineCode) uint8 {
+	if err := cpu.LoadCom(bytes.NewReader(code)); err != nil {
+		t.Errorf("%+v", err)
+	}
+	exitCode, err := cpu.Run()
+	if err != nil {
+		t.Errorf("%+v", err)
+	}
+	return exitCode
+}
+
+func TestMachineCodeBuilder(t *testing.T) {
+	actual := machineCode{}.movImm16(AX, 0x1035).movImm8(BL, 0x02).cmpAlImm8(0x35).je(2).jmp(-2).int21(0x4c)
+	expected := []byte{
+		0xb8, 0x35, 0x10, // mov ax,0x1035
+		0xb3, 0x02, // mov bl,2
+		0x3c, 0x35, // cmp al,35h
+		0x74, 0x02, // je +2
+		0xeb, 0xfe, // jmp -2
+		0xb4, 0x4c, 0xcd, 0x21, // mov ah,4ch; int 21h
+	}
+	if !bytes.Equal(actual, expected) {
+		t.Errorf("expected % x but actual % x", expected, actual)
+	}
+}
+
+func TestRunComWithMachineCodeBuilder(t *testing.T) {
+	// exit with 1 if al equals 0x35, otherwise with 2
+	b := machineCode{}.
+		movImm16(AX, 0x1035).
+		cmpAlImm8(0x35).
+		je(4).
+		movImm8(AL, 0x02).
+		jmp(2).
+		movImm8(AL, 0x01).
+		int21(0x4c)
+
+	exitCode, _, err := RunCom(bytes.NewReader(b))
+	if err != nil {
+		t.Errorf("%+v", err)
+	}
+	if exitCode != 1 {
+		t.Errorf("expected exit code 1 but actual %d", exitCode)
+	}
+}
+
+// headers for tests declare an image of one full page so that appended code is loaded
+func rawHeaderForRunExe() machineCode {
+	return []byte{
+		0x4d, 0x5a, 0x00, 0x00, 0x01, 0x00, 0x00, 0x00, 0x02, 0x00, 0x01, 0x01, 0xff, 0xff, 0x01, 0x00,
+		0x00, 0x10, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x20, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00,
+	}
+}
+
+func TestRunExe(t *testing.T) {
+	_, _, err := RunExe(bytes.NewReader(rawHeaderForRunExe().withMov().withInt21_4c()))
+	if err != nil {
+		t.Errorf("%+v", err)
+	}
+}
+
+func TestRunExeRejectsOverlay(t *testing.T) {
+	b := rawHeaderForRunExe().withMov().withInt21_4c()
+	b[0x1a] = 0x01 // overlay number
+	_, _, err := RunExe(bytes.NewReader(b))
+	if err == nil {
+		t.Errorf("expected error for overlay")
+	}
+}
+
+func TestWriteBeyondLoadModule(t *testing.T) {
+	// memory covers the whole address space, so BSS and heap past the load module are writable
+	b := rawHeaderForRunExe().
+		movImm16(AX, 0x0037).
+		with(0x2e, 0xa3, 0x00, 0x01). // mov [cs:0x0100],ax
+		movImm16(AX, 0x0000).
+		with(0x2e, 0xa1, 0x00, 0x01). // mov ax,[cs:0x0100]
+		int21(0x4c)
+
+	exitCode, _, err := RunExe(bytes.NewReader(b))
+	if err != nil {
+		t.Errorf("%+v", err)
+	}
+	if exitCode != 0x37 {
+		t.Errorf("expected to read back 0x37 but 0x%02x", exitCode)
+	}
+}
+
+func TestInt21_4c_ax(t *testing.T) {
+	// exit status 1
+	b := rawHeaderForRunExe()
 	b = append(b, []byte{0xb8, 0x4c, 0x00}...) // mov ax,4ch
 	b = append(b, []byte{0xc1, 0xe0, 0x08}...) // shl ax,8
 	b = append(b, []byte{0x83, 0xc0, 0x01}...) // add ax,01h
 	b = append(b, []byte{0xcd, 0x21}...)       // int 21h
 
-	intHandlers := make(intHandlers)
+	intHandlers := make(intHandlers)
+
+	actual, err := runExeWithCustomIntHandlers(bytes.NewReader(b), intHandlers)
+	if err != nil {
+		t.Errorf("%+v", err)
+	}
+
+	if actual.ax != 0x4c01 {
+		t.Errorf("ax is illegal: %04x", actual.ax)
+	}
+	if actual.al() != 0x01 {
+		t.Errorf("al is illegal: %02x", actual.al())
+	}
+	if actual.ah() != 0x4c {
+		t.Errorf("ah is illegal: %02x", actual.ah())
+	}
+	if actual.exitCode != 0x01 {
+		t.Errorf("exitCode is expected to be %02x but %02x", 0x01, actual.exitCode)
+	}
+}
+
+func TestInt21_4c_cx(t *testing.T) {
+	// exit status 1
+	b := rawHeaderForRunExe()
+	b = append(b, []byte{0xb9, 0x4c, 0x00}...) // mov cx,4ch
+	b = append(b, []byte{0xc1, 0xe1, 0x08}...) // shl cx,8
+	b = append(b, []byte{0x83, 0xc1, 0x01}...) // add cx,01h
+	b = append(b, []byte{0x8b, 0xc1}...)       // mov ax,cx
+	b = append(b, []byte{0xcd, 0x21}...)       // int 21h
+
+	intHandlers := make(intHandlers)
+
+	actual, err := runExeWithCustomIntHandlers(bytes.NewReader(b), intHandlers)
+	if err != nil {
+		t.Errorf("%+v", err)
+	}
+
+	if actual.ax != 0x4c01 {
+		t.Errorf("ax is illegal: %04x", actual.ax)
+	}
+	if actual.al() != 0x01 {
+		t.Errorf("al is illegal: %02x", actual.al())
+	}
+	if actual.ah() != 0x4c {
+		t.Errorf("ah is illegal: %02x", actual.ah())
+	}
+	if actual.exitCode != 0x01 {
+		t.Errorf("exitCode is expected to be %02x but %02x", 0x01, actual.exitCode)
+	}
+}
+
+// for print systemcall
+
+func rawHeaderForTestInt21_09() machineCode {
+	// assume that there is one relocation
+	// (1) relocation items
+	// (2) item of relocation table
+	return []byte{
+		//                                      <--(1)--->
+		0x4d, 0x5a, 0x00, 0x00, 0x01, 0x00, 0x01, 0x00, 0x03, 0x00, 0x01, 0x01, 0xff, 0xff, 0x02, 0x00,
+		0x00, 0x10, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x20, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00,
+		//  <--(2)--->
+		0x01, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00,
+	}
+}
+
+func TestInt21_09(t *testing.T) {
+	b := rawHeaderForTestInt21_09()
+	b = append(b, []byte{0xb8, 0x01, 0x00}...)       // mov ax,seg msg
+	b = append(b, []byte{0x8e, 0xd8}...)             // mov ds,ax
+	b = append(b, []byte{0xb4, 0x09}...)             // mov ah,09h
+	b = append(b, []byte{0x8d, 0x16, 0x02, 0x00}...) // lea dx,msg
+	b = append(b, []byte{0xcd, 0x21}...)             // int 21h
+	b = append(b, []byte{0xb8, 0x00, 0x4c}...)       // mov ax,4c00h
+	b = append(b, []byte{0xcd, 0x21}...)             // int 21h
+	b = append(b, []byte("Hello world!$")...)
+
+	var output bytes.Buffer
+	cpu := NewCPU()
+	cpu.SetStdout(&output)
+	if err := cpu.LoadExe(bytes.NewReader(b)); err != nil {
+		t.Errorf("%+v", err)
+	}
+	if _, err := cpu.Run(); err != nil {
+		t.Errorf("%+v", err)
+	}
+
+	if output.String() != "Hello world!" {
+		t.Errorf("expect output \"%s\" but \"%s\"", "Hello world!", output.String())
+	}
+}
+
+func TestInt21_09Unterminated(t *testing.T) {
+	memory := newMemory([]byte{})
+	// '$' at the start of segment must not be reached by wrapping around
+	if err := memory.writeByte(newAddress(0x3000, 0x0000), '$'); err != nil {
+		t.Errorf("%+v", err)
+	}
+	for offset := 0xfff0; offset <= 0xffff; offset++ {
+		if err := memory.writeByte(newAddress(0x3000, uint16(offset)), 'a'); err != nil {
+			t.Errorf("%+v", err)
+		}
+	}
+
+	var output bytes.Buffer
+	s := state{ds: 0x3000, dx: 0xfff0, stdout: &output}
+	if err := intHandler09(&s, memory); err == nil {
+		t.Errorf("expected error for string without '$'")
+	}
+	if output.Len() != 0 {
+		t.Errorf("expected no output but \"%s\"", output.String())
+	}
+}
+
+func TestInt21_30(t *testing.T) {
+	var b machineCode
+	b = append(b, []byte{0xb4, 0x30}...) // mov ah,30h
+	b = append(b, []byte{0xcd, 0x21}...) // int 21h
+
+	cases := []struct {
+		version  *dosVersion
+		expected word
+	}{
+		{nil, 0x0005},
+		{&dosVersion{major: 3, minor: 30}, 0x1e03},
+	}
+	for _, c := range cases {
+		cpu := NewCPU()
+		if c.version != nil {
+			cpu.SetDOSVersion(c.version.major, c.version.minor)
+		}
+		if err := cpu.LoadCom(bytes.NewReader(b)); err != nil {
+			t.Errorf("%+v", err)
+		}
+		for i := 0; i < 2; i++ {
+			if _, err := cpu.Step(); err != nil {
+				t.Errorf("%+v", err)
+			}
+		}
+		if cpu.state.ax != c.expected {
+			t.Errorf("expected ax 0x%04x but actual 0x%04x", c.expected, cpu.state.ax)
+		}
+	}
+}
+
+func TestInt21_25_35(t *testing.T) {
+	var b machineCode
+	b = append(b, []byte{0xb8, 0x1c, 0x35}...) // mov ax,351ch
+	b = append(b, []byte{0xcd, 0x21}...)       // int 21h
+	b = append(b, []byte{0x89, 0xde}...)       // mov si,bx
+	b = append(b, []byte{0x8c, 0xc7}...)       // mov di,es
+	b = append(b, []byte{0xb8, 0x1c, 0x25}...) // mov ax,251ch
+	b = append(b, []byte{0xba, 0x34, 0x12}...) // mov dx,1234h
+	b = append(b, []byte{0xcd, 0x21}...)       // int 21h
+	b = append(b, []byte{0xb8, 0x1c, 0x35}...) // mov ax,351ch
+	b = append(b, []byte{0xcd, 0x21}...)       // int 21h
+
+	cpu := NewCPU()
+	if err := cpu.LoadCom(bytes.NewReader(b)); err != nil {
+		t.Errorf("%+v", err)
+	}
+	for i := 0; i < 9; i++ {
+		if _, err := cpu.Step(); err != nil {
+			t.Errorf("%+v", err)
+		}
+	}
+
+	// initial vector
+	if cpu.state.di != biosSegment || cpu.state.si != 0x001c {
+		t.Errorf("expected initial vector 0x%04x:0x%04x but actual 0x%04x:0x%04x", biosSegment, 0x001c, cpu.state.di, cpu.state.si)
+	}
+	// vector set by 25h
+	if cpu.state.es != pspSegment || cpu.state.bx != 0x1234 {
+		t.Errorf("expected vector 0x%04x:0x%04x but actual 0x%04x:0x%04x", pspSegment, 0x1234, cpu.state.es, cpu.state.bx)
+	}
+	actual, err := cpu.ReadWordAt(0x0000, 0x1c*4)
+	if err != nil {
+		t.Errorf("%+v", err)
+	}
+	if actual != 0x1234 {
+		t.Errorf("expected offset 0x1234 in IVT but actual 0x%04x", actual)
+	}
+}
+
+func TestInt21_2a_2c(t *testing.T) {
+	var b machineCode
+	b = append(b, []byte{0xb4, 0x2a}...) // mov ah,2ah
+	b = append(b, []byte{0xcd, 0x21}...) // int 21h
+	b = append(b, []byte{0x89, 0xce}...) // mov si,cx
+	b = append(b, []byte{0x89, 0xd7}...) // mov di,dx
+	b = append(b, []byte{0x88, 0xc3}...) // mov bl,al
+	b = append(b, []byte{0xb4, 0x2c}...) // mov ah,2ch
+	b = append(b, []byte{0xcd, 0x21}...) // int 21h
+
+	cpu := NewCPU()
+	cpu.SetClock(func() time.Time {
+		// Tuesday
+		return time.Date(2019, time.March, 5, 13, 4, 56, 780000000, time.UTC)
+	})
+	if err := cpu.LoadCom(bytes.NewReader(b)); err != nil {
+		t.Errorf("%+v", err)
+	}
+	for i := 0; i < 7; i++ {
+		if _, err := cpu.Step(); err != nil {
+			t.Errorf("%+v", err)
+		}
+	}
+
+	if cpu.state.si != 2019 || cpu.state.di != 0x0305 || cpu.state.bl() != 2 {
+		t.Errorf("unexpected date cx: %d, dx: 0x%04x, al: %d", cpu.state.si, cpu.state.di, cpu.state.bl())
+	}
+	if cpu.state.cx != 0x0d04 || cpu.state.dx != 0x384e {
+		t.Errorf("unexpected time cx: 0x%04x, dx: 0x%04x", cpu.state.cx, cpu.state.dx)
+	}
+}
+
+func TestInt20(t *testing.T) {
+	cases := []struct {
+		name string
+		code machineCode
+	}{
+		// mov ax,4c05h; int 20h
+		{"int 20h", []byte{0xb8, 0x05, 0x4c, 0xcd, 0x20}},
+		// mov ax,4c05h; ret, which jumps to int 20h at the start of PSP
+		{"ret", []byte{0xb8, 0x05, 0x4c, 0xc3}},
+	}
+	for _, c := range cases {
+		exitCode, state, err := RunCom(bytes.NewReader(c.code))
+		if err != nil {
+			t.Errorf("%s: %+v", c.name, err)
+		}
+		if exitCode != 0 || !state.shouldExit {
+			t.Errorf("%s: expect to exit with 0 but actual %d", c.name, exitCode)
+		}
+	}
+}
+
+func TestInt10_0e(t *testing.T) {
+	var b machineCode
+	b = append(b, []byte{0xbb, 0x07, 0x00}...) // mov bx,0007h
+	for _, c := range []byte("BIOS") {
+		b = append(b, []byte{0xb4, 0x0e}...) // mov ah,0eh
+		b = append(b, []byte{0xb0, c}...)    // mov al,c
+		b = append(b, []byte{0xcd, 0x10}...) // int 10h
+	}
+	b = append(b, []byte{0xcd, 0x20}...) // int 20h
+
+	var output bytes.Buffer
+	cpu := NewCPU()
+	cpu.SetStdout(&output)
+	if err := cpu.LoadCom(bytes.NewReader(b)); err != nil {
+		t.Errorf("%+v", err)
+	}
+	if _, err := cpu.Run(); err != nil {
+		t.Errorf("%+v", err)
+	}
+	if output.String() != "BIOS" {
+		t.Errorf("expect output \"%s\" but \"%s\"", "BIOS", output.String())
+	}
+}
+
+func TestInt16(t *testing.T) {
+	var b machineCode
+	b = append(b, []byte{0xb4, 0x01}...) // mov ah,01h
+	b = append(b, []byte{0xcd, 0x16}...) // int 16h
+	b = append(b, []byte{0x89, 0xc3}...) // mov bx,ax
+	b = append(b, []byte{0xb4, 0x00}...) // mov ah,00h
+	b = append(b, []byte{0xcd, 0x16}...) // int 16h
+	b = append(b, []byte{0x89, 0xc1}...) // mov cx,ax
+	b = append(b, []byte{0xb4, 0x01}...) // mov ah,01h
+	b = append(b, []byte{0xcd, 0x16}...) // int 16h
+
+	cpu := NewCPU()
+	cpu.SetStdin(strings.NewReader("a"))
+	if err := cpu.LoadCom(bytes.NewReader(b)); err != nil {
+		t.Errorf("%+v", err)
+	}
+
+	for i := 0; i < 3; i++ {
+		if _, err := cpu.Step(); err != nil {
+			t.Errorf("%+v", err)
+		}
+	}
+	// key is available
+	if cpu.state.isActiveZF() || cpu.state.bx != 0x1e61 {
+		t.Errorf("expected key 0x1e61 to be available but actual 0x%04x", cpu.state.bx)
+	}
+
+	for i := 0; i < 5; i++ {
+		if _, err := cpu.Step(); err != nil {
+			t.Errorf("%+v", err)
+		}
+	}
+	// key is read, then no key is available
+	if cpu.state.cx != 0x1e61 || cpu.state.al() != 'a' {
+		t.Errorf("expected key 0x1e61 but actual 0x%04x", cpu.state.cx)
+	}
+	if cpu.state.isNotActiveZF() {
+		t.Errorf("expected ZF to be set when no key is available")
+	}
+}
+
+func TestCustomInterruptHandler(t *testing.T) {
+	var b machineCode
+	b = append(b, []byte{0xb4, 0x0e}...)       // mov ah,0eh
+	b = append(b, []byte{0xcd, 0x10}...)       // int 10h
+	b = append(b, []byte{0xb8, 0x00, 0x4c}...) // mov ax,4c00h
+	b = append(b, []byte{0xcd, 0x21}...)       // int 21h
+
+	called := 0
+	cpu := NewCPU()
+	cpu.setInterruptHandler(0x10, func(s *state, m *memory) error {
+		called++
+		if s.ah() != 0x0e {
+			t.Errorf("expected ah 0x0e but actual 0x%02x", s.ah())
+		}
+		return nil
+	})
+	if err := cpu.LoadCom(bytes.NewReader(b)); err != nil {
+		t.Errorf("%+v", err)
+	}
+	if _, err := cpu.Run(); err != nil {
+		t.Errorf("%+v", err)
+	}
+	if called != 1 {
+		t.Errorf("expected handler of int 10h to be called once but %d times", called)
+	}
+}
+
+func TestInvalidOpcode(t *testing.T) {
+	var b machineCode
+	b = append(b, []byte{0x0f, 0xff}...)       // undefined
+	b = append(b, []byte{0xb8, 0x03, 0x4c}...) // mov ax,4c03h
+	b = append(b, []byte{0xcd, 0x21}...)       // int 21h
+
+	// handler skips the invalid opcode
+	called := 0
+	handler := func(s *state, m *memory) error {
+		called++
+		s.ip += 2
+		return nil
+	}
+
+	cpu := NewCPU()
+	cpu.setInterruptHandler(0x06, handler)
+	if err := cpu.LoadCom(bytes.NewReader(b)); err != nil {
+		t.Errorf("%+v", err)
+	}
+	exitCode, err := cpu.Run()
+	if err != nil {
+		t.Errorf("%+v", err)
+	}
+	if called != 1 || exitCode != 3 {
+		t.Errorf("expected int 6 handler to be called once and exit with 3 but %d times and %d", called, exitCode)
+	}
+
+	// strict mode
+	cpu = NewCPU()
+	cpu.setInterruptHandler(0x06, handler)
+	cpu.SetStrictDecode(true)
+	if err := cpu.LoadCom(bytes.NewReader(b)); err != nil {
+		t.Errorf("%+v", err)
+	}
+	_, err = cpu.Run()
+	if _, ok := errors.Cause(err).(*DecodeError); !ok {
+		t.Errorf("expected unknown opcode error but actual %+v", err)
+	}
+}
+
+func TestSetInterruptHandler(t *testing.T) {
+	// handler skips the invalid opcode, so program exits normally
+	called := 0
+	cpu := NewCPU()
+	cpu.SetInterruptHandler(0x06, func(cpu *CPU) error {
+		called++
+		r := cpu.Registers()
+		r.IP += 2
+		return cpu.SetRegisters(r)
+	})
+	cpu.SetStrictDecode(false)
+	runCom(t, cpu, machineCode{0x0f, 0xff, 0xcd, 0x20})
+	if called != 1 {
+		t.Errorf("expected int 6 handler to be called once but %d times", called)
+	}
+
+	// handler which leaves CS:IP at the invalid opcode is called again until the instruction limit
+	called = 0
+	cpu = NewCPU()
+	cpu.SetInterruptHandler(0x06, func(cpu *CPU) error {
+		called++
+		return nil
+	})
+	cpu.SetStrictDecode(false)
+	cpu.SetInstructionLimit(10)
+	if err := cpu.LoadCom(bytes.NewReader([]byte{0x0f, 0xff, 0xcd, 0x20})); err != nil {
+		t.Errorf("%+v", err)
+	}
+	if _, err := cpu.Run(); err == nil || !strings.Contains(err.Error(), "instruction limit exceeded") {
+		t.Errorf("expected instruction limit to be exceeded but actual %+v", err)
+	}
+	if called != 10 {
+		t.Errorf("expected int 6 handler to be called 10 times but %d times", called)
+	}
+
+	// handler of divide error sets the result
+	b := machineCode{}.movImm16(AX, 0x0001).movImm8(BL, 0x00).with(0xf6, 0xf3) // div bl
+	b = b.int21(0x4c)
+	cpu = NewCPU()
+	cpu.SetInterruptHandler(0x00, func(cpu *CPU) error {
+		r := cpu.Registers()
+		r.AX = 0x0005
+		return cpu.SetRegisters(r)
+	})
+	if err := cpu.LoadCom(bytes.NewReader(b)); err != nil {
+		t.Errorf("%+v", err)
+	}
+	exitCode, err := cpu.Run()
+	if err != nil {
+		t.Errorf("%+v", err)
+	}
+	if exitCode != 5 {
+		t.Errorf("expected exit code 5 set by handler but %d", exitCode)
+	}
+}
+
+func TestInvalidOpcodeWithHandlerOfProgram(t *testing.T) {
+	// handler installed by int 21h 25h exits with 7
+	b := machineCode{}.movImm16(AX, 0x2506).movImm16(DX, 0x0000).with(0xcd, 0x21)
+	b = b.with(0x0f, 0xff) // undefined
+	handler := uint16(comEntryOffset + len(b))
+	b = b.movImm16(AX, 0x4c07).with(0xcd, 0x21)
+	b[4], b[5] = byte(handler), byte(handler>>8)
+
+	cpu := NewCPU()
+	if err := cpu.LoadCom(bytes.NewReader(b)); err != nil {
+		t.Errorf("%+v", err)
+	}
+	exitCode, err := cpu.Run()
+	if err != nil {
+		t.Errorf("%+v", err)
+	}
+	if exitCode != 7 {
+		t.Errorf("expected exit code 7 from handler of program but %d", exitCode)
+	}
+}
+
+func TestInto(t *testing.T) {
+	run := func(ax uint16) int {
+		b := machineCode{}.
+			movImm16(AX, ax).
+			with(0x83, 0xc0, 0x01). // add ax,1
+			with(0xce).             // into
+			int21(0x4c)
+
+		called := 0
+		cpu := NewCPU()
+		cpu.setInterruptHandler(0x04, func(s *state, m *memory) error {
+			called++
+			return nil
+		})
+		runCom(t, cpu, b)
+		return called
+	}
+
+	if called := run(0x7fff); called != 1 {
+		t.Errorf("expected int 4 handler to be called once after overflow but %d times", called)
+	}
+	if called := run(0x0001); called != 0 {
+		t.Errorf("expected int 4 handler not to be called without overflow but %d times", called)
+	}
+}
+
+func TestInterruptHandlerOfProgram(t *testing.T) {
+	cases := []struct {
+		n     uint8
+		fault machineCode
+	}{
+		// divide error
+		{0x00, machineCode{}.movImm16(AX, 0x0001).movImm8(BL, 0x00).with(0xf6, 0xf3)}, // div bl
+		// overflow
+		{0x04, machineCode{}.movImm16(AX, 0x7fff).with(0x83, 0xc0, 0x01).with(0xce)}, // add ax,1; into
+		// bound range exceeded, where bounds at [0x0200] are both 0
+		{0x05, machineCode{}.movImm16(AX, 0x0005).with(0x62, 0x06, 0x00, 0x02)}, // bound ax,[0x0200]
+	}
+	for _, c := range cases {
+		// install handler by int 21h 25h, which returns to the next instruction of the fault
+		b := machineCode{}.movImm16(AX, 0x2500|uint16(c.n)).movImm16(DX, 0x0000).with(0xcd, 0x21)
+		b = b.with(0xfb) // sti
+		b = append(b, c.fault...)
+		b = b.int21(0x4c)
+		handler := uint16(comEntryOffset + len(b))
+		b = b.movImm16(CX, 0x1234).with(0x9c, 0x5a) // pushf; pop dx
+		b = b.with(0xcf)                            // iret
+		b[4], b[5] = byte(handler), byte(handler>>8)
+
+		cpu := NewCPU()
+		if err := cpu.LoadCom(bytes.NewReader(b)); err != nil {
+			t.Errorf("%+v", err)
+		}
+		if _, err := cpu.Run(); err != nil {
+			t.Errorf("int 0x%02x: %+v", c.n, err)
+		}
+		r := cpu.Registers()
+		if r.CX != 0x1234 {
+			t.Errorf("int 0x%02x: expected handler of program to be called but cx 0x%04x", c.n, r.CX)
+		}
+		if r.DX&0x0200 != 0 {
+			t.Errorf("int 0x%02x: expected IF to be cleared in handler but flags 0x%04x", c.n, r.DX)
+		}
+		if r.CS != uint16(pspSegment) || r.SP != 0xfffe {
+			t.Errorf("int 0x%02x: expected iret to restore cs and sp but 0x%04x and 0x%04x", c.n, r.CS, r.SP)
+		}
+	}
+}
+
+func TestChainToOriginalInterruptVector(t *testing.T) {
+	// get the original vector of int 21h by int 21h 35h and save it at [0x0200]
+	getVector := machineCode{}.movImm16(AX, 0x3521).with(0xcd, 0x21).
+		with(0x89, 0x1e, 0x00, 0x02). // mov [0x0200],bx
+		with(0x8c, 0x06, 0x02, 0x02)  // mov [0x0202],es
+
+	// jump to the original vector with ah=4ch
+	b := append(machineCode{}, getVector...).
+		movImm16(AX, 0x4c07).
+		with(0xff, 0x2e, 0x00, 0x02) // jmp far [0x0200]
+	if exitCode := runCom(t, NewCPU(), b); exitCode != 0x07 {
+		t.Errorf("expected exit code 0x07 but 0x%02x", exitCode)
+	}
+
+	// hook int 21h by a handler which counts calls by di and chains to the original vector
+	b = append(machineCode{}, getVector...).movImm16(AX, 0x2521).movImm16(DX, 0x0000).with(0xcd, 0x21)
+	handlerAt := len(b) - 4
+	b = b.int21(0x30) // get DOS version, which returns to the next instruction
+	b = b.int21(0x4c) // exit with al, the major version
+	handler := uint16(comEntryOffset + len(b))
+	b[handlerAt], b[handlerAt+1] = byte(handler), byte(handler>>8)
+	b = b.with(0x47)                         // inc di
+	b = b.with(0x2e, 0xff, 0x2e, 0x00, 0x02) // jmp far [cs:0x0200]
+
+	cpu := NewCPU()
+	if exitCode := runCom(t, cpu, b); exitCode != 0x05 {
+		t.Errorf("expected exit code 0x05 but 0x%02x", exitCode)
+	}
+	if r := cpu.Registers(); r.DI != 2 {
+		t.Errorf("expected the hook to be called twice but %d times", r.DI)
+	}
+}
+
+func TestDecodeBound(t *testing.T) {
+	// bound ax,[bx+si]
+	actual, _, _, err := decodeInst(bytes.NewReader([]byte{0x62, 0x00}))
+	if err != nil {
+		t.Errorf("%+v", err)
+	}
+	expected := instBound{index: reg16{value: AX}, bounds: mem8BaseIndexDisp{base: BX, index: SI, disp: 0}}
+	if actual != expected {
+		t.Errorf("expected %v but actual %v", expected, actual)
+	}
+
+	// bound ax,ax is invalid since bounds must be in memory
+	if _, _, _, err := decodeInst(bytes.NewReader([]byte{0x62, 0xc0})); err == nil {
+		t.Errorf("expected error for register bounds")
+	}
+}
+
+func TestBound(t *testing.T) {
+	run := func(index uint16) int {
+		b := machineCode{}.movImm16(AX, index)
+		// bounds are placed just after bound and int 21h
+		boundsOffset := uint16(comEntryOffset + len(b) + 4 + 4)
+		b = b.with(0x62, 0x06, byte(boundsOffset), byte(boundsOffset>>8)) // bound ax,[bounds]
+		b = b.int21(0x4c)
+		b = b.with(0xfe, 0xff, 0x0a, 0x00) // bounds: -2, 10
+
+		called := 0
+		cpu := NewCPU()
+		cpu.setInterruptHandler(0x05, func(s *state, m *memory) error {
+			called++
+			return nil
+		})
+		runCom(t, cpu, b)
+		return called
+	}
+
+	cases := []struct {
+		index    uint16
+		expected int
+	}{
+		{0xfffe, 0}, // -2
+		{0x0000, 0},
+		{0x000a, 0},
+		{0xfffd, 1}, // -3
+		{0x000b, 1},
+		{0x8000, 1},
+	}
+	for _, c := range cases {
+		if actual := run(c.index); actual != c.expected {
+			t.Errorf("expected int 5 handler to be called %d times for index 0x%04x but %d times", c.expected, c.index, actual)
+		}
+	}
+}
+
+func TestStackGuard(t *testing.T) {
+	run := func(b machineCode, guard bool) error {
+		cpu := NewCPU()
+		cpu.SetStackGuard(guard)
+		cpu.SetInstructionLimit(100000)
+		if err := cpu.LoadCom(bytes.NewReader(b)); err != nil {
+			t.Errorf("%+v", err)
+		}
+		_, err := cpu.Run()
+		return err
+	}
+
+	// runaway push
+	var overflow machineCode
+	overflow = append(overflow, 0x50)                  // push ax
+	overflow = append(overflow, []byte{0xeb, 0xfd}...) // jmp 0x100
+	if err := run(overflow, true); err == nil || !strings.Contains(err.Error(), "stack overflow") {
+		t.Errorf("expected stack overflow but actual %+v", err)
+	}
+	if err := run(overflow, false); err == nil || strings.Contains(err.Error(), "stack overflow") {
+		t.Errorf("expected only instruction limit without guard but actual %+v", err)
+	}
+
+	// pop of the return address followed by ret
+	var underflow machineCode
+	underflow = append(underflow, 0x58) // pop ax
+	underflow = append(underflow, 0xc3) // ret
+	if err := run(underflow, true); err == nil || !strings.Contains(err.Error(), "stack underflow") {
+		t.Errorf("expected stack underflow but actual %+v", err)
+	}
+
+	// ret to PSP is within the stack
+	if err := run(machineCode{0xc3}, true); err != nil {
+		t.Errorf("%+v", err)
+	}
+}
+
+func TestDecodeError(t *testing.T) {
+	var b machineCode
+	b = append(b, []byte{0xb8, 0x01, 0x00}...) // mov ax,1
+	b = append(b, []byte{0x26, 0x0f, 0xff}...) // es: followed by undefined
+
+	cpu := NewCPU()
+	if err := cpu.LoadFlat(b, 0x2000, 0x0000); err != nil {
+		t.Errorf("%+v", err)
+	}
+	if _, err := cpu.Step(); err != nil {
+		t.Errorf("%+v", err)
+	}
+	_, err := cpu.Step()
+	decodeError, ok := errors.Cause(err).(*DecodeError)
+	if !ok {
+		t.Fatalf("expected DecodeError but actual %+v", err)
+	}
+	// location of the instruction including the prefix
+	if decodeError.Seg != 0x2000 || decodeError.Off != 0x0003 || decodeError.Opcode != 0x0f {
+		t.Errorf("unexpected error: %v", decodeError)
+	}
+	expected := []byte{0x26, 0x0f, 0xff, 0x00, 0x00, 0x00}
+	if !bytes.Equal(decodeError.Bytes, expected) {
+		t.Errorf("expected bytes %v but actual %v", expected, decodeError.Bytes)
+	}
+}
+
+func TestDecodeTwoByteOpcode(t *testing.T) {
+	cases := []struct {
+		code     []byte
+		expected interface{}
+	}{
+		{[]byte{0x0f, 0xa0}, instPushSreg{src: FS}},
+		{[]byte{0x0f, 0xa1}, instPopSreg{dest: FS}},
+		{[]byte{0x0f, 0xa8}, instPushSreg{src: GS}},
+		{[]byte{0x0f, 0xa9}, instPopSreg{dest: GS}},
+		// jne -0x0200
+		{[]byte{0x0f, 0x85, 0x00, 0xfe}, instJccRel16{cond: condNE, rel: -0x0200}},
+		// jg +0x1234
+		{[]byte{0x0f, 0x8f, 0x34, 0x12}, instJccRel16{cond: condG, rel: 0x1234}},
+		// sete al
+		{[]byte{0x0f, 0x94, 0xc0}, instSetcc{cond: condE, dest: reg8{value: AL}}},
+		// setl byte [bx+si]
+		{[]byte{0x0f, 0x9c, 0x00}, instSetcc{cond: condL, dest: mem8BaseIndexDisp{base: BX, index: SI}}},
+		// movzx ax,bl
+		{[]byte{0x0f, 0xb6, 0xc3}, instMovzx{dest: reg16{value: AX}, src: reg8{value: BL}}},
+		// movsx cx,byte [bp-0x02]
+		{[]byte{0x0f, 0xbe, 0x4e, 0xfe}, instMovsx{dest: reg16{value: CX}, src: mem8BaseDisp8{base: BP, disp8: -2}}},
+	}
+	for _, c := range cases {
+		actual, readBytesCount, _, err := decodeInst(bytes.NewReader(c.code))
+		if err != nil {
+			t.Errorf("%+v", err)
+		}
+		if actual != c.expected || readBytesCount != len(c.code) {
+			t.Errorf("expected %#v but actual %#v (%d bytes)", c.expected, actual, readBytesCount)
+		}
+	}
+}
+
+func TestDecoder(t *testing.T) {
+	// mov ax,0x0001; push ax; cs: mov ax,[bx+si]
+	decoder := newDecoder([]byte{0xb8, 0x01, 0x00, 0x50, 0x2e, 0x8b, 0x00})
+	expecteds := []interface{}{
+		instMov{dest: reg16{value: AX}, src: imm16{value: 1}},
+		instPush{src: AX},
+		instMov{dest: reg16{value: AX}, src: mem16BaseIndexDisp{base: BX, index: SI}},
+	}
+	for _, expected := range expecteds {
+		actual, _, _, err := decoder.decode()
+		if err != nil {
+			t.Errorf("%+v", err)
+		}
+		if actual != expected {
+			t.Errorf("expected %#v but actual %#v", expected, actual)
+		}
+	}
+	if _, _, _, err := decoder.decode(); err == nil {
+		t.Errorf("expected error at the end of code")
+	}
+}
+
+func BenchmarkDecode(b *testing.B) {
+	// mov ax,[bx+si+0x0002]; add ax,cx; push ax; jne -9
+	inst := []byte{0x8b, 0x40, 0x02, 0x03, 0xc1, 0x50, 0x75, 0xf7}
+	code := bytes.Repeat(inst, 0x1000)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		decoder := newDecoder(code)
+		for j := 0; j < 0x1000*4; j++ {
+			if _, _, _, err := decoder.decode(); err != nil {
+				b.Fatalf("%+v", err)
+			}
+		}
+	}
+}
+
+func TestDecodeAddressSizePrefix(t *testing.T) {
+	cases := []struct {
+		code     []byte
+		expected interface{}
+	}{
+		// mov ax,[eax]
+		{[]byte{0x67, 0x8b, 0x00}, instMov{dest: reg16{value: AX}, src: mem16Addr32{addressing32{base: AX, hasBase: true}}}},
+		// mov ax,[eax+ecx*2+0x00000010]
+		{[]byte{0x67, 0x8b, 0x84, 0x48, 0x10, 0x00, 0x00, 0x00},
+			instMov{dest: reg16{value: AX}, src: mem16Addr32{addressing32{base: AX, hasBase: true, index: CX, hasIndex: true, scale: 2, disp: 0x10}}}},
+		// mov byte [ebp-0x02],al
+		{[]byte{0x67, 0x88, 0x45, 0xfe}, instMov{dest: mem8Addr32{addressing32{base: BP, hasBase: true, disp: -2}}, src: reg8{value: AL}}},
+		// mov ax,[0x00001234]
+		{[]byte{0x67, 0x8b, 0x05, 0x34, 0x12, 0x00, 0x00}, instMov{dest: reg16{value: AX}, src: mem16Addr32{addressing32{disp: 0x1234}}}},
+		// mov ax,[esi*4+0x00000100]
+		{[]byte{0x67, 0x8b, 0x04, 0xb5, 0x00, 0x01, 0x00, 0x00},
+			instMov{dest: reg16{value: AX}, src: mem16Addr32{addressing32{index: SI, hasIndex: true, scale: 4, disp: 0x100}}}},
+		// register operands are not affected
+		{[]byte{0x67, 0x8b, 0xc3}, instMov{dest: reg16{value: AX}, src: reg16{value: BX}}},
+	}
+	for _, c := range cases {
+		actual, readBytesCount, _, err := decodeInst(bytes.NewReader(c.code))
+		if err != nil {
+			t.Errorf("%+v", err)
+		}
+		if actual != c.expected || readBytesCount != len(c.code) {
+			t.Errorf("expected %#v but actual %#v (%d bytes)", c.expected, actual, readBytesCount)
+		}
+	}
+}
+
+func TestAddressing32(t *testing.T) {
+	memory := newMemory([]byte{})
+	if err := memory.writeWord(newAddress(0x1000, 0x0036), 0x1234); err != nil {
+		t.Errorf("%+v", err)
+	}
+	// mov ax,[eax+ecx*2+0x00000010] with eax 0x0020 and ecx 0x0003
+	inst := instMov{dest: reg16{value: AX}, src: mem16Addr32{addressing32{base: AX, hasBase: true, index: CX, hasIndex: true, scale: 2, disp: 0x10}}}
+	actual := state{ax: 0x0020, cx: 0x0003, ds: 0x1000}
+	err := executeInst(inst, &actual, memory)
+	if err != nil {
+		t.Errorf("%+v", err)
+	}
+	if actual.ax != 0x1234 {
+		t.Errorf("expected 0x1234 but actual 0x%04x", actual.ax)
+	}
+}
+
+func TestDecodeUnknownOpcodeExtension(t *testing.T) {
+	// ff /7 is undefined
+	_, _, _, err := decodeInst(bytes.NewReader([]byte{0xff, 0xf8}))
+	if err == nil {
+		t.Errorf("expected error for undefined opcode extension")
+	}
+}
+
+func TestRunPastLoadedImage(t *testing.T) {
+	cases := []struct {
+		name string
+		code machineCode
+	}{
+		// mov ax,1 without terminating the program
+		{"no exit", []byte{0xb8, 0x01, 0x00}},
+		// mov ax,1 followed by mov bx,imm16 missing its last byte
+		{"truncated", []byte{0xb8, 0x01, 0x00, 0xbb, 0x02}},
+	}
+	for _, c := range cases {
+		if _, _, err := RunCom(bytes.NewReader(c.code)); err == nil {
+			t.Errorf("%s: expected error when running past the loaded image", c.name)
+		}
+	}
+}
+
+func TestUnknownInterrupt(t *testing.T) {
+	cpu := NewCPU()
+	if err := cpu.LoadFlat([]byte{0xcd, 0x10}, 0x1000, 0x0000); err != nil {
+		t.Errorf("%+v", err)
+	}
+	if _, err := cpu.Step(); err == nil {
+		t.Errorf("expected error for interrupt without handler")
+	}
+}
+
+func TestInt21_02(t *testing.T) {
+	var b machineCode
+	for _, c := range []byte("Hi!") {
+		b = append(b, []byte{0xb4, 0x02}...) // mov ah,02h
+		b = append(b, []byte{0xb2, c}...)    // mov dl,c
+		b = append(b, []byte{0xcd, 0x21}...) // int 21h
+	}
+	b = append(b, []byte{0xb8, 0x00, 0x4c}...) // mov ax,4c00h
+	b = append(b, []byte{0xcd, 0x21}...)       // int 21h
+
+	var output bytes.Buffer
+	cpu := NewCPU()
+	cpu.SetStdout(&output)
+	if err := cpu.LoadCom(bytes.NewReader(b)); err != nil {
+		t.Errorf("%+v", err)
+	}
+	if _, err := cpu.Run(); err != nil {
+		t.Errorf("%+v", err)
+	}
+
+	if output.String() != "Hi!" {
+		t.Errorf("expect output \"%s\" but \"%s\"", "Hi!", output.String())
+	}
+}
+
+func TestInt21_01(t *testing.T) {
+	var b machineCode
+	b = append(b, []byte{0xb4, 0x01}...) // mov ah,01h
+	b = append(b, []byte{0xcd, 0x21}...) // int 21h
+	b = append(b, []byte{0xb4, 0x4c}...) // mov ah,4ch
+	b = append(b, []byte{0xcd, 0x21}...) // int 21h
+
+	var output bytes.Buffer
+	cpu := NewCPU()
+	cpu.SetStdout(&output)
+	cpu.SetStdin(strings.NewReader("xy"))
+	if err := cpu.LoadCom(bytes.NewReader(b)); err != nil {
+		t.Errorf("%+v", err)
+	}
+	exitCode, err := cpu.Run()
+	if err != nil {
+		t.Errorf("%+v", err)
+	}
+
+	// exit code is AL, which holds the character read
+	if exitCode != 'x' {
+		t.Errorf("expect AL to be %q but actual %q", 'x', exitCode)
+	}
+	if output.String() != "x" {
+		t.Errorf("expect output \"%s\" but \"%s\"", "x", output.String())
+	}
+}
+
+func TestInt21_0a(t *testing.T) {
+	var b machineCode
+	b = append(b, []byte{0xb4, 0x0a}...)       // mov ah,0ah
+	b = append(b, []byte{0xba, 0x00, 0x02}...) // mov dx,0200h
+	b = append(b, []byte{0xcd, 0x21}...)       // int 21h
+	b = append(b, []byte{0xba, 0x10, 0x02}...) // mov dx,0210h
+	b = append(b, []byte{0xcd, 0x21}...)       // int 21h
+	b = append(b, []byte{0xb8, 0x00, 0x4c}...) // mov ax,4c00h
+	b = append(b, []byte{0xcd, 0x21}...)       // int 21h
+
+	cpu := NewCPU()
+	cpu.SetStdout(&bytes.Buffer{})
+	cpu.SetStdin(strings.NewReader("abc\r\nhello\n"))
+	if err := cpu.LoadCom(bytes.NewReader(b)); err != nil {
+		t.Errorf("%+v", err)
+	}
+	// buffers at 0200h and 0210h, where the second one can hold only 3 characters and CR
+	if err := cpu.WriteByteAt(uint16(pspSegment), 0x0200, 0x08); err != nil {
+		t.Errorf("%+v", err)
+	}
+	if err := cpu.WriteByteAt(uint16(pspSegment), 0x0210, 0x04); err != nil {
+		t.Errorf("%+v", err)
+	}
+	if _, err := cpu.Run(); err != nil {
+		t.Errorf("%+v", err)
+	}
+
+	cases := []struct {
+		offset   uint16
+		expected []byte
+	}{
+		{0x0200, []byte{0x08, 0x03, 'a', 'b', 'c', '\r'}},
+		{0x0210, []byte{0x04, 0x03, 'h', 'e', 'l', '\r'}},
+	}
+	for _, c := range cases {
+		actual, err := cpu.ReadBytesAt(uint16(pspSegment), c.offset, len(c.expected))
+		if err != nil {
+			t.Errorf("%+v", err)
+		}
+		if !bytes.Equal(actual, c.expected) {
+			t.Errorf("expected %v but actual %v", c.expected, actual)
+		}
+	}
+}
+
+// Append ASCIIZ file name to COM program and return its offset
+func (b machineCode) withFileName(name string) (machineCode, uint16) {
+	offset := uint16(comEntryOffset + len(b))
+	b = append(b, []byte(name)...)
+	return append(b, 0x00), offset
+}
+
+func TestInt21_3c_3e(t *testing.T) {
+	dir, err := ioutil.TempDir("", "TestInt21_3c_3e")
+	if err != nil {
+		t.Errorf("%+v", err)
+	}
+	defer os.RemoveAll(dir)
+	name := filepath.Join(dir, "out.txt")
+
+	var b machineCode
+	b = append(b, []byte{0xb4, 0x3c}...)       // mov ah,3ch
+	b = append(b, []byte{0x31, 0xc9}...)       // xor cx,cx
+	b = append(b, []byte{0xba, 0x00, 0x00}...) // mov dx,name (patched below)
+	b = append(b, []byte{0xcd, 0x21}...)       // int 21h
+	b = append(b, []byte{0x89, 0xc3}...)       // mov bx,ax
+	b = append(b, []byte{0xb4, 0x3e}...)       // mov ah,3eh
+	b = append(b, []byte{0xcd, 0x21}...)       // int 21h
+	b = append(b, []byte{0xb4, 0x4c}...)       // mov ah,4ch
+	b = append(b, []byte{0xcd, 0x21}...)       // int 21h
+	b, offset := b.withFileName(name)
+	b[5], b[6] = byte(offset), byte(offset>>8)
+
+	cpu := NewCPU()
+	if err := cpu.LoadCom(bytes.NewReader(b)); err != nil {
+		t.Errorf("%+v", err)
+	}
+	if _, err := cpu.Run(); err != nil {
+		t.Errorf("%+v", err)
+	}
+	if cpu.state.isActiveCF() {
+		t.Errorf("expected CF to be cleared but error code 0x%04x", cpu.state.ax)
+	}
+	if cpu.state.bx != firstFileHandle {
+		t.Errorf("expected handle 0x%04x but actual 0x%04x", firstFileHandle, cpu.state.bx)
+	}
+	if len(cpu.state.files) != 0 {
+		t.Errorf("expected file to be closed but %d files are open", len(cpu.state.files))
+	}
+	if _, err := os.Stat(name); err != nil {
+		t.Errorf("%+v", err)
+	}
+}
+
+func TestFilesClosedOnExit(t *testing.T) {
+	dir, err := ioutil.TempDir("", "TestFilesClosedOnExit")
+	if err != nil {
+		t.Errorf("%+v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	cases := []struct {
+		name string
+		exit []byte
+	}{
+		{"exit.txt", []byte{0xb4, 0x4c, 0xcd, 0x21}}, // mov ah,4ch; int 21h
+		{"error.txt", []byte{0x0f, 0xff}},            // unknown opcode
+	}
+	for _, c := range cases {
+		var b machineCode
+		b = append(b, []byte{0xb4, 0x3c}...)       // mov ah,3ch
+		b = append(b, []byte{0x31, 0xc9}...)       // xor cx,cx
+		b = append(b, []byte{0xba, 0x00, 0x00}...) // mov dx,name (patched below)
+		b = append(b, []byte{0xcd, 0x21}...)       // int 21h
+		b = append(b, c.exit...)
+		b, offset := b.withFileName(filepath.Join(dir, c.name))
+		b[5], b[6] = byte(offset), byte(offset>>8)
+
+		cpu := NewCPU()
+		if err := cpu.LoadCom(bytes.NewReader(b)); err != nil {
+			t.Errorf("%+v", err)
+		}
+		for i := 0; i < 4; i++ {
+			if _, err := cpu.Step(); err != nil {
+				t.Errorf("%+v", err)
+			}
+		}
+		f, ok := cpu.state.files[firstFileHandle]
+		if !ok {
+			t.Errorf("expected file to be open for %s", c.name)
+			continue
+		}
+		// the program doesn't close the file by itself
+		cpu.Run()
+		if len(cpu.state.files) != 0 {
+			t.Errorf("expected files to be closed but %d files are open for %s", len(cpu.state.files), c.name)
+		}
+		if err := f.Close(); err == nil {
+			t.Errorf("expected file to be closed already for %s", c.name)
+		}
+	}
+}
+
+func TestStepKeepsFilesOnError(t *testing.T) {
+	dir, err := ioutil.TempDir("", "TestStepKeepsFilesOnError")
+	if err != nil {
+		t.Errorf("%+v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	var f *os.File
+	cpu := NewCPU()
+	// handler which opens file and then fails
+	cpu.setInterruptHandler(0x60, func(s *state, memory *memory) error {
+		var err error
+		if f, err = os.Create(filepath.Join(dir, "out.txt")); err != nil {
+			return err
+		}
+		s.fileTable().add(f)
+		return errors.New("handler failed")
+	})
+	if err := cpu.LoadCom(bytes.NewReader([]byte{0xcd, 0x60})); err != nil {
+		t.Errorf("%+v", err)
+	}
+	if _, err := cpu.Step(); err == nil {
+		t.Errorf("expected error from handler")
+	}
+	// registers are restored but the file is still tracked to be closed
+	if cpu.Registers().IP != comEntryOffset {
+		t.Errorf("expected ip to be restored but actual 0x%04x", cpu.Registers().IP)
+	}
+	if len(cpu.state.files) != 1 {
+		t.Errorf("expected file to be kept but %d files are open", len(cpu.state.files))
+	}
+	if err := cpu.Reset(); err != nil {
+		t.Errorf("%+v", err)
+	}
+	if err := f.Close(); err == nil {
+		t.Errorf("expected file to be closed by Reset")
+	}
+}
+
+func TestInt21_3dFileNotFound(t *testing.T) {
+	var b machineCode
+	b = append(b, []byte{0xb8, 0x00, 0x3d}...) // mov ax,3d00h
+	b = append(b, []byte{0xba, 0x00, 0x00}...) // mov dx,name (patched below)
+	b = append(b, []byte{0xcd, 0x21}...)       // int 21h
+	b, offset := b.withFileName("no-such-file.txt")
+	b[4], b[5] = byte(offset), byte(offset>>8)
+
+	cpu := NewCPU()
+	if err := cpu.LoadCom(bytes.NewReader(b)); err != nil {
+		t.Errorf("%+v", err)
+	}
+	for i := 0; i < 3; i++ {
+		if _, err := cpu.Step(); err != nil {
+			t.Errorf("%+v", err)
+		}
+	}
+	if !cpu.state.isActiveCF() || cpu.state.ax != dosErrorFileNotFound {
+		t.Errorf("expected CF and error code 0x%04x but actual ax: 0x%04x", dosErrorFileNotFound, cpu.state.ax)
+	}
+}
+
+func TestInt21_4b(t *testing.T) {
+	var b machineCode
+	b = append(b, []byte{0xb8, 0x00, 0x4b}...) // mov ax,4b00h
+	b = append(b, []byte{0xba, 0x00, 0x00}...) // mov dx,name (patched below)
+	b = append(b, []byte{0xcd, 0x21}...)       // int 21h
+	b, offset := b.withFileName("bogus.exe")
+	b[4], b[5] = byte(offset), byte(offset>>8)
+
+	cpu := NewCPU()
+	if err := cpu.LoadCom(bytes.NewReader(b)); err != nil {
+		t.Errorf("%+v", err)
+	}
+	for i := 0; i < 3; i++ {
+		if _, err := cpu.Step(); err != nil {
+			t.Errorf("%+v", err)
+		}
+	}
+	if !cpu.state.isActiveCF() || cpu.state.ax != dosErrorFileNotFound {
+		t.Errorf("expected CF and error code 0x%04x but actual ax: 0x%04x", dosErrorFileNotFound, cpu.state.ax)
+	}
+}
+
+func TestInt21_3f_40(t *testing.T) {
+	dir, err := ioutil.TempDir("", "TestInt21_3f_40")
+	if err != nil {
+		t.Errorf("%+v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	var b machineCode
+	b = append(b, []byte{0xb4, 0x3c}...)       // mov ah,3ch
+	b = append(b, []byte{0x31, 0xc9}...)       // xor cx,cx
+	b = append(b, []byte{0xba, 0x00, 0x00}...) // mov dx,name (patched below)
+	b = append(b, []byte{0xcd, 0x21}...)       // int 21h
+	b = append(b, []byte{0x89, 0xc3}...)       // mov bx,ax
+	b = append(b, []byte{0xb4, 0x40}...)       // mov ah,40h
+	b = append(b, []byte{0xb9, 0x05, 0x00}...) // mov cx,5
+	b = append(b, []byte{0xba, 0x00, 0x00}...) // mov dx,data (patched below)
+	b = append(b, []byte{0xcd, 0x21}...)       // int 21h
+	b = append(b, []byte{0xb4, 0x3e}...)       // mov ah,3eh
+	b = append(b, []byte{0xcd, 0x21}...)       // int 21h
+	b = append(b, []byte{0xb8, 0x00, 0x3d}...) // mov ax,3d00h
+	b = append(b, []byte{0xba, 0x00, 0x00}...) // mov dx,name (patched below)
+	b = append(b, []byte{0xcd, 0x21}...)       // int 21h
+	b = append(b, []byte{0x89, 0xc3}...)       // mov bx,ax
+	b = append(b, []byte{0xb4, 0x3f}...)       // mov ah,3fh
+	b = append(b, []byte{0xb9, 0x10, 0x00}...) // mov cx,16
+	b = append(b, []byte{0xba, 0x00, 0x03}...) // mov dx,0300h
+	b = append(b, []byte{0xcd, 0x21}...)       // int 21h
+	b = append(b, []byte{0xb4, 0x4c}...)       // mov ah,4ch
+	b = append(b, []byte{0xcd, 0x21}...)       // int 21h
+	b, nameOffset := b.withFileName(filepath.Join(dir, "data.txt"))
+	dataOffset := uint16(comEntryOffset + len(b))
+	b = append(b, []byte("hello")...)
+	b[5], b[6] = byte(nameOffset), byte(nameOffset>>8)
+	b[17], b[18] = byte(dataOffset), byte(dataOffset>>8)
+	b[29], b[30] = byte(nameOffset), byte(nameOffset>>8)
+
+	cpu := NewCPU()
+	if err := cpu.LoadCom(bytes.NewReader(b)); err != nil {
+		t.Errorf("%+v", err)
+	}
+	exitCode, err := cpu.Run()
+	if err != nil {
+		t.Errorf("%+v", err)
+	}
+
+	// exit code is AL, which holds the number of bytes read
+	if cpu.state.isActiveCF() || exitCode != 5 {
+		t.Errorf("expected 5 bytes to be read but actual ax: 0x%04x", cpu.state.ax)
+	}
+	actual, err := cpu.ReadBytesAt(uint16(pspSegment), 0x0300, 5)
+	if err != nil {
+		t.Errorf("%+v", err)
+	}
+	if string(actual) != "hello" {
+		t.Errorf("expected %q but actual %q", "hello", actual)
+	}
+}
+
+func TestInt21_42(t *testing.T) {
+	dir, err := ioutil.TempDir("", "TestInt21_42")
+	if err != nil {
+		t.Errorf("%+v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	var b machineCode
+	b = append(b, []byte{0xb4, 0x3c}...)       // mov ah,3ch
+	b = append(b, []byte{0x31, 0xc9}...)       // xor cx,cx
+	b = append(b, []byte{0xba, 0x00, 0x00}...) // mov dx,name (patched below)
+	b = append(b, []byte{0xcd, 0x21}...)       // int 21h
+	b = append(b, []byte{0x89, 0xc3}...)       // mov bx,ax
+	b = append(b, []byte{0xb4, 0x40}...)       // mov ah,40h
+	b = append(b, []byte{0xb9, 0x05, 0x00}...) // mov cx,5
+	b = append(b, []byte{0xba, 0x00, 0x00}...) // mov dx,data (patched below)
+	b = append(b, []byte{0xcd, 0x21}...)       // int 21h
+	b = append(b, []byte{0xb8, 0x00, 0x42}...) // mov ax,4200h
+	b = append(b, []byte{0x31, 0xc9}...)       // xor cx,cx
+	b = append(b, []byte{0x31, 0xd2}...)       // xor dx,dx
+	b = append(b, []byte{0xcd, 0x21}...)       // int 21h
+	b = append(b, []byte{0xb4, 0x3f}...)       // mov ah,3fh
+	b = append(b, []byte{0xb9, 0x02, 0x00}...) // mov cx,2
+	b = append(b, []byte{0xba, 0x00, 0x03}...) // mov dx,0300h
+	b = append(b, []byte{0xcd, 0x21}...)       // int 21h
+	b = append(b, []byte{0xb8, 0x01, 0x42}...) // mov ax,4201h
+	b = append(b, []byte{0x31, 0xc9}...)       // xor cx,cx
+	b = append(b, []byte{0x31, 0xd2}...)       // xor dx,dx
+	b = append(b, []byte{0xcd, 0x21}...)       // int 21h
+	b, nameOffset := b.withFileName(filepath.Join(dir, "data.txt"))
+	dataOffset := uint16(comEntryOffset + len(b))
+	b = append(b, []byte("hello")...)
+	b[5], b[6] = byte(nameOffset), byte(nameOffset>>8)
+	b[17], b[18] = byte(dataOffset), byte(dataOffset>>8)
+
+	cpu := NewCPU()
+	if err := cpu.LoadCom(bytes.NewReader(b)); err != nil {
+		t.Errorf("%+v", err)
+	}
+	for i := 0; i < 21; i++ {
+		if _, err := cpu.Step(); err != nil {
+			t.Errorf("%+v", err)
+		}
+	}
+
+	actual, err := cpu.ReadBytesAt(uint16(pspSegment), 0x0300, 2)
+	if err != nil {
+		t.Errorf("%+v", err)
+	}
+	if string(actual) != "he" {
+		t.Errorf("expected %q but actual %q", "he", actual)
+	}
+	// current position after reading 2 bytes from the start
+	if cpu.state.isActiveCF() || cpu.state.dx != 0 || cpu.state.ax != 2 {
+		t.Errorf("expected position 2 but actual dx: 0x%04x, ax: 0x%04x", cpu.state.dx, cpu.state.ax)
+	}
+}
+
+func TestInt21_42InvalidHandle(t *testing.T) {
+	var b machineCode
+	b = append(b, []byte{0xb8, 0x00, 0x42}...) // mov ax,4200h
+	b = append(b, []byte{0xbb, 0x10, 0x00}...) // mov bx,10h
+	b = append(b, []byte{0xcd, 0x21}...)       // int 21h
+
+	cpu := NewCPU()
+	if err := cpu.LoadCom(bytes.NewReader(b)); err != nil {
+		t.Errorf("%+v", err)
+	}
+	for i := 0; i < 3; i++ {
+		if _, err := cpu.Step(); err != nil {
+			t.Errorf("%+v", err)
+		}
+	}
+	if !cpu.state.isActiveCF() || cpu.state.ax != dosErrorInvalidHandle {
+		t.Errorf("expected CF and error code 0x%04x but actual ax: 0x%04x", dosErrorInvalidHandle, cpu.state.ax)
+	}
+}
+
+func TestInt21_40Stdout(t *testing.T) {
+	var b machineCode
+	b = append(b, []byte{0xb4, 0x40}...)       // mov ah,40h
+	b = append(b, []byte{0xbb, 0x01, 0x00}...) // mov bx,1
+	b = append(b, []byte{0xb9, 0x02, 0x00}...) // mov cx,2
+	b = append(b, []byte{0xba, 0x0d, 0x01}...) // mov dx,010dh
+	b = append(b, []byte{0xcd, 0x21}...)       // int 21h
+	b = append(b, []byte("ok")...)
+
+	var output bytes.Buffer
+	cpu := NewCPU()
+	cpu.SetStdout(&output)
+	if err := cpu.LoadCom(bytes.NewReader(b)); err != nil {
+		t.Errorf("%+v", err)
+	}
+	for i := 0; i < 5; i++ {
+		if _, err := cpu.Step(); err != nil {
+			t.Errorf("%+v", err)
+		}
+	}
+	if output.String() != "ok" || cpu.state.ax != 2 {
+		t.Errorf("expected output \"ok\" but actual %q, ax: 0x%04x", output.String(), cpu.state.ax)
+	}
+}
+
+func rawHeaderForTestPush() machineCode {
+	return []byte{
+		0x4d, 0x5a, 0x00, 0x00, 0x01, 0x00, 0x00, 0x00, 0x02, 0x00, 0x01, 0x01, 0xff, 0xff, 0x01, 0x00,
+		0x00, 0x10, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x20, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00,
+	}
+}
+
+func TestPushAndPop(t *testing.T) {
+	b := rawHeaderForTestPush()
+	b = append(b, []byte{0xb8, 0x35, 0x10}...) // mov ax, 0x1035
+	b = append(b, []byte{0xb9, 0x36, 0x20}...) // mov cx, 0x2036
+	b = append(b, []byte{0x50}...)             // push ax
+	b = append(b, []byte{0x51}...)             // push cx
+	b = append(b, []byte{0x5b}...)             // pop bx
+	b = append(b, []byte{0x5a}...)             // pop dx
+	b = append(b, []byte{0xb8, 0x00, 0x4c}...) // mov ax,4c00h
+	b = append(b, []byte{0xcd, 0x21}...)       // int 21h
+
+	intHandlers := make(intHandlers)
+
+	actual, err := runExeWithCustomIntHandlers(bytes.NewReader(b), intHandlers)
+	if err != nil {
+		t.Errorf("%+v", err)
+	}
+
+	if actual.dx != 0x1035 {
+		t.Errorf("expect 0x%04x but 0x%04x", 0x1035, actual.dx)
+	}
+	if actual.bx != 0x2036 {
+		t.Errorf("expect 0x%04x but 0x%04x", 0x2036, actual.bx)
+	}
+}
+
+func TestXorClearsRegisterAndSetsZF(t *testing.T) {
+	b := rawHeaderForRunExe()
+	b = append(b, []byte{0xb9, 0x05, 0x00}...) // mov cx,0x0005
+	b = append(b, []byte{0x33, 0xc9}...)       // xor cx,cx
+	b = append(b, []byte{0x74, 0x03}...)       // je +3
+	b = append(b, []byte{0xb9, 0x07, 0x00}...) // mov cx,0x0007
+	b = append(b, []byte{0xb8, 0x00, 0x4c}...) // mov ax,4c00h
+	b = append(b, []byte{0xcd, 0x21}...)       // int 21h
+
+	actual, err := runExeWithCustomIntHandlers(bytes.NewReader(b), make(intHandlers))
+	if err != nil {
+		t.Errorf("%+v", err)
+	}
+	if actual.cx != 0x0000 {
+		t.Errorf("expect 0x%04x but 0x%04x", 0x0000, actual.cx)
+	}
+	if !actual.isActiveZF() {
+		t.Errorf("expected ZF to be set")
+	}
+}
+
+func TestTestDoesNotWrite(t *testing.T) {
+	inst := instTest{dest: reg8{value: AL}, src: imm8{value: 0x0f}}
+	actual := state{ax: 0x00f0}.setCF()
+	err := execTest(inst, &actual, nil)
+	if err != nil {
+		t.Errorf("%+v", err)
+	}
+	if actual.ax != 0x00f0 {
+		t.Errorf("expect 0x%04x but 0x%04x", 0x00f0, actual.ax)
+	}
+	if !actual.isActiveZF() {
+		t.Errorf("expected ZF to be set")
+	}
+	if actual.isActiveCF() {
+		t.Errorf("expected CF to be reset")
+	}
+}
+
+func TestPushWithStackBeyondImage(t *testing.T) {
+	b := rawHeaderForRunExe()
+	// ss:sp = 2000:0100, far beyond load module
+	b[14], b[15], b[16], b[17] = 0x00, 0x20, 0x00, 0x01
+	b = append(b, []byte{0xb8, 0x34, 0x12}...) // mov ax,0x1234
+	b = append(b, []byte{0x50}...)             // push ax
+	b = append(b, []byte{0x5b}...)             // pop bx
+	b = append(b, []byte{0xb8, 0x00, 0x4c}...) // mov ax,4c00h
+	b = append(b, []byte{0xcd, 0x21}...)       // int 21h
+
+	actual, err := runExeWithCustomIntHandlers(bytes.NewReader(b), make(intHandlers))
+	if err != nil {
+		t.Errorf("%+v", err)
+	}
+	if actual.bx != 0x1234 {
+		t.Errorf("expect 0x%04x but 0x%04x", 0x1234, actual.bx)
+	}
+}
+
+func TestStackOutOfMemory(t *testing.T) {
+	b := rawHeaderForRunExe()
+	// ss:sp = ffff:fff0, beyond 1MB
+	b[14], b[15], b[16], b[17] = 0xff, 0xff, 0xf0, 0xff
+	b = b.withInt21_4c()
+
+	_, err := runExeWithCustomIntHandlers(bytes.NewReader(b), make(intHandlers))
+	if err == nil {
+		t.Errorf("expected error for stack out of memory")
+	}
+}
+
+func TestCommandTailInPSP(t *testing.T) {
+	b := rawHeaderForRunExe()
+	b = append(b, []byte{0x26, 0x8a, 0x1e, 0x81, 0x00}...) // mov bl,es:[0x0081]
+	b = append(b, []byte{0x26, 0x8a, 0x06, 0x80, 0x00}...) // mov al,es:[0x0080]
+	b = b.withInt21_4c()
+
+	exitCode, state, err := RunExeWithCommandLine(bytes.NewReader(b), " foo")
+	if err != nil {
+		t.Errorf("%+v", err)
+	}
+	if exitCode != 4 {
+		t.Errorf("expect exitCode to be %d but actual %d", 4, exitCode)
+	}
+	if state.bl() != ' ' {
+		t.Errorf("expect bl as 0x%02x but actual 0x%02x", ' ', state.bl())
+	}
+	if state.ds != pspSegment || state.es != pspSegment {
+		t.Errorf("expect ds and es as 0x%04x but actual 0x%04x and 0x%04x", pspSegment, state.ds, state.es)
+	}
+	if state.cs != loadSegment {
+		t.Errorf("expect cs as 0x%04x but actual 0x%04x", loadSegment, state.cs)
+	}
+}
+
+func TestSetLoadSegment(t *testing.T) {
+	b := rawHeaderForRunExe().withInt21_4c()
+
+	cpu := NewCPU()
+	cpu.SetLoadSegment(0x2000)
+	if err := cpu.LoadExe(bytes.NewReader(b)); err != nil {
+		t.Errorf("%+v", err)
+	}
+	// load module is placed at the load segment, just after 256 bytes of PSP
+	actual, err := cpu.ReadBytesAt(0x2000, 0x0000, 4)
+	if err != nil {
+		t.Errorf("%+v", err)
+	}
+	expected := []byte{0xb4, 0x4c, 0xcd, 0x21}
+	if !bytes.Equal(actual, expected) {
+		t.Errorf("expected %v but actual %v", expected, actual)
+	}
+	r := cpu.Registers()
+	if r.DS != 0x1ff0 || r.ES != 0x1ff0 {
+		t.Errorf("expected ds and es to point PSP at 0x1ff0 but 0x%04x and 0x%04x", r.DS, r.ES)
+	}
+
+	// PSP would overlap BIOS data area
+	cpu = NewCPU()
+	cpu.SetLoadSegment(0x0040)
+	if err := cpu.LoadExe(bytes.NewReader(b)); err == nil {
+		t.Errorf("expected error for too low load segment")
+	}
+}
+
+func TestInitialCSAndSSWithLoadSegment(t *testing.T) {
+	b := rawHeaderForRunExe().with(0x8c, 0xc8) // mov ax,cs
+	b = b.withInt21_4c()
+
+	cpu := NewCPU()
+	cpu.SetLoadSegment(0x2000)
+	if err := cpu.LoadExe(bytes.NewReader(b)); err != nil {
+		t.Errorf("%+v", err)
+	}
+	if _, err := cpu.Step(); err != nil {
+		t.Errorf("%+v", err)
+	}
+	// header has CS 0x0000 and SS 0x0001, which are relative to the load segment
+	r := cpu.Registers()
+	if r.AX != 0x2000 || r.SS != 0x2001 {
+		t.Errorf("expected cs 0x2000 and ss 0x2001 but 0x%04x and 0x%04x", r.AX, r.SS)
+	}
+	if _, err := cpu.Run(); err != nil {
+		t.Errorf("%+v", err)
+	}
+}
+
+func TestWritePSP(t *testing.T) {
+	memory := newMemory([]byte{})
+	if err := memory.writePSP(pspSegment, " a b"); err != nil {
+		t.Errorf("%+v", err)
+	}
+	actual, err := memory.readBytes(newAddressFromWord(pspSegment, 0x80), 6)
+	if err != nil {
+		t.Errorf("%+v", err)
+	}
+	expected := []byte{0x04, ' ', 'a', ' ', 'b', 0x0d}
+	if !bytes.Equal(actual, expected) {
+		t.Errorf("expect %v but actual %v", expected, actual)
+	}
+
+	if err := memory.writePSP(pspSegment, string(make([]byte, 127))); err == nil {
+		t.Errorf("expected error for too long command line")
+	}
+}
+
+func TestCsSegmentOverride(t *testing.T) {
+	b := rawHeaderForRunExe()
+	b = append(b, []byte{0x2e, 0x8b, 0x1e, 0x00, 0x00}...) // mov bx,cs:[0x0000]
+	b = b.withInt21_4c()
+
+	actual, err := runExeWithCustomIntHandlers(bytes.NewReader(b), make(intHandlers))
+	if err != nil {
+		t.Errorf("%+v", err)
+	}
+	// the first word of code segment is the instruction itself
+	if actual.bx != 0x8b2e {
+		t.Errorf("expect 0x%04x but 0x%04x", 0x8b2e, actual.bx)
+	}
+	if actual.ds != pspSegment {
+		t.Errorf("expect ds to be restored as 0x%04x but 0x%04x", pspSegment, actual.ds)
+	}
+}
+
+func TestMovFsGs(t *testing.T) {
+	b := rawHeaderForRunExe()
+	b = append(b, []byte{0xb8, 0x34, 0x12}...) // mov ax,0x1234
+	b = append(b, []byte{0x8e, 0xe0}...)       // mov fs,ax
+	b = append(b, []byte{0xb8, 0x78, 0x56}...) // mov ax,0x5678
+	b = append(b, []byte{0x8e, 0xe8}...)       // mov gs,ax
+	b = append(b, []byte{0x8c, 0xe3}...)       // mov bx,fs
+	b = append(b, []byte{0x8c, 0xe9}...)       // mov cx,gs
+	b = b.withInt21_4c()
+
+	actual, err := runExeWithCustomIntHandlers(bytes.NewReader(b), make(intHandlers))
+	if err != nil {
+		t.Errorf("%+v", err)
+	}
+	if actual.bx != 0x1234 {
+		t.Errorf("expect 0x%04x but 0x%04x", 0x1234, actual.bx)
+	}
+	if actual.cx != 0x5678 {
+		t.Errorf("expect 0x%04x but 0x%04x", 0x5678, actual.cx)
+	}
+}
+
+func TestMovSregMemory(t *testing.T) {
+	var b machineCode
+	b = append(b, []byte{0xbb, 0x10, 0x00}...) // mov bx,0x0010
+	b = append(b, []byte{0xbe, 0x02, 0x00}...) // mov si,0x0002
+	b = append(b, []byte{0x8c, 0x18}...)       // mov [bx+si],ds
+	b = append(b, []byte{0xbd, 0x0e, 0x00}...) // mov bp,0x000e
+	b = append(b, []byte{0x8e, 0x46, 0x04}...) // mov es,[bp+4]
+
+	cpu := NewCPU()
+	if err := cpu.LoadFlat(b, 0x2000, 0x0000); err != nil {
+		t.Errorf("%+v", err)
+	}
+	for i := 0; i < 3; i++ {
+		if _, err := cpu.Step(); err != nil {
+			t.Errorf("%+v", err)
+		}
+	}
+	stored, err := cpu.ReadWordAt(0x2000, 0x0012)
+	if err != nil {
+		t.Errorf("%+v", err)
+	}
+	if stored != 0x2000 {
+		t.Errorf("expected ds 0x2000 to be stored but 0x%04x", stored)
+	}
+
+	if err := cpu.WriteWordAt(0x2000, 0x0012, 0x1234); err != nil {
+		t.Errorf("%+v", err)
+	}
+	for i := 0; i < 2; i++ {
+		if _, err := cpu.Step(); err != nil {
+			t.Errorf("%+v", err)
+		}
+	}
+	if cpu.state.es != 0x1234 {
+		t.Errorf("expected es 0x1234 but 0x%04x", cpu.state.es)
+	}
+}
+
+func TestCPUStep(t *testing.T) {
+	b := rawHeaderForRunExe()
+	b = append(b, []byte{0xb8, 0x34, 0x12}...) // mov ax,0x1234
+	b = append(b, []byte{0x89, 0xc3}...)       // mov bx,ax
+	b = b.withInt21_4c()
+
+	cpu := NewCPU()
+	if err := cpu.LoadExe(bytes.NewReader(b)); err != nil {
+		t.Errorf("%+v", err)
+	}
+
+	exited, err := cpu.Step()
+	if err != nil {
+		t.Errorf("%+v", err)
+	}
+	if exited || cpu.state.ax != 0x1234 || cpu.state.bx != 0x0000 || cpu.state.ip != 0x0003 {
+		t.Errorf("unexpected state after first step: %+v", cpu.state)
+	}
+
+	exited, err = cpu.Step()
+	if err != nil {
+		t.Errorf("%+v", err)
+	}
+	if exited || cpu.state.bx != 0x1234 || cpu.state.ip != 0x0005 {
+		t.Errorf("unexpected state after second step: %+v", cpu.state)
+	}
+
+	exitCode, err := cpu.Run()
+	if err != nil {
+		t.Errorf("%+v", err)
+	}
+	if exitCode != 0x34 {
+		t.Errorf("expect exitCode to be %d but actual %d", 0x34, exitCode)
+	}
+	exited, err = cpu.Step()
+	if err != nil {
+		t.Errorf("%+v", err)
+	}
+	if !exited {
+		t.Errorf("expected step after exit to report exited")
+	}
+}
+
+func TestCPULoadFlat(t *testing.T) {
+	var b machineCode
+	b = append(b, []byte{0x90, 0x90}...)       // data skipped by entryIP
+	b = append(b, []byte{0xb8, 0x34, 0x12}...) // mov ax,0x1234
+	b = append(b, []byte{0x8c, 0xcb}...)       // mov bx,cs
+
+	cpu := NewCPU()
+	if err := cpu.LoadFlat(b, 0x2000, 0x0002); err != nil {
+		t.Errorf("%+v", err)
+	}
+
+	if _, err := cpu.Step(); err != nil {
+		t.Errorf("%+v", err)
+	}
+	if cpu.state.ax != 0x1234 || cpu.state.ip != 0x0005 {
+		t.Errorf("unexpected state after first step: %+v", cpu.state)
+	}
+
+	if _, err := cpu.Step(); err != nil {
+		t.Errorf("%+v", err)
+	}
+	if cpu.state.bx != 0x2000 || cpu.state.ip != 0x0007 {
+		t.Errorf("unexpected state after second step: %+v", cpu.state)
+	}
+}
+
+func TestCPULoadFlatInterruptVectors(t *testing.T) {
+	cpu := NewCPU()
+	if err := cpu.LoadFlat([]byte{0xcd, 0x21}, 0x0030, 0x0000); err == nil {
+		t.Errorf("expected error for load segment overlapping interrupt vector table")
+	}
+
+	// mov ah,4ch; int 21h is handled by the emulator just above the table
+	b := machineCode{}.movImm8(AL, 0x03).int21(0x4c)
+	if err := cpu.LoadFlat(b, 0x0040, 0x0000); err != nil {
+		t.Errorf("%+v", err)
+	}
+	if offset, _ := cpu.ReadWordAt(0x0000, 0x21*4); offset != 0x0021 {
+		t.Errorf("expected vector of int 21h to point to its stub but offset 0x%04x", offset)
+	}
+	exitCode, err := cpu.Run()
+	if err != nil {
+		t.Errorf("%+v", err)
+	}
+	if exitCode != 0x03 {
+		t.Errorf("expected exit code 0x03 but 0x%02x", exitCode)
+	}
+}
+
+func TestCPUDump(t *testing.T) {
+	b := []byte("\xb8\x01\x00Hello, world!\x00\xff@")
+	cpu := NewCPU()
+	if err := cpu.LoadFlat(b, 0x2000, 0x0000); err != nil {
+		t.Errorf("%+v", err)
+	}
+
+	var out bytes.Buffer
+	if err := cpu.Dump(0x2000, 0x0000, len(b), &out); err != nil {
+		t.Errorf("%+v", err)
+	}
+	expected := "2000:0000  B8 01 00 48 65 6C 6C 6F 2C 20 77 6F 72 6C 64 21  |...Hello, world!|\n" +
+		"2000:0010  00 FF 40                                         |..@|\n"
+	if out.String() != expected {
+		t.Errorf("expected\n%s\nbut actual\n%s", expected, out.String())
+	}
+
+	// offset wraps around within the segment
+	out.Reset()
+	if err := cpu.Dump(0x2000, 0xffff, 2, &out); err != nil {
+		t.Errorf("%+v", err)
+	}
+	expected = "2000:FFFF  00 B8                                            |..|\n"
+	if out.String() != expected {
+		t.Errorf("expected\n%s\nbut actual\n%s", expected, out.String())
+	}
+
+	// bytes beyond memory are shown as ??
+	out.Reset()
+	if err := cpu.Dump(0xffff, 0x000e, 4, &out); err != nil {
+		t.Errorf("%+v", err)
+	}
+	expected = "FFFF:000E  00 00 ?? ??                                      |....|\n"
+	if out.String() != expected {
+		t.Errorf("expected\n%s\nbut actual\n%s", expected, out.String())
+	}
+}
+
+func TestCPUReset(t *testing.T) {
+	var b machineCode
+	b = append(b, []byte{0xa1, 0x10, 0x01}...) // mov ax,[0x0110]
+	b = append(b, 0x40)                        // inc ax
+	b = append(b, []byte{0xa3, 0x10, 0x01}...) // mov [0x0110],ax
+	b = append(b, []byte{0xb4, 0x4c}...)       // mov ah,4ch
+	b = append(b, []byte{0xcd, 0x21}...)       // int 21h
+	b = append(b, make([]byte, 0x10-len(b))...)
+	b = append(b, []byte{0x05, 0x00}...) // counter at 0x0110
+
+	cpu := NewCPU()
+	if err := cpu.Reset(); err == nil {
+		t.Errorf("expected error to reset before loading program")
+	}
+	if err := cpu.LoadCom(bytes.NewReader(b)); err != nil {
+		t.Errorf("%+v", err)
+	}
+	initialRegisters := cpu.Registers()
 
-	actual, err := runExeWithCustomIntHandlers(bytes.NewReader(b), intHandlers)
+	var registers []Registers
+	for i := 0; i < 2; i++ {
+		exitCode, err := cpu.Run()
+		if err != nil {
+			t.Errorf("%+v", err)
+		}
+		if exitCode != 6 {
+			t.Errorf("expected exit code 6 in run %d but %d", i, exitCode)
+		}
+		registers = append(registers, cpu.Registers())
+		if err := cpu.Reset(); err != nil {
+			t.Errorf("%+v", err)
+		}
+		if cpu.Registers() != initialRegisters {
+			t.Errorf("expected %+v after reset but %+v", initialRegisters, cpu.Registers())
+		}
+	}
+	if registers[0] != registers[1] {
+		t.Errorf("expected identical registers but %+v and %+v", registers[0], registers[1])
+	}
+}
+
+func TestCPUSetRegisters(t *testing.T) {
+	cpu := NewCPU()
+	if err := cpu.SetRegisters(Registers{}); err == nil {
+		t.Errorf("expected error to set registers before loading program")
+	}
+
+	b := []byte{0x90, 0x90, 0x03, 0xc3} // data skipped by IP, add ax,bx
+	if err := cpu.LoadFlat(b, 0x2000, 0x0000); err != nil {
+		t.Errorf("%+v", err)
+	}
+	r := cpu.Registers()
+	r.AX = 0x1200
+	r.BX = 0x0034
+	r.IP = 0x0002
+	r.FLAGS = EFLAGS_CF
+	if err := cpu.SetRegisters(r); err != nil {
+		t.Errorf("%+v", err)
+	}
+	if cpu.Registers().FLAGS != EFLAGS_CF|EFLAGS_RESERVED {
+		t.Errorf("expected FLAGS 0x%04x but 0x%04x", EFLAGS_CF|EFLAGS_RESERVED, cpu.Registers().FLAGS)
+	}
+
+	if _, err := cpu.Step(); err != nil {
+		t.Errorf("%+v", err)
+	}
+	actual := cpu.Registers()
+	if actual.AX != 0x1234 || actual.BX != 0x0034 || actual.IP != 0x0004 {
+		t.Errorf("unexpected registers after add ax,bx: %+v", actual)
+	}
+}
+
+func TestCPUFlag(t *testing.T) {
+	b := []byte{0x3c, 0x02} // cmp al,2
+	cpu := NewCPU()
+	if err := cpu.LoadFlat(b, 0x2000, 0x0000); err != nil {
+		t.Errorf("%+v", err)
+	}
+	cpu.SetFlag(DF, true)
+	if _, err := cpu.Step(); err != nil {
+		t.Errorf("%+v", err)
+	}
+
+	// 0 - 2 = 0xfe
+	expected := map[Flag]bool{CF: true, PF: false, AF: true, ZF: false, SF: true, DF: true, OF: false}
+	names := map[Flag]string{CF: "CF", PF: "PF", AF: "AF", ZF: "ZF", SF: "SF", DF: "DF", OF: "OF"}
+	for f, v := range expected {
+		if cpu.Flag(f) != v {
+			t.Errorf("expected %s to be %v", names[f], v)
+		}
+	}
+
+	cpu.SetFlag(CF, false)
+	if cpu.Flag(CF) || !cpu.Flag(SF) {
+		t.Errorf("expected only CF to be reset but FLAGS 0x%04x", cpu.Registers().FLAGS)
+	}
+}
+
+func TestCPUSyscallFunc(t *testing.T) {
+	file, err := os.Open("sample/hll.exe")
 	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	defer file.Close()
+
+	var calls []string
+	cpu := NewCPU()
+	cpu.SetStdout(ioutil.Discard)
+	cpu.SetSyscallFunc(func(intNo uint8, ah uint8, regs Registers) {
+		if uint8(regs.AX>>8) != ah {
+			t.Errorf("expected AH in registers to be 0x%02x but AX 0x%04x", ah, regs.AX)
+		}
+		calls = append(calls, fmt.Sprintf("%02x:%02x", intNo, ah))
+	})
+	if err := cpu.LoadExe(file); err != nil {
+		t.Errorf("%+v", err)
+	}
+	if _, err := cpu.Run(); err != nil {
 		t.Errorf("%+v", err)
 	}
 
-	if actual.ax != 0x4c01 {
-		t.Errorf("ax is illegal: %04x", actual.ax)
+	// startup code resizes memory block and checks DOS version before main prints message
+	expected := "21:4a 21:30 21:09 21:4c"
+	if actual := strings.Join(calls, " "); actual != expected {
+		t.Errorf("expected %s but actual %s", expected, actual)
 	}
-	if actual.al() != 0x01 {
-		t.Errorf("al is illegal: %02x", actual.al())
+}
+
+func TestCPUCoverage(t *testing.T) {
+	var b machineCode
+	b = append(b, []byte{0x31, 0xc0}...) // xor ax,ax
+	b = append(b, []byte{0x74, 0x02}...) // je 0x0006
+	b = append(b, []byte{0x40, 0x40}...) // inc ax (not taken)
+	b = append(b, 0x48)                  // dec ax
+
+	cpu := NewCPU()
+	if err := cpu.LoadFlat(b, 0x2000, 0x0000); err != nil {
+		t.Errorf("%+v", err)
 	}
-	if actual.ah() != 0x4c {
-		t.Errorf("ah is illegal: %02x", actual.ah())
+	if len(cpu.Coverage()) != 0 {
+		t.Errorf("expected no coverage by default but %v", cpu.Coverage())
 	}
-	if actual.exitCode != 0x01 {
-		t.Errorf("exitCode is expected to be %02x but %02x", 0x01, actual.exitCode)
+	cpu.SetCoverage(true)
+	for i := 0; i < 3; i++ {
+		if _, err := cpu.Step(); err != nil {
+			t.Errorf("%+v", err)
+		}
+	}
+
+	expected := []uint32{0x20000, 0x20002, 0x20006}
+	actual := cpu.Coverage()
+	if fmt.Sprint(actual) != fmt.Sprint(expected) {
+		t.Errorf("expected %x but actual %x", expected, actual)
 	}
 }
 
-func TestInt21_4c_cx(t *testing.T) {
-	// exit status 1
-	b := rawHeaderForRunExe()
-	b = append(b, []byte{0xb9, 0x4c, 0x00}...) // mov cx,4ch
-	b = append(b, []byte{0xc1, 0xe1, 0x08}...) // shl cx,8
-	b = append(b, []byte{0x83, 0xc1, 0x01}...) // add cx,01h
-	b = append(b, []byte{0x8b, 0xc1}...)       // mov ax,cx
+func TestCallIndirect(t *testing.T) {
+	var b machineCode
+	b = append(b, []byte{0xbb, 0x0f, 0x01}...) // mov bx,0x010f
+	b = append(b, []byte{0xff, 0xd3}...)       // call bx
+	b = append(b, []byte{0x89, 0xe5}...)       // mov bp,sp
+	b = append(b, 0x53)                        // push bx
+	b = append(b, []byte{0xff, 0x56, 0xfe}...) // call [bp-2]
+	b = append(b, []byte{0xb4, 0x4c}...)       // mov ah,4ch
 	b = append(b, []byte{0xcd, 0x21}...)       // int 21h
+	b = append(b, []byte{0x83, 0xc0, 0x01}...) // add ax,1
+	b = append(b, 0xc3)                        // ret
 
-	intHandlers := make(intHandlers)
+	cpu := NewCPU()
+	if err := cpu.LoadCom(bytes.NewReader(b)); err != nil {
+		t.Errorf("%+v", err)
+	}
+	exitCode, err := cpu.Run()
+	if err != nil {
+		t.Errorf("%+v", err)
+	}
+	if exitCode != 2 {
+		t.Errorf("expected both calls to return but exit code %d", exitCode)
+	}
+}
 
-	actual, err := runExeWithCustomIntHandlers(bytes.NewReader(b), intHandlers)
+func TestJmpIndirect(t *testing.T) {
+	// jump table of near offsets at 0x0120, indexed by al
+	run := func(index uint8) uint8 {
+		b := machineCode{}.
+			movImm8(AL, index).
+			movImm8(AH, 0).
+			with(0x03, 0xc0).            // add ax,ax
+			with(0x8b, 0xd8).            // mov bx,ax
+			with(0xff, 0xa7, 0x20, 0x01) // jmp [bx+0x0120]
+		// first entry at 0x010c
+		b = b.movImm8(AL, 0x10).int21(0x4c)
+		// second entry at 0x0112
+		b = b.movImm8(AL, 0x20).int21(0x4c)
+		for len(b) < 0x20 {
+			b = b.with(0x90)
+		}
+		b = b.with(0x0c, 0x01, 0x12, 0x01) // table
+
+		return runCom(t, NewCPU(), b)
+	}
+
+	if exitCode := run(0); exitCode != 0x10 {
+		t.Errorf("expected jump to the first entry but exit code 0x%02x", exitCode)
+	}
+	if exitCode := run(1); exitCode != 0x20 {
+		t.Errorf("expected jump to the second entry but exit code 0x%02x", exitCode)
+	}
+}
+
+func TestCallReturnsAfterCall(t *testing.T) {
+	var b machineCode
+	b = append(b, []byte{0xe8, 0x04, 0x00}...) // call 0x0107
+	b = append(b, []byte{0xb4, 0x4c}...)       // mov ah,4ch
+	b = append(b, []byte{0xcd, 0x21}...)       // int 21h
+	b = append(b, []byte{0xb0, 0x07}...)       // mov al,7
+	b = append(b, 0xc3)                        // ret
+
+	cpu := NewCPU()
+	if err := cpu.LoadCom(bytes.NewReader(b)); err != nil {
+		t.Errorf("%+v", err)
+	}
+
+	if _, err := cpu.Step(); err != nil {
+		t.Errorf("%+v", err)
+	}
+	returnAddress, err := cpu.ReadWordAt(uint16(cpu.state.ss), uint16(cpu.state.sp))
 	if err != nil {
 		t.Errorf("%+v", err)
 	}
+	if cpu.state.ip != 0x0107 || returnAddress != 0x0103 {
+		t.Errorf("expected call to 0x0107 with return address 0x0103 but ip 0x%04x and 0x%04x", cpu.state.ip, returnAddress)
+	}
 
-	if actual.ax != 0x4c01 {
-		t.Errorf("ax is illegal: %04x", actual.ax)
+	for i := 0; i < 2; i++ {
+		if _, err := cpu.Step(); err != nil {
+			t.Errorf("%+v", err)
+		}
 	}
-	if actual.al() != 0x01 {
-		t.Errorf("al is illegal: %02x", actual.al())
+	if cpu.state.ip != 0x0103 || cpu.state.sp != 0xfffe {
+		t.Errorf("expected ret to 0x0103 but ip 0x%04x and sp 0x%04x", cpu.state.ip, cpu.state.sp)
 	}
-	if actual.ah() != 0x4c {
-		t.Errorf("ah is illegal: %02x", actual.ah())
+
+	exitCode, err := cpu.Run()
+	if err != nil {
+		t.Errorf("%+v", err)
 	}
-	if actual.exitCode != 0x01 {
-		t.Errorf("exitCode is expected to be %02x but %02x", 0x01, actual.exitCode)
+	if exitCode != 7 {
+		t.Errorf("expected exit code 7 but %d", exitCode)
 	}
 }
 
-// for print systemcall
+func TestCPUWrapIPAroundSegment(t *testing.T) {
+	b := make([]byte, 0x10000)
+	copy(b[0xfff0:], []byte{0xe9, 0x10, 0x00}) // jmp 0x0003 (wraps)
+	copy(b[0x0003:], []byte{0xe9, 0xf8, 0xff}) // jmp 0xfffe (wraps)
+	copy(b[0xfffe:], []byte{0xb8, 0x34})       // mov ax,0x1234 (continues at 0x0000)
+	copy(b[0x0000:], []byte{0x12})
 
-func rawHeaderForTestInt21_09() machineCode {
-	// assume that there is one relocation
-	// (1) relocation items
-	// (2) item of relocation table
-	return []byte{
-		//                                      <--(1)--->
-		0x4d, 0x5a, 0x4f, 0x00, 0x01, 0x00, 0x01, 0x00, 0x03, 0x00, 0x01, 0x01, 0xff, 0xff, 0x02, 0x00,
-		0x00, 0x10, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x20, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00,
-		//  <--(2)--->
-		0x01, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00,
+	cpu := NewCPU()
+	if err := cpu.LoadFlat(b, 0x2000, 0xfff0); err != nil {
+		t.Errorf("%+v", err)
+	}
+
+	expectedIPs := []word{0x0003, 0xfffe, 0x0001}
+	for i, expectedIP := range expectedIPs {
+		if _, err := cpu.Step(); err != nil {
+			t.Fatalf("%+v", err)
+		}
+		if cpu.state.ip != expectedIP {
+			t.Errorf("expected ip 0x%04x after step %d but 0x%04x", expectedIP, i, cpu.state.ip)
+		}
+	}
+	if cpu.state.ax != 0x1234 {
+		t.Errorf("expected ax 0x1234 but 0x%04x", cpu.state.ax)
 	}
 }
 
-func TestInt21_09(t *testing.T) {
-	b := rawHeaderForTestInt21_09()
-	b = append(b, []byte{0xb8, 0x01, 0x00}...)       // mov ax,seg msg
-	b = append(b, []byte{0x8e, 0xd8}...)             // mov ds,ax
-	b = append(b, []byte{0xb4, 0x09}...)             // mov ah,09h
-	b = append(b, []byte{0x8d, 0x16, 0x02, 0x00}...) // lea dx,msg
-	b = append(b, []byte{0xcd, 0x21}...)             // int 21h
-	b = append(b, []byte{0xb8, 0x00, 0x4c}...)       // mov ax,4c00h
-	b = append(b, []byte{0xcd, 0x21}...)             // int 21h
-	b = append(b, []byte("Hello world!$")...)
+func TestCPUTraceFunc(t *testing.T) {
+	b := rawHeaderForRunExe()
+	b = append(b, []byte{0xb8, 0x34, 0x12}...) // mov ax,0x1234
+	b = append(b, []byte{0x83, 0xc0, 0x01}...) // add ax,0x0001
+	b = b.withInt21_4c()
 
-	tempFile, err := ioutil.TempFile("", "TestInt21_09")
-	if err != nil {
+	var types []string
+	var ips []uint16
+	cpu := NewCPU()
+	cpu.SetTraceFunc(func(cs, ip uint16, inst interface{}) {
+		types = append(types, fmt.Sprintf("%T", inst))
+		ips = append(ips, ip)
+	})
+	if err := cpu.LoadExe(bytes.NewReader(b)); err != nil {
+		t.Errorf("%+v", err)
+	}
+	if _, err := cpu.Run(); err != nil {
 		t.Errorf("%+v", err)
 	}
-	defer os.Remove(tempFile.Name())
 
-	intHandlers := make(intHandlers)
-	intHandlers[0x09] = func(s *state, m *memory) error {
-		originalStdout := os.Stdout
-		os.Stdout = tempFile
-		err = intHandler09(s, m)
-		os.Stdout = originalStdout
-		return err
+	expectedTypes := []string{"x86_emulator.instMov", "x86_emulator.instAdd", "x86_emulator.instMov", "x86_emulator.instInt"}
+	expectedIPs := []uint16{0x0000, 0x0003, 0x0006, 0x0008}
+	if fmt.Sprint(types) != fmt.Sprint(expectedTypes) {
+		t.Errorf("expect %v but actual %v", expectedTypes, types)
 	}
+	if fmt.Sprint(ips) != fmt.Sprint(expectedIPs) {
+		t.Errorf("expect %v but actual %v", expectedIPs, ips)
+	}
+}
 
-	// debug = debugT(true)
+func TestCPUBreakpoint(t *testing.T) {
+	b := rawHeaderForRunExe()
+	b = append(b, []byte{0xb8, 0x34, 0x12}...) // mov ax,0x1234
+	b = append(b, []byte{0x83, 0xc0, 0x01}...) // add ax,0x0001
+	b = b.withInt21_4c()
 
-	_, err = runExeWithCustomIntHandlers(bytes.NewReader(b), intHandlers)
-	if err != nil {
+	cpu := NewCPU()
+	if err := cpu.LoadExe(bytes.NewReader(b)); err != nil {
 		t.Errorf("%+v", err)
 	}
+	regs := cpu.Registers()
+	cpu.AddBreakpoint(regs.CS, 0x0003)
+
+	_, err := cpu.Run()
+	if errors.Cause(err) != ErrBreakpoint {
+		t.Errorf("expected to stop at breakpoint but actual %+v", err)
+	}
+	regs = cpu.Registers()
+	if regs.IP != 0x0003 || regs.AX != 0x1234 {
+		t.Errorf("unexpected registers at breakpoint: %+v", regs)
+	}
+	if cpu.state.shouldExit {
+		t.Errorf("expected program not to exit at breakpoint")
+	}
 
-	tempFile.Sync()
-	tempFile.Seek(0, 0)
-	output, err := ioutil.ReadAll(tempFile)
+	// resume from breakpoint
+	exitCode, err := cpu.Run()
 	if err != nil {
 		t.Errorf("%+v", err)
 	}
-	if string(output) != "Hello world!" {
-		t.Errorf("expect output \"%s\" but \"%s\"", "Hello world!", string(output))
+	if exitCode != 0x35 {
+		t.Errorf("expect exitCode to be %d but actual %d", 0x35, exitCode)
+	}
+}
+
+func TestCPUBreakpointAtEntry(t *testing.T) {
+	b := machineCode{}.movImm16(AX, 0x1234).with(0xcd, 0x20) // int 20h
+
+	cpu := NewCPU()
+	if err := cpu.LoadCom(bytes.NewReader(b)); err != nil {
+		t.Errorf("%+v", err)
+	}
+	cpu.AddBreakpoint(0x0100, 0x0100)
+
+	_, err := cpu.Run()
+	if errors.Cause(err) != ErrBreakpoint {
+		t.Errorf("expected to stop at breakpoint but actual %+v", err)
+	}
+	regs := cpu.Registers()
+	if regs.IP != 0x0100 || regs.AX != 0x0000 {
+		t.Errorf("unexpected registers at breakpoint: %+v", regs)
+	}
+
+	// resume from breakpoint
+	if _, err := cpu.Run(); err != nil {
+		t.Errorf("%+v", err)
+	}
+	if regs := cpu.Registers(); regs.AX != 0x1234 {
+		t.Errorf("expected ax 0x1234 but actual 0x%04x", regs.AX)
 	}
 
-	if err = tempFile.Close(); err != nil {
+	// the breakpoint is hit again after reset
+	if err := cpu.Reset(); err != nil {
 		t.Errorf("%+v", err)
 	}
+	if _, err := cpu.Run(); errors.Cause(err) != ErrBreakpoint {
+		t.Errorf("expected to stop at breakpoint but actual %+v", err)
+	}
 }
 
-func rawHeaderForTestPush() machineCode {
-	return []byte{
-		0x4d, 0x5a, 0x2b, 0x00, 0x01, 0x00, 0x00, 0x00, 0x02, 0x00, 0x01, 0x01, 0xff, 0xff, 0x01, 0x00,
-		0x00, 0x10, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x20, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00,
+func TestCPUInstructionLimit(t *testing.T) {
+	b := rawHeaderForRunExe()
+	b = append(b, []byte{0xeb, 0xfe}...) // jmp $
+	b = b.withInt21_4c()
+
+	var count int
+	cpu := NewCPU()
+	cpu.SetInstructionLimit(100)
+	cpu.SetTraceFunc(func(cs, ip uint16, inst interface{}) {
+		count++
+	})
+	if err := cpu.LoadExe(bytes.NewReader(b)); err != nil {
+		t.Errorf("%+v", err)
+	}
+	if _, err := cpu.Run(); err == nil {
+		t.Errorf("expected error for instruction limit")
+	}
+	if count != 100 {
+		t.Errorf("expected 100 instructions to be executed but actual %d", count)
 	}
 }
 
-func TestPushAndPop(t *testing.T) {
-	b := rawHeaderForTestPush()
-	b = append(b, []byte{0xb8, 0x35, 0x10}...) // mov ax, 0x1035
-	b = append(b, []byte{0xb9, 0x36, 0x20}...) // mov cx, 0x2036
+func TestCPUMemoryAccess(t *testing.T) {
+	cpu := NewCPU()
+	if err := cpu.WriteByteAt(0x2000, 0x0000, 0x12); err == nil {
+		t.Errorf("expected error before loading program")
+	}
+	if err := cpu.LoadExe(bytes.NewReader(rawHeaderForRunExe().withInt21_4c())); err != nil {
+		t.Errorf("%+v", err)
+	}
+
+	if err := cpu.WriteByteAt(0x2000, 0x0000, 0x12); err != nil {
+		t.Errorf("%+v", err)
+	}
+	if err := cpu.WriteWordAt(0x2000, 0x0001, 0x5634); err != nil {
+		t.Errorf("%+v", err)
+	}
+	b, err := cpu.ReadByteAt(0x2000, 0x0000)
+	if err != nil {
+		t.Errorf("%+v", err)
+	}
+	if b != 0x12 {
+		t.Errorf("expect 0x%02x but actual 0x%02x", 0x12, b)
+	}
+	w, err := cpu.ReadWordAt(0x2000, 0x0001)
+	if err != nil {
+		t.Errorf("%+v", err)
+	}
+	if w != 0x5634 {
+		t.Errorf("expect 0x%04x but actual 0x%04x", 0x5634, w)
+	}
+	bs, err := cpu.ReadBytesAt(0x2000, 0x0000, 3)
+	if err != nil {
+		t.Errorf("%+v", err)
+	}
+	if !bytes.Equal(bs, []byte{0x12, 0x34, 0x56}) {
+		t.Errorf("expect %v but actual %v", []byte{0x12, 0x34, 0x56}, bs)
+	}
+
+	if _, err := cpu.ReadBytesAt(0xffff, 0x0010, 1); err == nil {
+		t.Errorf("expected error for address beyond 1MB")
+	}
+}
+
+func TestPushfAtStartup(t *testing.T) {
+	var b machineCode
+	b = append(b, []byte{0x9c}...)       // pushf
+	b = append(b, []byte{0x58}...)       // pop ax
+	b = append(b, []byte{0xcd, 0x20}...) // int 20h
+
+	_, state, err := RunCom(bytes.NewReader(b))
+	if err != nil {
+		t.Errorf("%+v", err)
+	}
+	if state.ax != 0x0002 {
+		t.Errorf("expect flags at startup as 0x0002 but actual 0x%04x", state.ax)
+	}
+}
+
+func TestPopfKeepsReservedBits(t *testing.T) {
+	var b machineCode
+	b = append(b, []byte{0xb8, 0xff, 0xff}...) // mov ax,0xffff
 	b = append(b, []byte{0x50}...)             // push ax
-	b = append(b, []byte{0x51}...)             // push cx
+	b = append(b, []byte{0x9d}...)             // popf
+	b = append(b, []byte{0x9c}...)             // pushf
 	b = append(b, []byte{0x5b}...)             // pop bx
-	b = append(b, []byte{0x5a}...)             // pop dx
-	b = append(b, []byte{0xb8, 0x00, 0x4c}...) // mov ax,4c00h
-	b = append(b, []byte{0xcd, 0x21}...)       // int 21h
-
-	intHandlers := make(intHandlers)
+	b = append(b, []byte{0x31, 0xc0}...)       // xor ax,ax
+	b = append(b, []byte{0x50}...)             // push ax
+	b = append(b, []byte{0x9d}...)             // popf
+	b = append(b, []byte{0x9c}...)             // pushf
+	b = append(b, []byte{0x59}...)             // pop cx
+	b = append(b, []byte{0xcd, 0x20}...)       // int 20h
 
-	actual, err := runExeWithCustomIntHandlers(bytes.NewReader(b), intHandlers)
+	_, state, err := RunCom(bytes.NewReader(b))
 	if err != nil {
 		t.Errorf("%+v", err)
 	}
+	if state.bx != 0x0fd7 {
+		t.Errorf("expect flags after popf 0xffff as 0x0fd7 but actual 0x%04x", state.bx)
+	}
+	if state.cx != 0x0002 {
+		t.Errorf("expect flags after popf 0x0000 as 0x0002 but actual 0x%04x", state.cx)
+	}
+}
 
-	if actual.dx != 0x1035 {
-		t.Errorf("expect 0x%04x but 0x%04x", 0x1035, actual.dx)
+func BenchmarkArithmeticLoop(b *testing.B) {
+	var code machineCode
+	code = append(code, []byte{0xb9, 0x00, 0x10}...) // mov cx,0x1000
+	code = append(code, []byte{0x03, 0xc3}...)       // add ax,bx
+	code = append(code, []byte{0x33, 0xd0}...)       // xor dx,ax
+	code = append(code, []byte{0x49}...)             // dec cx
+	code = append(code, []byte{0x75, 0xf9}...)       // jne -7
+	code = append(code, []byte{0xcd, 0x20}...)       // int 20h
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, _, err := RunCom(bytes.NewReader(code)); err != nil {
+			b.Fatalf("%+v", err)
+		}
 	}
-	if actual.bx != 0x2036 {
-		t.Errorf("expect 0x%04x but 0x%04x", 0x2036, actual.bx)
+}
+
+func TestRunCom(t *testing.T) {
+	var b machineCode
+	b = append(b, []byte{0xb8, 0x34, 0x12}...) // mov ax,0x1234
+	b = append(b, []byte{0x8c, 0xcb}...)       // mov bx,cs
+	b = append(b, []byte{0x8c, 0xd1}...)       // mov cx,ss
+	b = append(b, []byte{0xb8, 0x05, 0x4c}...) // mov ax,4c05h
+	b = append(b, []byte{0xcd, 0x21}...)       // int 21h
+
+	exitCode, state, err := RunCom(bytes.NewReader(b))
+	if err != nil {
+		t.Errorf("%+v", err)
+	}
+	if exitCode != 5 {
+		t.Errorf("expect exitCode to be %d but actual %d", 5, exitCode)
+	}
+	if state.bx != pspSegment || state.cx != pspSegment || state.ds != pspSegment {
+		t.Errorf("expect segments as 0x%04x but actual cs: 0x%04x, ss: 0x%04x, ds: 0x%04x", pspSegment, state.bx, state.cx, state.ds)
+	}
+	if state.sp != 0xfffe {
+		t.Errorf("expect sp as 0x%04x but actual 0x%04x", 0xfffe, state.sp)
 	}
 }
 
@@ -1127,6 +5362,33 @@ func TestRunExeWithSampleFcallp(t *testing.T) {
 	}
 }
 
+func TestCPURegistersWithSampleFcallp(t *testing.T) {
+	file, err := os.Open("sample/fcallp.exe")
+	if err != nil {
+		t.Errorf("%+v", err)
+	}
+	cpu := NewCPU()
+	if err := cpu.LoadExe(file); err != nil {
+		t.Errorf("%+v", err)
+	}
+	initial := cpu.Registers()
+	if _, err := cpu.Run(); err != nil {
+		t.Errorf("%+v", err)
+	}
+
+	actual := cpu.Registers()
+	if actual.AX != 0x4c07 {
+		t.Errorf("expect ax as 0x%04x but actual 0x%04x", 0x4c07, actual.AX)
+	}
+	if actual.DX != 0x4c07 {
+		t.Errorf("expect dx as 0x%04x but actual 0x%04x", 0x4c07, actual.DX)
+	}
+	// every push has been popped
+	if actual.SP != initial.SP || actual.BP != initial.BP {
+		t.Errorf("expect sp and bp as 0x%04x and 0x%04x but actual 0x%04x and 0x%04x", initial.SP, initial.BP, actual.SP, actual.BP)
+	}
+}
+
 func TestRunExeWithSampleCmain(t *testing.T) {
 	file, err := os.Open("sample/cmain.exe")
 	if err != nil {
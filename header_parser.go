@@ -5,55 +5,52 @@ import (
 	"fmt"
 	"github.com/pkg/errors"
 	"io"
+	"io/ioutil"
 )
 
 const (
 	paragraphSize int = 16
+	pageSize int = 512
 )
 
 // --- parser
 
 type parser struct {
-	sc *bufio.Scanner
+	reader *bufio.Reader
 	offset int
 }
 
 func newParser(reader io.Reader) *parser {
-	sc := bufio.NewScanner(reader)
-	sc.Split(bufio.ScanBytes)
 	return &parser{
-		sc: sc,
+		reader: bufio.NewReader(reader),
 		offset: 0,
 	}
 }
 
+// io.EOF is returned if there are less than n bytes
 func (parser *parser) parseBytes(n int) ([]byte, error) {
 	buf := make([]byte, n)
-	for i := 0; i < n; i++ {
-		if b := parser.sc.Scan(); b {
-			buf[i] = parser.sc.Bytes()[0]
-			parser.offset++
-		} else {
-			if err := parser.sc.Err(); err != nil {
-				return nil, errors.Wrap(err, "failed to parse bytes")
-			} else {
-				return nil, io.EOF
-			}
+	read, err := io.ReadFull(parser.reader, buf)
+	parser.offset += read
+	if err != nil {
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return nil, io.EOF
 		}
+		return nil, errors.Wrap(err, "failed to parse bytes")
 	}
 	return buf, nil
 }
 
 func (parser *parser) parseByte() (byte, error) {
-	bs, err := parser.parseBytes(1)
+	b, err := parser.reader.ReadByte()
 	if err != nil {
-		if err := parser.sc.Err(); err != nil {
-			return 0, errors.Wrap(err, "failed to parse byte")
-		} else {
+		if err == io.EOF {
 			return 0, io.EOF
 		}
+		return 0, errors.Wrap(err, "failed to parse byte")
 	}
-	return bs[0], nil
+	parser.offset++
+	return b, nil
 }
 
 // assume little-endian
@@ -66,17 +63,10 @@ func (parser *parser) parseWord() (word, error) {
 }
 
 func (parser *parser) parseRemains() ([]byte, error) {
-	var buf []byte
-	for {
-		byte, err := parser.parseByte()
-		if err != nil {
-			if errors.Cause(err) == io.EOF {
-				break
-			} else {
-				return nil, errors.Wrap(err, "failed to parse")
-			}
-		}
-		buf = append(buf, byte)
+	buf, err := ioutil.ReadAll(parser.reader)
+	parser.offset += len(buf)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to parse")
 	}
 	return buf, nil
 }
@@ -85,18 +75,40 @@ func (parser *parser) parseRemains() ([]byte, error) {
 
 type header struct {
 	exSignature [2]byte
+	exBytesInLastPage word // 0 means that the last page is full
+	exPagesInFile word
 	relocationItems word
 	exHeaderSize word
+	exMinAlloc word // in paragraphs
+	exMaxAlloc word // in paragraphs
 	exInitSS word
 	exInitSP word
+	exChecksum word
 	exInitIP word
 	exInitCS word
 	relocationTableOffset word
+	exOverlayNumber word // 0 for the main program
+	relocations []relocationEntry
+}
+
+// an entry of relocation table, pointing a word which holds a segment relative to the load segment
+type relocationEntry struct {
+	offset word
+	seg word
 }
 
 func (h header) String() string {
-	return fmt.Sprintf("header{exSignature: %v, exHeaderSize: %d, exInitSS: 0x%04X, exInitSP: 0x%04X, exInitIP: 0x%04X, exInitCS: 0x%04X}",
-		h.exSignature, h.exHeaderSize, h.exInitSS, h.exInitSP, h.exInitIP, h.exInitCS)
+	return fmt.Sprintf("header{exSignature: %v, exBytesInLastPage: %d, exPagesInFile: %d, exHeaderSize: %d, exMinAlloc: 0x%04X, exMaxAlloc: 0x%04X, exInitSS: 0x%04X, exInitSP: 0x%04X, exChecksum: 0x%04X, exInitIP: 0x%04X, exInitCS: 0x%04X, exOverlayNumber: %d}",
+		h.exSignature, h.exBytesInLastPage, h.exPagesInFile, h.exHeaderSize, h.exMinAlloc, h.exMaxAlloc, h.exInitSS, h.exInitSP, h.exChecksum, h.exInitIP, h.exInitCS, h.exOverlayNumber)
+}
+
+// size in bytes of the image declared by header, which includes header itself
+func (h header) imageSize() int {
+	size := int(h.exPagesInFile) * pageSize
+	if h.exBytesInLastPage != 0 {
+		size -= pageSize - int(h.exBytesInLastPage)
+	}
+	return size
 }
 
 // header, load module, error
@@ -115,9 +127,14 @@ func parseHeaderWithParser(parser *parser) (*header, []byte, error) {
 	}
 	exSignature := [2]byte{buf[0], buf[1]}
 
-	_, err = parser.parseBytes(4)
+	exBytesInLastPage, err := parser.parseWord()
 	if err != nil {
-		return nil, nil, errors.Wrap(err, "failed to parse bytes at 2-5 of header")
+		return nil, nil, errors.Wrap(err, "failed to parse bytes at 2-3 of header")
+	}
+
+	exPagesInFile, err := parser.parseWord()
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "failed to parse bytes at 4-5 of header")
 	}
 
 	relocationItems, err := parser.parseWord()
@@ -130,9 +147,14 @@ func parseHeaderWithParser(parser *parser) (*header, []byte, error) {
 		return nil, nil, errors.Wrap(err, "failed to parse bytes at 8-9 of header")
 	}
 
-	_, err = parser.parseBytes(4)
+	exMinAlloc, err := parser.parseWord()
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "failed to parse bytes at 10-11 of header")
+	}
+
+	exMaxAlloc, err := parser.parseWord()
 	if err != nil {
-		return nil, nil, errors.Wrap(err, "failed to parse bytes at 10-13 of header")
+		return nil, nil, errors.Wrap(err, "failed to parse bytes at 12-13 of header")
 	}
 
 	exInitSS, err := parser.parseWord()
@@ -145,7 +167,7 @@ func parseHeaderWithParser(parser *parser) (*header, []byte, error) {
 		return nil, nil, errors.Wrap(err, "failed to parse bytes at 16-17 of header")
 	}
 
-	_, err = parser.parseBytes(2)
+	exChecksum, err := parser.parseWord()
 	if err != nil {
 		return nil, nil, errors.Wrap(err, "failed to parse bytes at 18-19 of header")
 	}
@@ -165,7 +187,38 @@ func parseHeaderWithParser(parser *parser) (*header, []byte, error) {
 		return nil, nil, errors.Wrap(err, "failed to parse bytes at 24-25 of header")
 	}
 
+	exOverlayNumber, err := parser.parseWord()
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "failed to parse bytes at 26-27 of header")
+	}
+
+	var relocations []relocationEntry
+	if relocationItems > 0 {
+		skipBytes := int(relocationTableOffset) - parser.offset
+		if skipBytes < 0 {
+			return nil, nil, errors.Errorf("illegal relocation table offset: 0x%04x", relocationTableOffset)
+		}
+		_, err = parser.parseBytes(skipBytes)
+		if err != nil {
+			return nil, nil, errors.Wrap(err, "failed to parse bytes before relocation table")
+		}
+		for i := 0; i < int(relocationItems); i++ {
+			offset, err := parser.parseWord()
+			if err != nil {
+				return nil, nil, errors.Wrapf(err, "failed to parse offset of relocation entry %d", i)
+			}
+			seg, err := parser.parseWord()
+			if err != nil {
+				return nil, nil, errors.Wrapf(err, "failed to parse segment of relocation entry %d", i)
+			}
+			relocations = append(relocations, relocationEntry{offset: offset, seg: seg})
+		}
+	}
+
 	remainHeaderBytes := int(exHeaderSize) * paragraphSize - int(parser.offset)
+	if remainHeaderBytes < 0 {
+		return nil, nil, errors.Errorf("header size is too small: %d paragraphs", exHeaderSize)
+	}
 	_, err = parser.parseBytes(remainHeaderBytes)
 	if err != nil {
 		return nil, nil, errors.Wrap(err, "failed to parse remains of header")
@@ -176,15 +229,33 @@ func parseHeaderWithParser(parser *parser) (*header, []byte, error) {
 		return nil, nil, errors.Wrap(err, "failed to parse load module")
 	}
 
-	return &header{
+	h := &header{
 		exSignature: exSignature,
+		exBytesInLastPage: exBytesInLastPage,
+		exPagesInFile: exPagesInFile,
 		relocationItems: relocationItems,
 		exHeaderSize: exHeaderSize,
+		exMinAlloc: exMinAlloc,
+		exMaxAlloc: exMaxAlloc,
 		exInitSS: exInitSS,
 		exInitSP: exInitSP,
+		exChecksum: exChecksum,
 		exInitIP: exInitIP,
 		exInitCS: exInitCS,
 		relocationTableOffset: relocationTableOffset,
-	}, loadModule, nil
+		exOverlayNumber: exOverlayNumber,
+		relocations: relocations,
+	}
+
+	// bytes beyond the declared image such as overlay or debug data are not a part of load module
+	loadModuleSize := h.imageSize() - int(exHeaderSize) * paragraphSize
+	if loadModuleSize < 0 {
+		return nil, nil, errors.Errorf("image size is smaller than header: %d bytes", h.imageSize())
+	}
+	if len(loadModule) > loadModuleSize {
+		loadModule = loadModule[:loadModuleSize]
+	}
+
+	return h, loadModule, nil
 }
 
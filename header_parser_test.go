@@ -2,6 +2,7 @@ package x86_emulator
 
 import (
 	"bytes"
+	"encoding/binary"
 	"io"
 	"testing"
 )
@@ -87,6 +88,64 @@ func TestParseHeaderInitCS(t *testing.T) {
 	}
 }
 
+func TestParseHeaderImageSize(t *testing.T) {
+	var reader io.Reader = bytes.NewReader(rawHeader())
+	actual, _, err := parseHeader(reader)
+	if err != nil {
+		t.Errorf("%+v", err)
+	}
+	if actual.exBytesInLastPage != word(0x002b) || actual.exPagesInFile != word(1) {
+		t.Errorf("expected 0x002b bytes in 1 page but actual 0x%04x bytes in %d pages", actual.exBytesInLastPage, actual.exPagesInFile)
+	}
+	if actual.imageSize() != 0x2b {
+		t.Errorf("expected %v but actual %v", 0x2b, actual.imageSize())
+	}
+}
+
+func TestParseHeaderExcludesTrailingData(t *testing.T) {
+	// the declared image ends at 0x2b, so 8 bytes after it are not a part of load module
+	b := append(rawHeader(), []byte{0x90, 0x90, 0x90, 0x90, 0x90, 0x90, 0x90, 0x90}...)
+	b = append(b, []byte{0xde, 0xad, 0xbe, 0xef}...)
+	_, loadModule, err := parseHeader(bytes.NewReader(b))
+	if err != nil {
+		t.Errorf("%+v", err)
+	}
+	expected := append([]byte{0x00, 0x00, 0x00}, []byte{0x90, 0x90, 0x90, 0x90, 0x90, 0x90, 0x90, 0x90}...)
+	if !bytes.Equal(loadModule, expected) {
+		t.Errorf("expected % x but actual % x", expected, loadModule)
+	}
+}
+
+func TestParseHeaderChecksumAndOverlay(t *testing.T) {
+	b := rawHeader()
+	b[0x12], b[0x13] = 0x34, 0x12 // checksum
+	b[0x1a], b[0x1b] = 0x02, 0x00 // overlay number
+	actual, _, err := parseHeader(bytes.NewReader(b))
+	if err != nil {
+		t.Errorf("%+v", err)
+	}
+	if actual.exChecksum != word(0x1234) {
+		t.Errorf("expected %v but actual %v", word(0x1234), actual.exChecksum)
+	}
+	if actual.exOverlayNumber != word(2) {
+		t.Errorf("expected %v but actual %v", word(2), actual.exOverlayNumber)
+	}
+}
+
+func TestParseHeaderMinMaxAlloc(t *testing.T) {
+	var reader io.Reader = bytes.NewReader(rawHeader())
+	actual, _, err := parseHeader(reader)
+	if err != nil {
+		t.Errorf("%+v", err)
+	}
+	if actual.exMinAlloc != word(0x0101) {
+		t.Errorf("expected %v but actual %v", word(0x0101), actual.exMinAlloc)
+	}
+	if actual.exMaxAlloc != word(0xffff) {
+		t.Errorf("expected %v but actual %v", word(0xffff), actual.exMaxAlloc)
+	}
+}
+
 // relocation
 
 func rawHeaderWithRelocation() machineCode {
@@ -122,12 +181,24 @@ func TestParseHeaderRelocationOffset(t *testing.T) {
 	}
 }
 
+func TestParseHeaderRelocations(t *testing.T) {
+	var reader io.Reader = bytes.NewReader(rawHeaderWithRelocation())
+	actual, _, err := parseHeader(reader)
+	if err != nil {
+		t.Errorf("%+v", err)
+	}
+	expected := []relocationEntry{{offset: 0x0001, seg: 0x0000}}
+	if len(actual.relocations) != len(expected) || actual.relocations[0] != expected[0] {
+		t.Errorf("expected %v but actual %v", expected, actual.relocations)
+	}
+}
+
 // intialize
 
 func rawHeaderForTestInitilization() []byte {
 	return []byte{
 		0x4d, 0x5a, 0x71, 0x00, 0x01, 0x00, 0x01, 0x00, 0x03, 0x00, 0x01, 0x01, 0xff, 0xff, 0x05, 0x00,
-		0x00, 0x10, 0x00, 0x00, 0x0c, 0x00, 0x03, 0x00, 0x00, 0x20, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00,
+		0x00, 0x10, 0x00, 0x00, 0x0c, 0x00, 0x03, 0x00, 0x20, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00,
 		0x15, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00,
 	}
 }
@@ -138,11 +209,10 @@ func TestInitialization(t *testing.T) {
 	if err != nil {
 		t.Errorf("%+v", err)
 	}
-	intHandlers := make(intHandlers)
-	state := newState(header, intHandlers)
+	state := newState(header, loadSegment, make(interruptHandlers))
 
-	// check CS
-	expectedCS := word(0x0003)
+	// check CS, which is relative to load segment in header
+	expectedCS := loadSegment + word(0x0003)
 	if state.cs != expectedCS {
 		t.Errorf("expected %v but actual %v", expectedCS, state.cs)
 	}
@@ -153,8 +223,8 @@ func TestInitialization(t *testing.T) {
 		t.Errorf("expected %v but actual %v", expectedIP, state.ip)
 	}
 
-	// check SS
-	expectedSS := word(0x0005)
+	// check SS, which is relative to load segment in header
+	expectedSS := loadSegment + word(0x0005)
 	if state.ss != expectedSS {
 		t.Errorf("expected %v but actual %v", expectedSS, state.ss)
 	}
@@ -166,3 +236,15 @@ func TestInitialization(t *testing.T) {
 	}
 }
 
+func BenchmarkParseHeader(b *testing.B) {
+	// header followed by 64KB of load module
+	image := append(rawHeader(), make([]byte, 0x10000)...)
+	binary.LittleEndian.PutUint16(image[4:], uint16(len(image)/pageSize+1))
+	binary.LittleEndian.PutUint16(image[2:], uint16(len(image)%pageSize))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, _, err := parseHeader(bytes.NewReader(image)); err != nil {
+			b.Fatalf("%+v", err)
+		}
+	}
+}